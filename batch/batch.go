@@ -0,0 +1,81 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+This package holds the messages of the batch endpoint, which runs an
+ordered list of operations in one round trip
+
+POST /?batch
+{"atomic": true, "ops": [
+	{"op": "mkdir", "path": "/dir", "mode": "20000000755"},
+	{"op": "create", "path": "/dir/a.txt", "mode": "644", "data": "aGVsbG8="},
+	{"op": "setattr", "path": "/dir/a.txt", "mtime": 1500000000},
+	{"op": "rename", "path": "/dir/a.txt", "to": "/dir/b.txt"},
+	{"op": "stat", "path": "/dir/b.txt"},
+	{"op": "delete", "path": "/old.txt"}
+]}
+
+200
+{"committed": true, "results": [{"status": 200}, ...]}
+
+paths are relative to the base path the batch is posted to, modes
+are octal os.FileMode values like the File-Mode header of requests.
+In atomic mode a failing op undoes the ones before it, they are
+answered with 424 Failed Dependency, and so are the ones after it
+*/
+
+package batch
+
+const (
+	Stat    = "stat"
+	Mkdir   = "mkdir"
+	Create  = "create"
+	Delete  = "delete"
+	SetAttr = "setattr"
+	Rename  = "rename"
+)
+
+type Request struct {
+	Atomic bool `json:"atomic"`
+	Ops    []Op `json:"ops"`
+}
+
+type Op struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// destination of a rename
+	To string `json:"to,omitempty"`
+	// mode of mkdir, create and setattr
+	Mode string `json:"mode,omitempty"`
+	// unix times of setattr, nil leaves the time alone
+	Atime *int64 `json:"atime,omitempty"`
+	Mtime *int64 `json:"mtime,omitempty"`
+	// content of create
+	Data []byte `json:"data,omitempty"`
+}
+
+type Response struct {
+	// false if an atomic batch was rolled back
+	Committed bool     `json:"committed"`
+	Results   []Result `json:"results"`
+}
+
+type Result struct {
+	// the http status the op would have had on its own
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// attributes of stat
+	Attr *Attr `json:"attr,omitempty"`
+}
+
+// Attr mirrors the attribute headers of a HEAD response
+type Attr struct {
+	Mode  uint32 `json:"mode"` // mode bits of a stat call, like File-Mode
+	Size  int64  `json:"size"`
+	Atime int64  `json:"atime"`
+	Mtime int64  `json:"mtime"`
+	IsDir bool   `json:"is_dir"`
+	// of files, like the ETag header it changes with the content
+	ETag string `json:"etag,omitempty"`
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ear7h/r3stfs/client"
+)
+
+/*
+the cache commands look after the cache roots of the cache directory,
+one for each user of each host that was mounted
+
+	r3stfs cache list
+	r3stfs cache clean [-age 720h] [-f] [-n] [USER@HOST...]
+
+clean removes the roots no mount uses which weren't mounted for -age,
+or the ones named. Roots with changes the server doesn't have yet are
+kept unless -f is given
+*/
+
+func cacheCmd(argv []string) error {
+	if len(argv) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: r3stfs cache list|clean [flags]")
+		return exitError(exitUsage)
+	}
+
+	switch argv[0] {
+	case "list":
+		return cacheList(argv[1:])
+	case "clean":
+		return cacheClean(argv[1:])
+	}
+
+	return fmt.Errorf("unknown cache command %q, use list or clean", argv[0])
+}
+
+// what a root holds, for list and clean
+func rootState(r client.CacheRootInfo) string {
+	switch {
+	case r.InUse:
+		return "mounted"
+	case r.Pending > 0:
+		return fmt.Sprintf("%d changes not sent", r.Pending)
+	case r.Dirty > 0:
+		return fmt.Sprintf("%d files not sent", r.Dirty)
+	}
+
+	return ""
+}
+
+func cacheList(argv []string) error {
+	c, _, fs, err := parseFlags("cache list", "", argv, (*config).cacheSettings, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	roots, err := client.CacheRoots(c.Cache)
+	if err != nil {
+		return err
+	}
+
+	if len(roots) == 0 {
+		fmt.Println("no caches in", c.Cache)
+		return nil
+	}
+
+	for _, r := range roots {
+		used := "never"
+		if !r.Used.IsZero() {
+			used = r.Used.Format("Jan _2 15:04 2006")
+		}
+
+		line := fmt.Sprintf("%-32s %10s %7d files  %s  %s", r.User+"@"+r.Host, byteSize(r.Bytes), r.Files, used, rootState(r))
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+
+	return nil
+}
+
+func cacheClean(argv []string) error {
+	var age time.Duration
+	var force, dryRun bool
+	c, _, fs, err := parseFlags("cache clean", "[USER@HOST...]", argv, (*config).cacheSettings, func(fs *flag.FlagSet) {
+		fs.DurationVar(&age, "age", 30*24*time.Hour, "remove the caches not mounted for this long")
+		fs.BoolVar(&force, "f", false, "remove caches with changes that weren't sent")
+		fs.BoolVar(&dryRun, "n", false, "show what would be removed without removing it")
+	})
+	if err != nil {
+		return err
+	}
+
+	roots, err := client.CacheRoots(c.Cache)
+	if err != nil {
+		return err
+	}
+
+	named := make(map[string]bool)
+	for _, arg := range fs.Args() {
+		named[arg] = true
+	}
+
+	var failed error
+	for _, r := range roots {
+		name := r.User + "@" + r.Host
+
+		if len(named) > 0 {
+			if !named[name] {
+				continue
+			}
+			delete(named, name)
+		} else if time.Since(r.Used) < age {
+			continue
+		}
+
+		if r.InUse {
+			fmt.Printf("keeping %s, it is mounted\n", name)
+			continue
+		}
+
+		if (r.Pending > 0 || r.Dirty > 0) && !force {
+			fmt.Printf("keeping %s, %s, -f removes it\n", name, rootState(r))
+			continue
+		}
+
+		fmt.Printf("removing %s, %s\n", name, byteSize(r.Bytes))
+		if dryRun {
+			continue
+		}
+
+		err := client.RemoveCacheRoot(r.Dir)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			failed = exitError(exitFailed)
+		}
+	}
+
+	for name := range named {
+		fmt.Printf("%s: no cache in %s\n", name, c.Cache)
+		failed = exitError(exitNotFound)
+	}
+
+	return failed
+}
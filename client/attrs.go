@@ -0,0 +1,129 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+/*
+the kernel and the attribute cache trust what they learned of a file
+for the Timeouts, GetAttr asks the server again once they run out.
+Changes made through the mount are never stale, they reach the kernel
+through it, and the client drops the entries of the paths it changes
+*/
+
+// Timeouts are how long what was learned of a file is trusted
+type Timeouts struct {
+	// attributes of files
+	Attr time.Duration
+	// names the kernel looked up
+	Entry time.Duration
+	// names found missing
+	Negative time.Duration
+}
+
+// what GetAttr learned of a file from the server
+type attrEntry struct {
+	// the server's attributes, nil when the cache holds the current
+	// content and its file has them
+	attr *fuse.Attr
+	// the server has no such file
+	missing bool
+	expires time.Time
+}
+
+type attrCache struct {
+	mu       sync.Mutex
+	timeouts Timeouts
+	entries  map[string]attrEntry
+	// the number of entries the next put prunes at
+	prune int
+}
+
+func newAttrCache(timeouts Timeouts) *attrCache {
+	return &attrCache{
+		timeouts: timeouts,
+		entries:  make(map[string]attrEntry),
+		prune:    1024,
+	}
+}
+
+// the entry of name if it is still trusted
+func (c *attrCache) get(name string) (attrEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[name]
+	if !ok {
+		return attrEntry{}, false
+	}
+
+	if time.Now().After(e.expires) {
+		delete(c.entries, name)
+		return attrEntry{}, false
+	}
+
+	return e, true
+}
+
+func (c *attrCache) put(name string, e attrEntry) {
+	ttl := c.timeouts.Attr
+	if e.missing {
+		ttl = c.timeouts.Negative
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	if e.attr != nil {
+		attr := *e.attr
+		e.attr = &attr
+	}
+	e.expires = time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[name] = e
+
+	// expired entries of files not asked for again go eventually
+	if len(c.entries) >= c.prune {
+		now := time.Now()
+		for p, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, p)
+			}
+		}
+
+		c.prune = 2 * len(c.entries)
+		if c.prune < 1024 {
+			c.prune = 1024
+		}
+	}
+}
+
+// the cache holds the server's content of name
+func (c *attrCache) validated(name string) {
+	c.put(name, attrEntry{})
+}
+
+// forget what is known of name and the files under it
+func (c *attrCache) invalidate(name string) {
+	prefix := name + "/"
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for p := range c.entries {
+		if p == name || strings.HasPrefix(p, prefix) || name == "" {
+			delete(c.entries, p)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+func TestAttrCache(t *testing.T) {
+	c := newAttrCache(Timeouts{Attr: time.Hour, Negative: 50 * time.Millisecond})
+
+	attr := &fuse.Attr{Size: 5}
+	c.put("d/a", attrEntry{attr: attr})
+	c.put("d/missing", attrEntry{missing: true})
+	c.validated("b")
+
+	// the cache keeps its own copy
+	attr.Size = 6
+	if e, ok := c.get("d/a"); !ok || e.attr.Size != 5 {
+		t.Errorf("d/a: %+v %v", e, ok)
+	}
+	if e, ok := c.get("b"); !ok || e.attr != nil || e.missing {
+		t.Errorf("b: %+v %v", e, ok)
+	}
+
+	// negative entries go sooner
+	if e, ok := c.get("d/missing"); !ok || !e.missing {
+		t.Errorf("d/missing: %+v %v", e, ok)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("d/missing"); ok {
+		t.Errorf("d/missing is trusted after its timeout")
+	}
+
+	// changing a directory forgets what is under it
+	c.invalidate("d")
+	if _, ok := c.get("d/a"); ok {
+		t.Errorf("d/a is trusted after d changed")
+	}
+	if _, ok := c.get("b"); !ok {
+		t.Errorf("b was forgotten with d")
+	}
+
+	// no timeout, nothing is kept
+	c = newAttrCache(Timeouts{})
+	c.put("a", attrEntry{attr: &fuse.Attr{}})
+	if _, ok := c.get("a"); ok {
+		t.Errorf("kept without a timeout")
+	}
+}
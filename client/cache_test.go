@@ -1,4 +1,4 @@
-package main
+package client
 
 import (
 	"testing"
@@ -6,17 +6,20 @@ import (
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"fmt"
 	"os"
-	"r3stfs/client/runtime"
+	"github.com/ear7h/r3stfs/client/runtime"
 )
 
 func TestR3stFs_cacheOK(t *testing.T) {
 	mtpt := "testfs"
-	rfs := NewR3stFs("localhost:8080", "user", "")
+	rfs, err := NewR3stFs("localhost:8080", "user", "", "ear7h_cache", CacheLimits{}, Timeouts{}, CloseToOpen)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	//make pathfs
 	nfs := pathfs.NewPathNodeFs(
 		rfs,
-		&pathfs.PathNodeFsOptions{false, true})
+		&pathfs.PathNodeFsOptions{Debug: true})
 
 	server, _, err := nodefs.MountRoot(mtpt, nfs.Root(), nil)
 	if err != nil {
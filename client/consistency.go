@@ -0,0 +1,80 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+)
+
+/*
+a mount promises one of two things of the files other clients change
+
+close-to-open, like nfs: opening a file checks the cache against the
+server, closing it sends what was written, and in between the cache is
+trusted. A file opened after another client closed it has that
+client's changes, reads of a file opened before don't. Attributes are
+trusted for the Timeouts
+
+strict: the same, and every read and stat checks the server first, so
+they see the changes of files other clients closed however long the
+file was open. The kernel keeps no pages or attributes of the files,
+mmap needs a kernel which maps files without them
+
+either way a file is only written on the server when it is closed, the
+changes of two clients writing one file at once aren't merged, the
+last to close it wins
+*/
+
+// Consistency is what a mount promises of files other clients change
+type Consistency int
+
+const (
+	CloseToOpen Consistency = iota
+	Strict
+)
+
+// ParseConsistency parses the name of a Consistency
+func ParseConsistency(s string) (Consistency, error) {
+	switch s {
+	case "close-to-open", "cto":
+		return CloseToOpen, nil
+	case "strict":
+		return Strict, nil
+	}
+
+	return 0, fmt.Errorf("%q isn't a consistency, close-to-open or strict", s)
+}
+
+func (c Consistency) String() string {
+	if c == Strict {
+		return "strict"
+	}
+
+	return "close-to-open"
+}
+
+// the timeouts under c, strict trusts nothing
+func (c Consistency) timeouts(t Timeouts) Timeouts {
+	if c == Strict {
+		return Timeouts{}
+	}
+
+	return t
+}
+
+// the file of an open, the kernel sends every read of strict mounts
+func (c Consistency) file(f nodefs.File) nodefs.File {
+	if c != Strict {
+		return f
+	}
+
+	return &nodefs.WithFlags{
+		File:      f,
+		FuseFlags: fuse.FOPEN_DIRECT_IO,
+	}
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+
+	"github.com/ear7h/r3stfs/lease"
+	"github.com/ear7h/r3stfs/server"
+)
+
+// serve a store in a temporary directory, its host is returned
+func startServer(t *testing.T) string {
+	host, _ := startStore(t)
+	return host
+}
+
+// startServer, and the directory of the store
+func startStore(t *testing.T) (string, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := l.Addr().String()
+	l.Close()
+
+	dirroot := t.TempDir()
+	go server.ServeFs(host, "", dirroot, &server.R3stFsHandler{})
+
+	for i := 0; ; i++ {
+		res, err := http.Head("http://" + host + "/")
+		if err == nil {
+			res.Body.Close()
+			return host, dirroot
+		}
+		if i == 50 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// a client of host with a cache of its own, not mounted
+func newClient(t *testing.T, host string, timeouts Timeouts, consistency Consistency) *R3stFs {
+	rfs, err := NewR3stFs(host, "user", "", filepath.Join(t.TempDir(), "cache"), CacheLimits{}, timeouts, consistency)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		rfs.lock.Close()
+	})
+
+	return rfs
+}
+
+// mount a client of host with a cache of its own, the test is skipped
+// without fuse
+func mountClient(t *testing.T, host string, timeouts Timeouts, consistency Consistency) (string, *R3stFs) {
+	mtpt := filepath.Join(t.TempDir(), "mnt")
+	os.Mkdir(mtpt, 0700)
+
+	rfs := newClient(t, host, timeouts, consistency)
+
+	srv, err := newServer(mtpt, host, rfs, consistency.timeouts(timeouts))
+	if err != nil {
+		t.Skipf("can't mount: %v", err)
+	}
+
+	go srv.Serve()
+	err = srv.WaitMount()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		srv.Unmount()
+	})
+
+	return mtpt, rfs
+}
+
+func readFile(t *testing.T, name string) string {
+	byt, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(byt)
+}
+
+func writeFile(t *testing.T, name, content string) {
+	err := ioutil.WriteFile(name, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// put content on the server of the store in dirroot at mtime
+func serveFile(t *testing.T, dirroot, name, content string, mtime time.Time) {
+	writeFile(t, filepath.Join(dirroot, name), content)
+	os.Chtimes(filepath.Join(dirroot, name), mtime, mtime)
+}
+
+// cache the server's content of name in rfs like a download would
+func cacheFile(t *testing.T, rfs *R3stFs, dirroot, name string) {
+	res, err := rfs.client.Head(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	writeFile(t, rfs.cache.Abs(name), readFile(t, filepath.Join(dirroot, name)))
+	rfs.stored(name, res.Header)
+}
+
+// cacheOK and validate of two clients, without mounting them
+func TestValidate(t *testing.T) {
+	host, dirroot := startStore(t)
+
+	long := Timeouts{Attr: time.Hour, Entry: time.Hour, Negative: time.Hour}
+	a := newClient(t, host, long, CloseToOpen)
+	b := newClient(t, host, long, CloseToOpen)
+	waitLeases(t, a)
+	waitLeases(t, b)
+
+	sec := time.Unix(1500000000, 0)
+	serveFile(t, dirroot, "f.txt", "one", sec.Add(100*time.Millisecond))
+	cacheFile(t, a, dirroot, "f.txt")
+	cacheFile(t, b, dirroot, "f.txt")
+
+	// the cache is current, and leased for reading
+	if !b.cacheOK("f.txt") {
+		t.Fatal("b's current cache isn't ok")
+	}
+	if kind := b.leases.has("f.txt"); kind != lease.Read {
+		t.Errorf("b holds a %q lease after validating", kind)
+	}
+
+	// a write lease recalls the read lease
+	if !a.validate("f.txt", lease.Write) {
+		t.Fatal("a's current cache isn't ok")
+	}
+	if kind := a.leases.has("f.txt"); kind != lease.Write {
+		t.Errorf("a holds a %q lease", kind)
+	}
+	if kind := b.leases.has("f.txt"); kind != "" {
+		t.Errorf("b kept a %q lease after a's write lease", kind)
+	}
+
+	// a trusts its cache while it holds the lease, changes through the
+	// server recall it first. This one went around the server
+	serveFile(t, dirroot, "f.txt", "two", sec.Add(600*time.Millisecond))
+	if !a.cacheOK("f.txt") {
+		t.Error("a asked the server while holding a write lease")
+	}
+
+	// a change in the second of the cached version and of the same
+	// size is told by its ETag, b's read recalls a's lease
+	if b.cacheOK("f.txt") {
+		t.Error("b's cache is ok after a change in its second")
+	}
+	if kind := a.leases.has("f.txt"); kind != "" {
+		t.Errorf("a kept a %q lease after b's read", kind)
+	}
+	if a.cacheOK("f.txt") {
+		t.Error("a's cache is ok after its lease was recalled")
+	}
+
+	// changes the server hasn't seen are kept
+	writeFile(t, b.cache.Abs("f.txt"), "mine")
+	b.changed("f.txt", 0, 4)
+	if !b.cacheOK("f.txt") {
+		t.Error("b's dirty cache isn't ok")
+	}
+
+	// a file gone from the server is gone from the cache
+	os.Remove(filepath.Join(dirroot, "f.txt"))
+	if !a.cacheOK("f.txt") {
+		t.Error("a's cache of a removed file isn't ok")
+	}
+	if _, err := a.cache.Stat("f.txt"); !os.IsNotExist(err) {
+		t.Errorf("a's cache of a removed file: %v", err)
+	}
+	if e, ok := a.attrs.get("f.txt"); !ok || !e.missing {
+		t.Errorf("a's attributes of a removed file: %+v %v", e, ok)
+	}
+
+	// offline the cache is all there is
+	b.journal.SetOffline()
+	if !b.cacheOK("g.txt") {
+		t.Error("b's cache isn't ok offline")
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	for s, want := range map[string]Consistency{"close-to-open": CloseToOpen, "cto": CloseToOpen, "strict": Strict} {
+		if c, err := ParseConsistency(s); err != nil || c != want {
+			t.Errorf("%s: %v %v", s, c, err)
+		}
+	}
+	if _, err := ParseConsistency("eventual"); err == nil {
+		t.Error("eventual parsed")
+	}
+
+	// strict trusts no attributes and has the kernel send every read
+	long := Timeouts{Attr: time.Hour, Entry: time.Hour, Negative: time.Hour}
+	if ttl := CloseToOpen.timeouts(long); ttl != long {
+		t.Errorf("close-to-open timeouts %+v", ttl)
+	}
+	if ttl := Strict.timeouts(long); ttl != (Timeouts{}) {
+		t.Errorf("strict timeouts %+v", ttl)
+	}
+
+	f := nodefs.NewDefaultFile()
+	if CloseToOpen.file(f) != f {
+		t.Error("close-to-open wrapped the file")
+	}
+	if w, ok := Strict.file(f).(*nodefs.WithFlags); !ok || w.FuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
+		t.Errorf("strict file %#v", Strict.file(f))
+	}
+}
+
+func TestCloseToOpen(t *testing.T) {
+	host := startServer(t)
+
+	// the attributes b learns are trusted for longer than the test
+	long := Timeouts{Attr: time.Hour, Entry: time.Hour, Negative: time.Hour}
+	a, _ := mountClient(t, host, long, CloseToOpen)
+	b, _ := mountClient(t, host, long, CloseToOpen)
+
+	// a close is seen by the next open
+	writeFile(t, filepath.Join(a, "f.txt"), "one")
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "one" {
+		t.Fatalf("b read %q after a closed the file", s)
+	}
+
+	// however long b trusts the file's attributes
+	writeFile(t, filepath.Join(a, "f.txt"), "second")
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "second" {
+		t.Errorf("b read %q after a closed the file again", s)
+	}
+
+	// and the other way around
+	writeFile(t, filepath.Join(b, "f.txt"), "third time")
+	if s := readFile(t, filepath.Join(a, "f.txt")); s != "third time" {
+		t.Errorf("a read %q after b closed the file", s)
+	}
+
+	// the cache is trusted between opens, a's attributes hold for
+	// its timeout
+	fi, err := os.Stat(filepath.Join(a, "f.txt"))
+	if err != nil || fi.Size() != int64(len("third time")) {
+		t.Errorf("a's stat of its own file: %v %v", fi, err)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	host := startServer(t)
+
+	// strict trusts none of them
+	long := Timeouts{Attr: time.Hour, Entry: time.Hour, Negative: time.Hour}
+	a, _ := mountClient(t, host, long, Strict)
+	b, _ := mountClient(t, host, long, Strict)
+
+	writeFile(t, filepath.Join(a, "f.txt"), "one")
+
+	f, err := os.Open(filepath.Join(b, "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64)
+	n, _ := f.ReadAt(buf, 0)
+	if s := string(buf[:n]); s != "one" {
+		t.Fatalf("b read %q", s)
+	}
+
+	// a read of a file opened before a's close sees it
+	writeFile(t, filepath.Join(a, "f.txt"), "second")
+	n, _ = f.ReadAt(buf, 0)
+	if s := string(buf[:n]); s != "second" {
+		t.Errorf("b read %q from its open file after a closed it", s)
+	}
+
+	// and so does a stat
+	writeFile(t, filepath.Join(a, "f.txt"), "third time")
+	fi, err := os.Stat(filepath.Join(b, "f.txt"))
+	if err != nil || fi.Size() != int64(len("third time")) {
+		t.Errorf("b's stat after a closed the file: %v %v", fi, err)
+	}
+
+	// names too
+	_, err = os.Stat(filepath.Join(b, "g.txt"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("g.txt: %v", err)
+	}
+	writeFile(t, filepath.Join(a, "g.txt"), "new")
+	if s := readFile(t, filepath.Join(b, "g.txt")); s != "new" {
+		t.Errorf("b read %q from a file a made", s)
+	}
+}
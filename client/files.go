@@ -2,7 +2,7 @@
 // Use of this source code is governed by the MIT
 // license that can be found in the LICENSE file.
 
-package main
+package client
 
 import (
 	"fmt"
@@ -12,24 +12,38 @@ import (
 
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"r3stfs/client/remote"
-	"r3stfs/client/log"
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/client/log"
+	"github.com/ear7h/r3stfs/lease"
 	"time"
 )
 
 // LoopbackFile delegates all operations back to an underlying os.file.
-func NewLoopbackFile(f *os.File, restPath string, client *remote.Client) nodefs.File {
+// base is the mtime of the cached file when it was opened, dirty files
+// are uploaded when they are closed. pin is unpinned by the release
+func NewLoopbackFile(f *os.File, restPath string, rfs *R3stFs, pin *cacheEntry, base int64, dirty bool) nodefs.File {
 	return &loopback{
 		file: f,
 		restPath: restPath,
-		remote: client,
+		fs: rfs,
+		remote: rfs.client,
+		pin: pin,
+		base: base,
+		dirty: dirty,
 	}
 }
 
 type loopback struct {
 	file   *os.File
 	restPath string //path passed in urls
+	fs     *R3stFs
 	remote *remote.Client
+	pin    *cacheEntry
+	base   int64
+	dirty  bool
+	// counts the changes, a flush leaves the file dirty if one came
+	// while it uploaded
+	gen int64
 
 	// os.file is not threadsafe. Although fd themselves are
 	// constant during the lifetime of an open file, the OS may
@@ -61,6 +75,14 @@ func (f *loopback) Read(buf []byte, off int64) (res fuse.ReadResult, status fuse
 	}()
 
 	f.lock.Lock()
+	if f.fs.consistency == Strict {
+		status = f.refresh()
+		if status != fuse.OK {
+			f.lock.Unlock()
+			return
+		}
+	}
+
 	// This is not racy by virtue of the kernel properly
 	// synchronizing the open/write/close.
 	r := fuse.ReadResultFd(f.file.Fd(), off, len(buf))
@@ -79,6 +101,9 @@ func (f *loopback) Write(data []byte, off int64) (n uint32, status fuse.Status)
 	}()
 	fmt.Println("writing: ", string(data))
 
+	// the metadata db knows of the change before the cache has it
+	f.setDirty(off, int64(len(data)))
+
 	f.lock.Lock()
 	nint, err := f.file.WriteAt(data, off)
 	if err != nil {
@@ -104,24 +129,96 @@ func (f *loopback) Release() {
 	//close file
 	f.lock.Lock()
 	f.file.Close()
+	dirty := f.dirty
 	f.lock.Unlock()
 
-	name := f.file.Name()
+	// the collector may evict it once it is uploaded or journaled,
+	// until then it is dirty
+	defer f.fs.lru.release(f.pin)
 
-	fileToSend, err := os.OpenFile(name, os.O_RDONLY, 0600)
-	if err != nil {
-		fmt.Println("err", err)
-		status = fuse.ToStatus(err)
+	// flushed when it was closed, unless it is leased for writing or
+	// was written through a mapping since
+	if !dirty {
 		return
 	}
 
 	fmt.Println("filename: ", f.restPath)
 
-	_, err = f.remote.Put(f.restPath, fileToSend)
-	if err != nil {
-		fmt.Println(err)
-		status = fuse.ToStatus(err)
+	// the uploader sends it, without the server it is journaled
+	f.fs.uploads.queue(f.restPath, f.base, uploadDelay)
+}
+
+// the range off, n changed without the server, the release uploads it
+func (f *loopback) setDirty(off, n int64) {
+	f.fs.changed(f.restPath, off, n)
+
+	f.lock.Lock()
+	f.dirty = true
+	f.gen++
+	f.lock.Unlock()
+}
+
+// fetch the content of other clients' closes, f.lock is held. The
+// server's content doesn't replace changes it doesn't have yet
+func (f *loopback) refresh() fuse.Status {
+	if f.dirty || f.fs.cacheOK(f.restPath) {
+		return fuse.OK
+	}
+
+	status := f.fs.fetch(f.restPath, lease.Read)
+	if status == errOffline {
+		// what the cache has is all there is
+		return fuse.OK
+	}
+	if status == fuse.OK {
+		f.base = f.fs.baseVersion(f.restPath)
+	}
+	return status
+}
+
+// send the changes made since the last flush, the next open anywhere
+// sees them. Durable changes, and those sent before, are on the
+// server's disk when it returns. A file leased for writing is left to
+// its release, an open of another client recalls the lease and waits
+// for the upload
+func (f *loopback) flush(durable bool) fuse.Status {
+	f.lock.Lock()
+	dirty, gen := f.dirty, f.gen
+	f.lock.Unlock()
+
+	switch {
+	case durable && !dirty:
+		return f.fs.commit(f.restPath)
+	case durable:
+	case !dirty || f.fs.leaseWrite(f.restPath):
+		return fuse.OK
+	}
+
+	// without a lease nothing holds other clients back, the file is
+	// sent before close returns
+
+	send := f.fs.uploads.send
+	if durable {
+		send = f.fs.uploads.sendSync
+	}
+
+	status := send(f.restPath, f.base)
+	if status != fuse.OK {
+		return status
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.gen != gen {
+		// the upload cleaned the record of a change it may have missed
+		f.fs.changed(f.restPath, 0, 0)
+		return fuse.OK
 	}
+
+	f.dirty = false
+	f.base = f.fs.baseVersion(f.restPath)
+	return fuse.OK
 }
 
 func (f *loopback) Flush() (status fuse.Status) {
@@ -147,7 +244,12 @@ func (f *loopback) Flush() (status fuse.Status) {
 		return fuse.ToStatus(err)
 	}
 	err = syscall.Close(newFd)
-	return fuse.ToStatus(err)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	// close to open, the server has the file when close returns
+	return f.flush(false)
 }
 
 func (f *loopback) Fsync(flags int) (status fuse.Status) {
@@ -163,7 +265,12 @@ func (f *loopback) Fsync(flags int) (status fuse.Status) {
 	f.lock.Lock()
 	status = fuse.ToStatus(syscall.Fsync(int(f.file.Fd())))
 	f.lock.Unlock()
+	if status != fuse.OK {
+		return
+	}
 
+	// and so is the server's copy, databases count on it
+	status = f.flush(true)
 	return
 }
 
@@ -197,7 +304,32 @@ func (f *loopback) Truncate(size uint64) (status fuse.Status) {
 	f.lock.Lock()
 	status = fuse.ToStatus(syscall.Ftruncate(int(f.file.Fd()), int64(size)))
 	f.lock.Unlock()
+	if status != fuse.OK {
+		return
+	}
 
+	// the release sends it, offline or leased for writing
+	if f.fs.journal.Active() || f.fs.leases.has(f.restPath) == lease.Write {
+		f.setDirty(int64(size), 0)
+		return
+	}
+
+	// the server truncates its copy, nothing is uploaded. An older
+	// upload would undo it
+	f.fs.uploads.wait(f.restPath)
+	res, err := f.remote.Truncate(f.restPath, int64(size))
+	if err != nil {
+		// the release journals the file
+		f.fs.goOffline(err)
+		f.setDirty(int64(size), 0)
+		return
+	}
+	res.Body.Close()
+
+	status = fuse.ToStatus(remote.Errno(res))
+	if status == fuse.OK {
+		f.fs.changedBoth(f.restPath, res)
+	}
 	return
 }
 
@@ -248,6 +380,13 @@ func (f *loopback) GetAttr(a *fuse.Attr) (status fuse.Status) {
 
 	st := syscall.Stat_t{}
 	f.lock.Lock()
+	if f.fs.consistency == Strict {
+		status = f.refresh()
+		if status != fuse.OK {
+			f.lock.Unlock()
+			return
+		}
+	}
 	err := syscall.Fstat(int(f.file.Fd()), &st)
 	f.lock.Unlock()
 	if err != nil {
@@ -2,7 +2,7 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-package main
+package client
 
 import (
 	"syscall"
@@ -10,7 +10,9 @@ import (
 
 	"github.com/hanwen/go-fuse/fuse"
 
-	"r3stfs/client/log"
+	"github.com/ear7h/r3stfs/client/log"
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/sparse"
 )
 
 func (f *loopback) Allocate(off uint64, sz uint64, mode uint32) (status fuse.Status) {
@@ -73,5 +75,25 @@ func (f *loopback) Allocate(off uint64, sz uint64, mode uint32) (status fuse.Sta
 	if errno != 0 {
 		return fuse.ToStatus(errno)
 	}
-	return fuse.OK
+
+	if f.fs.journal.Active() {
+		f.setDirty(int64(off), int64(sz))
+		return fuse.OK
+	}
+
+	// do the same on the server, no data needs to be sent
+	res, err := f.remote.Allocate(f.restPath, int64(off), int64(sz), sparse.ModeFromFallocate(mode))
+	if err != nil {
+		// the release journals the file
+		f.fs.goOffline(err)
+		f.setDirty(int64(off), int64(sz))
+		return fuse.OK
+	}
+	res.Body.Close()
+
+	status = fuse.ToStatus(remote.Errno(res))
+	if status == fuse.OK {
+		f.fs.changedBoth(f.restPath, res)
+	}
+	return
 }
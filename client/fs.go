@@ -3,80 +3,124 @@
 // license that can be found in the LICENSE file.
 
 
-package main
+package client
 
 import (
-	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
-	"github.com/0xAX/notificator"
+	"golang.org/x/sys/unix"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
 
-	"r3stfs/client/log"
-	"r3stfs/client/remote"
-	"r3stfs/sandbox"
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/client/log"
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/digest"
+	"github.com/ear7h/r3stfs/lease"
+	"github.com/ear7h/r3stfs/sandbox"
+	"github.com/ear7h/r3stfs/sparse"
 )
 
 type R3stFs struct {
 	pathfs.FileSystem
-	client *remote.Client
-	cache  sandbox.Store
+	client  *remote.Client
+	batcher *remote.Batcher
+	cache   sandbox.Store
+	journal *Journal
+	meta    *MetaDB
+	lru     *lru
+	attrs   *attrCache
+	leases  *leases
+	uploads *uploader
+	// what the mount promises of files other clients change
+	consistency Consistency
+	// the mounted file system, nil until it is
+	nfs *pathfs.PathNodeFs
+	// held while the cache root is mounted
+	lock *os.File
 }
 
+// cacheOK is true if the cache of name can be used, asking the
+// server for a read lease
 func (rfs *R3stFs) cacheOK(name string) bool {
-	notify := func(err error) {
+	return rfs.validate(name, lease.Read)
+}
+
+// validate the cache of name against the server like cacheOK, asking
+// for a lease of kind
+func (rfs *R3stFs) validate(name, kind string) bool {
+	cacheErr := func(err error) {
 		fmt.Println("cacheOK err: ", err)
+		notify("Cache Error", fmt.Sprint(err))
+	}
 
-		e := notificator.New(notificator.Options{
-			AppName: "r3stfs",
-		}).Push("Cache Error", fmt.Sprint(err), "", notificator.UR_NORMAL)
+	// the cache is all there is, or ahead of the server
+	if rfs.journal.Active() {
+		return true
+	}
 
-		if e != nil {
-			fmt.Println("cacheOK: notify - ", e)
-		}
+	// changes the server hasn't seen aren't replaced by its content
+	m, _ := rfs.meta.Get(name)
+	if m.IsDirty() {
+		return true
 	}
 
+	// the server recalls the lease before the file changes
+	if held := rfs.leases.has(name); m.State == Complete && (held == lease.Write || held == kind) {
+		if _, err := rfs.cache.Stat(name); err == nil {
+			return true
+		}
+	}
 
-	resp, err := rfs.client.Head(name)
+	resp, err := rfs.client.HeadLease(name, kind)
 	if err != nil {
-		go notify(err)
-		return false
+		rfs.goOffline(err)
+		return true
 	}
+	resp.Body.Close()
 
 	//if not exist
 	if resp.StatusCode == http.StatusNotFound {
 		rfs.cache.RemoveAll(name)
+		rfs.meta.Forget(name)
+		rfs.lru.forget(name)
+		rfs.attrs.put(name, attrEntry{missing: true})
 		return true
 	}
 
-	remoteUnix, err := strconv.ParseInt(resp.Header.Get("Mtime"), 10, 64)
-	if err != nil {
-		go notify(err)
-		return true
+	// cache is outdated, or holds nothing of the server's
+	if !m.Current(resp.Header) {
+		fmt.Println("cache miss")
+		return false
 	}
 
-	stat, err := rfs.cache.Stat(name)
+	_, err = rfs.cache.Stat(name)
 	if err != nil {
-		go notify(err)
+		// evicted files are fetched again
+		if !os.IsNotExist(err) {
+			go cacheErr(err)
+		}
 		return false
 	}
 
-	// cache is outdated
-	if time.Unix(remoteUnix, 0).After(stat.ModTime()) {
-		fmt.Println("cache miss")
-		return false
-	}
+	rfs.meta.Update(name, false, func(m *CacheMeta) {
+		m.Validated = time.Now().Unix()
+	})
+	rfs.attrs.validated(name)
 
+	// a stale cache gets its lease with the download
+	rfs.leases.granted(name, resp)
 	return true
 }
 
@@ -90,7 +134,18 @@ func (rfs *R3stFs) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 		}
 	}()
 
-	if rfs.cacheOK(name) {
+	// what the server said a moment ago still holds
+	e, trusted := rfs.attrs.get(name)
+	if trusted && e.missing {
+		attr, status = nil, fuse.ENOENT
+		return
+	}
+	if trusted && e.attr != nil {
+		attr, status = e.attr, fuse.OK
+		return
+	}
+
+	if trusted || rfs.cacheOK(name) {
 		var err error
 		sysStat := syscall.Stat_t{}
 
@@ -118,6 +173,7 @@ func (rfs *R3stFs) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 		return
 	}
 	if resp.StatusCode == http.StatusNotFound {
+		rfs.attrs.put(name, attrEntry{missing: true})
 		attr, status = nil, fuse.ENOENT
 		return
 	}
@@ -143,9 +199,14 @@ func (rfs *R3stFs) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 		return
 	}
 
-	rfs.cache.Chtimes(name, time.Unix(aTime, 0), time.Unix(mTime, 0))
-
 	if resp.Header["Is-Dir"][0] == "true" {
+		// directories have no content to go stale, the cached one
+		// has the server's attributes from now
+		if _, err := rfs.cache.Stat(name); err == nil {
+			rfs.cache.Chtimes(name, time.Unix(aTime, 0), time.Unix(mTime, 0))
+			rfs.stored(name, resp.Header)
+		}
+
 		mode |= syscall.S_IFDIR
 
 		//return dir
@@ -155,12 +216,20 @@ func (rfs *R3stFs) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 			Mode:  uint32(mode),
 		}, fuse.OK
 
+		rfs.attrs.put(name, attrEntry{attr: attr})
 		return attr, status
 	}
 
 	mode |= syscall.S_IFREG
 
-	size, err := strconv.ParseInt(resp.Header["Content-Length"][0], 10, 64)
+	// File-Size is the real size, Content-Length changes with
+	// the content coding of the response
+	sizeStr := resp.Header.Get("File-Size")
+	if sizeStr == "" {
+		sizeStr = resp.Header.Get("Content-Length")
+	}
+
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
 	if err != nil {
 		size = 0
 	}
@@ -173,6 +242,7 @@ func (rfs *R3stFs) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 		Mode:  uint32(mode),
 	}, fuse.OK
 
+	rfs.attrs.put(name, attrEntry{attr: attr})
 	return
 }
 
@@ -187,64 +257,62 @@ func (rfs *R3stFs) OpenDir(name string, context *fuse.Context) (dir []fuse.DirEn
 		}
 	}()
 
-	resp, err := rfs.client.Get(name)
-	if err != nil {
-		dir, status = nil, fuse.ToStatus(err)
+	if rfs.journal.Active() {
+		dir, status = rfs.cachedDir(name)
 		return
 	}
-	if resp.StatusCode == http.StatusNotFound {
-		dir, status = nil, fuse.ENOENT
+
+	entries, resp, err := rfs.client.List(name)
+	if err != nil {
+		rfs.goOffline(err)
+		dir, status = rfs.cachedDir(name)
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		dir, status = nil, fuse.EAGAIN
+	if errno := remote.Errno(resp); errno != 0 {
+		dir, status = nil, fuse.ToStatus(errno)
+		return
 	}
 
-	scanner := bufio.NewScanner(resp.Body)
-	scanner.Split(bufio.ScanLines)
-
-	for scanner.Scan() {
-		str := scanner.Text()
-
-		arr := strings.Split(str, " ")
-
-		if len(arr) != 2 {
-			return nil, fuse.EAGAIN
-		}
-
-		i, err := strconv.ParseUint(arr[1], 8, 32)
-		if err != nil {
-			return nil, fuse.EAGAIN
-		}
-
-		p := path.Join(name, arr[0])
-		fmt.Println("name join arr[0]", p)
-		m := os.FileMode(i)
-
-		//make structure and dummy files
-		fmt.Println("mode: ", arr[1])
-		fmt.Println("mode: ", arr[1])
-		fmt.Println("mode: ", arr[1])
-		fmt.Println("mode: ", arr[1])
-		fmt.Println("mode: ", m&fuse.S_IFDIR)
-
-		if i&syscall.S_IFDIR != 0 {
-			fmt.Println("making: ", p)
-			err = rfs.cache.MkDirAll(p, os.FileMode(i))
-			if err != nil {
+	rfs.restoreDir(name)
+	rfs.lru.touch(name)
+
+	for entry, m := range entries {
+		p := path.Join(name, entry)
+		i := uint32(m.Perm())
+
+		//make structure and dummy files, the metadata db says
+		// they hold nothing yet
+		if m.IsDir() {
+			i |= syscall.S_IFDIR
+
+			err = rfs.cache.MkDir(p, m.Perm())
+			if err == nil {
+				fmt.Println("making: ", p)
+				rfs.meta.Update(p, false, func(m *CacheMeta) {
+					m.State = Placeholder
+				})
+				rfs.lru.touch(p)
+			} else if !os.IsExist(err) {
 				fmt.Println("err: ", err)
 			}
 		} else {
-			fmt.Println("making: ", p)
-			f, err := rfs.cache.OpenFile(p, os.O_CREATE|os.O_RDONLY, os.FileMode(i))
-			if err != nil {
+			i |= syscall.S_IFREG
+
+			// cached files keep their content, it is served offline
+			f, err := rfs.cache.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_RDONLY, m.Perm())
+			if err == nil {
+				fmt.Println("making: ", p)
+				f.Close()
+				rfs.meta.Update(p, false, func(m *CacheMeta) {
+					m.State = Placeholder
+				})
+				rfs.lru.touch(p)
+			} else if !os.IsExist(err) {
 				fmt.Println("err: ", err)
 			}
-			f.Close()
 		}
 
-		rfs.cache.Chtimes(p, time.Time{}, time.Time{})
-
-		dir = append(dir, fuse.DirEntry{Name: arr[0], Mode: uint32(i)})
+		dir = append(dir, fuse.DirEntry{Name: entry, Mode: i})
 	}
 
 	status = fuse.OK
@@ -261,51 +329,154 @@ func (rfs *R3stFs) Open(name string, flags uint32, context *fuse.Context) (file
 		}
 	}()
 
+	// the collector leaves the file alone until it is released
+	pin := rfs.lru.pin(name)
+	defer func() {
+		if status != fuse.OK {
+			rfs.lru.release(pin)
+		}
+	}()
+
+	fetched := false
+
+	// files opened for writing are leased alone
+	kind := lease.Read
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		kind = lease.Write
+	}
+
 use_cache:
-	if rfs.cacheOK(name) {
+	if rfs.validate(name, kind) {
+		if !rfs.fetched(name) && rfs.journal.Active() {
+			rfs.lru.miss()
+			file, status = nil, errOffline
+			return
+		}
+
+		if !fetched {
+			rfs.lru.hit()
+		}
+
+		base := rfs.baseVersion(name)
 		f, err := rfs.cache.OpenFile(name, int(flags), 0)
 		if err != nil {
 			fmt.Println("open err: ", err)
+			file, status = nil, fuse.ToStatus(err)
+			return
+		}
+
+		// a truncating open changes the file without a write
+		dirty := flags&syscall.O_TRUNC != 0
+		if dirty {
+			rfs.changed(name, 0, 0)
 		}
-		file, status = NewLoopbackFile(f, name, rfs.client), fuse.OK
+		file, status = rfs.consistency.file(NewLoopbackFile(f, name, rfs, pin, base, dirty)), fuse.OK
 		return
 
 	}
 
+	rfs.lru.miss()
+	fetched = true
+
+	status = rfs.fetch(name, kind)
+	if status == errOffline {
+		// cacheOK uses the cache from now on
+		goto use_cache
+	}
+	if status != fuse.OK {
+		file = nil
+		return
+	}
+
+	//file downloaded successfully
+	goto use_cache
+}
+
+// download the server's content of name into the cache with a lease
+// of kind, errOffline if the server didn't answer. Open files of name
+// see the new content
+func (rfs *R3stFs) fetch(name, kind string) fuse.Status {
 	//get file remotely
-	resp, err := rfs.client.Get(name)
+	resp, err := rfs.client.GetLease(name, kind)
 	if err != nil {
-		file, status = nil, fuse.ToStatus(err)
-		return
+		rfs.goOffline(err)
+		return errOffline
+	}
+	defer resp.Body.Close()
+
+	if errno := remote.Errno(resp); errno != 0 {
+		return fuse.ToStatus(errno)
 	}
+
 	perm, err := strconv.ParseUint(resp.Header.Get("File-Mode"), 8, 32)
 	if err != nil {
-		file, status = nil, fuse.ToStatus(err)
-		return
+		return fuse.ToStatus(err)
+	}
+
+	// a crash from here on leaves a partial file, not a stale one
+	err = rfs.meta.Update(name, true, func(m *CacheMeta) {
+		m.State = Partial
+	})
+	if err != nil {
+		return fuse.ToStatus(err)
 	}
 
 	//open the file using the requested permission bits
+	rfs.restoreDir(path.Dir(name))
 	f, err := rfs.cache.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(perm))
 	if err != nil {
 		fmt.Println("err: ", err)
-		file, status = nil, fuse.ToStatus(err)
-		return
+		return fuse.ToStatus(err)
 	}
 
-	b, err := io.Copy(f, resp.Body)
-	if err != nil {
-		file, status = nil, fuse.ToStatus(err)
-		return
+	hash := digest.New()
+	var b int64
+
+	if resp.Header.Get("Content-Type") == sparse.ContentType {
+		// keep the holes of sparse files in the cache
+		w := sparse.NewWriter(f)
+		b, err = io.Copy(io.MultiWriter(w, hash), sparse.NewLogicalReader(resp.Body))
+		if err == nil {
+			err = w.Close()
+		}
+	} else {
+		b, err = io.Copy(io.MultiWriter(f, hash), resp.Body)
 	}
 
-	// close readers/writers
-	resp.Body.Close()
+	// the content is on disk before the record says it is there
+	if err == nil {
+		err = f.Sync()
+	}
 	f.Close()
 
+	// a short or corrupt download must not stay in the cache
+	if err == nil {
+		err = remote.Verify(resp, b, hash.Sum(nil))
+	}
+	if err != nil {
+		fmt.Println("download err: ", err)
+		rfs.cache.Remove(name)
+		rfs.meta.Forget(name)
+		return fuse.EIO
+	}
+
 	fmt.Printf("%d bytes written locally", b)
 
-	//file downloaded successfully
-	goto use_cache
+	// the cached file has the server's times for GetAttr
+	atime, _ := strconv.ParseInt(resp.Header.Get("Atime"), 10, 64)
+	mtime, _ := strconv.ParseInt(resp.Header.Get("Mtime"), 10, 64)
+	rfs.cache.Chtimes(name, time.Unix(atime, 0), time.Unix(mtime, 0))
+
+	rfs.stored(name, resp.Header)
+	rfs.lru.touch(name)
+	rfs.leases.granted(name, resp)
+
+	// the kernel trusts the old size for its attribute timeout, reads
+	// would stop at it
+	if rfs.nfs != nil {
+		rfs.nfs.FileNotify(name, -1, 0)
+	}
+	return fuse.OK
 }
 
 func (rfs *R3stFs) Create(name string, flags uint32, mode uint32, context *fuse.Context) (file nodefs.File, status fuse.Status) {
@@ -318,6 +489,9 @@ func (rfs *R3stFs) Create(name string, flags uint32, mode uint32, context *fuse.
 		}
 	}()
 
+	// it was likely found missing a moment ago
+	rfs.attrs.invalidate(name)
+
 	// create and close to register in host file system
 	f, err := rfs.cache.OpenFile(name, os.O_CREATE, os.FileMode(mode))
 	if err != nil {
@@ -325,62 +499,115 @@ func (rfs *R3stFs) Create(name string, flags uint32, mode uint32, context *fuse.
 		return
 	}
 
-	_, err = rfs.client.Put(name, f)
-	if err != nil {
-		file, status = nil, fuse.ToStatus(err)
+	f.Close()
+
+	// a new file has no base on the server
+	rfs.changed(name, 0, 0)
+	status = rfs.upload(name, 0)
+	if status != fuse.OK {
+		rfs.cache.Remove(name)
+		rfs.meta.Forget(name)
+		file = nil
 		return
 	}
 
-	f.Close()
+	// leased like the files opened for writing
+	rfs.validate(name, lease.Write)
 
-	f, err = rfs.cache.OpenFile(name, int(flags), os.FileMode(mode))
+	// made above, O_EXCL would fail
+	pin := rfs.lru.pin(name)
+	f, err = rfs.cache.OpenFile(name, int(flags)&^os.O_EXCL, os.FileMode(mode))
 	if err != nil {
+		rfs.lru.release(pin)
 		file, status = nil, fuse.ToStatus(err)
 		return
 	}
 
 
-	file, status = NewLoopbackFile(f, name, rfs.client), fuse.OK
+	file, status = rfs.consistency.file(NewLoopbackFile(f, name, rfs, pin, rfs.baseVersion(name), false)), fuse.OK
 	return
 }
 
-func (rfs *R3stFs) Rename(oldName string, newName string, context *fuse.Context) (status fuse.Status) {
-	log.Func(oldName, newName, context)
+// run a metadata op on the server and then local on the cache, ops
+// from concurrent calls are sent together. Offline, or behind journaled
+// changes, local runs alone and op is journaled
+func (rfs *R3stFs) mutate(op batch.Op, base int64, local func() error) fuse.Status {
 	defer func() {
-		if status != fuse.OK {
-			log.Return("ERROR", status)
-		} else {
-			log.Return(status)
+		rfs.attrs.invalidate(op.Path)
+		if op.To != "" {
+			rfs.attrs.invalidate(op.To)
 		}
 	}()
 
-	//send message to server
-
-	f, err := rfs.cache.OpenFile(oldName, os.O_RDONLY, 0700)
-	if err != nil {
-		status = fuse.ToStatus(err)
-		return
+	// the server has what was written before it changes, a rename
+	// moves the uploaded file
+	rfs.uploads.wait(op.Path)
+	if op.To != "" {
+		rfs.uploads.wait(op.To)
 	}
 
-	_, err = rfs.client.Put(newName, f)
-	if err != nil {
-		status = fuse.ToStatus(err)
-		return
+	// the server drops the leases of what is removed or renamed
+	if op.Op == batch.Delete || op.Op == batch.Rename {
+		rfs.leases.drop(op.Path)
+		if op.To != "" {
+			rfs.leases.drop(op.To)
+		}
 	}
 
-	_, err = rfs.client.Delete(oldName)
-	if err != nil {
-		status = fuse.ToStatus(err)
-		return
+	if !rfs.journal.Active() {
+		res, err := rfs.batcher.Do(op)
+		if err == nil {
+			if errno := remote.ResultErrno(res); errno != 0 {
+				return fuse.ToStatus(errno)
+			}
+
+			err = local()
+			if os.IsNotExist(err) {
+				// the collector evicted it, the server's copy changed
+				err = nil
+			}
+			return fuse.ToStatus(err)
+		}
+
+		rfs.goOffline(err)
 	}
 
-	err = rfs.cache.Rename(oldName, newName)
+	err := local()
 	if err != nil {
-		status = fuse.ToStatus(err)
-		return
+		return fuse.ToStatus(err)
 	}
 
-	status = fuse.OK
+	return fuse.ToStatus(rfs.journal.Append(JournalEntry{Op: op, Base: base, BaseETag: rfs.baseETag(op.Path, base)}))
+}
+
+func (rfs *R3stFs) Rename(oldName string, newName string, context *fuse.Context) (status fuse.Status) {
+	log.Func(oldName, newName, context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(status)
+		}
+	}()
+
+	// the server moves the file and its extended attributes
+	status = rfs.mutate(batch.Op{
+		Op:   batch.Rename,
+		Path: oldName,
+		To:   newName,
+	}, 0, func() error {
+		err := rfs.cache.Rename(oldName, newName)
+		if err == nil {
+			rfs.meta.Rename(oldName, newName)
+			rfs.lru.rename(oldName, newName)
+		} else if os.IsNotExist(err) {
+			// evicted, a cached newName is what it replaced
+			rfs.cache.RemoveAll(newName)
+			rfs.meta.Forget(newName)
+			rfs.lru.forget(newName)
+		}
+		return err
+	})
 	return
 }
 
@@ -394,12 +621,14 @@ func (rfs *R3stFs) Unlink(name string, context *fuse.Context) (status fuse.Statu
 		}
 	}()
 
-	_, err := rfs.client.Delete(name)
-	if err != nil {
-		status = fuse.ToStatus(err)
-	}
-
-	status = fuse.ToStatus(syscall.Unlink(rfs.cache.Abs(name)))
+	status = rfs.mutate(batch.Op{Op: batch.Delete, Path: name}, rfs.baseVersion(name), func() error {
+		err := syscall.Unlink(rfs.cache.Abs(name))
+		if err == nil || os.IsNotExist(err) {
+			rfs.meta.Forget(name)
+			rfs.lru.forget(name)
+		}
+		return err
+	})
 	return
 }
 
@@ -413,13 +642,104 @@ func (rfs *R3stFs) Rmdir(name string, context *fuse.Context) (status fuse.Status
 		}
 	}()
 
-	_, err := rfs.client.Delete(name)
-	if err != nil {
-		status = fuse.ToStatus(err)
-		return
+	status = rfs.mutate(batch.Op{Op: batch.Delete, Path: name}, 0, func() error {
+		err := syscall.Rmdir(rfs.cache.Abs(name))
+		if err == nil || os.IsNotExist(err) {
+			rfs.meta.Forget(name)
+			rfs.lru.forget(name)
+		}
+		return err
+	})
+	return
+}
+
+func (rfs *R3stFs) Mkdir(name string, mode uint32, context *fuse.Context) (status fuse.Status) {
+	log.Func(name, "mode: " + strconv.FormatInt(int64(mode), 8), context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(status)
+		}
+	}()
+
+	perm := os.FileMode(mode).Perm()
+
+	status = rfs.mutate(batch.Op{
+		Op:   batch.Mkdir,
+		Path: name,
+		Mode: strconv.FormatUint(uint64(perm), 8),
+	}, 0, func() error {
+		err := rfs.cache.MkDir(name, perm)
+		rfs.lru.touch(name)
+		return err
+	})
+	return
+}
+
+func (rfs *R3stFs) Chmod(name string, mode uint32, context *fuse.Context) (status fuse.Status) {
+	log.Func(name, "mode: " + strconv.FormatInt(int64(mode), 8), context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(status)
+		}
+	}()
+
+	perm := os.FileMode(mode).Perm()
+
+	status = rfs.mutate(batch.Op{
+		Op:   batch.SetAttr,
+		Path: name,
+		Mode: strconv.FormatUint(uint64(perm), 8),
+	}, 0, func() error {
+		return os.Chmod(rfs.cache.Abs(name), perm)
+	})
+	return
+}
+
+func (rfs *R3stFs) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) (status fuse.Status) {
+	log.Func(name, atime, mtime, context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(status)
+		}
+	}()
+
+	op := batch.Op{Op: batch.SetAttr, Path: name}
+	if atime != nil {
+		sec := atime.Unix()
+		op.Atime = &sec
+	}
+	if mtime != nil {
+		sec := mtime.Unix()
+		op.Mtime = &sec
 	}
 
-	status = fuse.ToStatus(syscall.Rmdir(rfs.cache.Abs(name)))
+	// the content stays, only the server's version of it changes
+	status = rfs.mutate(op, 0, func() error {
+		stat, err := rfs.cache.Stat(name)
+		if err != nil {
+			return err
+		}
+
+		a, m := stat.ModTime(), stat.ModTime()
+		if atime != nil {
+			a = *atime
+		}
+		if mtime != nil {
+			m = *mtime
+		}
+
+		rfs.cache.Chtimes(name, a, m)
+		if !rfs.journal.Active() {
+			rfs.revalidate(name)
+		}
+		return nil
+	})
 	return
 }
 
@@ -435,7 +755,14 @@ func (rfs *R3stFs) Access(name string, mode uint32, context *fuse.Context) (stat
 		}
 	}()
 
-	status = fuse.ToStatus(syscall.Access(rfs.cache.Abs(name), mode))
+	err := syscall.Access(rfs.cache.Abs(name), mode)
+	if os.IsNotExist(err) && !rfs.journal.Active() {
+		// evicted by the collector, the server knows
+		_, status = rfs.GetAttr(name, context)
+		return
+	}
+
+	status = fuse.ToStatus(err)
 	return
 }
 
@@ -449,25 +776,192 @@ func (rfs *R3stFs) Truncate(name string, offset uint64, context *fuse.Context) (
 		}
 	}()
 
-	err := os.Truncate(rfs.cache.Abs(name), int64(offset))
-	if err != nil {
+	defer rfs.attrs.invalidate(name)
+
+	// a stale cache file would keep its old bytes under the new
+	// length, it is only truncated if it holds the server's content
+	cached := offset == 0 || rfs.cacheOK(name)
+
+	if rfs.journal.Active() {
+		status = rfs.truncateOffline(name, offset)
+		return
+	}
+
+	// no other client sees the file before the lease is recalled, it
+	// is sent with its other changes
+	if cached && rfs.leases.has(name) == lease.Write {
+		base := rfs.baseVersion(name)
+		rfs.changed(name, int64(offset), 0)
+		err := os.Truncate(rfs.cache.Abs(name), int64(offset))
+		if err == nil {
+			rfs.uploads.queue(name, base, uploadDelay)
+		}
 		status = fuse.ToStatus(err)
 		return
 	}
 
-	f, err := rfs.cache.OpenFile(name, os.O_RDONLY, 0200)
+	// the server truncates its copy, nothing is uploaded. An older
+	// upload would undo it
+	rfs.uploads.wait(name)
+	res, err := rfs.client.Truncate(name, int64(offset))
+	if err != nil {
+		rfs.goOffline(err)
+		status = rfs.truncateOffline(name, offset)
+		return
+	}
+	res.Body.Close()
+
+	if errno := remote.Errno(res); errno != 0 {
+		status = fuse.ToStatus(errno)
+		return
+	}
+
+	if !cached {
+		// like the placeholders of OpenDir, the next Open downloads it
+		rfs.unfetched(name)
+		status = fuse.OK
+		return
+	}
+
+	err = os.Truncate(rfs.cache.Abs(name), int64(offset))
+	if err == nil {
+		rfs.changedBoth(name, res)
+	}
+	rfs.lru.touch(name)
+	status = fuse.ToStatus(err)
+	return
+}
+
+func (rfs *R3stFs) GetXAttr(name string, attribute string, context *fuse.Context) (data []byte, status fuse.Status) {
+	log.Func(name, attribute, context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(len(data), status)
+		}
+	}()
+
+	// attributes aren't cached, the kernel asks for some on each write
+	if rfs.journal.Active() {
+		status = fuse.ENOATTR
+		return
+	}
+
+	res, err := rfs.client.GetXAttr(name, attribute)
+	if err != nil {
+		rfs.goOffline(err)
+		status = fuse.ENOATTR
+		return
+	}
+	defer res.Body.Close()
+
+	if remote.IsNoAttr(res) {
+		status = fuse.ENOATTR
+		return
+	}
+
+	if errno := remote.Errno(res); errno != 0 {
+		status = fuse.ToStatus(errno)
+		return
+	}
+
+	// go-fuse answers ERANGE when the caller's buffer is too small
+	data, err = ioutil.ReadAll(res.Body)
+	status = fuse.ToStatus(err)
+	return
+}
+
+func (rfs *R3stFs) ListXAttr(name string, context *fuse.Context) (attributes []string, status fuse.Status) {
+	log.Func(name, context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(attributes, status)
+		}
+	}()
+
+	if rfs.journal.Active() {
+		status = fuse.OK
+		return
+	}
+
+	res, err := rfs.client.ListXAttr(name)
+	if err != nil {
+		rfs.goOffline(err)
+		status = fuse.OK
+		return
+	}
+	defer res.Body.Close()
+
+	if errno := remote.Errno(res); errno != 0 {
+		status = fuse.ToStatus(errno)
+		return
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&attributes)
+	status = fuse.ToStatus(err)
+	return
+}
+
+func (rfs *R3stFs) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) (status fuse.Status) {
+	log.Func(name, attr, flags, context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(status)
+		}
+	}()
+
+	var flagStr string
+	switch {
+	case flags&unix.XATTR_CREATE != 0:
+		flagStr = "create"
+	case flags&unix.XATTR_REPLACE != 0:
+		flagStr = "replace"
+	}
+
+	res, err := rfs.client.SetXAttr(name, attr, data, flagStr)
 	if err != nil {
 		status = fuse.ToStatus(err)
 		return
 	}
+	res.Body.Close()
+
+	if remote.IsNoAttr(res) {
+		status = fuse.ENOATTR
+		return
+	}
 
-	_, err = rfs.client.Put(name, f)
+	status = fuse.ToStatus(remote.Errno(res))
+	return
+}
+
+func (rfs *R3stFs) RemoveXAttr(name string, attr string, context *fuse.Context) (status fuse.Status) {
+	log.Func(name, attr, context)
+	defer func() {
+		if status != fuse.OK {
+			log.Return("ERROR", status)
+		} else {
+			log.Return(status)
+		}
+	}()
+
+	res, err := rfs.client.RemoveXAttr(name, attr)
 	if err != nil {
 		status = fuse.ToStatus(err)
 		return
 	}
+	res.Body.Close()
 
-	status = fuse.OK
+	if remote.IsNoAttr(res) {
+		status = fuse.ENOATTR
+		return
+	}
+
+	status = fuse.ToStatus(remote.Errno(res))
 	return
 }
 
@@ -483,25 +977,82 @@ func (rfs *R3stFs) StatFs(name string) (stat *fuse.StatfsOut) {
 	return nil
 }
 
-func NewR3stFs(host, user, pass string) *R3stFs {
+// metadata ops issued within this long of each other share a batch
+const batchDelay = 5 * time.Millisecond
+
+// NewR3stFs is the file system of user's files on host, they are
+// cached within limits in the cache root of user and host under
+// cacheDir. No other mount may use the root while it is mounted,
+// attributes are trusted for the timeouts unless consistency is Strict
+func NewR3stFs(host, user, pass, cacheDir string, limits CacheLimits, timeouts Timeouts, consistency Consistency) (*R3stFs, error) {
 	client := remote.Login(host, user, pass)
+	client.SetLeaseClient(newLeaseClient())
+
+	root := CacheRoot(cacheDir, host, user)
+	lock, err := LockCacheRoot(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateCache(cacheDir, host, root)
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := sandbox.NewStore(filepath.Join(root, rootFiles))
+	if err != nil {
+		return nil, err
+	}
 
-	//u, err := osuser.Current()
-	//if err != nil {
-	//	panic(err)
-	//}
-	//
-	//homedir := u.HomeDir
-	//
-	//cache, err := sandbox.NewStore(path.Join(homedir, host, user))
-	cache, err := sandbox.NewStore("ear7h_cache/localhost:8080")
+	journal, err := OpenJournal(JournalPath(root))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+
+	metaPath := MetaPath(root)
+	_, err = os.Stat(metaPath)
+	seed := os.IsNotExist(err)
+
+	meta, err := OpenMetaDB(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	rfs := &R3stFs{
+		FileSystem:  pathfs.NewDefaultFileSystem(),
+		client:      client,
+		batcher:     remote.NewBatcher(client, batchDelay),
+		cache:       cache,
+		journal:     journal,
+		meta:        meta,
+		lru:         newLRU(cache, meta, limits),
+		attrs:       newAttrCache(consistency.timeouts(timeouts)),
+		leases:      newLeases(),
+		consistency: consistency,
+		lock:        lock,
+	}
+
+	rfs.lru.attrs = rfs.attrs
+	rfs.uploads = newUploader(rfs.uploadProgress, rfs.baseVersion)
+
+	if seed {
+		err = rfs.seedMeta()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return &R3stFs{
-		FileSystem: pathfs.NewDefaultFileSystem(),
-		client:     client,
-		cache:      cache,
+	go rfs.collector(CacheStatsPath(root))
+
+	err = rfs.lru.load()
+	if err != nil {
+		return nil, err
 	}
+
+	// changes a previous mount journaled are sent by it too
+	go rfs.watch()
+	go rfs.watchLeases()
+	rfs.queueDirty()
+
+	return rfs, nil
 }
@@ -0,0 +1,233 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+)
+
+/*
+the journal keeps the changes made to the cache while the server
+can't be reached, they are sent in order once it answers again. It
+is a file of json lines next to the cache, synced after each line
+
+	{"seq":1,"time":1501632000,"op":"put","path":"notes.txt","base":1501600000,"baseetag":"\"14d3...-1a2\""}
+	{"seq":2,"time":1501632010,"op":"rename","path":"notes.txt","to":"old.txt"}
+	{"done":1}
+
+put uploads the cached file, the other ops are the ops of a batch.
+base and baseetag are the server's mtime and ETag of the cached file
+when it was changed, a put or delete of a file the server changed
+since is a conflict. The ETags are compared when both have one, mtimes
+are in seconds and miss a change made in the second of base. A done
+line marks the changes up to its seq as sent, the file is emptied
+when none are left. A line cut short by a crash is dropped
+*/
+
+// JournalPut uploads the cached content of a file
+const JournalPut = "put"
+
+// JournalEntry is a change waiting for the server
+type JournalEntry struct {
+	Seq  int64 `json:"seq"`
+	Time int64 `json:"time"`
+	batch.Op
+	Base     int64  `json:"base,omitempty"`
+	BaseETag string `json:"baseetag,omitempty"`
+}
+
+func (e JournalEntry) String() string {
+	if e.To != "" {
+		return fmt.Sprintf("%s /%s -> /%s", e.Op.Op, e.Path, e.To)
+	}
+
+	return fmt.Sprintf("%s /%s", e.Op.Op, e.Path)
+}
+
+type journalLine struct {
+	JournalEntry
+	Done int64 `json:"done"`
+}
+
+// Journal is the durable list of changes made offline. While it holds
+// changes new ones go to it too, so the server sees them in order
+type Journal struct {
+	mu      sync.Mutex
+	f       *os.File
+	seq     int64
+	pending []JournalEntry
+	offline bool
+}
+
+// OpenJournal opens or makes a journal, the changes a previous mount
+// left in it are pending
+func OpenJournal(name string) (*Journal, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, seq, size, err := readJournal(f)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &Journal{f: f, seq: seq, pending: pending}, nil
+}
+
+// ReadJournal returns the pending changes of a journal file
+func ReadJournal(name string) ([]JournalEntry, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pending, _, _, err := readJournal(f)
+	return pending, err
+}
+
+// the pending entries of a journal, its last seq and the size of its
+// whole lines
+func readJournal(r io.Reader) (pending []JournalEntry, seq, size int64, err error) {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		var l journalLine
+		if json.Unmarshal(line, &l) != nil {
+			break
+		}
+		size += int64(len(line))
+
+		if l.Done != 0 {
+			for len(pending) > 0 && pending[0].Seq <= l.Done {
+				pending = pending[1:]
+			}
+			continue
+		}
+
+		pending = append(pending, l.JournalEntry)
+		seq = l.Seq
+	}
+
+	return pending, seq, size, nil
+}
+
+func (j *Journal) write(v interface{}) error {
+	byt, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.f.Write(append(byt, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return j.f.Sync()
+}
+
+// Append records a change, it is on disk when Append returns
+func (j *Journal) Append(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e.Seq = j.seq + 1
+	e.Time = time.Now().Unix()
+
+	err := j.write(e)
+	if err != nil {
+		return err
+	}
+
+	j.seq = e.Seq
+	j.pending = append(j.pending, e)
+	return nil
+}
+
+// Active is true while changes go to the journal instead of the server
+func (j *Journal) Active() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.offline || len(j.pending) > 0
+}
+
+// SetOffline sends changes to the journal until it is emptied, it is
+// true if the journal wasn't already offline
+func (j *Journal) SetOffline() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	was := j.offline
+	j.offline = true
+	return !was
+}
+
+// Pending returns the changes waiting for the server
+func (j *Journal) Pending() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return append([]JournalEntry(nil), j.pending...)
+}
+
+// next returns the oldest pending change. Without one the journal
+// is emptied and goes online
+func (j *Journal) next() (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.pending) == 0 {
+		j.offline = false
+		j.f.Truncate(0)
+		return JournalEntry{}, false
+	}
+
+	return j.pending[0], true
+}
+
+// done marks the oldest pending change as sent
+func (j *Journal) done(seq int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.write(struct {
+		Done int64 `json:"done"`
+	}{seq})
+	if err != nil {
+		return err
+	}
+
+	j.pending = j.pending[1:]
+	return nil
+}
+
+func (j *Journal) Close() error {
+	return j.f.Close()
+}
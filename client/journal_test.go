@@ -0,0 +1,205 @@
+package client
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+)
+
+func TestJournal(t *testing.T) {
+	name := path.Join(t.TempDir(), "host.journal")
+
+	j, err := OpenJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if j.Active() {
+		t.Errorf("an empty journal is active")
+	}
+
+	entries := []JournalEntry{
+		{Op: batch.Op{Op: JournalPut, Path: "a.txt"}, Base: 1500000000},
+		{Op: batch.Op{Op: batch.Rename, Path: "a.txt", To: "b.txt"}},
+		{Op: batch.Op{Op: batch.Delete, Path: "c.txt"}},
+	}
+	for _, e := range entries {
+		err := j.Append(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e, ok := j.next()
+	if !ok || e.Seq != 1 || e.Path != "a.txt" || e.Base != 1500000000 {
+		t.Fatalf("next: %+v %v", e, ok)
+	}
+
+	err = j.done(e.Seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// a line cut short by a crash
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":4,"op":"put","pa`)
+	f.Close()
+
+	pending, err := ReadJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].String() != "rename /a.txt -> /b.txt" {
+		t.Fatalf("pending: %v", pending)
+	}
+
+	j, err = OpenJournal(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	if !j.Active() {
+		t.Errorf("a journal with pending changes isn't active")
+	}
+
+	err = j.Append(JournalEntry{Op: batch.Op{Op: batch.Mkdir, Path: "d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending = j.Pending()
+	if len(pending) != 3 || pending[2].Seq != 4 {
+		t.Fatalf("after reopening: %v", pending)
+	}
+
+	for _, e := range pending {
+		j.next()
+		err := j.done(e.Seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok := j.next(); ok || j.Active() {
+		t.Errorf("the journal wasn't emptied")
+	}
+
+	if fi, err := os.Stat(name); err != nil || fi.Size() != 0 {
+		t.Errorf("journal file: %v %v", fi, err)
+	}
+}
+
+func TestReplayRetried(t *testing.T) {
+	// the server going away keeps the change, a conflict drops it
+	for status, retried := range map[int]bool{
+		http.StatusInternalServerError: true,
+		http.StatusBadGateway:          true,
+		http.StatusServiceUnavailable:  true,
+		http.StatusTooManyRequests:     true,
+		http.StatusConflict:            false,
+		http.StatusPreconditionFailed:  false,
+		http.StatusNotFound:            false,
+		http.StatusForbidden:           false,
+	} {
+		if replayRetried(status) != retried {
+			t.Errorf("%d retried %v, want %v", status, !retried, retried)
+		}
+	}
+}
+
+func TestConflictName(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"d/a.txt":    {"d/a.conflict-", ".txt"},
+		"d/.profile": {"d/.profile.conflict-", ""},
+	} {
+		c := ConflictName(name, nil)
+		stamp := strings.TrimSuffix(strings.TrimPrefix(c, want[0]), want[1])
+		if _, err := time.Parse("20060102-150405", stamp); err != nil {
+			t.Errorf("%s: %s", name, c)
+		}
+	}
+
+	// the first name is in use
+	var first string
+	taken := func(name string) bool {
+		if first == "" {
+			first = name
+		}
+		return name == first
+	}
+	if c := ConflictName("a.txt", taken); c != strings.TrimSuffix(first, ".txt")+"-2.txt" {
+		t.Errorf("a.txt with %s taken: %s", first, c)
+	}
+}
+
+func TestReplayConflict(t *testing.T) {
+	host, dirroot := startStore(t)
+	rfs := newClient(t, host, Timeouts{}, CloseToOpen)
+
+	sec := time.Unix(1500000000, 0)
+	serveFile(t, dirroot, "kept.txt", "one", sec.Add(100*time.Millisecond))
+	serveFile(t, dirroot, "mine.txt", "one", sec.Add(100*time.Millisecond))
+	cacheFile(t, rfs, dirroot, "kept.txt")
+	cacheFile(t, rfs, dirroot, "mine.txt")
+
+	// the server's change in the second of the cached version is only
+	// told apart by its ETag
+	serveFile(t, dirroot, "kept.txt", "two", sec.Add(600*time.Millisecond))
+
+	rfs.journal.SetOffline()
+	for _, name := range []string{"kept.txt", "mine.txt"} {
+		writeFile(t, rfs.cache.Abs(name), "mine")
+		rfs.changed(name, 0, 4)
+		rfs.upload(name, rfs.baseVersion(name))
+	}
+
+	// the names of conflict copies made now are in use
+	now := time.Now()
+	var theirs []string
+	for _, d := range []time.Duration{0, time.Second} {
+		name := "kept.conflict-" + now.Add(d).Format("20060102-150405") + ".txt"
+		serveFile(t, dirroot, name, "theirs", now)
+		theirs = append(theirs, name)
+	}
+
+	rfs.replay()
+
+	if s := readFile(t, filepath.Join(dirroot, "kept.txt")); s != "two" {
+		t.Errorf("the server's change was overwritten with %q", s)
+	}
+	for _, name := range theirs {
+		if s := readFile(t, filepath.Join(dirroot, name)); s != "theirs" {
+			t.Errorf("%s was overwritten with %q", name, s)
+		}
+	}
+	conflicts, _ := filepath.Glob(filepath.Join(dirroot, "kept.conflict-*.txt"))
+	mine := 0
+	for _, name := range conflicts {
+		if readFile(t, name) == "mine" {
+			mine++
+		}
+	}
+	if len(conflicts) != 3 || mine != 1 {
+		t.Errorf("conflict copies %v", conflicts)
+	}
+
+	// a file only changed in the cache is sent
+	if s := readFile(t, filepath.Join(dirroot, "mine.txt")); s != "mine" {
+		t.Errorf("mine.txt on the server: %q", s)
+	}
+
+	if pending := rfs.journal.Pending(); len(pending) != 0 {
+		t.Errorf("pending after the replay: %v", pending)
+	}
+}
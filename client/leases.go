@@ -0,0 +1,227 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ear7h/r3stfs/lease"
+)
+
+/*
+a mount asks for a read lease on the files it checks against the
+server, and for a write lease on the files it opens for writing. The
+server recalls a lease before another client changes the file, or
+reads it if it is a write lease, so while the mount holds one cacheOK
+trusts the cache without asking. A file held with a write lease isn't
+sent when it is closed but when it is released, which the kernel does
+after close returns, or when the lease is recalled. A file closed
+without one gets one then, if the server grants it, so closes don't
+wait for uploads
+
+leases last while the recall stream is connected, watchLeases keeps
+it connected and gives the leases back when they are recalled. A
+server without leases never grants any
+*/
+
+// how long a broken recall stream waits before it connects again
+const leaseRetry = 5 * time.Second
+
+type heldLease struct {
+	kind string
+	id   int64
+}
+
+type leases struct {
+	mu   sync.Mutex
+	held map[string]heldLease
+	// ids recalled before their grant was recorded
+	recalled map[int64]bool
+	// the recall stream is connected, leases granted without it
+	// can't be recalled
+	connected bool
+}
+
+func newLeases() *leases {
+	return &leases{
+		held:     make(map[string]heldLease),
+		recalled: make(map[int64]bool),
+	}
+}
+
+// a random id for the leases of a mount
+func newLeaseClient() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the kind of the lease held on name, "" for none
+func (l *leases) has(name string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.held[name].kind
+}
+
+// record the lease res granted on name, if any
+func (l *leases) granted(name string, res *http.Response) {
+	kind, id, ok := lease.Parse(res.Header.Get(lease.Header))
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.recalled[id] {
+		delete(l.recalled, id)
+		return
+	}
+
+	if l.connected {
+		l.held[name] = heldLease{kind, id}
+	}
+}
+
+// forget the lease id of name, it was recalled
+func (l *leases) recall(name string, id int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if h, ok := l.held[name]; ok && h.id == id {
+		delete(l.held, name)
+		return
+	}
+
+	// its grant is on its way, a grant which never arrives leaves
+	// its id here until there are too many
+	if len(l.recalled) > 1024 {
+		l.recalled = make(map[int64]bool)
+	}
+	l.recalled[id] = true
+}
+
+// forget the leases of name and the files under it, the server drops
+// them when the mount removes or renames them
+func (l *leases) drop(name string) {
+	prefix := name + "/"
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for p := range l.held {
+		if p == name || strings.HasPrefix(p, prefix) {
+			delete(l.held, p)
+		}
+	}
+}
+
+// the recall stream connected or broke, the leases from before are gone
+func (l *leases) reset(connected bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.held = make(map[string]heldLease)
+	l.recalled = make(map[int64]bool)
+	l.connected = connected
+}
+
+// hold a write lease on name, asking the server for one if the mount
+// has none. False when the server grants none
+func (rfs *R3stFs) leaseWrite(name string) bool {
+	if rfs.leases.has(name) == lease.Write {
+		return true
+	}
+	if rfs.journal.Active() {
+		return false
+	}
+
+	res, err := rfs.client.HeadLease(name, lease.Write)
+	if err != nil {
+		// the upload finds out whether the server is gone
+		return false
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusOK {
+		rfs.leases.granted(name, res)
+	}
+
+	return rfs.leases.has(name) == lease.Write
+}
+
+// keep the recall stream connected and answer its recalls
+func (rfs *R3stFs) watchLeases() {
+	for {
+		res, err := rfs.client.Leases()
+		if err == nil && res.StatusCode == http.StatusOK && res.Header.Get("Content-Type") == "application/x-ndjson" {
+			rfs.leases.reset(true)
+			rfs.readRecalls(res)
+		} else if err == nil && res.StatusCode != http.StatusOK {
+			res.Body.Close()
+		} else if err == nil {
+			// an older server, it grants no leases
+			res.Body.Close()
+			return
+		}
+
+		rfs.leases.reset(false)
+		time.Sleep(leaseRetry)
+	}
+}
+
+func (rfs *R3stFs) readRecalls(res *http.Response) {
+	defer res.Body.Close()
+
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			// heartbeat
+			continue
+		}
+
+		var r lease.Recall
+		err := json.Unmarshal(line, &r)
+		if err != nil {
+			fmt.Println("lease recall: ", err)
+			continue
+		}
+
+		// uploads may take a while, the others go on meanwhile
+		go rfs.giveBack(r)
+	}
+}
+
+// give a recalled lease back, after the changes it kept
+func (rfs *R3stFs) giveBack(r lease.Recall) {
+	name := strings.TrimPrefix(r.Path, "/")
+	rfs.leases.recall(name, r.ID)
+
+	// the file may change on the server from now on
+	rfs.attrs.invalidate(name)
+
+	if m, _ := rfs.meta.Get(name); m.IsDirty() {
+		rfs.uploads.send(name, rfs.baseVersion(name))
+	}
+
+	res, err := rfs.client.ReleaseLease(r.Path, r.ID)
+	if err != nil {
+		// the server breaks it after its timeout
+		fmt.Println("lease release: ", err)
+		return
+	}
+	res.Body.Close()
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ear7h/r3stfs/lease"
+)
+
+// wait for the recall stream of rfs to connect
+func waitLeases(t *testing.T, rfs *R3stFs) {
+	for i := 0; ; i++ {
+		rfs.leases.mu.Lock()
+		connected := rfs.leases.connected
+		rfs.leases.mu.Unlock()
+
+		if connected {
+			return
+		}
+		if i == 100 {
+			t.Fatal("the recall stream didn't connect")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestLeases(t *testing.T) {
+	host := startServer(t)
+
+	a, ra := mountClient(t, host, Timeouts{}, CloseToOpen)
+	b, rb := mountClient(t, host, Timeouts{}, CloseToOpen)
+	waitLeases(t, ra)
+	waitLeases(t, rb)
+
+	// opening for writing leases the file to a alone
+	writeFile(t, filepath.Join(a, "f.txt"), "one")
+	if kind := ra.leases.has("f.txt"); kind != lease.Write {
+		t.Fatalf("a holds a %q lease after writing", kind)
+	}
+
+	// b's read recalls it, a sends the file first
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "one" {
+		t.Fatalf("b read %q", s)
+	}
+	if kind := rb.leases.has("f.txt"); kind != lease.Read {
+		t.Errorf("b holds a %q lease after reading", kind)
+	}
+	if kind := ra.leases.has("f.txt"); kind != "" {
+		t.Errorf("a kept a %q lease after the recall", kind)
+	}
+
+	// a's write recalls b's read lease
+	writeFile(t, filepath.Join(a, "f.txt"), "second")
+	if kind := rb.leases.has("f.txt"); kind != "" {
+		t.Errorf("b kept a %q lease after a's write", kind)
+	}
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "second" {
+		t.Errorf("b read %q after a's write", s)
+	}
+
+	// a write of a file open elsewhere is seen at its next read
+	f, err := os.OpenFile(filepath.Join(a, "f.txt"), os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("third time")
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "third time" {
+		t.Errorf("b read %q while a had the file open", s)
+	}
+
+	// closing it leases it to a again rather than sending it, b's
+	// next read recalls the lease
+	f.WriteString(", again")
+	f.Close()
+	if kind := ra.leases.has("f.txt"); kind != lease.Write {
+		t.Errorf("a holds a %q lease after closing the file", kind)
+	}
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "third time, again" {
+		t.Errorf("b read %q after a closed the file", s)
+	}
+
+	// removing the file ends the leases on it
+	err = os.Remove(filepath.Join(b, "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind := rb.leases.has("f.txt"); kind != "" {
+		t.Errorf("b kept a %q lease of the file it removed", kind)
+	}
+	if _, err := os.Stat(filepath.Join(a, "f.txt")); !os.IsNotExist(err) {
+		t.Errorf("a's stat of the removed file: %v", err)
+	}
+}
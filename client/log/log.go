@@ -6,18 +6,31 @@ import (
 	"time"
 	"os"
 	"io"
+	"sync"
 )
 
 var outStream io.Writer
+var openOnce sync.Once
 
-func init() {
-	fmt.Println("will log stuff!")
-	outFile, err := os.OpenFile("log.txt", os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0666)
-	if err != nil {
-		panic(err)
-	}
-	outStream = io.MultiWriter(os.Stdout, outFile)
+// the log file is opened by the first call, so programs which only
+// link the client don't make one
+func out() io.Writer {
+	openOnce.Do(func() {
+		fmt.Println("will log stuff!")
+		outFile, err := os.OpenFile("log.txt", os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0666)
+		if err != nil {
+			panic(err)
+		}
+		outStream = io.MultiWriter(os.Stdout, outFile)
+	})
+
+	return outStream
+}
 
+// SetOutput sends the log to w instead of stdout and log.txt
+func SetOutput(w io.Writer) {
+	openOnce.Do(func() {})
+	outStream = w
 }
 
 func Func(name string, params ...interface{}) {
@@ -32,7 +45,7 @@ func Func(name string, params ...interface{}) {
 	if name == "" {
 		name = "/"
 	}
-	fmt.Fprintf(outStream, "%s | %s called : %s ", ts, fn, name)
+	fmt.Fprintf(out(), "%s | %s called : %s ", ts, fn, name)
 	fmt.Fprintln(outStream, params...)
 }
 
@@ -47,6 +60,6 @@ func Return(params ...interface{}) {
 
 	fn := runtime.FuncForPC(pc).Name()
 
-	fmt.Fprintf(outStream,"%s | %s returned: ", ts, fn)
+	fmt.Fprintf(out(),"%s | %s returned: ", ts, fn)
 	fmt.Fprintln(outStream, params...)
 }
\ No newline at end of file
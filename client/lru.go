@@ -0,0 +1,485 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+/*
+the cache is bounded by CacheLimits. The lru keeps its files and
+directories in the order they were used, when the cache is over a
+limit the least recently used are evicted: while over the byte limit
+files lose their content and become placeholders, like those of
+OpenDir, while over the file limit they are removed, directories once
+they are empty. Open files and files with journaled changes are never
+evicted, they are in use or only on this machine.
+
+a new mount orders the files it finds by the time the server last
+validated them, content checked long ago goes first
+*/
+
+// how often the counters are written for r3stfs status
+const statsInterval = 10 * time.Second
+
+// CacheLimits bound the cache of a mount, a zero limit is no bound
+type CacheLimits struct {
+	// disk space of the cached files
+	Bytes int64 `json:"bytes"`
+	// cached files and directories
+	Files int64 `json:"files"`
+}
+
+// CacheStats are the size and counters of a mount's cache
+type CacheStats struct {
+	Limits    CacheLimits `json:"limits"`
+	Bytes     int64       `json:"bytes"`
+	Files     int64       `json:"files"`
+	Hits      int64       `json:"hits"`
+	Misses    int64       `json:"misses"`
+	Evictions int64       `json:"evictions"`
+	Uploads   UploadStats `json:"uploads"`
+}
+
+// ReadCacheStats reads the stats of a mount, nil if it never wrote them
+func ReadCacheStats(name string) (*CacheStats, error) {
+	byt, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &CacheStats{}
+	err = json.Unmarshal(byt, stats)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return stats, nil
+}
+
+type cacheEntry struct {
+	name string
+	dir  bool
+	size int64
+	// open files, they aren't evicted
+	pins int
+}
+
+type lru struct {
+	mu      sync.Mutex
+	store   sandbox.Store
+	meta    *MetaDB
+	list    *list.List // of *cacheEntry, the most recently used first
+	entries map[string]*list.Element
+	stats   CacheStats
+	kick    chan struct{}
+	// told of evicted files, may be nil
+	attrs *attrCache
+}
+
+func newLRU(store sandbox.Store, meta *MetaDB, limits CacheLimits) *lru {
+	return &lru{
+		store:   store,
+		meta:    meta,
+		list:    list.New(),
+		entries: make(map[string]*list.Element),
+		stats:   CacheStats{Limits: limits},
+		kick:    make(chan struct{}, 1),
+	}
+}
+
+// the disk space of a file, holes of sparse files take none
+func usage(fi os.FileInfo) int64 {
+	if fi.IsDir() {
+		return 0
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+
+	return fi.Size()
+}
+
+// add the files already in the cache
+func (l *lru) load() error {
+	root := l.store.Abs("")
+
+	type found struct {
+		name string
+		fi   os.FileInfo
+	}
+	var all []found
+
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(root, p)
+		if err != nil || name == "." {
+			return err
+		}
+
+		all = append(all, found{filepath.ToSlash(name), fi})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	used := func(f found) int64 {
+		if m, ok := l.meta.Get(f.name); ok && m.Validated != 0 {
+			return m.Validated
+		}
+		return f.fi.ModTime().Unix()
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return used(all[i]) < used(all[j])
+	})
+
+	l.mu.Lock()
+	for _, f := range all {
+		l.use(f.name, f.fi)
+	}
+	l.mu.Unlock()
+
+	l.collect()
+	return nil
+}
+
+// move name to the front, l.mu is held
+func (l *lru) use(name string, fi os.FileInfo) *cacheEntry {
+	el, ok := l.entries[name]
+	if !ok {
+		el = l.list.PushFront(&cacheEntry{name: name})
+		l.entries[name] = el
+		l.stats.Files++
+	} else {
+		l.list.MoveToFront(el)
+	}
+
+	e := el.Value.(*cacheEntry)
+	if fi != nil {
+		size := usage(fi)
+		l.stats.Bytes += size - e.size
+		e.size, e.dir = size, fi.IsDir()
+	}
+
+	return e
+}
+
+// drop the entry of el, l.mu is held
+func (l *lru) drop(el *list.Element) {
+	e := el.Value.(*cacheEntry)
+
+	l.list.Remove(el)
+	delete(l.entries, e.name)
+	l.stats.Files--
+	l.stats.Bytes -= e.size
+}
+
+// touch records a use of name and its size in the cache
+func (l *lru) touch(name string) {
+	if name == "" {
+		return
+	}
+
+	fi, err := os.Lstat(l.store.Abs(name))
+	if err != nil {
+		l.forget(name)
+		return
+	}
+
+	l.mu.Lock()
+	l.use(name, fi)
+	l.mu.Unlock()
+
+	l.collect()
+}
+
+// pin keeps name in the cache until it is unpinned
+func (l *lru) pin(name string) *cacheEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e := l.use(name, nil)
+	e.pins++
+	return e
+}
+
+// release unpins e and records the use of its file, which may have
+// been renamed or removed since it was pinned
+func (l *lru) release(e *cacheEntry) {
+	l.mu.Lock()
+	e.pins--
+	name := e.name
+	l.mu.Unlock()
+
+	l.touch(name)
+}
+
+func (l *lru) hit() {
+	l.mu.Lock()
+	l.stats.Hits++
+	l.mu.Unlock()
+}
+
+func (l *lru) miss() {
+	l.mu.Lock()
+	l.stats.Misses++
+	l.mu.Unlock()
+}
+
+// the entries of name and of the files under it
+func (l *lru) under(name string) []*list.Element {
+	var els []*list.Element
+	for n, el := range l.entries {
+		if n == name || strings.HasPrefix(n, name+"/") {
+			els = append(els, el)
+		}
+	}
+
+	return els
+}
+
+// forget drops name and the files under it, they left the cache
+func (l *lru) forget(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, el := range l.under(name) {
+		l.drop(el)
+	}
+}
+
+// rename moves the entries of oldName and the files under it, pins
+// move with them
+func (l *lru) rename(oldName, newName string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	moved := l.under(oldName)
+	for _, el := range l.under(newName) {
+		l.drop(el)
+	}
+
+	for _, el := range moved {
+		e := el.Value.(*cacheEntry)
+		delete(l.entries, e.name)
+		e.name = newName + e.name[len(oldName):]
+	}
+
+	for _, el := range moved {
+		e := el.Value.(*cacheEntry)
+		l.entries[e.name] = el
+		l.list.MoveToFront(el)
+	}
+}
+
+// over a limit, l.mu is held
+func (l *lru) over() (bytes, files bool) {
+	limits := l.stats.Limits
+	bytes = limits.Bytes > 0 && l.stats.Bytes > limits.Bytes
+	files = limits.Files > 0 && l.stats.Files > limits.Files
+	return
+}
+
+// collect asks the collector to evict if the cache is over a limit
+func (l *lru) collect() {
+	l.mu.Lock()
+	bytes, files := l.over()
+	l.mu.Unlock()
+
+	if !bytes && !files {
+		return
+	}
+
+	select {
+	case l.kick <- struct{}{}:
+	default:
+	}
+}
+
+// evict the least recently used until the cache is within its
+// limits, the names in keep are left alone. A directory is only removed
+// once its files are, passes are made while one evicts something
+func (l *lru) evict(keep map[string]bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for evicted := true; evicted; {
+		evicted = false
+
+		for el := l.list.Back(); el != nil; {
+			bytes, files := l.over()
+			if !bytes && !files {
+				return
+			}
+
+			prev := el.Prev()
+			e := el.Value.(*cacheEntry)
+
+			if e.pins == 0 && !keep[e.name] && l.evictEntry(el, files) {
+				evicted = true
+				l.stats.Evictions++
+			}
+
+			el = prev
+		}
+	}
+}
+
+// evict an entry, remove is true over the file limit, otherwise a file
+// becomes a placeholder. l.mu is held
+func (l *lru) evictEntry(el *list.Element, remove bool) bool {
+	e := el.Value.(*cacheEntry)
+	p := l.store.Abs(e.name)
+
+	if remove {
+		// fails for directories with files, a later pass gets them
+		if os.Remove(p) != nil {
+			return false
+		}
+
+		l.meta.Forget(e.name)
+		l.drop(el)
+		l.evicted(e.name)
+		return true
+	}
+
+	if e.dir || e.size == 0 {
+		return false
+	}
+
+	// the record goes first, a crash mustn't leave it trusting an
+	// emptied file
+	err := l.meta.Update(e.name, true, func(m *CacheMeta) {
+		*m = CacheMeta{Path: m.Path, State: Placeholder}
+	})
+	if err != nil || os.Truncate(p, 0) != nil {
+		return false
+	}
+
+	l.stats.Bytes -= e.size
+	e.size = 0
+	l.evicted(e.name)
+	return true
+}
+
+// the cached file of name no longer has the server's attributes
+func (l *lru) evicted(name string) {
+	if l.attrs != nil {
+		l.attrs.invalidate(name)
+	}
+}
+
+// Stats returns the size and counters of the cache
+func (l *lru) Stats() CacheStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stats
+}
+
+// save stats for r3stfs status
+func saveStats(name string, stats CacheStats) error {
+	byt, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, byt, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, name)
+}
+
+// the names with changes the server hasn't, they aren't evicted
+func (rfs *R3stFs) dirty() map[string]bool {
+	keep := make(map[string]bool)
+	for _, name := range rfs.meta.Dirty() {
+		keep[name] = true
+	}
+
+	for _, e := range rfs.journal.Pending() {
+		keep[e.Path] = true
+		keep[rfs.cachedName(e.Path)] = true
+		if e.To != "" {
+			keep[e.To] = true
+		}
+	}
+
+	return keep
+}
+
+// make the directories up to name the collector removed, like the
+// placeholders of OpenDir their attributes come from the server
+func (rfs *R3stFs) restoreDir(name string) {
+	if name == "" || name == "." {
+		return
+	}
+	if _, err := rfs.cache.Stat(name); !os.IsNotExist(err) {
+		return
+	}
+
+	rfs.restoreDir(path.Dir(name))
+
+	if rfs.cache.MkDir(name, 0700) == nil {
+		rfs.meta.Update(name, false, func(m *CacheMeta) {
+			m.State = Placeholder
+		})
+		rfs.lru.touch(name)
+	}
+}
+
+// evict when the cache goes over a limit and write the stats of the
+// cache and the uploads to statsFile now and then
+func (rfs *R3stFs) collector(statsFile string) {
+	tick := time.NewTicker(statsInterval)
+	defer tick.Stop()
+
+	var saved CacheStats
+	for {
+		select {
+		case <-rfs.lru.kick:
+			rfs.lru.evict(rfs.dirty())
+		case <-tick.C:
+		}
+
+		stats := rfs.lru.Stats()
+		stats.Uploads = rfs.uploads.Stats()
+		if stats == saved {
+			continue
+		}
+
+		err := saveStats(statsFile, stats)
+		if err != nil {
+			fmt.Println("cache stats: ", err)
+			continue
+		}
+		saved = stats
+	}
+}
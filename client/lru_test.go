@@ -0,0 +1,108 @@
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+func TestLRU(t *testing.T) {
+	dir := t.TempDir()
+	store, err := sandbox.NewStore(path.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := OpenMetaDB(path.Join(dir, "meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer meta.Close()
+
+	store.MkDir("d", 0700)
+
+	// fetched in this order, a first
+	content := bytes.Repeat([]byte("x"), 8192)
+	for i, name := range []string{"a", "b", "d/c", "e"} {
+		err := ioutil.WriteFile(store.Abs(name), content, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mtime := time.Unix(1500000000+int64(i), 0)
+		store.Chtimes(name, mtime, mtime)
+	}
+
+	l := newLRU(store, meta, CacheLimits{})
+	err = l.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats := l.Stats()
+	if stats.Files != 5 || stats.Bytes < 4*8192 {
+		t.Fatalf("loaded %+v", stats)
+	}
+
+	size := func(name string) int64 {
+		fi, err := store.Stat(name)
+		if err != nil {
+			return -1
+		}
+		return fi.Size()
+	}
+
+	// a is in use, e has journaled changes
+	pin := l.pin("a")
+	keep := map[string]bool{"e": true}
+
+	// room for two files, b and d/c lose their content
+	l.stats.Limits = CacheLimits{Bytes: stats.Bytes / 2}
+	l.evict(keep)
+
+	if size("a") != 8192 || size("b") != 0 || size("d/c") != 0 || size("e") != 8192 {
+		t.Errorf("sizes after evicting content: %d %d %d %d", size("a"), size("b"), size("d/c"), size("e"))
+	}
+
+	if m, _ := meta.Get("b"); m.State != Placeholder {
+		t.Errorf("b isn't a placeholder: %+v", m)
+	}
+
+	if l.Stats().Evictions != 2 {
+		t.Errorf("evictions: %+v", l.Stats())
+	}
+
+	// room for three entries, the directory goes after its file
+	l.touch("b")
+	l.stats.Limits = CacheLimits{Files: 3}
+	l.evict(keep)
+
+	if _, err := os.Stat(store.Abs("d")); !os.IsNotExist(err) {
+		t.Errorf("d wasn't removed: %v", err)
+	}
+
+	if size("a") < 0 || size("b") < 0 || size("e") < 0 {
+		t.Errorf("a, b or e was removed")
+	}
+
+	// released, a goes before the renamed b
+	l.release(pin)
+	l.touch("b")
+	l.rename("b", "f")
+	l.stats.Limits = CacheLimits{Files: 2}
+	l.evict(keep)
+
+	if size("a") >= 0 {
+		t.Errorf("a wasn't removed")
+	}
+
+	stats = l.Stats()
+	if stats.Files != 2 || l.entries["f"] == nil || l.entries["b"] != nil {
+		t.Errorf("entries after the rename: %+v %v", stats, l.entries)
+	}
+}
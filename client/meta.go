@@ -0,0 +1,560 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/sparse"
+)
+
+/*
+the metadata db records what the cache holds of each file, the cache
+is trusted by it and not by the times of the cached files. It is a
+file of json lines next to the cache, each line the whole record of
+a path replacing the one before
+
+	{"path":"notes.txt","state":"complete","version":1501600000,"etag":"\"14d3...-1a2\"","validated":1501632000}
+	{"path":"notes.txt","state":"complete","version":1501600000,"dirty":[{"Offset":0,"Length":512}]}
+	{"path":"old.txt","forget":true}
+
+the lines that change what the cache can be trusted with, like a
+fetch starting or finishing or a file getting dirty, are synced before
+the cache is changed, validation times are written without a sync.
+When the lines outgrow the records the file is compacted to one line
+a record, written aside and renamed over it. A line cut short by a
+crash is dropped
+*/
+
+// FetchState is how much of the server's content the cache holds
+type FetchState string
+
+const (
+	// listed by OpenDir, the content was never fetched
+	Placeholder FetchState = "placeholder"
+	// a fetch started and didn't finish
+	Partial FetchState = "partial"
+	// the server's content of the record's version
+	Complete FetchState = "complete"
+)
+
+// CacheMeta is the record of a cached path
+type CacheMeta struct {
+	Path  string     `json:"path"`
+	State FetchState `json:"state,omitempty"`
+	// the server's mtime and ETag of the content
+	Version int64  `json:"version,omitempty"`
+	ETag    string `json:"etag,omitempty"`
+	// ranges changed in the cache and not sent yet, a truncation is
+	// an empty extent at the new size
+	Dirty []sparse.Extent `json:"dirty,omitempty"`
+	// unix time the server last said the content is current
+	Validated int64 `json:"validated,omitempty"`
+	// the record is dropped
+	Forget bool `json:"forget,omitempty"`
+}
+
+// IsDirty is true while the cache has changes the server hasn't
+func (m CacheMeta) IsDirty() bool {
+	return len(m.Dirty) > 0
+}
+
+// Current is true if the record is of the version the server answered
+// with, an ETag is compared when both have one
+func (m CacheMeta) Current(header http.Header) bool {
+	if m.State != Complete {
+		return false
+	}
+
+	if etag := header.Get("ETag"); etag != "" && m.ETag != "" {
+		return etag == m.ETag
+	}
+
+	mtime, err := strconv.ParseInt(header.Get("Mtime"), 10, 64)
+	return err == nil && mtime == m.Version
+}
+
+// fetched sets the version of the server's content the cache holds
+func (m *CacheMeta) fetched(header http.Header, now int64) {
+	m.State = Complete
+	m.Version, _ = strconv.ParseInt(header.Get("Mtime"), 10, 64)
+	m.ETag = header.Get("ETag")
+	m.Dirty = nil
+	m.Validated = now
+}
+
+// merge the range off, n into sorted extents
+func addExtent(extents []sparse.Extent, off, n int64) []sparse.Extent {
+	extents = append(extents, sparse.Extent{Offset: off, Length: n})
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].Offset < extents[j].Offset
+	})
+
+	merged := extents[:1]
+	for _, e := range extents[1:] {
+		last := &merged[len(merged)-1]
+		if e.Offset > last.Offset+last.Length {
+			merged = append(merged, e)
+			continue
+		}
+
+		if end := e.Offset + e.Length; end > last.Offset+last.Length {
+			last.Length = end - last.Offset
+		}
+	}
+
+	return merged
+}
+
+// MetaDB is the durable set of CacheMeta records of a cache
+type MetaDB struct {
+	mu      sync.Mutex
+	name    string
+	f       *os.File
+	records map[string]*CacheMeta
+	// lines in the file, it is compacted when they outgrow records
+	lines int
+	// records changed in memory since their last line
+	unsaved map[string]bool
+}
+
+// OpenMetaDB opens or makes a metadata db
+func OpenMetaDB(name string) (*MetaDB, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &MetaDB{
+		name:    name,
+		f:       f,
+		records: make(map[string]*CacheMeta),
+		unsaved: make(map[string]bool),
+	}
+
+	size, err := db.read(f)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// read the records of r and return the size of its whole lines
+func (db *MetaDB) read(r io.Reader) (size int64, err error) {
+	br := bufio.NewReader(r)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		m := &CacheMeta{}
+		if json.Unmarshal(line, m) != nil {
+			break
+		}
+		size += int64(len(line))
+		db.lines++
+
+		if m.Forget {
+			delete(db.records, m.Path)
+		} else {
+			db.records[m.Path] = m
+		}
+	}
+
+	return size, nil
+}
+
+// write the line of a record, db.mu is held
+func (db *MetaDB) write(m *CacheMeta, sync bool) error {
+	byt, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.f.Write(append(byt, '\n'))
+	if err != nil {
+		return err
+	}
+	db.lines++
+	delete(db.unsaved, m.Path)
+
+	if db.lines > 4*len(db.records)+1024 {
+		return db.compact()
+	}
+
+	if sync {
+		return db.f.Sync()
+	}
+
+	return nil
+}
+
+// rewrite the file with a line for each record, db.mu is held
+func (db *MetaDB) compact() error {
+	tmp := db.name + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, m := range db.records {
+		err = enc.Encode(m)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, db.name)
+	if err != nil {
+		return err
+	}
+
+	// the rename is only durable once the directory is synced
+	if dir, err := os.Open(path.Dir(db.name)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	nf, err := os.OpenFile(db.name, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	db.f.Close()
+	db.f = nf
+	db.lines = len(db.records)
+	db.unsaved = make(map[string]bool)
+	return nil
+}
+
+// Get returns the record of name, a path without one holds nothing
+// of the server's
+func (db *MetaDB) Get(name string) (CacheMeta, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.records[name]
+	if !ok {
+		return CacheMeta{Path: name}, false
+	}
+
+	c := *m
+	c.Dirty = append([]sparse.Extent(nil), m.Dirty...)
+	return c, true
+}
+
+// Update changes the record of name with fn, sync is true for the
+// changes the cache must not get ahead of
+func (db *MetaDB) Update(name string, sync bool, fn func(m *CacheMeta)) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.records[name]
+	if !ok {
+		m = &CacheMeta{Path: name}
+		db.records[name] = m
+	}
+
+	fn(m)
+	return db.write(m, sync)
+}
+
+// MarkDirty records a change of the range off, n of name. The first
+// change of a clean file is synced, the ranges of later ones are
+// written by Flush
+func (db *MetaDB) MarkDirty(name string, off, n int64) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.records[name]
+	if !ok {
+		m = &CacheMeta{Path: name}
+		db.records[name] = m
+	}
+
+	clean := !m.IsDirty()
+	m.Dirty = addExtent(m.Dirty, off, n)
+
+	if clean {
+		return db.write(m, true)
+	}
+
+	db.unsaved[name] = true
+	return nil
+}
+
+// Flush syncs the unsaved changes of name's record
+func (db *MetaDB) Flush(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	m, ok := db.records[name]
+	if !ok || !db.unsaved[name] {
+		return nil
+	}
+
+	return db.write(m, true)
+}
+
+// the records of name and of the paths under it, db.mu is held
+func (db *MetaDB) under(name string) []*CacheMeta {
+	var ms []*CacheMeta
+	for p, m := range db.records {
+		if p == name || strings.HasPrefix(p, name+"/") {
+			ms = append(ms, m)
+		}
+	}
+
+	return ms
+}
+
+// Forget drops the records of name and the paths under it
+func (db *MetaDB) Forget(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, m := range db.under(name) {
+		delete(db.records, m.Path)
+
+		err := db.write(&CacheMeta{Path: m.Path, Forget: true}, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rename moves the records of oldName and the paths under it
+func (db *MetaDB) Rename(oldName, newName string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if oldName == newName {
+		return nil
+	}
+
+	var forget []string
+	for _, m := range db.under(newName) {
+		delete(db.records, m.Path)
+		forget = append(forget, m.Path)
+	}
+
+	moved := db.under(oldName)
+	for _, m := range moved {
+		delete(db.records, m.Path)
+		forget = append(forget, m.Path)
+	}
+
+	for _, m := range moved {
+		m.Path = newName + m.Path[len(oldName):]
+		db.records[m.Path] = m
+	}
+
+	// the new records go first, a crash leaves dirty ones under
+	// both names rather than none
+	for i, m := range moved {
+		err := db.write(m, i == len(moved)-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range forget {
+		if _, ok := db.records[p]; ok {
+			continue
+		}
+
+		err := db.write(&CacheMeta{Path: p, Forget: true}, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Dirty lists the paths with changes the server hasn't
+func (db *MetaDB) Dirty() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var names []string
+	for p, m := range db.records {
+		if m.IsDirty() {
+			names = append(names, p)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Close writes the unsaved records and closes the db
+func (db *MetaDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for name := range db.unsaved {
+		if m, ok := db.records[name]; ok {
+			db.write(m, false)
+		}
+	}
+
+	return db.f.Close()
+}
+
+// the server's version of name the cache holds, the base of changes
+// to it
+func (rfs *R3stFs) baseVersion(name string) int64 {
+	m, _ := rfs.meta.Get(name)
+	if m.State != Complete {
+		return 0
+	}
+
+	return m.Version
+}
+
+// the server's ETag of name at the mtime base, "" if the cache doesn't
+// hold that version
+func (rfs *R3stFs) baseETag(name string, base int64) string {
+	m, _ := rfs.meta.Get(name)
+	if base == 0 || m.State != Complete || m.Version != base {
+		return ""
+	}
+
+	return m.ETag
+}
+
+// fetched is true if the cache holds content of name, the server's or
+// changes to it
+func (rfs *R3stFs) fetched(name string) bool {
+	m, _ := rfs.meta.Get(name)
+	return m.State == Complete || m.IsDirty()
+}
+
+// record that the cache holds the version of name the server answered
+// with, clean
+func (rfs *R3stFs) stored(name string, header http.Header) {
+	err := rfs.meta.Update(name, true, func(m *CacheMeta) {
+		m.fetched(header, time.Now().Unix())
+	})
+	if err != nil {
+		fmt.Println("meta: ", err)
+	}
+}
+
+// record that the cache holds nothing of name, before its content goes
+func (rfs *R3stFs) unfetched(name string) {
+	err := rfs.meta.Update(name, true, func(m *CacheMeta) {
+		*m = CacheMeta{Path: m.Path, State: Placeholder}
+	})
+	if err != nil {
+		fmt.Println("meta: ", err)
+	}
+}
+
+// record a change made to the cached name and by the server to its
+// copy, res is the server's answer. Other changes of a dirty file still
+// have to be sent, it stays dirty
+func (rfs *R3stFs) changedBoth(name string, res *http.Response) {
+	err := rfs.meta.Update(name, true, func(m *CacheMeta) {
+		if m.State == Complete && !m.IsDirty() {
+			m.fetched(res.Header, time.Now().Unix())
+		}
+	})
+	if err != nil {
+		fmt.Println("meta: ", err)
+	}
+}
+
+// record a change of the range off, n of name made only in the cache
+func (rfs *R3stFs) changed(name string, off, n int64) {
+	err := rfs.meta.MarkDirty(name, off, n)
+	if err != nil {
+		fmt.Println("meta: ", err)
+	}
+}
+
+// record the server's version of name after a change that left its
+// content alone, like setting its times
+func (rfs *R3stFs) revalidate(name string) {
+	m, _ := rfs.meta.Get(name)
+	if m.State != Complete || m.IsDirty() {
+		return
+	}
+
+	res, err := rfs.client.Head(name)
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+
+	if remote.Errno(res) == 0 {
+		rfs.stored(name, res.Header)
+	}
+}
+
+// records for a cache from before the db, its files were trusted when
+// their mtime wasn't older than the server's
+func (rfs *R3stFs) seedMeta() error {
+	root := rfs.cache.Abs("")
+
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+
+		name, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+
+		return rfs.meta.Update(filepath.ToSlash(name), false, func(m *CacheMeta) {
+			if mtime := fi.ModTime().Unix(); mtime > 0 {
+				m.State, m.Version = Complete, mtime
+			} else {
+				m.State = Placeholder
+			}
+		})
+	})
+}
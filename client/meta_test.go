@@ -0,0 +1,107 @@
+package client
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMetaDB(t *testing.T) {
+	name := path.Join(t.TempDir(), "host.meta")
+
+	db, err := OpenMetaDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	header.Set("Mtime", "1500000000")
+	header.Set("ETag", `"1-2"`)
+
+	for _, p := range []string{"d/a.txt", "d/b.txt", "c.txt"} {
+		err := db.Update(p, true, func(m *CacheMeta) {
+			m.fetched(header, 1500000100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.MarkDirty("d/a.txt", 10, 10)
+	db.MarkDirty("d/a.txt", 0, 10)
+	db.MarkDirty("d/a.txt", 100, 0)
+
+	err = db.Rename("d", "e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Forget("c.txt")
+	db.Close()
+
+	// a line cut short by a crash
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"path":"e/b.txt","sta`)
+	f.Close()
+
+	db, err = OpenMetaDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if _, ok := db.Get("d/a.txt"); ok {
+		t.Errorf("d/a.txt wasn't renamed")
+	}
+	if _, ok := db.Get("c.txt"); ok {
+		t.Errorf("c.txt wasn't forgotten")
+	}
+
+	a, _ := db.Get("e/a.txt")
+	if len(a.Dirty) != 2 || a.Dirty[0].Length != 20 || a.Dirty[1].Offset != 100 {
+		t.Errorf("dirty extents of e/a.txt: %+v", a.Dirty)
+	}
+
+	b, ok := db.Get("e/b.txt")
+	if !ok || !b.Current(header) || b.IsDirty() {
+		t.Errorf("e/b.txt: %+v", b)
+	}
+
+	header.Set("ETag", `"3-2"`)
+	if b.Current(header) {
+		t.Errorf("a new ETag is current")
+	}
+
+	if names := db.Dirty(); len(names) != 1 || names[0] != "e/a.txt" {
+		t.Errorf("dirty: %v", names)
+	}
+
+	// compacted to one line a record
+	db.mu.Lock()
+	err = db.compact()
+	db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Update("e/b.txt", false, func(m *CacheMeta) {
+		m.Validated = 1500000200
+	})
+
+	reopened, err := OpenMetaDB(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.lines != 3 || len(reopened.records) != 2 {
+		t.Errorf("after compacting: %d lines, %d records", reopened.lines, len(reopened.records))
+	}
+
+	if b, _ := reopened.Get("e/b.txt"); b.Validated != 1500000200 {
+		t.Errorf("validation time wasn't kept: %+v", b)
+	}
+}
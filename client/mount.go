@@ -0,0 +1,69 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/hanwen/go-fuse/fuse/nodefs"
+	"github.com/hanwen/go-fuse/fuse/pathfs"
+
+	"github.com/ear7h/r3stfs/client/runtime"
+)
+
+// FsName prefixes the source of r3stfs mounts in the mount table,
+// r3stfs@localhost:8080
+const FsName = "r3stfs"
+
+// Mount serves the files of user on host at mtpt until the file
+// system is unmounted, files are cached under cacheDir within limits.
+// The kernel and the client trust what they learned for the timeouts,
+// consistency is what the mount promises of other clients' changes
+func Mount(mtpt, host, user, pass, cacheDir string, limits CacheLimits, timeouts Timeouts, consistency Consistency) error {
+	rfs, err := NewR3stFs(host, user, pass, cacheDir, limits, timeouts, consistency)
+	if err != nil {
+		return err
+	}
+
+	server, err := newServer(mtpt, host, rfs, consistency.timeouts(timeouts))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("mounted")
+
+	//cleanup
+	runtime.AddCleaner(func(signal os.Signal) {
+		server.Unmount()
+	})
+
+	server.Serve()
+
+	// the files released last are sent before the mount exits
+	rfs.uploads.wait("")
+	return nil
+}
+
+// mount rfs at mtpt, the caller serves it
+func newServer(mtpt, host string, rfs *R3stFs, timeouts Timeouts) (*fuse.Server, error) {
+	//make pathfs
+	nfs := pathfs.NewPathNodeFs(
+		rfs,
+		&pathfs.PathNodeFsOptions{Debug: true})
+	rfs.nfs = nfs
+
+	opts := nodefs.NewOptions()
+	opts.AttrTimeout = timeouts.Attr
+	opts.EntryTimeout = timeouts.Entry
+	opts.NegativeTimeout = timeouts.Negative
+
+	conn := nodefs.NewFileSystemConnector(nfs.Root(), opts)
+	return fuse.NewServer(conn.RawFS(), mtpt, &fuse.MountOptions{
+		FsName: FsName + "@" + host,
+		Name:   FsName,
+	})
+}
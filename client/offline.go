@@ -0,0 +1,406 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/0xAX/notificator"
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/client/remote"
+)
+
+/*
+without the server the mount keeps working on the cache. Reads are
+served from cached files, files only known from a listing fail with
+EHOSTDOWN. Changes are made to the cache and recorded in the journal,
+which is replayed once the server answers again. See journal.go
+*/
+
+// how often the server is tried while the journal holds changes
+const journalRetry = 5 * time.Second
+
+// errOffline is the error of files which were never downloaded
+const errOffline = fuse.Status(syscall.EHOSTDOWN)
+
+func notify(title, msg string) {
+	fmt.Println(title+": ", msg)
+
+	err := notificator.New(notificator.Options{
+		AppName: "r3stfs",
+	}).Push(title, msg, "", notificator.UR_NORMAL)
+
+	if err != nil {
+		fmt.Println("notify: ", err)
+	}
+}
+
+// go offline after a request failed without an answer
+func (rfs *R3stFs) goOffline(err error) {
+	if rfs.journal.SetOffline() {
+		go notify("Offline", fmt.Sprintf("%v, changes are kept until the server is back", err))
+	}
+}
+
+// send the cached content of name to the server, or to the journal.
+// The metadata db keeps it dirty until the server has it
+func (rfs *R3stFs) upload(name string, base int64) fuse.Status {
+	return rfs.uploadProgress(name, base, false, nil)
+}
+
+// upload, on the server's disk if durable, calling progress with the
+// bytes sent so far when it isn't nil
+func (rfs *R3stFs) uploadProgress(name string, base int64, durable bool, progress func(n int64)) fuse.Status {
+	entry := JournalEntry{Op: batch.Op{Op: JournalPut, Path: name}, Base: base, BaseETag: rfs.baseETag(name, base)}
+
+	err := rfs.meta.Flush(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	if rfs.journal.Active() {
+		return fuse.ToStatus(rfs.journal.Append(entry))
+	}
+
+	f, err := rfs.cache.Open(name)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	put := rfs.client.PutProgress
+	if durable {
+		put = rfs.client.PutSync
+	}
+
+	res, err := put(name, f, progress)
+	f.Close()
+	if err != nil {
+		rfs.goOffline(err)
+		return fuse.ToStatus(rfs.journal.Append(entry))
+	}
+	res.Body.Close()
+
+	// the server refused the file, read only mounts answer with EROFS
+	if errno := remote.Errno(res); errno != 0 {
+		fmt.Println("upload refused: ", res.Status)
+		return fuse.ToStatus(errno)
+	}
+
+	// the cache holds the server's content, cacheOK needn't fetch it
+	rfs.stored(name, res.Header)
+	return fuse.OK
+}
+
+// truncate the cached file and journal its content
+func (rfs *R3stFs) truncateOffline(name string, size uint64) fuse.Status {
+	if !rfs.fetched(name) && size != 0 {
+		return errOffline
+	}
+
+	base := rfs.baseVersion(name)
+
+	rfs.changed(name, int64(size), 0)
+	err := os.Truncate(rfs.cache.Abs(name), int64(size))
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+
+	return rfs.upload(name, base)
+}
+
+// the entries of a cached directory, for when the server can't list it
+func (rfs *R3stFs) cachedDir(name string) ([]fuse.DirEntry, fuse.Status) {
+	f, err := rfs.cache.Open(name)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	defer f.Close()
+
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+
+	dir := make([]fuse.DirEntry, 0, len(infos))
+	for _, fi := range infos {
+		mode := uint32(fi.Mode().Perm())
+		if fi.IsDir() {
+			mode |= syscall.S_IFDIR
+		} else {
+			mode |= syscall.S_IFREG
+		}
+
+		dir = append(dir, fuse.DirEntry{Name: fi.Name(), Mode: mode})
+	}
+
+	return dir, fuse.OK
+}
+
+// try the server while the journal holds changes
+func (rfs *R3stFs) watch() {
+	for range time.Tick(journalRetry) {
+		if rfs.journal.Active() {
+			rfs.replay()
+		}
+	}
+}
+
+// send the journal's changes to the server in order, until they are
+// all sent or the server goes away again
+func (rfs *R3stFs) replay() {
+	res, err := rfs.client.Head("")
+	if err != nil {
+		return
+	}
+	res.Body.Close()
+
+	// server versions of the files sent by this replay, the base of
+	// the changes after theirs
+	known := make(map[string]remoteVersion)
+
+	n := 0
+	for {
+		e, ok := rfs.journal.next()
+		if !ok {
+			break
+		}
+
+		err := rfs.replayEntry(e, known)
+		if err != nil {
+			rfs.goOffline(err)
+			return
+		}
+
+		err = rfs.journal.done(e.Seq)
+		if err != nil {
+			fmt.Println("journal: ", err)
+			return
+		}
+		n++
+	}
+
+	if n > 0 {
+		// the server's files changed under what was learned of them
+		rfs.attrs.invalidate("")
+		go notify("Online", fmt.Sprintf("%d changes sent to the server", n))
+	}
+}
+
+// send a journaled change, the error is that of a failed request or
+// a failure of the server, the change is tried again with the next
+// replay. Conflicts and refused changes are reported and dropped
+func (rfs *R3stFs) replayEntry(e JournalEntry, known map[string]remoteVersion) error {
+	base, ok := known[e.Path]
+	if !ok {
+		base = remoteVersion{e.Base, e.BaseETag}
+	}
+
+	switch e.Op.Op {
+	case JournalPut:
+		return rfs.replayPut(e.Path, base, known)
+
+	case batch.Delete:
+		v, exists, err := rfs.remoteVersion(e.Path)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return nil
+		}
+		if base.mtime != 0 && v.changedSince(base) {
+			go notify("Conflict", fmt.Sprintf("/%s changed on the server, it was kept", e.Path))
+			return nil
+		}
+	}
+
+	res, err := rfs.batcher.Do(e.Op)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case remote.ResultErrno(res) == 0:
+	case e.Op.Op == batch.Mkdir && res.Status == http.StatusConflict:
+		// made on the server too
+	case e.Op.Op == batch.Delete && res.Status == http.StatusNotFound:
+		// deleted on the server too
+	default:
+		return replayFailed(e.String(), res.Status)
+	}
+
+	switch {
+	case e.Op.Op == batch.Rename:
+		if v, ok := known[e.Path]; ok {
+			known[e.To] = v
+			delete(known, e.Path)
+		}
+	case e.Op.Op == batch.SetAttr && e.Mtime != nil:
+		// the ETag changed with the mtime
+		known[e.Path] = remoteVersion{mtime: *e.Mtime}
+	}
+
+	return nil
+}
+
+// the cached name of a file after the journal's pending renames, the
+// content of a put is where the file went
+func (rfs *R3stFs) cachedName(name string) string {
+	for _, e := range rfs.journal.Pending() {
+		if e.Op.Op != batch.Rename {
+			continue
+		}
+
+		if name == e.Path || strings.HasPrefix(name, e.Path+"/") {
+			name = e.To + name[len(e.Path):]
+		}
+	}
+
+	return name
+}
+
+func (rfs *R3stFs) replayPut(name string, base remoteVersion, known map[string]remoteVersion) error {
+	f, err := rfs.cache.Open(rfs.cachedName(name))
+	if os.IsNotExist(err) {
+		// removed since, a later change says so
+		return nil
+	}
+	if err != nil {
+		go notify("Conflict", fmt.Sprintf("put /%s: %v", name, err))
+		return nil
+	}
+	defer f.Close()
+
+	v, exists, err := rfs.remoteVersion(name)
+	if err != nil {
+		return err
+	}
+
+	// changed on both sides, the server's copy stays
+	dst := name
+	if exists && v.changedSince(base) {
+		dst = ConflictName(name, rfs.conflictTaken)
+	}
+
+	res, err := rfs.client.Put(dst, f)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if errno := remote.Errno(res); errno != 0 {
+		return replayFailed("put /"+name, res.StatusCode)
+	}
+
+	if dst != name {
+		f.Close()
+		// the next open downloads the server's copy
+		if rfs.cache.Rename(rfs.cachedName(name), dst) == nil {
+			rfs.meta.Rename(rfs.cachedName(name), dst)
+			rfs.lru.rename(rfs.cachedName(name), dst)
+			rfs.stored(dst, res.Header)
+		}
+		go notify("Conflict", fmt.Sprintf("/%s changed on the server too, your copy is /%s", name, dst))
+		return nil
+	}
+
+	v, _, err = rfs.remoteVersion(name)
+	if err != nil {
+		return err
+	}
+
+	known[name] = v
+	rfs.stored(rfs.cachedName(name), res.Header)
+	return nil
+}
+
+// conflictTaken is true if a conflict copy can't be kept as name, the
+// server or the cache has a file of that name. A server which doesn't
+// answer takes none, the put fails too
+func (rfs *R3stFs) conflictTaken(name string) bool {
+	if _, err := rfs.cache.Stat(rfs.cachedName(name)); err == nil {
+		return true
+	}
+
+	_, exists, err := rfs.remoteVersion(name)
+	return err == nil && exists
+}
+
+// the error of a change the server answered with status, nil if the
+// change is dropped. A server failing or too busy may take it later
+func replayFailed(change string, status int) error {
+	if replayRetried(status) {
+		return fmt.Errorf("%s: %s", change, http.StatusText(status))
+	}
+
+	go notify("Conflict", fmt.Sprintf("%s: %s", change, http.StatusText(status)))
+	return nil
+}
+
+func replayRetried(status int) bool {
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// remoteVersion is a version of a file on the server
+type remoteVersion struct {
+	mtime int64
+	etag  string
+}
+
+// changedSince is true if v isn't the version base. Without an ETag
+// on either side it is true if v is newer, which misses changes made
+// in the second of base
+func (v remoteVersion) changedSince(base remoteVersion) bool {
+	if v.etag != "" && base.etag != "" {
+		return v.etag != base.etag
+	}
+
+	return v.mtime > base.mtime
+}
+
+// the server's version of name, if it exists
+func (rfs *R3stFs) remoteVersion(name string) (remoteVersion, bool, error) {
+	res, err := rfs.client.Head(name)
+	if err != nil {
+		return remoteVersion{}, false, err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return remoteVersion{}, false, nil
+	}
+
+	mtime, _ := strconv.ParseInt(res.Header.Get("Mtime"), 10, 64)
+	return remoteVersion{mtime, res.Header.Get("ETag")}, true, nil
+}
+
+// ConflictName is the name the copy of name which lost a conflict is
+// kept under, name.conflict-<time>.ext. If taken isn't nil and says
+// it is in use name.conflict-<time>-2.ext and on are tried
+func ConflictName(name string, taken func(string) bool) string {
+	ext := path.Ext(name)
+	if ext == path.Base(name) {
+		// a dot file is all extension
+		ext = ""
+	}
+
+	base := strings.TrimSuffix(name, ext)
+	stamp := time.Now().Format("20060102-150405")
+
+	ret := base + ".conflict-" + stamp + ext
+	for i := 2; taken != nil && taken(ret); i++ {
+		ret = fmt.Sprintf("%s.conflict-%s-%d%s", base, stamp, i, ext)
+	}
+
+	return ret
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package remote
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+)
+
+// most ops sent in one batch, a full queue is sent right away
+const maxBatchOps = 64
+
+// Batcher coalesces metadata operations issued close together, like
+// the unlinks of an rm -r, into batch requests. Each caller waits for
+// the result of its own op
+type Batcher struct {
+	client *Client
+	delay  time.Duration
+
+	lock    sync.Mutex
+	pending []*pendingOp
+}
+
+type pendingOp struct {
+	op   batch.Op
+	done chan error
+	res  batch.Result
+}
+
+// NewBatcher sends the ops queued within delay of the first one as a
+// single batch
+func NewBatcher(c *Client, delay time.Duration) *Batcher {
+	return &Batcher{
+		client: c,
+		delay:  delay,
+	}
+}
+
+// Do queues op and waits for its result, the error is set if the
+// batch couldn't be sent
+func (b *Batcher) Do(op batch.Op) (batch.Result, error) {
+	p := &pendingOp{
+		op:   op,
+		done: make(chan error, 1),
+	}
+
+	b.lock.Lock()
+	b.pending = append(b.pending, p)
+	switch len(b.pending) {
+	case 1:
+		time.AfterFunc(b.delay, b.flush)
+	case maxBatchOps:
+		go b.flush()
+	}
+	b.lock.Unlock()
+
+	err := <-p.done
+	return p.res, err
+}
+
+// send the queued ops
+func (b *Batcher) flush() {
+	b.lock.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.lock.Unlock()
+
+	// the timer of a queue which was sent when it filled up
+	if len(pending) == 0 {
+		return
+	}
+
+	ops := make([]batch.Op, len(pending))
+	for i, p := range pending {
+		ops[i] = p.op
+	}
+
+	res, err := b.client.Batch(ops, false)
+
+	for i, p := range pending {
+		if err == nil {
+			p.res = res.Results[i]
+		}
+		p.done <- err
+	}
+}
+
+// ResultErrno maps the status of a batch result to the errno a file
+// system call should fail with, like Errno
+func ResultErrno(res batch.Result) syscall.Errno {
+	return statusErrno(res.Status)
+}
@@ -5,27 +5,51 @@
 package remote
 
 import (
+	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strconv"
+	"sync"
 	"syscall"
 	"time"
-	"r3stfs/client/log"
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/client/log"
+	"github.com/ear7h/r3stfs/codec"
+	"github.com/ear7h/r3stfs/digest"
+	"github.com/ear7h/r3stfs/lease"
+	"github.com/ear7h/r3stfs/sparse"
 )
 
 type Client struct {
 	host, user, token string
-	b64Username       string
+	// basic auth credentials, servers with users check them
+	b64Auth           string
 	http              http.Client
+
+	// codings the server accepts for request bodies, as
+	// advertised in the Accept-Encoding header of its responses
+	lock          sync.Mutex
+	uploadCodings string
+
+	// sent with every request so the server knows the client's leases,
+	// "" for none
+	leaseClient string
 }
 
 //get expecting a file
 func (c *Client) Get(urlPath string) (*http.Response, error) {
+	return c.GetLease(urlPath, "")
+}
 
+// GetLease gets a file and asks for a lease of kind on it, see the
+// lease package. The response's Lease header has the one granted
+func (c *Client) GetLease(urlPath, kind string) (*http.Response, error) {
 	u := fmt.Sprint("http://", c.host, "/", urlPath)
 
 	req, err := newRequest(http.MethodGet, u, nil)
@@ -33,10 +57,39 @@ func (c *Client) Get(urlPath string) (*http.Response, error) {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "basic "+c.b64Username)
+	// files with holes may come as sparse bodies, see Content-Type
+	req.Header.Set("Accept", sparse.ContentType+", */*")
+	if kind != "" {
+		req.Header.Set(lease.Header, kind)
+	}
 
-	return c.http.Do(req)
+	return c.do(req)
+}
 
+// List gets the entries of a directory and their modes
+func (c *Client) List(urlPath string) (map[string]os.FileMode, *http.Response, error) {
+	res, err := c.Get(urlPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if Errno(res) != 0 {
+		return nil, res, nil
+	}
+
+	if res.Header.Get("Is-Dir") != "true" {
+		return nil, res, &os.PathError{Op: "list", Path: urlPath, Err: syscall.ENOTDIR}
+	}
+
+	// the listing is a json object of names and modes
+	entries := make(map[string]os.FileMode)
+	err = json.NewDecoder(res.Body).Decode(&entries)
+	if err != nil {
+		return nil, res, err
+	}
+
+	return entries, res, nil
 }
 
 func (c *Client) Post(urlPath string, body io.Reader) (*http.Response, error) {
@@ -47,12 +100,26 @@ func (c *Client) Post(urlPath string, body io.Reader) (*http.Response, error) {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "basic "+c.b64Username)
-
-	return c.http.Do(req)
+	return c.do(req)
 }
 
 func (c *Client) Put(urlPath string, file *os.File) (res *http.Response, err error) {
+	return c.PutProgress(urlPath, file, nil)
+}
+
+// PutProgress is Put, calling progress with the bytes of the body
+// sent so far when it isn't nil
+func (c *Client) PutProgress(urlPath string, file *os.File, progress func(n int64)) (res *http.Response, err error) {
+	return c.put(urlPath, file, progress, false)
+}
+
+// PutSync is PutProgress, the server answers once the file and its
+// directory entry are on its disk
+func (c *Client) PutSync(urlPath string, file *os.File, progress func(n int64)) (res *http.Response, err error) {
+	return c.put(urlPath, file, progress, true)
+}
+
+func (c *Client) put(urlPath string, file *os.File, progress func(n int64), durable bool) (res *http.Response, err error) {
 	log.Func(urlPath, file.Name())
 	defer func() {
 		log.Return(res, err)
@@ -67,26 +134,239 @@ func (c *Client) Put(urlPath string, file *os.File) (res *http.Response, err err
 	}
 
 	mode := fi.Mode()
-	stat := fi.Sys().(*syscall.Stat_t)
-	atime := stat.Mtimespec.Sec
-	mtime := stat.Mtimespec.Sec
+	atime := fi.ModTime().Unix()
+	mtime := fi.ModTime().Unix()
+
+	// the server checks the upload against this digest
+	sum, err := digest.Sum(io.NewSectionReader(file, 0, fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = file
+	contentType := ""
+
+	// leave the holes of sparse files out
+	if isSparse, _ := sparse.IsSparse(file); isSparse {
+		body, err = sparse.NewReader(file, nil)
+		if err != nil {
+			return nil, err
+		}
+		contentType = sparse.ContentType
+	}
 
-	req, err := newRequest(http.MethodPut, u, file)
+	if progress != nil {
+		body = &progressReader{r: body, progress: progress}
+	}
+
+	// compress the upload if the server takes it and it's worth it
+	coding := c.uploadCoding()
+	if coding != "" {
+		head := make([]byte, 512)
+		n, _ := file.ReadAt(head, 0)
+
+		if codec.Compressible(file.Name(), fi.Size(), head[:n]) {
+			body = compressReader(body, coding)
+		} else {
+			coding = ""
+		}
+	}
+
+	req, err := newRequest(http.MethodPut, u, body)
 	if err != nil {
 		return nil, err
 	}
 
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	if coding != "" {
+		req.Header.Set("Content-Encoding", coding)
+	}
+
 	req.Header.Set("File-Mode", strconv.FormatInt(int64(mode), 8))
 	req.Header.Set("Atime", strconv.FormatInt(atime, 10))
 	req.Header.Set("Mtime", strconv.FormatInt(mtime, 10))
+	req.Header.Set(digest.Header, digest.Format(sum))
+	if durable {
+		req.Header.Set("Sync", "T")
+	}
 
-	req.Header.Set("Authorization", "basic "+c.b64Username)
+	res, err = c.do(req)
+	if err != nil {
+		return
+	}
+
+	// and the client checks what the server says it stored
+	stored := digest.Parse(res.Header.Get(digest.Header))
+	if Errno(res) == 0 && stored != nil && !bytes.Equal(stored, sum) {
+		res.Body.Close()
+		res, err = nil, &os.PathError{Op: "put", Path: urlPath, Err: syscall.EIO}
+	}
 
-	res, err = c.http.Do(req)
 	return
 }
 
+type progressReader struct {
+	r        io.Reader
+	n        int64
+	progress func(n int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.n += int64(n)
+	pr.progress(pr.n)
+
+	return n, err
+}
+
+// Verify checks a downloaded body against the size and digest sent
+// by the server, n and sum are the length and digest of the body as
+// it was received. It must be called after the body is read to the
+// end, before that the digest trailer isn't available
+func Verify(res *http.Response, n int64, sum []byte) error {
+	fail := &os.PathError{Op: "get", Path: res.Request.URL.Path, Err: syscall.EIO}
+
+	if size := res.Header.Get("File-Size"); size != "" && size != strconv.FormatInt(n, 10) {
+		return fail
+	}
+
+	want := digest.Parse(res.Trailer.Get(digest.Header))
+	if want == nil {
+		want = digest.Parse(res.Header.Get(digest.Header))
+	}
+
+	// a trailer that was announced but never came means the
+	// server failed half way through the body
+	if _, announced := res.Trailer[digest.Header]; announced && want == nil {
+		return fail
+	}
+
+	if want != nil && !bytes.Equal(want, sum) {
+		return fail
+	}
+
+	return nil
+}
+
+// Batch runs ops on the server in one request, the response has
+// a result for each op
+func (c *Client) Batch(ops []batch.Op, atomic bool) (*batch.Response, error) {
+	byt, err := json.Marshal(batch.Request{Atomic: atomic, Ops: ops})
+	if err != nil {
+		return nil, err
+	}
+
+	u := fmt.Sprint("http://", c.host, "/?batch")
+
+	req, err := newRequest(http.MethodPost, u, bytes.NewReader(byt))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("batch: %s", res.Status)
+	}
+
+	ret := &batch.Response{}
+	err = json.NewDecoder(res.Body).Decode(ret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ret.Results) != len(ops) {
+		return nil, fmt.Errorf("batch: %d results for %d ops", len(ret.Results), len(ops))
+	}
+
+	return ret, nil
+}
+
+// Copy a file or directory on the server without downloading it.
+// The pathfs api the mount is built on never sees copy_file_range,
+// go-fuse's bridge answers it with ENOSYS and the kernel falls back
+// to reads and writes, r3stfs cp uses it instead
+func (c *Client) Copy(src, dst string, overwrite bool) (*http.Response, error) {
+	u := fmt.Sprint("http://", c.host, path.Join("/", src))
+
+	req, err := newRequest("COPY", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Destination", path.Join("/", dst))
+	if !overwrite {
+		req.Header.Set("Overwrite", "F")
+	}
+
+	return c.do(req)
+}
+
+// Truncate sets the length of a remote file without sending it
+func (c *Client) Truncate(urlPath string, size int64) (*http.Response, error) {
+	q := url.Values{}
+	q.Set("op", "truncate")
+	q.Set("size", strconv.FormatInt(size, 10))
+
+	u := fmt.Sprint("http://", c.host, path.Join("/", urlPath), "?", q.Encode())
+
+	req, err := newRequest(http.MethodPatch, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// Sync answers once the server's copy of a remote file and its
+// directory entry are on its disk
+func (c *Client) Sync(urlPath string) (*http.Response, error) {
+	q := url.Values{}
+	q.Set("op", "sync")
+
+	u := fmt.Sprint("http://", c.host, path.Join("/", urlPath), "?", q.Encode())
+
+	req, err := newRequest(http.MethodPatch, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// Allocate preallocates, zeros or punches a hole in a range of a
+// remote file without sending any data
+func (c *Client) Allocate(urlPath string, off, length int64, mode sparse.AllocMode) (*http.Response, error) {
+	q := url.Values{}
+	q.Set("op", "allocate")
+	q.Set("offset", strconv.FormatInt(off, 10))
+	q.Set("length", strconv.FormatInt(length, 10))
+	q.Set("mode", mode.String())
+
+	u := fmt.Sprint("http://", c.host, path.Join("/", urlPath), "?", q.Encode())
+
+	req, err := newRequest(http.MethodPatch, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
 func (c *Client) Head(urlPath string) (*http.Response, error) {
+	return c.HeadLease(urlPath, "")
+}
+
+// HeadLease is Head asking for a lease like GetLease
+func (c *Client) HeadLease(urlPath, kind string) (*http.Response, error) {
 	u := fmt.Sprint("http://", c.host, "/", urlPath)
 
 	req, err := newRequest(http.MethodHead, u, nil)
@@ -94,9 +374,46 @@ func (c *Client) Head(urlPath string) (*http.Response, error) {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "basic "+c.b64Username)
+	if kind != "" {
+		req.Header.Set(lease.Header, kind)
+	}
+
+	return c.do(req)
+}
+
+// SetLeaseClient sets the id the client's leases are held by, it is
+// sent with every request. Call it before the first one
+func (c *Client) SetLeaseClient(id string) {
+	c.leaseClient = id
+}
+
+// Leases opens the stream the server recalls the client's leases on,
+// it has no time limit
+func (c *Client) Leases() (*http.Response, error) {
+	u := fmt.Sprint("http://", c.host, "/?leases")
+
+	req, err := newRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(lease.ClientHeader, c.leaseClient)
+	req.Header.Set("Authorization", "Basic "+c.b64Auth)
+
+	stream := c.http
+	stream.Timeout = 0
+	return stream.Do(req)
+}
+
+// ReleaseLease gives the lease id on a file back
+func (c *Client) ReleaseLease(urlPath string, id int64) (*http.Response, error) {
+	u := fmt.Sprint("http://", c.host, path.Join("/", urlPath), "?lease=", id)
 
-	return c.http.Do(req)
+	req, err := newRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
 }
 
 func (c *Client) Delete(urlPath string) (*http.Response, error) {
@@ -107,9 +424,156 @@ func (c *Client) Delete(urlPath string) (*http.Response, error) {
 		return nil, err
 	}
 
-	req.Header.Set("Authorization", "basic "+c.b64Username)
+	return c.do(req)
+}
 
-	return c.http.Do(req)
+// xattr requests address the attribute as a query on the file
+func (c *Client) xattrURL(urlPath, attr string) string {
+	return fmt.Sprint("http://", c.host, path.Join("/", urlPath), "?xattr=", url.QueryEscape(attr))
+}
+
+func (c *Client) GetXAttr(urlPath, attr string) (*http.Response, error) {
+	req, err := newRequest(http.MethodGet, c.xattrURL(urlPath, attr), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// the response body is a json array of attribute names
+func (c *Client) ListXAttr(urlPath string) (*http.Response, error) {
+	req, err := newRequest(http.MethodGet, c.xattrURL(urlPath, ""), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// flags is "", "create" or "replace"
+func (c *Client) SetXAttr(urlPath, attr string, value []byte, flags string) (*http.Response, error) {
+	req, err := newRequest(http.MethodPut, c.xattrURL(urlPath, attr), bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+
+	if flags != "" {
+		req.Header.Set("Xattr-Flags", flags)
+	}
+
+	return c.do(req)
+}
+
+func (c *Client) RemoveXAttr(urlPath, attr string) (*http.Response, error) {
+	req, err := newRequest(http.MethodDelete, c.xattrURL(urlPath, attr), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+// IsNoAttr reports whether the server answered that the requested
+// extended attribute doesn't exist, as opposed to the file
+func IsNoAttr(res *http.Response) bool {
+	return res.StatusCode == http.StatusNotFound && res.Header.Get("Xattr-Missing") != ""
+}
+
+// do sends req with the headers every request carries and undoes
+// any content coding on the response body
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Basic "+c.b64Auth)
+	req.Header.Set("Accept-Encoding", codec.Accepted)
+	if c.leaseClient != "" {
+		req.Header.Set(lease.ClientHeader, c.leaseClient)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if codings := res.Header.Get("Accept-Encoding"); codings != "" {
+		c.lock.Lock()
+		c.uploadCodings = codings
+		c.lock.Unlock()
+	}
+
+	coding := res.Header.Get("Content-Encoding")
+	if coding == "" || coding == "identity" {
+		return res, nil
+	}
+
+	body, err := codec.NewReader(res.Body, coding)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	res.Body = body
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+
+	return res, nil
+}
+
+// the coding to use for request bodies, "" if the server didn't
+// advertise any
+func (c *Client) uploadCoding() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return codec.Negotiate(c.uploadCodings)
+}
+
+// compress r in the background, the returned reader yields the
+// compressed stream
+func compressReader(r io.Reader, coding string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		cw, err := codec.NewWriter(pw, coding)
+		if err == nil {
+			_, err = io.Copy(cw, r)
+			if e := cw.Close(); err == nil {
+				err = e
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// Errno maps the status of a server response to the errno a file
+// system call should fail with, 0 means the request succeeded
+func Errno(res *http.Response) syscall.Errno {
+	return statusErrno(res.StatusCode)
+}
+
+func statusErrno(status int) syscall.Errno {
+	switch status {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return 0
+	case http.StatusNotFound:
+		return syscall.ENOENT
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return syscall.EACCES
+	case http.StatusConflict:
+		return syscall.EEXIST
+	case http.StatusMethodNotAllowed:
+		// the server answers writes to read only mounts with 405
+		return syscall.EROFS
+	case http.StatusBadRequest:
+		return syscall.EINVAL
+	case http.StatusNotImplemented:
+		return syscall.ENOSYS
+	default:
+		return syscall.EIO
+	}
 }
 
 func newRequest(method, url string, body io.Reader) (req *http.Request, err error) {
@@ -122,6 +586,21 @@ func newRequest(method, url string, body io.Reader) (req *http.Request, err erro
 	return
 }
 
+// the default transport without its transparent gzip, content
+// codings are negotiated by Client.do
+func transport() http.RoundTripper {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DisableCompression = true
+
+	return t
+}
+
+// SetTimeout sets the time limit of requests, including reading
+// the response body. Zero means no limit, for large transfers
+func (c *Client) SetTimeout(d time.Duration) {
+	c.http.Timeout = d
+}
+
 //actual login, returns token
 func login(host, user, pass string) string {
 	return ""
@@ -132,9 +611,10 @@ func Login(host, user, pass string) *Client {
 		host:        host,
 		user:        user,
 		token:       login(host, user, pass),
-		b64Username: base64.StdEncoding.EncodeToString([]byte(user)),
+		b64Auth:     base64.StdEncoding.EncodeToString([]byte(user + ":" + pass)),
 		http: http.Client{
-			Timeout: 10 * time.Second,
+			Timeout:   10 * time.Second,
+			Transport: transport(),
 		},
 	}
 }
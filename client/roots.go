@@ -0,0 +1,297 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+/*
+each user of each host has a cache root under the cache directory,
+only one mount uses a root at a time
+
+	~/.cache/r3stfs/julio@files.example.com%3A8080/
+		files/    the cached files
+		journal   changes made offline, see journal.go
+		meta      the metadata db, see meta.go
+		stats     the counters of the lru, see lru.go
+		lock      locked by the mount using the root, it has its pid
+
+the user and host are escaped so neither can leave the cache directory
+or be confused with the other
+*/
+
+// the parts of a cache root
+const (
+	rootFiles   = "files"
+	rootJournal = "journal"
+	rootMeta    = "meta"
+	rootStats   = "stats"
+	rootLock    = "lock"
+)
+
+// escape the bytes of s that aren't letters, digits, dashes,
+// underscores or dots not leading it, like %3A
+func escapeName(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+func unescapeName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("bad escape in %q", s)
+		}
+
+		b.WriteByte(byte(c))
+		i += 2
+	}
+
+	return b.String(), nil
+}
+
+// CacheRoot is the directory of the cache of user's files on host
+func CacheRoot(cacheDir, host, user string) string {
+	return filepath.Join(cacheDir, escapeName(user)+"@"+escapeName(host))
+}
+
+// JournalPath is the journal of a cache root
+func JournalPath(root string) string {
+	return filepath.Join(root, rootJournal)
+}
+
+// MetaPath is the metadata db of a cache root
+func MetaPath(root string) string {
+	return filepath.Join(root, rootMeta)
+}
+
+// CacheStatsPath is the file the mount using root keeps its CacheStats in
+func CacheStatsPath(root string) string {
+	return filepath.Join(root, rootStats)
+}
+
+// RootInUseError is the error of locking a root another mount uses
+type RootInUseError struct {
+	Root string
+	Pid  int
+}
+
+func (e *RootInUseError) Error() string {
+	if e.Pid == 0 {
+		return fmt.Sprintf("cache %s is in use by another mount", e.Root)
+	}
+
+	return fmt.Sprintf("cache %s is in use by the mount of pid %d", e.Root, e.Pid)
+}
+
+// LockCacheRoot makes root if needed and locks it for the caller, the
+// lock goes with the process or when the file is closed
+func LockCacheRoot(root string) (*os.File, error) {
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(root, rootLock), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		byt, _ := ioutil.ReadAll(f)
+		pid, _ := strconv.Atoi(string(bytes.TrimSpace(byt)))
+		f.Close()
+		return nil, &RootInUseError{root, pid}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// the pid for the error of the next mount, and the time the
+	// root was last used for r3stfs cache list
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// before cache roots a host's files were in cacheDir/host and its
+// journal and metadata db beside them, the first user to mount the
+// host gets them
+func migrateCache(cacheDir, host, root string) error {
+	old := filepath.Join(cacheDir, host)
+	if fi, err := os.Stat(old); err != nil || !fi.IsDir() {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(root, rootFiles)); !os.IsNotExist(err) {
+		return nil
+	}
+
+	moves := [][2]string{
+		{old, filepath.Join(root, rootFiles)},
+		{old + ".journal", JournalPath(root)},
+		{old + ".meta", MetaPath(root)},
+	}
+	for _, m := range moves {
+		err := os.Rename(m[0], m[1])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	os.Remove(old + ".stats")
+	return nil
+}
+
+// CacheRootInfo describes a cache root for r3stfs cache
+type CacheRootInfo struct {
+	Dir        string
+	User, Host string
+	// disk space and number of the cached files
+	Bytes, Files int64
+	// when a mount last locked it
+	Used time.Time
+	// locked by a mount
+	InUse bool
+	// changes made offline and not sent, and files with changes
+	Pending, Dirty int
+}
+
+// CacheRoots lists the cache roots under cacheDir
+func CacheRoots(cacheDir string) ([]CacheRootInfo, error) {
+	infos, err := ioutil.ReadDir(cacheDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var roots []CacheRootInfo
+	for _, fi := range infos {
+		i := strings.LastIndexByte(fi.Name(), '@')
+		if !fi.IsDir() || i < 0 {
+			continue
+		}
+
+		user, err := unescapeName(fi.Name()[:i])
+		if err != nil {
+			continue
+		}
+		host, err := unescapeName(fi.Name()[i+1:])
+		if err != nil {
+			continue
+		}
+
+		info, err := ReadCacheRoot(filepath.Join(cacheDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		info.User, info.Host = user, host
+
+		roots = append(roots, info)
+	}
+
+	return roots, nil
+}
+
+// ReadCacheRoot describes the cache root dir
+func ReadCacheRoot(dir string) (CacheRootInfo, error) {
+	info := CacheRootInfo{Dir: dir}
+
+	lock, err := os.Open(filepath.Join(dir, rootLock))
+	if err == nil {
+		fi, err := lock.Stat()
+		if err == nil {
+			info.Used = fi.ModTime()
+		}
+
+		// a lock we can't take is a mount's
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_SH|syscall.LOCK_NB)
+		info.InUse = err == syscall.EWOULDBLOCK
+		lock.Close()
+	}
+
+	files := filepath.Join(dir, rootFiles)
+	filepath.Walk(files, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == files {
+			return nil
+		}
+
+		info.Files++
+		info.Bytes += usage(fi)
+		return nil
+	})
+
+	pending, err := ReadJournal(JournalPath(dir))
+	if err != nil {
+		return info, err
+	}
+	info.Pending = len(pending)
+
+	f, err := os.Open(MetaPath(dir))
+	if err == nil {
+		db := &MetaDB{records: make(map[string]*CacheMeta)}
+		_, err = db.read(f)
+		f.Close()
+		if err != nil {
+			return info, err
+		}
+
+		info.Dirty = len(db.Dirty())
+	}
+
+	return info, nil
+}
+
+// RemoveCacheRoot removes the cache root dir unless a mount uses it
+func RemoveCacheRoot(dir string) error {
+	lock, err := LockCacheRoot(dir)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	return os.RemoveAll(dir)
+}
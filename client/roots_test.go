@@ -0,0 +1,77 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheRoots(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, s := range []string{"julio", "files.example.com:8080", "../etc", ".hidden", "a@b", "a/b%"} {
+		e := escapeName(s)
+		if filepath.Base(e) != e || e[0] == '.' {
+			t.Errorf("%q escaped to %q", s, e)
+		}
+
+		u, err := unescapeName(e)
+		if err != nil || u != s {
+			t.Errorf("%q unescaped to %q, %v", e, u, err)
+		}
+	}
+
+	// the old layout of the host's cache
+	host := "files.example.com:8080"
+	os.MkdirAll(filepath.Join(dir, host, "docs"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, host, "docs", "a.txt"), []byte("hello"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, host+".journal"), nil, 0600)
+
+	root := CacheRoot(dir, host, "julio")
+	lock, err := LockCacheRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = migrateCache(dir, host, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(root, rootFiles, "docs", "a.txt")); err != nil {
+		t.Errorf("files weren't moved: %v", err)
+	}
+	if _, err := os.Stat(JournalPath(root)); err != nil {
+		t.Errorf("journal wasn't moved: %v", err)
+	}
+
+	// a second mount of the root
+	_, err = LockCacheRoot(root)
+	if e, ok := err.(*RootInUseError); !ok || e.Pid != os.Getpid() {
+		t.Errorf("second lock: %v", err)
+	}
+
+	roots, err := CacheRoots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].User != "julio" || roots[0].Host != host ||
+		!roots[0].InUse || roots[0].Files != 2 {
+		t.Fatalf("roots: %+v", roots)
+	}
+
+	if RemoveCacheRoot(root) == nil {
+		t.Errorf("removed a root in use")
+	}
+
+	lock.Close()
+	err = RemoveCacheRoot(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if roots, _ := CacheRoots(dir); len(roots) != 0 {
+		t.Errorf("roots after removing: %+v", roots)
+	}
+}
@@ -0,0 +1,379 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+
+	"github.com/ear7h/r3stfs/client/remote"
+)
+
+/*
+the release of a file doesn't wait for its upload, the file is queued
+and a pool of workers sends it once uploadDelay passed without another
+release of it, so a file closed over and over is sent once. Closes
+leave the file to its release as long as the mount holds a write lease
+on it, or gets one. Those which have to reach the server, flushes of a
+file the server won't lease and recalls, send the file at once and
+wait for it
+
+a file is sent by one worker at a time, in the order the files came
+due. Changes of a path wait for its uploads and those of the files
+under it, a rename moves what the server has and a truncate isn't
+undone by an older upload. Uploads the server failed are tried again
+uploadRetries times, each after twice the delay of the one before.
+Those it refuses, or which fail every time, are reported and the file
+stays dirty until it is closed again
+
+fsync sends the file at once and asks the server to have it on its
+disk before it answers, or if there is nothing to send to put what it
+has there. Offline the journal and the cache file are on the local
+disk, and that is all there is
+
+files are dirty in the metadata db until the server has them, a mount
+queues those a previous one left behind
+*/
+
+const (
+	uploadWorkers = 4
+	// how long a released file waits for another release
+	uploadDelay = 500 * time.Millisecond
+	// releases stop pushing a file back after this long
+	uploadMaxDelay = 5 * time.Second
+	uploadRetries  = 5
+	// the delay before the first retry
+	uploadBackoff = time.Second
+)
+
+// UploadStats are the counters of a mount's uploads
+type UploadStats struct {
+	// queued files, those being sent among them
+	Pending int `json:"pending"`
+	Active  int `json:"active"`
+	// files sent and the bytes of all uploads, failed ones too
+	Uploaded int64 `json:"uploaded"`
+	Bytes    int64 `json:"bytes"`
+	Retries  int64 `json:"retries"`
+	Failed   int64 `json:"failed"`
+	// of the last failed upload
+	LastError string `json:"last_error,omitempty"`
+}
+
+type pendingUpload struct {
+	name string
+	base int64
+	// when it was queued, releases push it back until uploadMaxDelay
+	queued time.Time
+	// fires when it is due, nil once it is
+	timer  *time.Timer
+	ready  bool
+	active bool
+	// released again while it was sent, it is sent again
+	again bool
+	// somebody waits for it, it is sent again without a delay
+	hurry bool
+	// an fsync waits for it, the next upload is durable
+	durable bool
+	tries   int
+	// of the last upload, read once done is closed
+	status fuse.Status
+	done   chan struct{}
+}
+
+type uploader struct {
+	mu sync.Mutex
+	// sends a file, on the server's disk if durable, calling progress
+	// with the bytes sent so far
+	put func(name string, base int64, durable bool, progress func(n int64)) fuse.Status
+	// the server mtime of a file the server has
+	version func(name string) int64
+	// signalled when a file is due
+	cond    *sync.Cond
+	pending map[string]*pendingUpload
+	// due files, the first due first
+	ready []*pendingUpload
+	stats UploadStats
+}
+
+func newUploader(put func(string, int64, bool, func(int64)) fuse.Status, version func(string) int64) *uploader {
+	u := &uploader{
+		put:     put,
+		version: version,
+		pending: make(map[string]*pendingUpload),
+	}
+	u.cond = sync.NewCond(&u.mu)
+
+	for i := 0; i < uploadWorkers; i++ {
+		go u.worker()
+	}
+
+	return u
+}
+
+// queue the upload of name after delay, base is its server mtime the
+// changes were made to. A queued upload of name is pushed back
+func (u *uploader) queue(name string, base int64, delay time.Duration) *pendingUpload {
+	return u.add(name, base, delay, false)
+}
+
+func (u *uploader) add(name string, base int64, delay time.Duration, durable bool) *pendingUpload {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	p := u.pending[name]
+	if p == nil {
+		p = &pendingUpload{
+			name:    name,
+			base:    base,
+			queued:  time.Now(),
+			durable: durable,
+			done:    make(chan struct{}),
+		}
+		u.pending[name] = p
+		u.schedule(p, delay)
+		return p
+	}
+
+	p.durable = p.durable || durable
+	switch {
+	case p.active:
+		p.again = true
+		p.hurry = p.hurry || delay == 0
+	case p.ready:
+	default:
+		if left := uploadMaxDelay - time.Since(p.queued); delay > left {
+			delay = left
+		}
+		u.schedule(p, delay)
+	}
+
+	return p
+}
+
+// make p due after delay, u.mu is held
+func (u *uploader) schedule(p *pendingUpload, delay time.Duration) {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	if delay <= 0 {
+		p.ready = true
+		u.ready = append(u.ready, p)
+		u.cond.Signal()
+		return
+	}
+
+	var t *time.Timer
+	t = time.AfterFunc(delay, func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		// pushed back or made due since
+		if p.timer == t {
+			u.schedule(p, 0)
+		}
+	})
+	p.timer = t
+}
+
+// send name at once and wait until the server has it
+func (u *uploader) send(name string, base int64) fuse.Status {
+	p := u.add(name, base, 0, false)
+	<-p.done
+	return p.status
+}
+
+// send name like send, and wait until it is on the server's disk
+func (u *uploader) sendSync(name string, base int64) fuse.Status {
+	p := u.add(name, base, 0, true)
+	<-p.done
+	return p.status
+}
+
+// name is queued or being sent
+func (u *uploader) queued(name string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.pending[name] != nil
+}
+
+// send the queued uploads of name and the files under it at once, and
+// wait until the server has them. "" waits for all. The status is that
+// of a failed one
+func (u *uploader) wait(name string) fuse.Status {
+	prefix := name + "/"
+
+	u.mu.Lock()
+	var ps []*pendingUpload
+	for n, p := range u.pending {
+		if name != "" && n != name && !strings.HasPrefix(n, prefix) {
+			continue
+		}
+
+		ps = append(ps, p)
+		switch {
+		case p.active:
+			p.hurry = p.hurry || p.again
+		case !p.ready:
+			u.schedule(p, 0)
+		}
+	}
+	u.mu.Unlock()
+
+	status := fuse.OK
+	for _, p := range ps {
+		<-p.done
+		if p.status != fuse.OK {
+			status = p.status
+		}
+	}
+
+	return status
+}
+
+func (u *uploader) worker() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for {
+		for len(u.ready) == 0 {
+			u.cond.Wait()
+		}
+
+		p := u.ready[0]
+		u.ready = u.ready[1:]
+		p.ready = false
+		p.active = true
+		durable := p.durable
+		p.durable = false
+		u.stats.Active++
+		u.mu.Unlock()
+
+		var sent int64
+		status := u.put(p.name, p.base, durable, func(n int64) {
+			u.mu.Lock()
+			u.stats.Bytes += n - sent
+			sent = n
+			u.mu.Unlock()
+		})
+
+		u.mu.Lock()
+		u.finish(p, status, durable)
+	}
+}
+
+// p was sent with status, u.mu is held
+func (u *uploader) finish(p *pendingUpload, status fuse.Status, durable bool) {
+	p.active = false
+	p.status = status
+	u.stats.Active--
+
+	// the fsync waits for the next one
+	if status != fuse.OK {
+		p.durable = p.durable || durable
+	}
+
+	switch {
+	case status == fuse.OK:
+		u.stats.Uploaded++
+		p.tries = 0
+		p.base = u.version(p.name)
+
+	case status == fuse.EIO && p.tries < uploadRetries:
+		// the server failed, not the file
+		p.tries++
+		u.stats.Retries++
+
+		// unless it is sent again anyway
+		if !p.again {
+			delay := uploadBackoff << uint(p.tries-1)
+			fmt.Printf("upload /%s: %v, again in %v\n", p.name, status, delay)
+			u.schedule(p, delay)
+			return
+		}
+
+	default:
+		u.stats.Failed++
+		u.stats.LastError = fmt.Sprintf("/%s: %v", p.name, status)
+		go notify("Upload failed", fmt.Sprintf("/%s wasn't sent: %v, it is kept in the cache", p.name, status))
+	}
+
+	if p.again {
+		delay := uploadDelay
+		if p.hurry {
+			delay = 0
+		}
+
+		p.again, p.hurry = false, false
+		p.queued = time.Now()
+		u.schedule(p, delay)
+		return
+	}
+
+	delete(u.pending, p.name)
+	close(p.done)
+}
+
+// Stats returns the counters of the uploads
+func (u *uploader) Stats() UploadStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	stats := u.stats
+	stats.Pending = len(u.pending)
+	return stats
+}
+
+// have the server put name on its disk, with the upload queued for it
+func (rfs *R3stFs) commit(name string) fuse.Status {
+	if rfs.uploads.queued(name) {
+		return rfs.uploads.sendSync(name, rfs.baseVersion(name))
+	}
+
+	// the journal has the changes the server hasn't
+	if rfs.journal.Active() {
+		return fuse.OK
+	}
+
+	res, err := rfs.client.Sync(name)
+	if err != nil {
+		rfs.goOffline(err)
+		return fuse.EIO
+	}
+	res.Body.Close()
+
+	// servers from before sync have nothing more to promise
+	if res.StatusCode == http.StatusBadRequest {
+		return fuse.OK
+	}
+
+	return fuse.ToStatus(remote.Errno(res))
+}
+
+// queue the dirty files a previous mount didn't send, those journaled
+// are sent by the replay
+func (rfs *R3stFs) queueDirty() {
+	journaled := make(map[string]bool)
+	for _, e := range rfs.journal.Pending() {
+		journaled[e.Path] = true
+	}
+
+	for _, name := range rfs.meta.Dirty() {
+		fi, err := rfs.cache.Stat(name)
+		if err != nil || !fi.Mode().IsRegular() || journaled[name] {
+			continue
+		}
+
+		rfs.uploads.queue(name, rfs.baseVersion(name), uploadDelay)
+	}
+}
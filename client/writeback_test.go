@@ -0,0 +1,215 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/fuse"
+)
+
+// uploads to nowhere, failing with the statuses given for a name
+type fakePuts struct {
+	mu      sync.Mutex
+	calls   map[string]int
+	fail    map[string][]fuse.Status
+	active  map[string]bool
+	durable map[string]bool
+	overlap bool
+	// held by tests to keep an upload active
+	block sync.Mutex
+}
+
+func (f *fakePuts) put(name string, base int64, durable bool, progress func(int64)) fuse.Status {
+	f.mu.Lock()
+	if f.active[name] {
+		f.overlap = true
+	}
+	f.active[name] = true
+	f.calls[name]++
+	f.durable[name] = durable
+	f.mu.Unlock()
+
+	f.block.Lock()
+	f.block.Unlock()
+	progress(10)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active[name] = false
+	if fails := f.fail[name]; len(fails) > 0 {
+		f.fail[name] = fails[1:]
+		return fails[0]
+	}
+	return fuse.OK
+}
+
+func (f *fakePuts) count(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[name]
+}
+
+func TestUploader(t *testing.T) {
+	f := &fakePuts{
+		calls:   make(map[string]int),
+		fail:    make(map[string][]fuse.Status),
+		active:  make(map[string]bool),
+		durable: make(map[string]bool),
+	}
+	u := newUploader(f.put, func(string) int64 { return 1 })
+
+	// releases in a row are sent once
+	for i := 0; i < 5; i++ {
+		u.queue("a", 0, uploadDelay)
+	}
+	if n := f.count("a"); n != 0 {
+		t.Fatalf("a sent %d times before its delay", n)
+	}
+	if status := u.wait("a"); status != fuse.OK {
+		t.Fatal(status)
+	}
+	if n := f.count("a"); n != 1 {
+		t.Errorf("a sent %d times, want 1", n)
+	}
+
+	// waiting for a directory sends the files under it at once
+	u.queue("d/b", 0, time.Hour)
+	u.queue("d/e/c", 0, time.Hour)
+	u.queue("dx", 0, time.Hour)
+	start := time.Now()
+	u.wait("d")
+	if f.count("d/b") != 1 || f.count("d/e/c") != 1 || time.Since(start) > uploadDelay {
+		t.Errorf("d sent d/b %d and d/e/c %d times in %v", f.count("d/b"), f.count("d/e/c"), time.Since(start))
+	}
+	if n := f.count("dx"); n != 0 {
+		t.Errorf("dx sent %d times with d", n)
+	}
+
+	// a release while the file is sent sends it again after, never
+	// at the same time
+	f.block.Lock()
+	u.queue("g", 0, 0)
+	for f.count("g") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	u.queue("g", 0, 0)
+	f.block.Unlock()
+	u.send("g", 0)
+	if n := f.count("g"); n != 2 || f.overlap {
+		t.Errorf("g sent %d times, overlapping %v", n, f.overlap)
+	}
+
+	// failures of the server are retried, refusals aren't
+	f.fail["h"] = []fuse.Status{fuse.EIO}
+	if status := u.send("h", 0); status != fuse.OK || f.count("h") != 2 {
+		t.Errorf("h: %v after %d tries", status, f.count("h"))
+	}
+
+	f.fail["r"] = []fuse.Status{fuse.EACCES}
+	if status := u.send("r", 0); status != fuse.EACCES || f.count("r") != 1 {
+		t.Errorf("r: %v after %d tries", status, f.count("r"))
+	}
+
+	// fsyncs make the next upload durable, the others aren't
+	f.block.Lock()
+	u.queue("s", 0, 0)
+	for f.count("s") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	p := u.add("s", 0, 0, true)
+	f.block.Unlock()
+	<-p.done
+	if n := f.count("s"); n != 2 || !f.durable["s"] {
+		t.Errorf("s sent %d times, the last durable %v", n, f.durable["s"])
+	}
+	if f.durable["a"] {
+		t.Error("a release was sent durably")
+	}
+
+	stats := u.Stats()
+	want := UploadStats{
+		Pending:   1,
+		Uploaded:  8,
+		Bytes:     100,
+		Retries:   1,
+		Failed:    1,
+		LastError: "/r: " + fuse.EACCES.String(),
+	}
+	if stats != want {
+		t.Errorf("stats %+v, want %+v", stats, want)
+	}
+}
+
+func TestWriteBack(t *testing.T) {
+	host := startServer(t)
+
+	a, ra := mountClient(t, host, Timeouts{}, CloseToOpen)
+	b, _ := mountClient(t, host, Timeouts{}, CloseToOpen)
+	waitLeases(t, ra)
+
+	// a holds a write lease, its closes are sent once after the last
+	name := filepath.Join(a, "f.txt")
+	for i := 0; i < 5; i++ {
+		writeFile(t, name, fmt.Sprint("version ", i))
+	}
+
+	// the kernel releases the file after close returns
+	for i := 0; ra.uploads.Stats().Uploaded == 0; i++ {
+		if i == 100 {
+			t.Fatal("the closes weren't uploaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(uploadDelay)
+	if stats := ra.uploads.Stats(); stats.Uploaded != 1 || stats.Pending != 0 {
+		t.Errorf("5 closes uploaded %d times, %d pending", stats.Uploaded, stats.Pending)
+	}
+	if s := readFile(t, filepath.Join(b, "f.txt")); s != "version 4" {
+		t.Errorf("b read %q", s)
+	}
+
+	// a rename waits for the upload of the file it moves
+	writeFile(t, name, "moved")
+	err := os.Rename(name, filepath.Join(a, "g.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readFile(t, filepath.Join(b, "g.txt")); s != "moved" {
+		t.Errorf("b read %q from the renamed file", s)
+	}
+}
+
+func TestFsync(t *testing.T) {
+	host := startServer(t)
+
+	a, ra := mountClient(t, host, Timeouts{}, CloseToOpen)
+	waitLeases(t, ra)
+
+	f, err := os.Create(filepath.Join(a, "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the write lease keeps the file, fsync sends it anyway
+	f.WriteString("page 1")
+	err = f.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := ra.meta.Get("db"); m.IsDirty() {
+		t.Error("the server hasn't the file after fsync")
+	}
+
+	// with nothing to send the server syncs what it has
+	err = f.Sync()
+	if err != nil {
+		t.Errorf("fsync of a clean file: %v", err)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+This package holds the content codings the server and the client
+negotiate for file bodies with the Accept-Encoding and
+Content-Encoding headers
+*/
+
+package codec
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// Accepted lists the supported codings in order of preference,
+// it is the value sent in Accept-Encoding headers
+const Accepted = "zstd, gzip"
+
+// MinSize is the smallest body worth compressing
+const MinSize = 1024
+
+// Supported reports whether coding can be read and written
+func Supported(coding string) bool {
+	return coding == Gzip || coding == Zstd
+}
+
+// Negotiate picks the coding for a response from the value of a
+// request's Accept-Encoding header, "" means the body is sent as is
+func Negotiate(acceptEncoding string) string {
+	best, bestQ := "", 0.0
+
+	for _, v := range strings.Split(acceptEncoding, ",") {
+		coding, q := parseQ(v)
+		if !Supported(coding) || q <= 0 {
+			continue
+		}
+
+		// on a tie zstd wins, it is cheaper on both ends
+		if q > bestQ || (q == bestQ && coding == Zstd) {
+			best, bestQ = coding, q
+		}
+	}
+
+	return best
+}
+
+// parse one element of an Accept-Encoding list, "gzip;q=0.5"
+func parseQ(v string) (coding string, q float64) {
+	arr := strings.Split(v, ";")
+	coding = strings.ToLower(strings.TrimSpace(arr[0]))
+	q = 1
+
+	for _, param := range arr[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "q=") {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(param[2:], 64)
+		if err != nil {
+			return coding, 0
+		}
+		q = f
+	}
+
+	return
+}
+
+// file extensions of formats which are already compressed
+var compressedExt = map[string]bool{
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".zip": true, ".7z": true, ".rar": true, ".jar": true, ".lz4": true,
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".mp3": true, ".mp4": true, ".mkv": true, ".mov": true, ".ogg": true,
+	".pdf": true, ".docx": true, ".xlsx": true, ".pptx": true, ".odt": true,
+}
+
+// Compressible reports whether a file is worth compressing given its
+// name, size and the first bytes of its content
+func Compressible(name string, size int64, head []byte) bool {
+	if size >= 0 && size < MinSize {
+		return false
+	}
+
+	if compressedExt[strings.ToLower(path.Ext(name))] {
+		return false
+	}
+
+	if len(head) == 0 {
+		return true
+	}
+
+	switch ct := http.DetectContentType(head); {
+	case strings.HasPrefix(ct, "image/"),
+		strings.HasPrefix(ct, "audio/"),
+		strings.HasPrefix(ct, "video/"),
+		ct == "application/zip",
+		ct == "application/x-gzip",
+		ct == "application/x-rar-compressed",
+		ct == "application/pdf",
+		ct == "font/woff2":
+		return false
+	}
+
+	return true
+}
+
+// NewWriter compresses what is written to it into w, closing it
+// flushes the compressor but does not close w
+func NewWriter(w io.Writer, coding string) (io.WriteCloser, error) {
+	switch coding {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	default:
+		return nil, fmt.Errorf("content coding %q not supported", coding)
+	}
+}
+
+// NewReader decompresses r, closing it closes r as well
+func NewReader(r io.ReadCloser, coding string) (io.ReadCloser, error) {
+	var dec io.ReadCloser
+
+	switch coding {
+	case Gzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		dec = gz
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		dec = zr.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("content coding %q not supported", coding)
+	}
+
+	return &readCloser{Reader: dec, closers: []io.Closer{dec, r}}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (rc *readCloser) Close() (err error) {
+	for _, c := range rc.closers {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return
+}
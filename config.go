@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ear7h/r3stfs/client"
+)
+
+type config struct {
+	// server
+	Listen   string `json:"listen"`
+	Root     string `json:"root"`
+	BasePath string `json:"basepath"`
+	Auth     string `json:"auth"`
+	Dav      string `json:"dav"`
+	S3       string `json:"s3"`
+	P9       string `json:"9p"`
+
+	// client
+	Host   string `json:"host"`
+	User   string `json:"user"`
+	Secret string `json:"secret"`
+	Cache  string `json:"cache"`
+
+	CacheSize  string `json:"cachesize"`
+	CacheFiles string `json:"cachefiles"`
+
+	AttrTTL     string `json:"attrttl"`
+	EntryTTL    string `json:"entryttl"`
+	NegativeTTL string `json:"negativettl"`
+	Consistency string `json:"consistency"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen: ":8080",
+		Root:   "./store",
+		Auth:   "./users.json",
+		Dav:    "/dav",
+		S3:     "/s3",
+		P9:     "unix:./r3stfs.9p",
+
+		Host:  "localhost:8080",
+		User:  "user",
+		Cache: defaultCacheDir(),
+
+		CacheSize:  "5G",
+		CacheFiles: "100000",
+
+		AttrTTL:     "1s",
+		EntryTTL:    "1s",
+		NegativeTTL: "1s",
+		Consistency: "close-to-open",
+	}
+}
+
+// a setting of the config, the name of its flag and json field
+type setting struct {
+	name, usage string
+	value       *string
+}
+
+func (c *config) serverSettings() []setting {
+	return []setting{
+		{"listen", "address of the http server", &c.Listen},
+		{"root", "directory of the store, users of the front ends have a directory in it", &c.Root},
+		{"basepath", "path the store is served under", &c.BasePath},
+		{"auth", `user database, a json file of users and secrets, the server doesn't start without it. "none" serves the whole store to anyone without authentication, and leaves out webdav, s3 and 9p`, &c.Auth},
+		{"dav", `path of the webdav mount, "" to leave it out`, &c.Dav},
+		{"s3", `path of the s3 mount, "" to leave it out`, &c.S3},
+		{"9p", `listener of the 9p server, unix:PATH without authentication or tcp:ADDR with it, "" to leave it out`, &c.P9},
+	}
+}
+
+func (c *config) clientSettings() []setting {
+	return []setting{
+		{"host", "address of the server", &c.Host},
+		{"user", "user name", &c.User},
+		{"secret", "secret of the user", &c.Secret},
+		{"cache", "directory of the caches, each user of each host has one in it", &c.Cache},
+		{"cachesize", "disk space the cache may take, like 512M or 10G, 0 for no bound", &c.CacheSize},
+		{"cachefiles", "files and directories the cache may hold, 0 for no bound", &c.CacheFiles},
+		{"attrttl", "how long attributes of files are trusted before the server is asked again", &c.AttrTTL},
+		{"entryttl", "how long the kernel trusts the names it looked up", &c.EntryTTL},
+		{"negativettl", "how long names found missing are trusted to be", &c.NegativeTTL},
+		{"consistency", `what the mount promises of other clients' changes, "close-to-open" or "strict", which checks the server on every read and trusts no ttl`, &c.Consistency},
+	}
+}
+
+func (c *config) cacheSettings() []setting {
+	return []setting{
+		{"cache", "directory of the caches, each user of each host has one in it", &c.Cache},
+	}
+}
+
+// the cache limits of the client settings
+func (c *config) cacheLimits() (client.CacheLimits, error) {
+	bytes, err := parseByteSize(c.CacheSize)
+	if err != nil {
+		return client.CacheLimits{}, fmt.Errorf("cachesize: %v", err)
+	}
+
+	files, err := strconv.ParseInt(c.CacheFiles, 10, 64)
+	if err != nil || files < 0 {
+		return client.CacheLimits{}, fmt.Errorf("cachefiles: %q isn't a number of files", c.CacheFiles)
+	}
+
+	return client.CacheLimits{Bytes: bytes, Files: files}, nil
+}
+
+// the timeouts of the client settings
+func (c *config) timeouts() (client.Timeouts, error) {
+	var t client.Timeouts
+	for _, d := range []struct {
+		name, value string
+		dur         *time.Duration
+	}{
+		{"attrttl", c.AttrTTL, &t.Attr},
+		{"entryttl", c.EntryTTL, &t.Entry},
+		{"negativettl", c.NegativeTTL, &t.Negative},
+	} {
+		dur, err := time.ParseDuration(d.value)
+		if err != nil || dur < 0 {
+			return client.Timeouts{}, fmt.Errorf("%s: %q isn't a duration, like 1s or 500ms", d.name, d.value)
+		}
+		*d.dur = dur
+	}
+
+	return t, nil
+}
+
+// parse a size like 512M or 10G, the units are powers of 1024
+func parseByteSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+
+	mult := int64(1)
+	if i := len(num) - 1; i >= 0 {
+		if u := strings.IndexByte("KMGTP", num[i]); u >= 0 {
+			mult <<= 10 * uint(u+1)
+			num = num[:i]
+		}
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q isn't a size", s)
+	}
+
+	return int64(n * float64(mult)), nil
+}
+
+// the file settings are read from and login writes
+func configPath(flagValue string) (string, error) {
+	if flagValue != "" {
+		return flagValue, nil
+	}
+
+	if p := os.Getenv("R3STFS_CONFIG"); p != "" {
+		return p, nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, "r3stfs", "config.json"), nil
+}
+
+// the caches go in $XDG_CACHE_HOME/r3stfs, or the like of the os
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "ear7h_cache"
+	}
+
+	return filepath.Join(dir, "r3stfs")
+}
+
+// read the config file, a missing one leaves the defaults
+func readConfig(filename string) (*config, error) {
+	c := defaultConfig()
+
+	byt, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(byt, c)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return c, nil
+}
+
+func envName(name string) string {
+	return "R3STFS_" + strings.ToUpper(name)
+}
+
+/*
+parse the settings of a command, flags override environment
+variables which override the config file
+
+the config file is named by -config, which has to come first, so
+the other flags' defaults can be read from it. extra adds the flags
+of the command, it may be nil
+*/
+func parseFlags(name, args string, argv []string, settings func(*config) []setting, extra func(*flag.FlagSet)) (*config, string, *flag.FlagSet, error) {
+	var configFlag string
+	if len(argv) > 0 && strings.HasPrefix(argv[0], "-config=") {
+		configFlag, argv = strings.TrimPrefix(argv[0], "-config="), argv[1:]
+	} else if len(argv) > 1 && argv[0] == "-config" {
+		configFlag, argv = argv[1], argv[2:]
+	}
+
+	filename, err := configPath(configFlag)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	c, err := readConfig(filename)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", filename, "config file, it has to be the first flag")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: r3stfs %s [flags] %s\n\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	for _, s := range settings(c) {
+		if v, ok := os.LookupEnv(envName(s.name)); ok {
+			*s.value = v
+		}
+
+		fs.StringVar(s.value, s.name, *s.value, s.usage+", $"+envName(s.name))
+	}
+
+	if extra != nil {
+		extra(fs)
+	}
+
+	err = fs.Parse(argv)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return c, filename, fs, nil
+}
+
+// print settings, secrets are left out
+func printSettings(settings []setting) {
+	sort.Slice(settings, func(i, j int) bool {
+		return settings[i].name < settings[j].name
+	})
+
+	for _, s := range settings {
+		v := *s.value
+		if s.name == "secret" && v != "" {
+			v = "(set)"
+		}
+
+		fmt.Printf("%-12s %q\n", s.name, v)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+This package computes and checks the sha-256 digests the server and
+the client exchange in Repr-Digest headers and trailers (rfc 9530)
+
+Repr-Digest: sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:
+
+the digest always covers the content of the file, never a content
+coding applied to it for the transfer
+*/
+
+package digest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"io"
+	"strings"
+)
+
+const (
+	// digest of the file sent by the server or the client
+	Header = "Repr-Digest"
+	// sent by a client asking for a digest in a HEAD response
+	WantHeader = "Want-Repr-Digest"
+	// the only algorithm used
+	Algorithm = "sha-256"
+)
+
+var ErrMismatch = errors.New("content digest mismatch")
+
+func New() hash.Hash {
+	return sha256.New()
+}
+
+// Format a sum as the value of a Repr-Digest header
+func Format(sum []byte) string {
+	return Algorithm + "=:" + base64.StdEncoding.EncodeToString(sum) + ":"
+}
+
+// Parse the sha-256 sum out of the value of a Repr-Digest header,
+// it returns nil if the value has no sha-256 member
+func Parse(value string) []byte {
+	for _, member := range strings.Split(value, ",") {
+		arr := strings.SplitN(strings.TrimSpace(member), "=", 2)
+		if len(arr) != 2 || strings.ToLower(arr[0]) != Algorithm {
+			continue
+		}
+
+		b64 := strings.Trim(arr[1], ":")
+		sum, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(sum) != sha256.Size {
+			return nil
+		}
+
+		return sum
+	}
+
+	return nil
+}
+
+// Sum reads r to the end and returns its digest
+func Sum(r io.Reader) ([]byte, error) {
+	h := New()
+
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// Reader hashes what is read through it, if it was made with an
+// expected sum the final read fails with ErrMismatch instead of
+// io.EOF when the content doesn't match
+type Reader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+}
+
+func NewReader(r io.Reader, want []byte) *Reader {
+	return &Reader{
+		r:    r,
+		h:    New(),
+		want: want,
+	}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+
+	if err == io.EOF && r.want != nil && !bytes.Equal(r.want, r.h.Sum(nil)) {
+		err = ErrMismatch
+	}
+
+	return n, err
+}
+
+// Sum of what was read so far
+func (r *Reader) Sum() []byte {
+	return r.h.Sum(nil)
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+This package holds the headers and messages of file leases, which let
+a client trust its cache of a file until the server recalls them
+
+GET /?leases
+Lease-Client: 5f2c9a0e
+
+200, a recall per line for as long as the client stays connected
+{"path": "/docs/a.txt", "id": 17}
+
+HEAD /docs/a.txt
+Lease-Client: 5f2c9a0e
+Lease: read
+
+200
+Lease: read 17
+
+DELETE /docs/a.txt?lease=17
+Lease-Client: 5f2c9a0e
+
+read leases are shared, a write lease is held by one client alone.
+Reads of other clients conflict with write leases and their writes
+with any lease. Before a conflicting request is served the server
+recalls the leases and waits for them to be given back, once the
+holder sent what it kept of the file, or for RecallTimeout after
+which they are broken. A client's leases end with its recall stream
+*/
+
+package lease
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	Read  = "read"
+	Write = "write"
+
+	// asks for a lease in requests, and grants it in responses
+	Header = "Lease"
+	// the id a client gives all its requests
+	ClientHeader = "Lease-Client"
+)
+
+const (
+	// how long a conflicting request waits for a recalled lease
+	RecallTimeout = 30 * time.Second
+	// the server writes an empty line this often, so both ends
+	// notice a dead stream
+	Heartbeat = 15 * time.Second
+)
+
+type Recall struct {
+	Path string `json:"path"`
+	ID   int64  `json:"id"`
+}
+
+// Format the Lease header of a granted lease
+func Format(kind string, id int64) string {
+	return fmt.Sprintf("%s %d", kind, id)
+}
+
+// Parse the Lease header of a response, ok is false if none was granted
+func Parse(s string) (kind string, id int64, ok bool) {
+	f := strings.Fields(s)
+	if len(f) != 2 || (f[0] != Read && f[0] != Write) {
+		return "", 0, false
+	}
+
+	id, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return f[0], id, true
+}
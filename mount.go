@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/ear7h/r3stfs/client"
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/client/runtime"
+)
+
+func mount(argv []string) error {
+	c, _, fs, err := parseFlags("mount", "MOUNTPOINT", argv, (*config).clientSettings, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a mount point")
+	}
+
+	limits, err := c.cacheLimits()
+	if err != nil {
+		return err
+	}
+
+	timeouts, err := c.timeouts()
+	if err != nil {
+		return err
+	}
+
+	consistency, err := client.ParseConsistency(c.Consistency)
+	if err != nil {
+		return err
+	}
+
+	err = client.Mount(fs.Arg(0), c.Host, c.User, c.Secret, c.Cache, limits, timeouts, consistency)
+	if err != nil {
+		return err
+	}
+
+	// Exit leaves with 0, the mount's failures have to come first
+	runtime.Exit()
+	return nil
+}
+
+func unmount(argv []string) error {
+	_, _, fs, err := parseFlags("unmount", "MOUNTPOINT", argv, func(*config) []setting { return nil }, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected a mount point")
+	}
+
+	return unmountPath(fs.Arg(0))
+}
+
+func status(argv []string) error {
+	c, filename, _, err := parseFlags("status", "", argv, (*config).clientSettings, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filename); err == nil {
+		fmt.Println("config", filename)
+	} else {
+		fmt.Println("config", filename, "(missing)")
+	}
+	fmt.Println()
+
+	printSettings(c.clientSettings())
+	fmt.Println()
+
+	res, err := remote.Login(c.Host, c.User, c.Secret).Head("")
+	if err != nil {
+		fmt.Println("server unreachable:", err)
+	} else {
+		res.Body.Close()
+		fmt.Println("server", c.Host, res.Status)
+	}
+
+	root := client.CacheRoot(c.Cache, c.Host, c.User)
+	fmt.Println("cache", root)
+
+	journal := client.JournalPath(root)
+	pending, err := client.ReadJournal(journal)
+	if err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		fmt.Printf("\n%d changes made offline wait in %s\n", len(pending), journal)
+		for _, e := range pending {
+			fmt.Printf("  %s %s\n", time.Unix(e.Time, 0).Format("Jan _2 15:04:05"), e)
+		}
+	}
+
+	stats, err := client.ReadCacheStats(client.CacheStatsPath(root))
+	if err != nil {
+		return err
+	}
+
+	if stats != nil {
+		fmt.Println()
+		printCacheStats(stats)
+	}
+
+	mounts, err := listMounts()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	if len(mounts) == 0 {
+		fmt.Println("no mounts")
+	}
+	for _, m := range mounts {
+		fmt.Printf("%s on %s\n", m.source, m.point)
+	}
+
+	return nil
+}
+
+// the cache of the last mount against its limits, and its uploads
+func printCacheStats(s *client.CacheStats) {
+	bytes := byteSize(s.Bytes)
+	if s.Limits.Bytes > 0 {
+		bytes += " of " + byteSize(s.Limits.Bytes)
+	}
+
+	files := fmt.Sprint(s.Files)
+	if s.Limits.Files > 0 {
+		files += fmt.Sprint(" of ", s.Limits.Files)
+	}
+
+	fmt.Printf("cache %s, %s files\n", bytes, files)
+	fmt.Printf("      %d hits, %d misses, %d evictions\n", s.Hits, s.Misses, s.Evictions)
+
+	u := s.Uploads
+	fmt.Printf("uploads %d pending, %d sending, %d sent (%s), %d retries, %d failed\n",
+		u.Pending, u.Active, u.Uploaded, byteSize(u.Bytes), u.Retries, u.Failed)
+	if u.LastError != "" {
+		fmt.Println("        last failed", u.LastError)
+	}
+}
+
+func login(argv []string) error {
+	c, filename, _, err := parseFlags("login", "", argv, (*config).clientSettings, nil)
+	if err != nil {
+		return err
+	}
+
+	if c.Secret == "" {
+		c.Secret, err = readSecret(fmt.Sprintf("secret of %s@%s: ", c.User, c.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := remote.Login(c.Host, c.User, c.Secret).Head("")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if remote.Errno(res) != 0 {
+		return fmt.Errorf("%s answered %s", c.Host, res.Status)
+	}
+
+	err = saveSettings(filename, c.clientSettings())
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("saved to", filename)
+	return nil
+}
+
+// read a secret without echoing it when stdin is a terminal
+func readSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	byt, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	return string(byt), err
+}
+
+// set settings in the config file, leaving its other fields alone
+func saveSettings(filename string, settings []setting) error {
+	values := make(map[string]interface{})
+
+	byt, err := ioutil.ReadFile(filename)
+	switch {
+	case err == nil:
+		err = json.Unmarshal(byt, &values)
+		if err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	for _, s := range settings {
+		values[s.name] = *s.value
+	}
+
+	byt, err = json.MarshalIndent(values, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0700)
+	if err != nil {
+		return err
+	}
+
+	// it holds a secret, only the user reads it
+	return ioutil.WriteFile(filename, append(byt, '\n'), 0600)
+}
+
+// a mount of the mount table
+type mountInfo struct {
+	source, point string
+}
+
+// the r3stfs mounts of the mount table
+func listMounts() ([]mountInfo, error) {
+	all, err := mountTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []mountInfo
+	for _, m := range all {
+		if strings.HasPrefix(m.source, client.FsName+"@") {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret, nil
+}
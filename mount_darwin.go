@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func unmountPath(mtpt string) error {
+	out, err := exec.Command("umount", mtpt).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("umount: %v %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// the mounts printed by mount(8)
+//
+// r3stfs@localhost:8080 on /Users/julio/fs (macfuse, nodev, nosuid)
+func mountTable() ([]mountInfo, error) {
+	out, err := exec.Command("mount").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []mountInfo
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		i := strings.Index(line, " on ")
+		j := strings.LastIndex(line, " (")
+		if i < 0 || j < i {
+			continue
+		}
+
+		ret = append(ret, mountInfo{line[:i], line[i+len(" on ") : j]})
+	}
+
+	return ret, scanner.Err()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// fusermount unmounts as the user who mounted
+func unmountPath(mtpt string) error {
+	out, err := exec.Command("fusermount", "-u", mtpt).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fusermount: %v %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// the mounts of /proc/self/mounts
+func mountTable() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var ret []mountInfo
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		ret = append(ret, mountInfo{unescapeMount(fields[0]), unescapeMount(fields[1])})
+	}
+
+	return ret, scanner.Err()
+}
+
+// spaces and such are octal escapes in the mount table, \040
+func unescapeMount(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
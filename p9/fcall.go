@@ -0,0 +1,606 @@
+package p9
+
+// message types
+const (
+	TypeRlerror   = 7
+	TypeTstatfs   = 8
+	TypeRstatfs   = 9
+	TypeTlopen    = 12
+	TypeRlopen    = 13
+	TypeTlcreate  = 14
+	TypeRlcreate  = 15
+	TypeTrename   = 20
+	TypeRrename   = 21
+	TypeTreadlink = 22
+	TypeRreadlink = 23
+	TypeTgetattr  = 24
+	TypeRgetattr  = 25
+	TypeTsetattr  = 26
+	TypeRsetattr  = 27
+	TypeTreaddir  = 40
+	TypeRreaddir  = 41
+	TypeTfsync    = 50
+	TypeRfsync    = 51
+	TypeTmkdir    = 72
+	TypeRmkdir    = 73
+	TypeTrenameat = 74
+	TypeRrenameat = 75
+	TypeTunlinkat = 76
+	TypeRunlinkat = 77
+	TypeTversion  = 100
+	TypeRversion  = 101
+	TypeTauth     = 102
+	TypeRauth     = 103
+	TypeTattach   = 104
+	TypeRattach   = 105
+	TypeTflush    = 108
+	TypeRflush    = 109
+	TypeTwalk     = 110
+	TypeRwalk     = 111
+	TypeTread     = 116
+	TypeRread     = 117
+	TypeTwrite    = 118
+	TypeRwrite    = 119
+	TypeTclunk    = 120
+	TypeRclunk    = 121
+	TypeTremove   = 122
+	TypeRremove   = 123
+)
+
+var msgTypes = map[uint8]func() Msg{
+	TypeRlerror:   func() Msg { return new(Rlerror) },
+	TypeTstatfs:   func() Msg { return new(Tstatfs) },
+	TypeRstatfs:   func() Msg { return new(Rstatfs) },
+	TypeTlopen:    func() Msg { return new(Tlopen) },
+	TypeRlopen:    func() Msg { return new(Rlopen) },
+	TypeTlcreate:  func() Msg { return new(Tlcreate) },
+	TypeRlcreate:  func() Msg { return new(Rlcreate) },
+	TypeTrename:   func() Msg { return new(Trename) },
+	TypeRrename:   func() Msg { return new(Rrename) },
+	TypeTreadlink: func() Msg { return new(Treadlink) },
+	TypeRreadlink: func() Msg { return new(Rreadlink) },
+	TypeTgetattr:  func() Msg { return new(Tgetattr) },
+	TypeRgetattr:  func() Msg { return new(Rgetattr) },
+	TypeTsetattr:  func() Msg { return new(Tsetattr) },
+	TypeRsetattr:  func() Msg { return new(Rsetattr) },
+	TypeTreaddir:  func() Msg { return new(Treaddir) },
+	TypeRreaddir:  func() Msg { return new(Rreaddir) },
+	TypeTfsync:    func() Msg { return new(Tfsync) },
+	TypeRfsync:    func() Msg { return new(Rfsync) },
+	TypeTmkdir:    func() Msg { return new(Tmkdir) },
+	TypeRmkdir:    func() Msg { return new(Rmkdir) },
+	TypeTrenameat: func() Msg { return new(Trenameat) },
+	TypeRrenameat: func() Msg { return new(Rrenameat) },
+	TypeTunlinkat: func() Msg { return new(Tunlinkat) },
+	TypeRunlinkat: func() Msg { return new(Runlinkat) },
+	TypeTversion:  func() Msg { return new(Tversion) },
+	TypeRversion:  func() Msg { return new(Rversion) },
+	TypeTauth:     func() Msg { return new(Tauth) },
+	TypeRauth:     func() Msg { return new(Rauth) },
+	TypeTattach:   func() Msg { return new(Tattach) },
+	TypeRattach:   func() Msg { return new(Rattach) },
+	TypeTflush:    func() Msg { return new(Tflush) },
+	TypeRflush:    func() Msg { return new(Rflush) },
+	TypeTwalk:     func() Msg { return new(Twalk) },
+	TypeRwalk:     func() Msg { return new(Rwalk) },
+	TypeTread:     func() Msg { return new(Tread) },
+	TypeRread:     func() Msg { return new(Rread) },
+	TypeTwrite:    func() Msg { return new(Twrite) },
+	TypeRwrite:    func() Msg { return new(Rwrite) },
+	TypeTclunk:    func() Msg { return new(Tclunk) },
+	TypeRclunk:    func() Msg { return new(Rclunk) },
+	TypeTremove:   func() Msg { return new(Tremove) },
+	TypeRremove:   func() Msg { return new(Rremove) },
+}
+
+// Unsupported is a message of a type this package doesn't know, like
+// the symlink, mknod, link, xattr and lock requests
+type Unsupported struct {
+	T uint8
+}
+
+func (m *Unsupported) Type() uint8     { return m.T }
+func (m *Unsupported) fields(c *coder) {}
+
+type Rlerror struct {
+	Ecode Errno
+}
+
+func (m *Rlerror) Type() uint8 { return TypeRlerror }
+func (m *Rlerror) fields(c *coder) {
+	c.u32((*uint32)(&m.Ecode))
+}
+
+type Tstatfs struct {
+	Fid uint32
+}
+
+func (m *Tstatfs) Type() uint8 { return TypeTstatfs }
+func (m *Tstatfs) fields(c *coder) {
+	c.u32(&m.Fid)
+}
+
+type Rstatfs struct {
+	FsType  uint32
+	Bsize   uint32
+	Blocks  uint64
+	Bfree   uint64
+	Bavail  uint64
+	Files   uint64
+	Ffree   uint64
+	Fsid    uint64
+	Namelen uint32
+}
+
+func (m *Rstatfs) Type() uint8 { return TypeRstatfs }
+func (m *Rstatfs) fields(c *coder) {
+	c.u32(&m.FsType)
+	c.u32(&m.Bsize)
+	c.u64(&m.Blocks)
+	c.u64(&m.Bfree)
+	c.u64(&m.Bavail)
+	c.u64(&m.Files)
+	c.u64(&m.Ffree)
+	c.u64(&m.Fsid)
+	c.u32(&m.Namelen)
+}
+
+type Tlopen struct {
+	Fid   uint32
+	Flags uint32
+}
+
+func (m *Tlopen) Type() uint8 { return TypeTlopen }
+func (m *Tlopen) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u32(&m.Flags)
+}
+
+type Rlopen struct {
+	Qid    Qid
+	Iounit uint32
+}
+
+func (m *Rlopen) Type() uint8 { return TypeRlopen }
+func (m *Rlopen) fields(c *coder) {
+	c.qid(&m.Qid)
+	c.u32(&m.Iounit)
+}
+
+// Tlcreate creates and opens Name in the directory of Fid, which is
+// then the new file
+type Tlcreate struct {
+	Fid   uint32
+	Name  string
+	Flags uint32
+	Mode  uint32
+	Gid   uint32
+}
+
+func (m *Tlcreate) Type() uint8 { return TypeTlcreate }
+func (m *Tlcreate) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.str(&m.Name)
+	c.u32(&m.Flags)
+	c.u32(&m.Mode)
+	c.u32(&m.Gid)
+}
+
+type Rlcreate struct {
+	Qid    Qid
+	Iounit uint32
+}
+
+func (m *Rlcreate) Type() uint8 { return TypeRlcreate }
+func (m *Rlcreate) fields(c *coder) {
+	c.qid(&m.Qid)
+	c.u32(&m.Iounit)
+}
+
+// Trename moves the file of Fid to Name in the directory of Dfid
+type Trename struct {
+	Fid  uint32
+	Dfid uint32
+	Name string
+}
+
+func (m *Trename) Type() uint8 { return TypeTrename }
+func (m *Trename) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u32(&m.Dfid)
+	c.str(&m.Name)
+}
+
+type Rrename struct{}
+
+func (m *Rrename) Type() uint8     { return TypeRrename }
+func (m *Rrename) fields(c *coder) {}
+
+type Treadlink struct {
+	Fid uint32
+}
+
+func (m *Treadlink) Type() uint8 { return TypeTreadlink }
+func (m *Treadlink) fields(c *coder) {
+	c.u32(&m.Fid)
+}
+
+type Rreadlink struct {
+	Target string
+}
+
+func (m *Rreadlink) Type() uint8 { return TypeRreadlink }
+func (m *Rreadlink) fields(c *coder) {
+	c.str(&m.Target)
+}
+
+type Tgetattr struct {
+	Fid  uint32
+	Mask uint64
+}
+
+func (m *Tgetattr) Type() uint8 { return TypeTgetattr }
+func (m *Tgetattr) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u64(&m.Mask)
+}
+
+type Rgetattr struct {
+	Valid       uint64
+	Qid         Qid
+	Mode        uint32
+	Uid         uint32
+	Gid         uint32
+	Nlink       uint64
+	Rdev        uint64
+	Size        uint64
+	Blksize     uint64
+	Blocks      uint64
+	AtimeSec    uint64
+	AtimeNsec   uint64
+	MtimeSec    uint64
+	MtimeNsec   uint64
+	CtimeSec    uint64
+	CtimeNsec   uint64
+	BtimeSec    uint64
+	BtimeNsec   uint64
+	Gen         uint64
+	DataVersion uint64
+}
+
+func (m *Rgetattr) Type() uint8 { return TypeRgetattr }
+func (m *Rgetattr) fields(c *coder) {
+	c.u64(&m.Valid)
+	c.qid(&m.Qid)
+	c.u32(&m.Mode)
+	c.u32(&m.Uid)
+	c.u32(&m.Gid)
+	for _, v := range []*uint64{
+		&m.Nlink, &m.Rdev, &m.Size, &m.Blksize, &m.Blocks,
+		&m.AtimeSec, &m.AtimeNsec, &m.MtimeSec, &m.MtimeNsec,
+		&m.CtimeSec, &m.CtimeNsec, &m.BtimeSec, &m.BtimeNsec,
+		&m.Gen, &m.DataVersion,
+	} {
+		c.u64(v)
+	}
+}
+
+type Tsetattr struct {
+	Fid       uint32
+	Valid     uint32
+	Mode      uint32
+	Uid       uint32
+	Gid       uint32
+	Size      uint64
+	AtimeSec  uint64
+	AtimeNsec uint64
+	MtimeSec  uint64
+	MtimeNsec uint64
+}
+
+func (m *Tsetattr) Type() uint8 { return TypeTsetattr }
+func (m *Tsetattr) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u32(&m.Valid)
+	c.u32(&m.Mode)
+	c.u32(&m.Uid)
+	c.u32(&m.Gid)
+	c.u64(&m.Size)
+	c.u64(&m.AtimeSec)
+	c.u64(&m.AtimeNsec)
+	c.u64(&m.MtimeSec)
+	c.u64(&m.MtimeNsec)
+}
+
+type Rsetattr struct{}
+
+func (m *Rsetattr) Type() uint8     { return TypeRsetattr }
+func (m *Rsetattr) fields(c *coder) {}
+
+type Treaddir struct {
+	Fid    uint32
+	Offset uint64
+	Count  uint32
+}
+
+func (m *Treaddir) Type() uint8 { return TypeTreaddir }
+func (m *Treaddir) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u64(&m.Offset)
+	c.u32(&m.Count)
+}
+
+// Rreaddir holds encoded Dirents, see AppendDirent and ParseDirents
+type Rreaddir struct {
+	Data []byte
+}
+
+func (m *Rreaddir) Type() uint8 { return TypeRreaddir }
+func (m *Rreaddir) fields(c *coder) {
+	c.data(&m.Data)
+}
+
+type Tfsync struct {
+	Fid uint32
+	// older clients leave it out
+	Datasync uint32
+}
+
+func (m *Tfsync) Type() uint8 { return TypeTfsync }
+func (m *Tfsync) fields(c *coder) {
+	c.u32(&m.Fid)
+	if !c.done() {
+		c.u32(&m.Datasync)
+	}
+}
+
+type Rfsync struct{}
+
+func (m *Rfsync) Type() uint8     { return TypeRfsync }
+func (m *Rfsync) fields(c *coder) {}
+
+type Tmkdir struct {
+	Dfid uint32
+	Name string
+	Mode uint32
+	Gid  uint32
+}
+
+func (m *Tmkdir) Type() uint8 { return TypeTmkdir }
+func (m *Tmkdir) fields(c *coder) {
+	c.u32(&m.Dfid)
+	c.str(&m.Name)
+	c.u32(&m.Mode)
+	c.u32(&m.Gid)
+}
+
+type Rmkdir struct {
+	Qid Qid
+}
+
+func (m *Rmkdir) Type() uint8 { return TypeRmkdir }
+func (m *Rmkdir) fields(c *coder) {
+	c.qid(&m.Qid)
+}
+
+type Trenameat struct {
+	OldDirFid uint32
+	OldName   string
+	NewDirFid uint32
+	NewName   string
+}
+
+func (m *Trenameat) Type() uint8 { return TypeTrenameat }
+func (m *Trenameat) fields(c *coder) {
+	c.u32(&m.OldDirFid)
+	c.str(&m.OldName)
+	c.u32(&m.NewDirFid)
+	c.str(&m.NewName)
+}
+
+type Rrenameat struct{}
+
+func (m *Rrenameat) Type() uint8     { return TypeRrenameat }
+func (m *Rrenameat) fields(c *coder) {}
+
+type Tunlinkat struct {
+	DirFid uint32
+	Name   string
+	Flags  uint32
+}
+
+func (m *Tunlinkat) Type() uint8 { return TypeTunlinkat }
+func (m *Tunlinkat) fields(c *coder) {
+	c.u32(&m.DirFid)
+	c.str(&m.Name)
+	c.u32(&m.Flags)
+}
+
+type Runlinkat struct{}
+
+func (m *Runlinkat) Type() uint8     { return TypeRunlinkat }
+func (m *Runlinkat) fields(c *coder) {}
+
+type Tversion struct {
+	Msize   uint32
+	Version string
+}
+
+func (m *Tversion) Type() uint8 { return TypeTversion }
+func (m *Tversion) fields(c *coder) {
+	c.u32(&m.Msize)
+	c.str(&m.Version)
+}
+
+type Rversion struct {
+	Msize   uint32
+	Version string
+}
+
+func (m *Rversion) Type() uint8 { return TypeRversion }
+func (m *Rversion) fields(c *coder) {
+	c.u32(&m.Msize)
+	c.str(&m.Version)
+}
+
+type Tauth struct {
+	Afid  uint32
+	Uname string
+	Aname string
+	Uid   uint32
+}
+
+func (m *Tauth) Type() uint8 { return TypeTauth }
+func (m *Tauth) fields(c *coder) {
+	c.u32(&m.Afid)
+	c.str(&m.Uname)
+	c.str(&m.Aname)
+	c.u32(&m.Uid)
+}
+
+type Rauth struct {
+	Aqid Qid
+}
+
+func (m *Rauth) Type() uint8 { return TypeRauth }
+func (m *Rauth) fields(c *coder) {
+	c.qid(&m.Aqid)
+}
+
+type Tattach struct {
+	Fid   uint32
+	Afid  uint32
+	Uname string
+	Aname string
+	Uid   uint32
+}
+
+func (m *Tattach) Type() uint8 { return TypeTattach }
+func (m *Tattach) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u32(&m.Afid)
+	c.str(&m.Uname)
+	c.str(&m.Aname)
+	c.u32(&m.Uid)
+}
+
+type Rattach struct {
+	Qid Qid
+}
+
+func (m *Rattach) Type() uint8 { return TypeRattach }
+func (m *Rattach) fields(c *coder) {
+	c.qid(&m.Qid)
+}
+
+type Tflush struct {
+	OldTag uint16
+}
+
+func (m *Tflush) Type() uint8 { return TypeTflush }
+func (m *Tflush) fields(c *coder) {
+	c.u16(&m.OldTag)
+}
+
+type Rflush struct{}
+
+func (m *Rflush) Type() uint8     { return TypeRflush }
+func (m *Rflush) fields(c *coder) {}
+
+type Twalk struct {
+	Fid    uint32
+	NewFid uint32
+	Names  []string
+}
+
+func (m *Twalk) Type() uint8 { return TypeTwalk }
+func (m *Twalk) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u32(&m.NewFid)
+	c.strs(&m.Names)
+}
+
+// Rwalk has the qids of the names walked, fewer than asked for if
+// the walk stopped early
+type Rwalk struct {
+	Qids []Qid
+}
+
+func (m *Rwalk) Type() uint8 { return TypeRwalk }
+func (m *Rwalk) fields(c *coder) {
+	c.qids(&m.Qids)
+}
+
+type Tread struct {
+	Fid    uint32
+	Offset uint64
+	Count  uint32
+}
+
+func (m *Tread) Type() uint8 { return TypeTread }
+func (m *Tread) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u64(&m.Offset)
+	c.u32(&m.Count)
+}
+
+type Rread struct {
+	Data []byte
+}
+
+func (m *Rread) Type() uint8 { return TypeRread }
+func (m *Rread) fields(c *coder) {
+	c.data(&m.Data)
+}
+
+type Twrite struct {
+	Fid    uint32
+	Offset uint64
+	Data   []byte
+}
+
+func (m *Twrite) Type() uint8 { return TypeTwrite }
+func (m *Twrite) fields(c *coder) {
+	c.u32(&m.Fid)
+	c.u64(&m.Offset)
+	c.data(&m.Data)
+}
+
+type Rwrite struct {
+	Count uint32
+}
+
+func (m *Rwrite) Type() uint8 { return TypeRwrite }
+func (m *Rwrite) fields(c *coder) {
+	c.u32(&m.Count)
+}
+
+type Tclunk struct {
+	Fid uint32
+}
+
+func (m *Tclunk) Type() uint8 { return TypeTclunk }
+func (m *Tclunk) fields(c *coder) {
+	c.u32(&m.Fid)
+}
+
+type Rclunk struct{}
+
+func (m *Rclunk) Type() uint8     { return TypeRclunk }
+func (m *Rclunk) fields(c *coder) {}
+
+// Tremove removes the file of Fid and clunks it, even if the removal
+// fails
+type Tremove struct {
+	Fid uint32
+}
+
+func (m *Tremove) Type() uint8 { return TypeTremove }
+func (m *Tremove) fields(c *coder) {
+	c.u32(&m.Fid)
+}
+
+type Rremove struct{}
+
+func (m *Rremove) Type() uint8     { return TypeRremove }
+func (m *Rremove) fields(c *coder) {}
@@ -0,0 +1,232 @@
+package p9
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrMalformed = errors.New("malformed 9p message")
+
+// ErrTooLarge is returned for messages over the negotiated msize
+var ErrTooLarge = errors.New("9p message larger than msize")
+
+// Msg is a 9p message, its fields are read and written in order
+type Msg interface {
+	Type() uint8
+	fields(c *coder)
+}
+
+// ReadMsg reads a message of at most msize bytes, messages of types
+// this package doesn't know are returned as *Unsupported
+func ReadMsg(r io.Reader, msize uint32) (tag uint16, m Msg, err error) {
+	var head [7]byte
+	_, err = io.ReadFull(r, head[:])
+	if err != nil {
+		return
+	}
+
+	size := binary.LittleEndian.Uint32(head[:4])
+	if size < uint32(len(head)) {
+		err = ErrMalformed
+		return
+	}
+	if size > msize {
+		err = ErrTooLarge
+		return
+	}
+
+	body := make([]byte, size-uint32(len(head)))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+
+	tag = binary.LittleEndian.Uint16(head[5:])
+
+	newMsg, ok := msgTypes[head[4]]
+	if !ok {
+		m = &Unsupported{T: head[4]}
+		return
+	}
+
+	m = newMsg()
+	c := &coder{buf: body, decoding: true}
+	m.fields(c)
+	if c.err != nil || len(c.buf) != 0 {
+		err = ErrMalformed
+	}
+
+	return
+}
+
+// WriteMsg writes a message in a single write
+func WriteMsg(w io.Writer, tag uint16, m Msg) error {
+	c := &coder{buf: make([]byte, 7, 64)}
+	m.fields(c)
+
+	binary.LittleEndian.PutUint32(c.buf, uint32(len(c.buf)))
+	c.buf[4] = m.Type()
+	binary.LittleEndian.PutUint16(c.buf[5:], tag)
+
+	_, err := w.Write(c.buf)
+	return err
+}
+
+// coder reads the fields of a message from buf or appends them to it
+type coder struct {
+	buf      []byte
+	decoding bool
+	err      error
+}
+
+// the next n bytes of a message being decoded
+func (c *coder) next(n int) []byte {
+	if c.err != nil || len(c.buf) < n {
+		c.err = ErrMalformed
+		return nil
+	}
+
+	b := c.buf[:n]
+	c.buf = c.buf[n:]
+	return b
+}
+
+func (c *coder) u8(v *uint8) {
+	if !c.decoding {
+		c.buf = append(c.buf, *v)
+	} else if b := c.next(1); b != nil {
+		*v = b[0]
+	}
+}
+
+func (c *coder) u16(v *uint16) {
+	if !c.decoding {
+		c.buf = binary.LittleEndian.AppendUint16(c.buf, *v)
+	} else if b := c.next(2); b != nil {
+		*v = binary.LittleEndian.Uint16(b)
+	}
+}
+
+func (c *coder) u32(v *uint32) {
+	if !c.decoding {
+		c.buf = binary.LittleEndian.AppendUint32(c.buf, *v)
+	} else if b := c.next(4); b != nil {
+		*v = binary.LittleEndian.Uint32(b)
+	}
+}
+
+func (c *coder) u64(v *uint64) {
+	if !c.decoding {
+		c.buf = binary.LittleEndian.AppendUint64(c.buf, *v)
+	} else if b := c.next(8); b != nil {
+		*v = binary.LittleEndian.Uint64(b)
+	}
+}
+
+func (c *coder) str(v *string) {
+	n := uint16(len(*v))
+	c.u16(&n)
+
+	if !c.decoding {
+		c.buf = append(c.buf, *v...)
+	} else if b := c.next(int(n)); b != nil {
+		*v = string(b)
+	}
+}
+
+// data with a uint32 count, like the data of reads and writes
+func (c *coder) data(v *[]byte) {
+	n := uint32(len(*v))
+	c.u32(&n)
+
+	if !c.decoding {
+		c.buf = append(c.buf, *v...)
+	} else if b := c.next(int(n)); b != nil {
+		*v = append([]byte(nil), b...)
+	}
+}
+
+func (c *coder) qid(v *Qid) {
+	c.u8(&v.Type)
+	c.u32(&v.Version)
+	c.u64(&v.Path)
+}
+
+func (c *coder) strs(v *[]string) {
+	n := uint16(len(*v))
+	c.u16(&n)
+
+	if c.decoding {
+		*v = make([]string, n)
+	}
+	for i := range *v {
+		c.str(&(*v)[i])
+	}
+}
+
+func (c *coder) qids(v *[]Qid) {
+	n := uint16(len(*v))
+	c.u16(&n)
+
+	if c.decoding {
+		*v = make([]Qid, n)
+	}
+	for i := range *v {
+		c.qid(&(*v)[i])
+	}
+}
+
+// true when decoding a message with no fields left, for fields old
+// clients leave out
+func (c *coder) done() bool {
+	return c.decoding && len(c.buf) == 0
+}
+
+// Dirent is an entry of the data of Rreaddir, Offset is the offset
+// of the entry after it
+type Dirent struct {
+	Qid    Qid
+	Offset uint64
+	Type   uint8
+	Name   string
+}
+
+// AppendDirent appends the encoding of d to buf
+func AppendDirent(buf []byte, d Dirent) []byte {
+	c := &coder{buf: buf}
+	c.qid(&d.Qid)
+	c.u64(&d.Offset)
+	c.u8(&d.Type)
+	c.str(&d.Name)
+	return c.buf
+}
+
+// DirentSize is the encoded size of d
+func DirentSize(d Dirent) int {
+	return 13 + 8 + 1 + 2 + len(d.Name)
+}
+
+// ParseDirents reads the entries in the data of Rreaddir
+func ParseDirents(data []byte) ([]Dirent, error) {
+	var ret []Dirent
+
+	c := &coder{buf: data, decoding: true}
+	for len(c.buf) > 0 {
+		var d Dirent
+		c.qid(&d.Qid)
+		c.u64(&d.Offset)
+		c.u8(&d.Type)
+		c.str(&d.Name)
+
+		if c.err != nil {
+			return nil, c.err
+		}
+		ret = append(ret, d)
+	}
+
+	return ret, nil
+}
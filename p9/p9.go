@@ -0,0 +1,159 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+This package holds the messages of 9P2000.L, the dialect of the 9p
+protocol the linux v9fs client speaks, and reads and writes them
+
+| size uint32 | type uint8 | tag uint16 | fields ...
+
+integers are little endian, strings are a uint16 length followed by
+the bytes, size counts the whole message. The messages are described
+in the diod protocol document
+https://github.com/chaos/diod/blob/master/protocol.md
+
+errors are Rlerror messages carrying a linux errno, whatever the
+system of the server
+*/
+
+package p9
+
+import "fmt"
+
+const Version = "9P2000.L"
+
+// NoFid is the fid of no file, like the afid of attaches without
+// authentication
+const NoFid = ^uint32(0)
+
+// NoTag is the tag of Tversion
+const NoTag = ^uint16(0)
+
+// IOHeaderSize is the room a Tread or Twrite leaves out of msize,
+// the rest of a message is the iounit
+const IOHeaderSize = 24
+
+// types of a Qid
+const (
+	QTDir     = 0x80
+	QTAuth    = 0x08
+	QTSymlink = 0x02
+	QTFile    = 0x00
+)
+
+// Qid is the server's identity of a file
+type Qid struct {
+	Type    uint8
+	Version uint32
+	Path    uint64
+}
+
+// flags of Tlopen and Tlcreate, the linux values of open(2)
+const (
+	ORdonly    = 00
+	OWronly    = 01
+	ORdwr      = 02
+	OAccMode   = 03
+	OCreate    = 0100
+	OExcl      = 0200
+	OTrunc     = 01000
+	OAppend    = 02000
+	ODirectory = 0200000
+)
+
+// bits of the mask of Tgetattr and the valid field of Rgetattr
+const (
+	GetattrMode   = 0x1
+	GetattrNlink  = 0x2
+	GetattrUid    = 0x4
+	GetattrGid    = 0x8
+	GetattrRdev   = 0x10
+	GetattrAtime  = 0x20
+	GetattrMtime  = 0x40
+	GetattrCtime  = 0x80
+	GetattrIno    = 0x100
+	GetattrSize   = 0x200
+	GetattrBlocks = 0x400
+	GetattrBasic  = 0x7ff
+)
+
+// bits of the valid field of Tsetattr, without the Set bits the
+// times are set to the time of the server
+const (
+	SetattrMode     = 0x1
+	SetattrUid      = 0x2
+	SetattrGid      = 0x4
+	SetattrSize     = 0x8
+	SetattrAtime    = 0x10
+	SetattrMtime    = 0x20
+	SetattrCtime    = 0x40
+	SetattrAtimeSet = 0x80
+	SetattrMtimeSet = 0x100
+)
+
+// flag of Tunlinkat removing a directory
+const AtRemoveDir = 0x200
+
+// Errno is a linux error number
+type Errno uint32
+
+const (
+	EPERM        Errno = 1
+	ENOENT       Errno = 2
+	EIO          Errno = 5
+	EBADF        Errno = 9
+	EAGAIN       Errno = 11
+	EACCES       Errno = 13
+	EBUSY        Errno = 16
+	EEXIST       Errno = 17
+	EXDEV        Errno = 18
+	ENOTDIR      Errno = 20
+	EISDIR       Errno = 21
+	EINVAL       Errno = 22
+	EFBIG        Errno = 27
+	ENOSPC       Errno = 28
+	EROFS        Errno = 30
+	EMLINK       Errno = 31
+	ERANGE       Errno = 34
+	ENAMETOOLONG Errno = 36
+	ENOSYS       Errno = 38
+	ENOTEMPTY    Errno = 39
+	ELOOP        Errno = 40
+	EOPNOTSUPP   Errno = 95
+	EDQUOT       Errno = 122
+)
+
+var errnoNames = map[Errno]string{
+	EPERM:        "operation not permitted",
+	ENOENT:       "no such file or directory",
+	EIO:          "input/output error",
+	EBADF:        "bad file descriptor",
+	EAGAIN:       "resource temporarily unavailable",
+	EACCES:       "permission denied",
+	EBUSY:        "device or resource busy",
+	EEXIST:       "file exists",
+	EXDEV:        "invalid cross-device link",
+	ENOTDIR:      "not a directory",
+	EISDIR:       "is a directory",
+	EINVAL:       "invalid argument",
+	EFBIG:        "file too large",
+	ENOSPC:       "no space left on device",
+	EROFS:        "read-only file system",
+	EMLINK:       "too many links",
+	ERANGE:       "numerical result out of range",
+	ENAMETOOLONG: "file name too long",
+	ENOSYS:       "function not implemented",
+	ENOTEMPTY:    "directory not empty",
+	ELOOP:        "too many levels of symbolic links",
+	EOPNOTSUPP:   "operation not supported",
+	EDQUOT:       "disk quota exceeded",
+}
+
+func (e Errno) Error() string {
+	if name, ok := errnoNames[e]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("errno %d", uint32(e))
+}
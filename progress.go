@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progress of a transfer, shown on stderr when it is a terminal
+type progress struct {
+	name  string
+	total int64
+	n     int64
+	shown time.Time
+	show  bool
+}
+
+func (t *transfer) progress(name string, total int64) *progress {
+	return &progress{
+		name:  "/" + name,
+		total: total,
+		show:  !t.quiet && term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.set(p.n + int64(len(b)))
+	return len(b), nil
+}
+
+func (p *progress) set(n int64) {
+	p.n = n
+
+	if p.show && time.Since(p.shown) > 100*time.Millisecond {
+		p.print()
+	}
+}
+
+func (p *progress) print() {
+	p.shown = time.Now()
+	fmt.Fprintf(os.Stderr, "\r%s %s / %s", p.name, byteSize(p.n), byteSize(p.total))
+}
+
+func (p *progress) done() {
+	if p.show {
+		p.print()
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,11 +1,116 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
 /*
-this is will eventually have the command line tool
-for now it is a placeholder go file for the go get command
- */
+r3stfs serves a file store and mounts it
+
+	r3stfs serve [flags]
+	r3stfs mount [flags] MOUNTPOINT
+	r3stfs unmount MOUNTPOINT
+	r3stfs status [flags]
+	r3stfs login [flags]
+
+	r3stfs ls [-l] [-R] [PATH...]
+	r3stfs stat PATH...
+	r3stfs cat PATH...
+	r3stfs get [-r] [-q] REMOTE... LOCAL
+	r3stfs put [-r] [-q] LOCAL... REMOTE
+	r3stfs mkdir [-p] [-m MODE] PATH...
+	r3stfs mv SRC... DST
+	r3stfs cp [-r] [-n] SRC... DST
+	r3stfs rm [-r] [-f] PATH...
+	r3stfs sync [-conflict POLICY] [-n] [-q] LOCAL REMOTE
+
+	r3stfs cache list
+	r3stfs cache clean [-age DURATION] [-f] [-n] [USER@HOST...]
+
+settings come from, in increasing precedence, their defaults, the
+config file, R3STFS_* environment variables and flags. The config
+file is a json object of settings, $XDG_CONFIG_HOME/r3stfs/config.json
+unless -config or R3STFS_CONFIG names another
+
+	{"host": "files.example.com:8080", "user": "julio", "cache": "/var/cache/r3stfs"}
+
+run a command with -h for its settings. The file commands don't
+need fuse, their remote paths may hold glob patterns. They exit with
+3 when a file is not found, 4 when it exists, 5 when permission is
+denied, 2 for bad usage and 1 for other failures
+*/
 package main
 
-import "fmt"
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+type command struct {
+	name, args, usage string
+	run               func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "serve the store over http, webdav, s3 and 9p to the users of a user database", serve},
+		{"mount", "MOUNTPOINT", "mount the remote files with fuse", mount},
+		{"unmount", "MOUNTPOINT", "unmount a mount point", unmount},
+		{"status", "", "show the settings, the server and the mounts", status},
+		{"login", "", "check and save the host, user and secret", login},
+		{"ls", "[PATH...]", "list remote directories", ls},
+		{"stat", "PATH...", "show the attributes of remote files", stat},
+		{"cat", "PATH...", "write remote files to stdout", cat},
+		{"get", "REMOTE... LOCAL", "download remote files", get},
+		{"put", "LOCAL... REMOTE", "upload local files", put},
+		{"mkdir", "PATH...", "make remote directories", mkdir},
+		{"mv", "SRC... DST", "move remote files", mv},
+		{"cp", "SRC... DST", "copy remote files on the server", cp},
+		{"rm", "PATH...", "remove remote files", rm},
+		{"sync", "LOCAL REMOTE", "sync a local directory with a remote one", syncDirs},
+		{"cache", "list|clean", "list the caches of users and hosts, or remove them", cacheCmd},
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: r3stfs COMMAND [flags] [args]")
+	fmt.Fprintln(os.Stderr)
+
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, c.usage)
+	}
+}
 
 func main() {
-	fmt.Println("resty")
-}
\ No newline at end of file
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+
+	for _, c := range commands {
+		if c.name != os.Args[1] {
+			continue
+		}
+
+		err := c.run(os.Args[2:])
+		if err == flag.ErrHelp {
+			os.Exit(exitUsage)
+		}
+		if err != nil {
+			// failures of the file commands were printed as they went
+			if _, ok := err.(exitError); !ok {
+				fmt.Fprintf(os.Stderr, "r3stfs %s: %v\n", c.name, err)
+			}
+			os.Exit(exitCode(err))
+		}
+
+		return
+	}
+
+	if os.Args[1] != "-h" && os.Args[1] != "help" {
+		fmt.Fprintf(os.Stderr, "r3stfs: unknown command %q\n", os.Args[1])
+	}
+	usage()
+	os.Exit(exitUsage)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ear7h/r3stfs/sandbox"
+	"github.com/ear7h/r3stfs/server"
+)
+
+func serve(argv []string) error {
+	c, _, fs, err := parseFlags("serve", "", argv, (*config).serverSettings, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	fmt.Println("server starting")
+
+	// one handler, so the front ends share its path locks and leases
+	handler := &server.R3stFsHandler{}
+
+	// the front ends are served when there are users to authenticate
+	db, err := loadAuth(c.Auth)
+	if err != nil {
+		return err
+	}
+
+	if db == nil {
+		log.Printf("WARNING: -auth none, %s is served to anyone without authentication, and without webdav, s3 and 9p", c.Root)
+		return server.ServeFs(c.Listen, c.BasePath, c.Root, handler)
+	}
+
+	users, err := sandbox.NewUserStore(c.Root)
+	if err != nil {
+		return err
+	}
+
+	// rest clients authenticate too and only see their user's store
+	mounts := []server.Mount{server.UserFsMount(c.BasePath, users, handler, db)}
+
+	if c.Dav != "" {
+		mounts = append(mounts, server.DavMount(c.Dav, users, handler, db))
+	}
+
+	// for s3 clients which accept an endpoint with a path
+	if c.S3 != "" {
+		mounts = append(mounts, server.S3Mount(c.S3, users, handler, db))
+	}
+
+	if c.P9 != "" {
+		network, addr, err := p9Listener(c.P9)
+		if err != nil {
+			return err
+		}
+
+		// v9fs doesn't authenticate, on a unix socket the socket's
+		// permissions are its access control. Over tcp anyone may
+		// connect, attaches need the user's secret
+		auth := db
+		if network == "unix" {
+			os.Remove(addr)
+			auth = nil
+		}
+
+		// listen first, so a bad address fails the command
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			return err
+		}
+
+		if network == "unix" {
+			err = os.Chmod(addr, 0600)
+			if err != nil {
+				l.Close()
+				return err
+			}
+		}
+
+		go func() {
+			log.Printf("9p server: %v", server.NewP9Server(users, handler, auth).Serve(l))
+		}()
+	}
+
+	return server.ServeMounts(c.Listen, c.Root, mounts...)
+}
+
+// the user database named by the auth setting, nil for none. Serving
+// without one has to be asked for, a missing database is an error
+func loadAuth(auth string) (*server.UserDB, error) {
+	if auth == "none" {
+		return nil, nil
+	}
+
+	db, err := server.LoadUserDB(auth)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no user database at %q, make one or serve the store to anyone with -auth none", auth)
+	}
+
+	return db, err
+}
+
+// the network and address of the 9p setting
+func p9Listener(s string) (network, addr string, err error) {
+	arr := strings.SplitN(s, ":", 2)
+	if len(arr) != 2 || (arr[0] != "unix" && arr[0] != "tcp") {
+		return "", "", fmt.Errorf("9p listener %q is not unix:PATH or tcp:ADDR", s)
+	}
+
+	return arr[0], arr[1], nil
+}
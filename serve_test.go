@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAuth(t *testing.T) {
+	dir := t.TempDir()
+
+	// serving without users is only done on request
+	db, err := loadAuth("none")
+	if db != nil || err != nil {
+		t.Errorf("none: %v %v", db, err)
+	}
+
+	for _, auth := range []string{"", filepath.Join(dir, "users.json")} {
+		if _, err := loadAuth(auth); err == nil {
+			t.Errorf("%q: no error for a missing database", auth)
+		}
+	}
+
+	filename := filepath.Join(dir, "users.json")
+	err = ioutil.WriteFile(filename, []byte(`{"julio": "secret"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = loadAuth(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, ok := db.Secret("julio"); !ok || secret != "secret" {
+		t.Errorf("julio's secret: %q %v", secret, ok)
+	}
+}
@@ -0,0 +1,467 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/digest"
+)
+
+/*
+POST /?batch runs an ordered list of operations and answers with
+the result of each, see the batch package for the messages
+
+without atomic every op runs and fails on its own, with atomic the
+first failure undoes the ops before it. Files an atomic batch
+deletes or replaces are moved to a trash name in their directory
+and only removed once every op succeeded
+*/
+
+// largest batch body accepted, create ops carry file content
+const maxBatchSize = 32 * 1024 * 1024
+
+const batchTrashPrefix = ".r3stfs-batch."
+
+// names the server keeps for itself, hidden from clients
+func isReserved(filename string) bool {
+	return isSidecar(filename) || isUploadTemp(filename) || isCopyTemp(filename) ||
+		strings.HasPrefix(path.Base(filename), batchTrashPrefix)
+}
+
+// a random name with prefix in the directory of filename, renames
+// between the two stay in one file system
+func tempName(filename, prefix string) (string, error) {
+	var rnd [8]byte
+	_, err := rand.Read(rnd[:])
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(path.Dir(filename), prefix+hex.EncodeToString(rnd[:])), nil
+}
+
+// an applied op, undo reverts it and commit finishes it once the
+// batch succeeded, both may be nil
+type batchStep struct {
+	undo, commit func() error
+}
+
+func (h *fsHandlerWrapper) serveBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req batch.Request
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid batch body", http.StatusBadRequest)
+		return
+	}
+
+	defer h.batchAccess(h.leaseClient(r), req.Ops)()
+
+	res := h.runBatch(opHeader(r.Header), req)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(res)
+	if err != nil {
+		log.Printf("error writing response %v", err)
+	}
+}
+
+func (h *fsHandlerWrapper) runBatch(header http.Header, req batch.Request) batch.Response {
+	res := batch.Response{
+		Committed: true,
+		Results:   make([]batch.Result, len(req.Ops)),
+	}
+
+	steps := make([]batchStep, len(req.Ops))
+
+	for i, op := range req.Ops {
+		step, err := h.runOp(header, op, req.Atomic, &res.Results[i])
+		if err == nil {
+			steps[i] = step
+			continue
+		}
+
+		res.Results[i].Status, res.Results[i].Error = errorStatus(op.Op, op.Path, err)
+
+		if req.Atomic {
+			res.Committed = false
+			rollback(res.Results, steps, i)
+			return res
+		}
+	}
+
+	for i, step := range steps {
+		if step.commit == nil {
+			continue
+		}
+
+		// the batch already happened, a leftover trash file is
+		// hidden from clients anyway
+		if err := step.commit(); err != nil {
+			log.Printf("batch %s %s: %v", req.Ops[i].Op, req.Ops[i].Path, err)
+		}
+	}
+
+	return res
+}
+
+// undo the ops before the failed one, in reverse order
+func rollback(results []batch.Result, steps []batchStep, failed int) {
+	for i := failed + 1; i < len(results); i++ {
+		results[i] = batch.Result{
+			Status: http.StatusFailedDependency,
+			Error:  "not run",
+		}
+	}
+
+	for i := failed - 1; i >= 0; i-- {
+		results[i] = batch.Result{
+			Status: http.StatusFailedDependency,
+			Error:  "rolled back",
+		}
+
+		if steps[i].undo == nil {
+			continue
+		}
+
+		if err := steps[i].undo(); err != nil {
+			log.Printf("batch rollback: %v", err)
+			results[i] = batch.Result{
+				Status: http.StatusInternalServerError,
+				Error:  "rollback failed",
+			}
+		}
+	}
+}
+
+// run one op, the result is filled in on success
+func (h *fsHandlerWrapper) runOp(header http.Header, op batch.Op, atomic bool, result *batch.Result) (step batchStep, err error) {
+	filename := h.filename(op.Path)
+
+	switch op.Op {
+	case batch.Stat:
+		var fi os.FileInfo
+		fi, err = h.HandleHead(header, filename)
+		if err == nil {
+			result.Attr = statAttr(fi)
+		}
+	case batch.Mkdir:
+		step, err = h.batchMkdir(header, filename, op)
+	case batch.Create:
+		step, err = h.batchCreate(header, filename, op)
+	case batch.Delete:
+		step, err = h.batchDelete(header, filename, atomic)
+	case batch.SetAttr:
+		step, err = h.batchSetAttr(header, filename, op, atomic)
+	case batch.Rename:
+		step, err = h.batchRename(header, filename, op, atomic)
+	default:
+		err = NewUserError("unknown batch op " + op.Op)
+	}
+
+	if err == nil {
+		result.Status = http.StatusOK
+	}
+
+	return
+}
+
+func (h *fsHandlerWrapper) batchMkdir(header http.Header, filename string, op batch.Op) (step batchStep, err error) {
+	mode, err := opMode(op, 0755)
+	if err != nil {
+		return
+	}
+
+	_, err = h.HandlePost(modeHeader(header, mode|os.ModeDir), filename, bytes.NewReader(nil))
+
+	step.undo = func() error {
+		return h.HandleDelete(header, filename)
+	}
+	return
+}
+
+func (h *fsHandlerWrapper) batchCreate(header http.Header, filename string, op batch.Op) (step batchStep, err error) {
+	mode, err := opMode(op, 0644)
+	if err != nil {
+		return
+	}
+
+	if mode&os.ModeType != 0 {
+		err = NewUserError("create makes files, use mkdir for directories")
+		return
+	}
+
+	_, err = h.HandlePost(modeHeader(header, mode), filename, bytes.NewReader(op.Data))
+
+	step.undo = func() error {
+		return h.HandleDelete(header, filename)
+	}
+	return
+}
+
+func (h *fsHandlerWrapper) batchDelete(header http.Header, filename string, atomic bool) (step batchStep, err error) {
+	if !atomic {
+		err = h.HandleDelete(header, filename)
+		return
+	}
+
+	fi, err := h.HandleHead(header, filename)
+	if err != nil {
+		return
+	}
+
+	// the trash would take a full directory, a plain delete wouldn't
+	if fi.IsDir() {
+		err = h.checkEmpty(header, filename)
+		if err != nil {
+			return
+		}
+	}
+
+	trash, err := h.trash(header, filename)
+	if err != nil {
+		return
+	}
+
+	step.undo = func() error {
+		return h.renameTrash(header, trash, filename)
+	}
+	step.commit = func() error {
+		return h.deleteTrash(header, trash)
+	}
+	return
+}
+
+func (h *fsHandlerWrapper) batchSetAttr(header http.Header, filename string, op batch.Op, atomic bool) (step batchStep, err error) {
+	attr := Attr{}
+
+	if op.Mode != "" {
+		var mode os.FileMode
+		mode, err = parseMode(op.Mode)
+		if err != nil {
+			return
+		}
+		attr.Mode = &mode
+	}
+
+	if op.Atime != nil {
+		t := time.Unix(*op.Atime, 0)
+		attr.Atime = &t
+	}
+
+	if op.Mtime != nil {
+		t := time.Unix(*op.Mtime, 0)
+		attr.Mtime = &t
+	}
+
+	if atomic {
+		var fi os.FileInfo
+		fi, err = h.HandleHead(header, filename)
+		if err != nil {
+			return
+		}
+
+		_, atime, mtime := fileAttr(fi)
+		mode := fi.Mode()
+		a, m := time.Unix(atime, 0), time.Unix(mtime, 0)
+		prev := Attr{Mode: &mode, Atime: &a, Mtime: &m}
+
+		step.undo = func() error {
+			return h.HandleSetAttr(header, filename, prev)
+		}
+	}
+
+	err = h.HandleSetAttr(header, filename, attr)
+	return
+}
+
+func (h *fsHandlerWrapper) batchRename(header http.Header, filename string, op batch.Op, atomic bool) (step batchStep, err error) {
+	if op.To == "" {
+		err = NewUserError("missing to")
+		return
+	}
+
+	to := h.filename(op.To)
+
+	if !atomic || to == filename {
+		err = h.HandleRename(header, filename, to)
+		return
+	}
+
+	undo := func() error {
+		return h.HandleRename(header, to, filename)
+	}
+
+	src, err := h.HandleHead(header, filename)
+	if err != nil {
+		return
+	}
+
+	dst, err := h.HandleHead(header, to)
+	switch {
+	case os.IsNotExist(err):
+		err = h.HandleRename(header, filename, to)
+		step.undo = undo
+
+	case err != nil:
+
+	case dst.IsDir():
+		// only an empty directory is replaced, undo makes it again
+		err = h.HandleRename(header, filename, to)
+		step.undo = func() error {
+			err := undo()
+			if err != nil {
+				return err
+			}
+
+			_, err = h.HandlePost(modeHeader(header, dst.Mode()), to, bytes.NewReader(nil))
+			return err
+		}
+
+	case src.IsDir():
+		err = &os.LinkError{Op: "rename", Old: filename, New: to, Err: syscall.ENOTDIR}
+
+	default:
+		// the replaced file waits in the trash until the batch is done
+		var trash string
+		trash, err = h.trash(header, to)
+		if err != nil {
+			return
+		}
+
+		err = h.HandleRename(header, filename, to)
+		if err != nil {
+			h.renameTrash(header, trash, to)
+			return
+		}
+
+		step.undo = func() error {
+			err := undo()
+			if err != nil {
+				return err
+			}
+
+			return h.renameTrash(header, trash, to)
+		}
+		step.commit = func() error {
+			return h.deleteTrash(header, trash)
+		}
+	}
+
+	return
+}
+
+// move a file out of the way to a trash name in its directory
+func (h *fsHandlerWrapper) trash(header http.Header, filename string) (string, error) {
+	trash, err := tempName(filename, batchTrashPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	return trash, h.renameTrash(header, filename, trash)
+}
+
+// handlers hiding reserved names from clients still move and delete
+// the trash of their batches
+type trashHandler interface {
+	rename(oldname, newname string) error
+	remove(header http.Header, filename string) error
+}
+
+func (h *fsHandlerWrapper) renameTrash(header http.Header, oldname, newname string) error {
+	if t, ok := h.FsHandler.(trashHandler); ok {
+		return t.rename(oldname, newname)
+	}
+
+	return h.HandleRename(header, oldname, newname)
+}
+
+func (h *fsHandlerWrapper) deleteTrash(header http.Header, filename string) error {
+	if t, ok := h.FsHandler.(trashHandler); ok {
+		return t.remove(header, filename)
+	}
+
+	return h.HandleDelete(header, filename)
+}
+
+// fail with ENOTEMPTY if the directory has any entries
+func (h *fsHandlerWrapper) checkEmpty(header http.Header, filename string) error {
+	rc, err := h.HandleGet(header, filename)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var entries map[string]os.FileMode
+	err = json.NewDecoder(rc).Decode(&entries)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		return &os.PathError{Op: "remove", Path: filename, Err: syscall.ENOTEMPTY}
+	}
+
+	return nil
+}
+
+// the header ops are run with, the batch request's own body
+// headers don't apply to them
+func opHeader(header http.Header) http.Header {
+	header = header.Clone()
+
+	for _, key := range []string{"Content-Type", "Content-Encoding", "Content-Length", "File-Mode", digest.Header} {
+		header.Del(key)
+	}
+
+	return header
+}
+
+func modeHeader(header http.Header, mode os.FileMode) http.Header {
+	header = header.Clone()
+	header.Set("File-Mode", strconv.FormatUint(uint64(mode), 8))
+
+	return header
+}
+
+// the mode of an op, def if it has none
+func opMode(op batch.Op, def os.FileMode) (os.FileMode, error) {
+	if op.Mode == "" {
+		return def, nil
+	}
+
+	return parseMode(op.Mode)
+}
+
+func statAttr(fi os.FileInfo) *batch.Attr {
+	mode, atime, mtime := fileAttr(fi)
+
+	attr := &batch.Attr{
+		Mode:  mode,
+		Size:  fi.Size(),
+		Atime: atime,
+		Mtime: mtime,
+		IsDir: fi.IsDir(),
+	}
+	if fi.Mode().IsRegular() {
+		attr.ETag = etag(fi)
+	}
+
+	return attr
+}
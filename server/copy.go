@@ -0,0 +1,263 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ear7h/r3stfs/sparse"
+)
+
+/*
+COPY /dir/file.txt
+Destination: /other/file.txt	// a url or a path under the base path
+Overwrite: T | F		// replace the destination, T by default
+Depth: 0 | infinity		// 0 copies a directory without its content
+Preserve: T | F			// keep times and extended attributes, F by default
+
+the headers are the ones of webdav (rfc 4918) plus Preserve
+*/
+
+func (h *fsHandlerWrapper) handleCopy(r *http.Request, filename string) error {
+	dest := r.Header.Get("Destination")
+	if dest == "" {
+		return NewUserError("missing Destination")
+	}
+
+	// the destination has to be under the same base path, /files
+	// doesn't take /filesX/...
+	u, err := url.Parse(dest)
+	if err != nil || (u.Path != h.basepath && !strings.HasPrefix(u.Path, h.basepath+"/")) {
+		return NewUserError("invalid Destination")
+	}
+
+	opts := CopyOptions{
+		Overwrite: r.Header.Get("Overwrite") != "F",
+		Preserve:  r.Header.Get("Preserve") == "T",
+	}
+
+	switch r.Header.Get("Depth") {
+	case "", "infinity":
+	case "0":
+		opts.Shallow = true
+	default:
+		return NewUserError("invalid Depth")
+	}
+
+	dst := h.filename(u.Path[len(h.basepath):])
+
+	client := h.leaseClient(r)
+	h.leases.access(client, filename, true, false)
+	defer h.leases.write(client, dst, true)()
+
+	return h.HandleCopy(r.Header, filename, dst, opts)
+}
+
+const copyTempPrefix = ".r3stfs-copy."
+
+// copy temporaries are hidden from clients
+func isCopyTemp(filename string) bool {
+	return strings.HasPrefix(path.Base(filename), copyTempPrefix)
+}
+
+// copy src to dst, an existing dst is replaced if opts allow it. The
+// copy is made beside dst and renamed over it once complete, a copy
+// failing half way leaves dst as it was
+func copyPath(src, dst string, opts CopyOptions) error {
+	stat, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if src == dst || (stat.IsDir() && strings.HasPrefix(dst, src+"/")) {
+		return NewUserError("can't copy a file into itself")
+	}
+
+	old, err := os.Lstat(dst)
+	switch {
+	case err == nil && !opts.Overwrite:
+		return &os.PathError{Op: "copy", Path: dst, Err: os.ErrExist}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+
+	tmp, err := tempName(dst, copyTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	err = copyTree(src, tmp, stat, opts)
+	if err == nil {
+		// a directory can't be renamed over a file or a full
+		// directory, nor a file over a directory
+		aside := old != nil && (old.IsDir() || stat.IsDir())
+		err = renameCopy(tmp, dst, aside)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		os.Remove(sidecarName(tmp))
+		return err
+	}
+
+	return nil
+}
+
+// rename the complete copy tmp to dst, with aside the old dst waits
+// under a temporary name until tmp took its place
+func renameCopy(tmp, dst string, aside bool) error {
+	var old string
+	if aside {
+		var err error
+		old, err = tempName(dst, copyTempPrefix)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(dst, old)
+		if err != nil {
+			return err
+		}
+		moveSidecar(dst, old)
+	}
+
+	err := os.Rename(tmp, dst)
+	if err != nil {
+		if aside {
+			os.Rename(old, dst)
+			moveSidecar(old, dst)
+		}
+		return err
+	}
+	moveSidecar(tmp, dst)
+
+	if aside {
+		os.RemoveAll(old)
+		os.Remove(sidecarName(old))
+	}
+
+	return nil
+}
+
+func copyTree(src, dst string, stat os.FileInfo, opts CopyOptions) error {
+	switch mode := stat.Mode(); {
+	case mode.IsRegular():
+		err := copyFile(src, dst, mode.Perm())
+		if err != nil {
+			return err
+		}
+
+	case mode.IsDir():
+		err := os.Mkdir(dst, mode.Perm())
+		if err != nil {
+			return err
+		}
+
+		if opts.Shallow {
+			break
+		}
+
+		entries, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range entries {
+			if isReserved(e.Name()) {
+				continue
+			}
+
+			err = copyTree(path.Join(src, e.Name()), path.Join(dst, e.Name()), e, opts)
+			if err != nil {
+				return err
+			}
+		}
+
+	default:
+		str := fmt.Sprintf("mode %s not implemented", mode)
+		return NewNotImplementedError(str)
+	}
+
+	// after the content, copying it changes the times of directories
+	if opts.Preserve {
+		return preserveAttrs(src, dst, stat)
+	}
+
+	return nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	// a clone shares the data of src until either file is written
+	if cloneFile(src, dst, perm) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	err = copyData(out, in)
+	if e := out.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		// don't leave a partial file behind
+		os.Remove(dst)
+	}
+
+	return err
+}
+
+// copy the content of in to the empty file out, holes are kept.
+// Between two files io.Copy uses copy_file_range on linux, the data
+// doesn't pass through the server
+func copyData(out, in *os.File) error {
+	if isSparse, _ := sparse.IsSparse(in); isSparse {
+		w := sparse.NewWriter(out)
+
+		_, err := io.Copy(w, in)
+		if err != nil {
+			return err
+		}
+
+		return w.Close()
+	}
+
+	_, err := io.Copy(out, in)
+	return err
+}
+
+func preserveAttrs(src, dst string, stat os.FileInfo) error {
+	names, err := listXAttr(src)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		value, err := getXAttr(src, name)
+		if err != nil {
+			return err
+		}
+
+		err = setXAttr(dst, name, value, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, atime, mtime := fileAttr(stat)
+	return os.Chtimes(dst, time.Unix(atime, 0), time.Unix(mtime, 0))
+}
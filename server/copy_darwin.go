@@ -0,0 +1,25 @@
+package server
+
+import (
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// make dst a clone of src, only apfs has them
+func cloneFile(src, dst string, perm os.FileMode) error {
+	err := unix.Clonefile(src, dst, unix.CLONE_NOFOLLOW)
+	if err != nil {
+		return err
+	}
+
+	// clonefile keeps the times of src, the copy is a new file
+	now := time.Now()
+	err = os.Chtimes(dst, now, now)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(dst, perm)
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// make dst a reflink of src, file systems without them (most but
+// btrfs and xfs) fail with EOPNOTSUPP or EXDEV
+func cloneFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	err = unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+	if e := out.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		os.Remove(dst)
+	}
+
+	return err
+}
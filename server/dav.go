@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/webdav"
+	"golang.org/x/sys/unix"
+
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+/*
+the webdav mount serves each user's sandbox root to stock clients,
+davfs2, file managers and office suites, with webdav class 1 and 2
+(rfc 4918): PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK and UNLOCK.
+Requests authenticate with basic auth against a UserDB
+
+the files the rest handlers keep next to a user's files, like the
+sidecars of extended attributes, are hidden and move with the files.
+Opening a file recalls the leases rest clients hold on it, those of a
+file opened to write until it is closed
+
+a PUT is written to a temporary and renamed over the file once the
+whole body was received, like the rest PUT, see upload.go. Changes
+take the path locks of the rest handlers, see pathlock.go
+*/
+
+type davMount struct {
+	basepath  string
+	users     *sandbox.UserStore
+	fsHandler *R3stFsHandler
+	db        *UserDB
+
+	// handlers keep the locks of their user between requests
+	lock     sync.Mutex
+	handlers map[string]*webdav.Handler
+}
+
+// DavMount serves the stores in users over webdav under basepath,
+// sharing the leases of handler with the other front ends
+func DavMount(basepath string, users *sandbox.UserStore, handler *R3stFsHandler, db *UserDB) Mount {
+	return &davMount{
+		basepath:  strings.TrimSuffix(path.Join("/", basepath), "/"),
+		users:     users,
+		fsHandler: handler,
+		db:        db,
+		handlers:  make(map[string]*webdav.Handler),
+	}
+}
+
+func (m *davMount) mount(mux *http.ServeMux) {
+	mux.Handle(m.basepath+"/", m)
+}
+
+func (m *davMount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.db.basicAuth(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="r3stfs"`)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	h, err := m.handler(user)
+	if err != nil {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+
+	// a PUT whose body breaks off leaves the file as it was
+	if r.Method == http.MethodPut {
+		body := &davBody{ReadCloser: r.Body}
+		r = r.WithContext(context.WithValue(r.Context(), davBodyKey{}, body))
+		r.Body = body
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+// davBody is the body of a PUT, remembering whether it broke off
+type davBody struct {
+	io.ReadCloser
+	err error
+}
+
+type davBodyKey struct{}
+
+func (b *davBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+// the webdav handler of a user's store
+func (m *davMount) handler(user string) (*webdav.Handler, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if h, ok := m.handlers[user]; ok {
+		return h, nil
+	}
+
+	store, err := m.users.User(user)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &webdav.Handler{
+		Prefix:     m.basepath,
+		FileSystem: davFS{webdav.Dir(store.Abs("/")), m.fsHandler},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("dav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	m.handlers[user] = h
+	return h, nil
+}
+
+// davFS is a webdav.Dir which hides the files kept by the server
+type davFS struct {
+	webdav.Dir
+	h *R3stFsHandler
+}
+
+// the path of a file on disk, like webdav.Dir resolves it
+func (fs davFS) abs(name string) string {
+	return filepath.Join(string(fs.Dir), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (fs davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if isReserved(name) {
+		return os.ErrPermission
+	}
+
+	defer fs.h.leaseTable().write(noLeaseClient, fs.abs(name), false)()
+	defer fs.h.locks.write(fs.abs(name))()
+
+	return fs.Dir.Mkdir(ctx, name, perm)
+}
+
+func (fs davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if isReserved(name) {
+		return nil, os.ErrNotExist
+	}
+
+	leases := fs.h.leaseTable()
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) == 0 {
+		leases.access(noLeaseClient, fs.abs(name), false, false)
+
+		// an open file reads on after a put replaced it
+		unlock := fs.h.locks.read(fs.abs(name))
+		f, err := fs.Dir.OpenFile(ctx, name, flag, perm)
+		unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		return davFile{File: f}, nil
+	}
+
+	done := leases.write(noLeaseClient, fs.abs(name), false)
+
+	var f webdav.File
+	var err error
+	if flag&os.O_TRUNC != 0 {
+		// written anew, PUT and COPY do
+		f, err = fs.create(ctx, name, flag, perm)
+	} else {
+		unlock := fs.h.locks.write(fs.abs(name))
+		f, err = fs.Dir.OpenFile(ctx, name, flag, perm)
+		unlock()
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	return davFile{File: f, done: done}, nil
+}
+
+// open a temporary to write name anew, it replaces name when it is
+// closed
+func (fs davFS) create(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	filename := fs.abs(name)
+
+	fi, err := os.Stat(filename)
+	switch {
+	case err == nil && !fi.Mode().IsRegular():
+		return nil, &os.PathError{Op: "open", Path: filename, Err: unix.EISDIR}
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrExist}
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+	case err != nil:
+		return nil, err
+	}
+
+	f, err := fs.h.openTemp(filename, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := ctx.Value(davBodyKey{}).(*davBody)
+	return &davTemp{File: f, tmp: f.Name(), filename: filename, h: fs.h, body: body}, nil
+}
+
+func (fs davFS) RemoveAll(ctx context.Context, name string) error {
+	if isReserved(name) {
+		return os.ErrNotExist
+	}
+
+	defer fs.h.leaseTable().write(noLeaseClient, fs.abs(name), true)()
+	defer fs.h.locks.write(fs.abs(name))()
+
+	err := fs.Dir.RemoveAll(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	os.Remove(sidecarName(fs.abs(name)))
+	return nil
+}
+
+func (fs davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if isReserved(oldName) || isReserved(newName) {
+		return os.ErrPermission
+	}
+
+	leases := fs.h.leaseTable()
+	defer leases.write(noLeaseClient, fs.abs(oldName), true)()
+	defer leases.write(noLeaseClient, fs.abs(newName), true)()
+	defer fs.h.locks.lock(nil, []string{fs.abs(oldName), fs.abs(newName)})()
+
+	err := fs.Dir.Rename(ctx, oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	moveSidecar(fs.abs(oldName), fs.abs(newName))
+	return nil
+}
+
+func (fs davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if isReserved(name) {
+		return nil, os.ErrNotExist
+	}
+
+	defer fs.h.locks.read(fs.abs(name))()
+
+	return fs.Dir.Stat(ctx, name)
+}
+
+// davTemp is a temporary written in place of filename
+type davTemp struct {
+	// not the *os.File, io.Copy would write past Write with ReadFrom
+	webdav.File
+	tmp, filename string
+	h             *R3stFsHandler
+	// of the PUT writing it, nil for other requests
+	body *davBody
+	// a write failed, the file stays as it was
+	failed bool
+}
+
+func (f *davTemp) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if err != nil {
+		f.failed = true
+	}
+
+	return n, err
+}
+
+// put the temporary in place of the file, unless it is incomplete
+func (f *davTemp) Close() error {
+	err := f.File.Close()
+	switch {
+	case err != nil:
+	case f.failed:
+		err = &os.PathError{Op: "write", Path: f.filename, Err: unix.EIO}
+	case f.body != nil && f.body.err != nil:
+		err = f.body.err
+	default:
+		err = f.h.replace(f.filename, f.tmp)
+	}
+
+	if err != nil {
+		os.Remove(f.tmp)
+	}
+	return err
+}
+
+// davFile leaves the server's files out of directory listings
+type davFile struct {
+	webdav.File
+	// ends the write of a file opened to write
+	done func()
+}
+
+func (f davFile) Close() error {
+	err := f.File.Close()
+	if f.done != nil {
+		f.done()
+	}
+
+	return err
+}
+
+func (f davFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := f.File.Readdir(count)
+
+	ret := fis[:0]
+	for _, fi := range fis {
+		if !isReserved(fi.Name()) {
+			ret = append(ret, fi)
+		}
+	}
+
+	return ret, err
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+func davRequest(t *testing.T, method, url, body string, header map[string]string) *http.Response {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.SetBasicAuth("julio", "secret")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res
+}
+
+func TestDav(t *testing.T) {
+	root := t.TempDir()
+	userRoot := path.Join(root, "julio")
+
+	err := os.Mkdir(userRoot, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := sandbox.NewUserStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	DavMount("/dav", users, &R3stFsHandler{}, NewUserDB(map[string]string{"julio": "secret"})).mount(mux)
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/dav/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("no auth: %s", res.Status)
+	}
+
+	steps := []struct {
+		method, path, body string
+		header             map[string]string
+		status             int
+	}{
+		{"MKCOL", "/dav/dir", "", nil, http.StatusCreated},
+		{"PUT", "/dav/dir/a.txt", "hello", nil, http.StatusCreated},
+		{"COPY", "/dav/dir/a.txt", "", map[string]string{"Destination": ts.URL + "/dav/dir/b.txt"}, http.StatusCreated},
+		{"MOVE", "/dav/dir/b.txt", "", map[string]string{"Destination": ts.URL + "/dav/c.txt"}, http.StatusCreated},
+		{"GET", "/dav/" + xattrSidecarPrefix + "c.txt", "", nil, http.StatusNotFound},
+	}
+
+	for _, s := range steps {
+		if s.method == "MOVE" {
+			// an attribute the rest handler would have set
+			err = ioutil.WriteFile(path.Join(userRoot, "dir", xattrSidecarPrefix+"b.txt"), []byte(`{"user.tag":"dGFn"}`), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		res := davRequest(t, s.method, ts.URL+s.path, s.body, s.header)
+		res.Body.Close()
+
+		if res.StatusCode != s.status {
+			t.Errorf("%s %s: %s", s.method, s.path, res.Status)
+		}
+	}
+
+	byt, err := ioutil.ReadFile(path.Join(userRoot, "c.txt"))
+	if err != nil || string(byt) != "hello" {
+		t.Errorf("c.txt: %q %v", byt, err)
+	}
+
+	if _, err := os.Stat(path.Join(userRoot, xattrSidecarPrefix+"c.txt")); err != nil {
+		t.Errorf("sidecar didn't move: %v", err)
+	}
+
+	res = davRequest(t, "PROPFIND", ts.URL+"/dav/", "", map[string]string{"Depth": "1"})
+	byt, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("propfind: %s", res.Status)
+	}
+
+	if !strings.Contains(string(byt), "c.txt") || strings.Contains(string(byt), xattrSidecarPrefix) {
+		t.Errorf("propfind listing:\n%s", byt)
+	}
+
+	lock := `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`
+
+	res = davRequest(t, "LOCK", ts.URL+"/dav/c.txt", lock, nil)
+	res.Body.Close()
+
+	token := res.Header.Get("Lock-Token")
+	if res.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("lock: %s", res.Status)
+	}
+
+	res = davRequest(t, "PUT", ts.URL+"/dav/c.txt", "bye", nil)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusLocked {
+		t.Errorf("put to a locked file: %s", res.Status)
+	}
+
+	res = davRequest(t, "PUT", ts.URL+"/dav/c.txt", "bye", map[string]string{"If": "(" + token + ")"})
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("put with the lock token: %s", res.Status)
+	}
+
+	// a put which stops half way leaves the file as it was
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "PUT /dav/c.txt HTTP/1.1\r\nHost: x\r\nAuthorization: Basic %s\r\nIf: (%s)\r\nContent-Length: 100\r\n\r\nhalf",
+		base64.StdEncoding.EncodeToString([]byte("julio:secret")), token)
+
+	// the server is done with the put when it closes the connection
+	conn.(*net.TCPConn).CloseWrite()
+	ioutil.ReadAll(conn)
+	conn.Close()
+
+	if names := uploadTemps(t, userRoot); len(names) != 0 {
+		t.Errorf("temporaries left: %v", names)
+	}
+	if byt, _ := ioutil.ReadFile(path.Join(userRoot, "c.txt")); string(byt) != "bye" {
+		t.Errorf("a dropped put left %q", byt)
+	}
+}
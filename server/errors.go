@@ -37,4 +37,40 @@ func WrapUserError(e error) *UserError {
 func IsUser(e error) bool {
 	_, ok := e.(*UserError)
 	return ok
-}
\ No newline at end of file
+}
+
+// Read only error, corresponds with a method not allowed
+type ReadOnlyError struct {
+	msg string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return e.msg
+}
+
+func NewReadOnlyError(msg string) *ReadOnlyError {
+	return &ReadOnlyError{msg:msg}
+}
+
+func IsReadOnly(e error) bool {
+	_, ok := e.(*ReadOnlyError)
+	return ok
+}
+
+// Missing extended attribute, corresponds with a not found
+type NoAttrError struct {
+	msg string
+}
+
+func (e *NoAttrError) Error() string {
+	return e.msg
+}
+
+func NewNoAttrError(msg string) *NoAttrError {
+	return &NoAttrError{msg:msg}
+}
+
+func IsNoAttr(e error) bool {
+	_, ok := e.(*NoAttrError)
+	return ok
+}
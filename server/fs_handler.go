@@ -3,11 +3,17 @@ package server
 import (
 	"net/http"
 	"io"
+	"os"
+	"time"
+
+	"github.com/ear7h/r3stfs/sparse"
 )
 
 // FsHandler is an interface which defines a serving abstraction over the filesystem
 // the file names at this point are assumed to be safe
 type FsHandler interface {
+	// Stat files, the result is written to the response header
+	HandleHead(header http.Header, filename string) (os.FileInfo, error)
 	// Read files
 	HandleGet(header http.Header, filename string) (io.ReadCloser, error)
 	// Create or write files
@@ -18,4 +24,41 @@ type FsHandler interface {
 	HandleDelete(header http.Header, filename string) (error)
 	// Check available methods for file
 	HandleOptions(header http.Header, filename string) (io.ReadCloser, error)
+	// Read an extended attribute
+	HandleGetXAttr(header http.Header, filename, attr string) ([]byte, error)
+	// List extended attribute names
+	HandleListXAttr(header http.Header, filename string) ([]string, error)
+	// Set an extended attribute, Xattr-Flags may ask for create or replace
+	HandleSetXAttr(header http.Header, filename, attr string, value []byte) error
+	// Remove an extended attribute
+	HandleRemoveXAttr(header http.Header, filename, attr string) error
+	// Set the length of a file without sending its content
+	HandleTruncate(header http.Header, filename string, size int64) error
+	// Preallocate, zero or punch a hole in a range of a file
+	HandleAllocate(header http.Header, filename string, offset, length int64, mode sparse.AllocMode) error
+	// Move a file or directory, an existing file at newname is replaced
+	HandleRename(header http.Header, oldname, newname string) error
+	// Change the mode and times of a file
+	HandleSetAttr(header http.Header, filename string, attr Attr) error
+	// Copy a file or directory on the server
+	HandleCopy(header http.Header, src, dst string, opts CopyOptions) error
+	// Write a file and its directory entry to disk
+	HandleSync(header http.Header, filename string) error
+}
+
+// Attr holds the attributes changed by HandleSetAttr, nil fields
+// are left as they are
+type Attr struct {
+	Mode         *os.FileMode
+	Atime, Mtime *time.Time
+}
+
+// CopyOptions are the options of HandleCopy
+type CopyOptions struct {
+	// replace an existing destination
+	Overwrite bool
+	// keep the times and extended attributes, the mode is always kept
+	Preserve bool
+	// copy a directory without its content
+	Shallow bool
 }
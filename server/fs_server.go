@@ -10,9 +10,29 @@ import (
 	"io/ioutil"
 	"fmt"
 	"log"
+	"syscall"
+	"errors"
+	"io/fs"
+	"bufio"
+	"sync"
+	"time"
+
+	"github.com/ear7h/r3stfs/codec"
+	"github.com/ear7h/r3stfs/digest"
+	"github.com/ear7h/r3stfs/lease"
+	"github.com/ear7h/r3stfs/sandbox"
+	"github.com/ear7h/r3stfs/sparse"
 )
 
-func ServeFs(addr, basepath, dirroot string, handler FsHandler) error {
+// ServeFs serves handler's files under dirroot at basepath, any extra
+// mounts are served alongside it
+func ServeFs(addr, basepath, dirroot string, handler FsHandler, mounts ...Mount) error {
+	return ServeMounts(addr, dirroot, append([]Mount{FsMount(basepath, dirroot, handler)}, mounts...)...)
+}
+
+// ServeMounts serves mounts of the store at dirroot, without the
+// unauthenticated rest mount of ServeFs
+func ServeMounts(addr, dirroot string, mounts ...Mount) error {
 	_, err := os.Stat(dirroot)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -29,18 +49,150 @@ func ServeFs(addr, basepath, dirroot string, handler FsHandler) error {
 		fmt.Printf("root %s already exists", dirroot)
 	}
 
+	// uploads and copies a previous server was writing won't end
+	go removeTemps(dirroot, time.Now())
+
+	return http.ListenAndServe(addr, NewServeMux(mounts...))
+}
+
+// NewServeMux routes requests to mounts, for servers of the caller's
+// own like httptest ones
+func NewServeMux(mounts ...Mount) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	for _, m := range mounts {
+		m.mount(mux)
+	}
+
+	return mux
+}
+
+// Mount attaches a handler to the server started by ServeFs
+type Mount interface {
+	mount(mux *http.ServeMux)
+}
+
+type fsMount struct {
+	basepath, dirroot string
+	handler           FsHandler
+}
+
+// FsMount serves handler under basepath, request paths are joined
+// with dirroot before being passed to the handler
+func FsMount(basepath, dirroot string, handler FsHandler) Mount {
+	return &fsMount{
+		basepath: path.Join("/", basepath),
+		dirroot:  dirroot,
+		handler:  handler,
+	}
+}
+
+// IoFsMount serves a read only view of fsys under basepath
+func IoFsMount(basepath string, fsys fs.FS) Mount {
+	// io/fs names are unrooted, joining with "." keeps them that way
+	return FsMount(basepath, ".", NewIoFsHandler(fsys))
+}
+
+func (m *fsMount) mount(mux *http.ServeMux) {
+	h := &fsHandlerWrapper{
+		FsHandler: m.handler,
+		basepath:  strings.TrimSuffix(m.basepath, "/"),
+		dirroot:   m.dirroot,
+		leases:    leasesOf(m.handler),
+	}
+
+	mux.Handle(m.basepath, h)
+	if m.basepath != "/" {
+		mux.Handle(m.basepath+"/", h)
+	}
+}
+
+type userFsMount struct {
+	basepath string
+	users    *sandbox.UserStore
+	handler  FsHandler
+	db       *UserDB
+
+	// the wrappers of the users seen so far
+	lock     sync.Mutex
+	wrappers map[string]*fsHandlerWrapper
+}
+
+// UserFsMount serves each user's store in users under basepath,
+// requests authenticate with basic auth against db and only see the
+// store of their user
+func UserFsMount(basepath string, users *sandbox.UserStore, handler FsHandler, db *UserDB) Mount {
+	return &userFsMount{
+		basepath: path.Join("/", basepath),
+		users:    users,
+		handler:  handler,
+		db:       db,
+		wrappers: make(map[string]*fsHandlerWrapper),
+	}
+}
+
+func (m *userFsMount) mount(mux *http.ServeMux) {
+	mux.Handle(m.basepath, m)
+	if m.basepath != "/" {
+		mux.Handle(m.basepath+"/", m)
+	}
+}
+
+func (m *userFsMount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := m.db.basicAuth(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="r3stfs"`)
+		http.Error(w, "not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	h, err := m.wrapper(user)
+	if err != nil {
+		http.Error(w, "not authorized", http.StatusForbidden)
+		return
+	}
+
+	h.ServeHTTP(w, r)
+}
+
+// the wrapper of the handler rooted at a user's store
+func (m *userFsMount) wrapper(user string) (*fsHandlerWrapper, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if h, ok := m.wrappers[user]; ok {
+		return h, nil
+	}
+
+	store, err := m.users.User(user)
+	if err != nil {
+		return nil, err
+	}
+
 	h := &fsHandlerWrapper{
-		FsHandler: handler,
-		basepath:  basepath,
-		dirroot:   dirroot,
+		FsHandler: m.handler,
+		basepath:  strings.TrimSuffix(m.basepath, "/"),
+		dirroot:   store.Abs("/"),
+		user:      user,
+		leases:    leasesOf(m.handler),
 	}
 
-	return http.ListenAndServe(addr, h)
+	m.wrappers[user] = h
+	return h, nil
 }
 
 type fsHandlerWrapper struct {
 	FsHandler
 	basepath, dirroot string
+	// the user of a UserFsMount's wrapper
+	user   string
+	leases *leaseTable
+}
+
+// the file name of a path under basepath, cleaning the path first
+// keeps it from climbing out of dirroot
+func (h *fsHandlerWrapper) filename(p string) string {
+	return path.Join(h.dirroot, path.Clean("/"+p))
 }
 
 func stringReadCloser(str string) io.ReadCloser {
@@ -48,34 +200,117 @@ func stringReadCloser(str string) io.ReadCloser {
 }
 
 func (h *fsHandlerWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if !strings.HasPrefix(h.basepath, r.URL.Path) {
+	if !strings.HasPrefix(r.URL.Path, h.basepath) {
 		http.Error(w, "invalid path", http.StatusBadRequest)
 		return
 	}
 
-	filename := r.URL.Path[len(h.basepath):]
-	filename = path.Join(h.basepath, filename)
+	filename := h.filename(r.URL.Path[len(h.basepath):])
+
+	// a client's recall stream, and the leases it gives back
+	query := r.URL.Query()
+	if _, ok := query["leases"]; ok {
+		h.serveLeases(w, r)
+		return
+	}
+	if _, ok := query["lease"]; ok {
+		h.serveLeaseRelease(w, r)
+		return
+	}
+
+	// uploads may be compressed, the handlers only see plain bodies
+	if coding := r.Header.Get("Content-Encoding"); coding != "" && coding != "identity" {
+		if !codec.Supported(coding) {
+			w.Header().Set("Accept-Encoding", codec.Accepted)
+			http.Error(w, "content coding not supported", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		body, err := codec.NewReader(r.Body, coding)
+		if err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = body
+	}
+
+	// sparse uploads are expanded for the handlers, the Content-Type
+	// stays so they can write the holes back
+	if r.Header.Get("Content-Type") == sparse.ContentType {
+		r.Body = ioutil.NopCloser(sparse.NewLogicalReader(r.Body))
+	}
+
+	// batches run many operations in one request
+	if _, ok := r.URL.Query()["batch"]; ok {
+		h.serveBatch(w, r)
+		return
+	}
+
+	// extended attributes are a sub resource of the file
+	if _, ok := r.URL.Query()["xattr"]; ok {
+		h.serveXAttr(w, r, filename)
+		return
+	}
+
+	// leases of other clients the request conflicts with are recalled
+	// first, and none are granted on the files it writes until it is
+	// done. A lease asked for is granted before the file is looked at,
+	// any change after it recalls the lease
+	client := h.leaseClient(r)
+	var granted *heldLease
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		kind := r.Header.Get(lease.Header)
+		h.leases.access(client, filename, false, kind == lease.Write)
+		if kind != "" {
+			granted = h.leases.grant(client, filename, r.URL.Path[len(h.basepath):], kind)
+		}
+	case http.MethodDelete:
+		defer h.leases.write(client, filename, true)()
+	case http.MethodOptions, "COPY":
+		// copies recall the leases of both of their files
+	default:
+		switch op := query.Get("op"); {
+		case r.Method != http.MethodPatch:
+			defer h.leases.write(client, filename, false)()
+		case op == "rename":
+			// both ends of a rename and the files under them change
+			defer h.leases.write(client, filename, true)()
+			if to := query.Get("to"); to != "" {
+				defer h.leases.write(client, h.filename(to), true)()
+			}
+		case op != "sync":
+			// a sync changes nothing
+			defer h.leases.write(client, filename, false)()
+		}
+	}
 
+	var fi os.FileInfo
 	var res io.ReadCloser
 	var err error
 
-	defer func(rc io.ReadCloser) {
+	defer func() {
 		if res != nil {
 			res.Close()
 		}
-	}(res)
+	}()
+
+	// uploads are hashed and checked against the client's digest
+	upload := digest.NewReader(r.Body, digest.Parse(r.Header.Get(digest.Header)))
 
 	switch r.Method {
+	case http.MethodHead:
+		fi, err = h.HandleHead(r.Header, filename)
 	case http.MethodGet:
 		res, err = h.HandleGet(r.Header, filename)
 	case http.MethodPut:
 		var num int
-		num, err = h.HandlePut(r.Header, filename, r.Body)
+		num, err = h.HandlePut(r.Header, filename, upload)
 		defer r.Body.Close()
 		res = stringReadCloser(strconv.Itoa(num))
 	case http.MethodPost:
 		var num int
-		num, err = h.HandlePost(r.Header, filename, r.Body)
+		num, err = h.HandlePost(r.Header, filename, upload)
 		defer r.Body.Close()
 		res = stringReadCloser(strconv.Itoa(num))
 	case http.MethodDelete:
@@ -83,60 +318,213 @@ func (h *fsHandlerWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		res = stringReadCloser("delete")
 	case http.MethodOptions:
 		res, err = h.HandleOptions(r.Header, filename)
+	case http.MethodPatch:
+		err = h.handlePatch(r, filename)
+		res = stringReadCloser("patch")
+	case "COPY":
+		err = h.handleCopy(r, filename)
+		res = stringReadCloser("copy")
 	default:
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if err != nil {
-		switch {
-		case os.IsNotExist(err):
-			// 404
-			s := fmt.Sprintf("%s not found", filename)
-			http.Error(w, s, http.StatusNotFound)
-		case os.IsPermission(err):
-			// forbidden
-			s := fmt.Sprintf("%s access forbidden", filename)
-			http.Error(w, s, http.StatusForbidden)
-		case os.IsExist(err):
-			// not allowed
-			s := fmt.Sprintf("%s already exists", filename)
-			http.Error(w, s, http.StatusConflict)
-		case os.IsTimeout(err):
-			// timeout
-			s := fmt.Sprintf("%s i/o timed out", filename)
-			http.Error(w, s, http.StatusInternalServerError)
-		case IsNotImplemented(err):
-			s := fmt.Sprintf("%s method %s not implemented", filename, r.Method)
-			http.Error(w, s, http.StatusNotImplemented)
-		case IsUser(err):
-			s := fmt.Sprintf("%s %s", filename, err.Error())
-			http.Error(w, s, http.StatusBadRequest)
-		default:
-			// internal server error
-			log.Printf("unexpected error %v", err)
-			http.Error(w, "internal error", http.StatusInternalServerError)
+		if granted != nil {
+			h.leases.releaseLease(granted)
 		}
+		writeError(w, r, filename, err)
 		return
 	}
 
 	// header should be written after http method handling to ensure
 	// the requested file has already been made
-	headerErr := make(chan error)
-	go func() {
-		header := w.Header()
-		headerErr <- writeHead(&header, filename)
-	}()
+	if fi == nil && r.Method != http.MethodDelete {
+		fi, _ = h.HandleHead(r.Header, filename)
+	}
+
+	header := w.Header()
+
+	// tell clients which codings they can use for request bodies
+	header.Set("Accept-Encoding", codec.Accepted)
+
+	// directories have no content to lease
+	if granted != nil {
+		if fi != nil && fi.Mode().IsRegular() {
+			header.Set(lease.Header, lease.Format(granted.kind, granted.id))
+		} else {
+			h.leases.releaseLease(granted)
+		}
+	}
+
+	if fi != nil {
+		writeHead(header, fi)
+
+		if fi.Mode().IsRegular() && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+			header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		}
+	}
 
-	// copy response and check for errors
+	switch r.Method {
+	case http.MethodPut, http.MethodPost:
+		// the digest of what was stored, for the client to check
+		header.Set(digest.Header, digest.Format(upload.Sum()))
+
+	case http.MethodHead:
+		// hashing means reading the whole file, only do it on request
+		if fi.Mode().IsRegular() && r.Header.Get(digest.WantHeader) != "" {
+			err = h.headDigest(r, header, filename)
+			if err != nil {
+				writeError(w, r, filename, err)
+				return
+			}
+		}
+
+	case http.MethodGet:
+		if fi != nil && fi.Mode().IsRegular() {
+			h.writeFile(w, r, filename, fi, res)
+			return
+		}
+	}
+
+	if res == nil {
+		return
+	}
+
+	// copy response and check for errors, the header is already
+	// sent so the client can only notice a short body
 	_, err = io.Copy(w, res)
 	if err != nil {
-		http.Error(w, "error writing response", http.StatusInternalServerError)
+		log.Printf("error writing response %v", err)
+	}
+}
+
+// write a file's content as the response body, holes are left out
+// and the content is compressed when the client accepts it, the
+// digest of the content is sent in a trailer
+func (h *fsHandlerWrapper) writeFile(w http.ResponseWriter, r *http.Request, filename string, fi os.FileInfo, res io.Reader) {
+	header := w.Header()
+	header.Add("Vary", "Accept-Encoding")
+
+	// trailers can't follow a body with a known length, File-Size
+	// still tells the client what to expect
+	header.Set("Trailer", digest.Header)
+	header.Del("Content-Length")
+
+	hash := digest.New()
+
+	var out io.Writer = w
+	var body io.Reader = io.TeeReader(res, hash)
+
+	// files with holes are sent without them if the client asks
+	if f, ok := res.(*os.File); ok && acceptsSparse(r) {
+		if isSparse, _ := sparse.IsSparse(f); isSparse {
+			sr, err := sparse.NewReader(f, hash)
+			if err != nil {
+				writeError(w, r, filename, err)
+				return
+			}
+
+			header.Set("Content-Type", sparse.ContentType)
+			body = sr
+		}
+	}
+
+	if coding := codec.Negotiate(r.Header.Get("Accept-Encoding")); coding != "" {
+		br := bufio.NewReader(body)
+		head, _ := br.Peek(512)
+		body = br
+
+		if codec.Compressible(filename, fi.Size(), head) {
+			cw, err := codec.NewWriter(w, coding)
+			if err != nil {
+				writeError(w, r, filename, err)
+				return
+			}
+			defer cw.Close()
+
+			header.Set("Content-Encoding", coding)
+			out = cw
+		}
+	}
+
+	_, err := io.Copy(out, body)
+	if err != nil {
+		// without the trailer the client knows the body is bad
+		log.Printf("error writing response %v", err)
+		return
 	}
 
-	// check header error
-	err = <-headerErr
+	header.Set(digest.Header, digest.Format(hash.Sum(nil)))
+}
+
+func acceptsSparse(r *http.Request) bool {
+	for _, v := range r.Header["Accept"] {
+		if strings.Contains(v, sparse.ContentType) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// set the digest header of a file
+func (h *fsHandlerWrapper) headDigest(r *http.Request, header http.Header, filename string) error {
+	rc, err := h.HandleGet(r.Header, filename)
 	if err != nil {
-		http.Error(w, "error writing header", http.StatusInternalServerError)
+		return err
+	}
+	defer rc.Close()
+
+	sum, err := digest.Sum(rc)
+	if err != nil {
+		return err
+	}
+
+	header.Set(digest.Header, digest.Format(sum))
+	return nil
+}
+
+// write an error response matching err
+func writeError(w http.ResponseWriter, r *http.Request, filename string, err error) {
+	status, msg := errorStatus(r.Method, filename, err)
+
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+	}
+
+	http.Error(w, msg, status)
+}
+
+// the status and message of an error response matching err
+func errorStatus(method, filename string, err error) (int, string) {
+	switch {
+	case IsNoAttr(err):
+		return http.StatusNotFound, err.Error()
+	case os.IsNotExist(err):
+		// 404
+		return http.StatusNotFound, fmt.Sprintf("%s not found", filename)
+	case os.IsPermission(err):
+		// forbidden
+		return http.StatusForbidden, fmt.Sprintf("%s access forbidden", filename)
+	case os.IsExist(err):
+		// not allowed
+		return http.StatusConflict, fmt.Sprintf("%s already exists", filename)
+	case os.IsTimeout(err):
+		// timeout
+		return http.StatusInternalServerError, fmt.Sprintf("%s i/o timed out", filename)
+	case IsReadOnly(err), errors.Is(err, syscall.EROFS):
+		// read only, only the methods which don't write are allowed
+		return http.StatusMethodNotAllowed, fmt.Sprintf("%s is read only", filename)
+	case errors.Is(err, digest.ErrMismatch):
+		return http.StatusBadRequest, fmt.Sprintf("%s %s", filename, err.Error())
+	case IsNotImplemented(err):
+		return http.StatusNotImplemented, fmt.Sprintf("%s method %s not implemented", filename, method)
+	case IsUser(err):
+		return http.StatusBadRequest, fmt.Sprintf("%s %s", filename, err.Error())
+	default:
+		// internal server error
+		log.Printf("unexpected error %v", err)
+		return http.StatusInternalServerError, "internal error"
 	}
 }
@@ -0,0 +1,722 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/codec"
+	"github.com/ear7h/r3stfs/digest"
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+// start a server for a R3stFsHandler rooted in a temporary directory
+func startTestServer(t *testing.T) (*httptest.Server, string) {
+	dirroot := t.TempDir()
+
+	mux := http.NewServeMux()
+	FsMount("", dirroot, &R3stFsHandler{}).mount(mux)
+
+	ts := httptest.NewServer(mux)
+	t.Cleanup(ts.Close)
+
+	return ts, dirroot
+}
+
+func TestCompression(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	text := []byte(strings.Repeat("some very compressible text\n", 1000))
+
+	// upload a gzip compressed body
+	buf := &bytes.Buffer{}
+	w, _ := codec.NewWriter(buf, codec.Gzip)
+	w.Write(text)
+	w.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, ts.URL+"/file.txt", buf)
+	req.Header.Set("File-Mode", "644")
+	req.Header.Set("Content-Encoding", codec.Gzip)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: %s", res.Status)
+	}
+
+	stored, err := ioutil.ReadFile(path.Join(dirroot, "file.txt"))
+	if err != nil || !bytes.Equal(stored, text) {
+		t.Fatalf("stored file differs from upload, err: %v", err)
+	}
+
+	// download it zstd compressed
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/file.txt", nil)
+	req.Header.Set("Accept-Encoding", "gzip;q=0.5, zstd")
+
+	tr := &http.Transport{DisableCompression: true}
+	res, err = (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Header.Get("Content-Encoding") != codec.Zstd {
+		t.Fatalf("GET: Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+	if res.Header.Get("File-Size") != strconv.Itoa(len(text)) {
+		t.Errorf("GET: File-Size %q", res.Header.Get("File-Size"))
+	}
+
+	body, _ := codec.NewReader(res.Body, codec.Zstd)
+	got, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, text) {
+		t.Errorf("GET: decoded body differs, err: %v", err)
+	}
+
+	// already compressed content is sent as is
+	err = ioutil.WriteFile(path.Join(dirroot, "file.gz"), stored, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, ts.URL+"/file.gz", nil)
+	req.Header.Set("Accept-Encoding", codec.Accepted)
+
+	res, err = (&http.Client{Transport: tr}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.Header.Get("Content-Encoding") != "" {
+		t.Errorf("GET .gz: Content-Encoding %q", res.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestDigest(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	text := []byte("hello digest")
+	sum, _ := digest.Sum(bytes.NewReader(text))
+
+	// an upload with a wrong digest is refused
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/file.txt", bytes.NewReader(text))
+	req.Header.Set("File-Mode", "644")
+	req.Header.Set(digest.Header, digest.Format(make([]byte, len(sum))))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST bad digest: %s", res.Status)
+	}
+
+	req, _ = http.NewRequest(http.MethodPost, ts.URL+"/file.txt", bytes.NewReader(text))
+	req.Header.Set("File-Mode", "644")
+	req.Header.Set(digest.Header, digest.Format(sum))
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("POST: %s", res.Status)
+	}
+	if !bytes.Equal(digest.Parse(res.Header.Get(digest.Header)), sum) {
+		t.Errorf("POST: digest %q", res.Header.Get(digest.Header))
+	}
+
+	stored, _ := ioutil.ReadFile(path.Join(dirroot, "file.txt"))
+	if !bytes.Equal(stored, text) {
+		t.Errorf("stored %q", stored)
+	}
+
+	// downloads carry the digest in a trailer
+	res, err = http.Get(ts.URL + "/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if !bytes.Equal(digest.Parse(res.Trailer.Get(digest.Header)), sum) {
+		t.Errorf("GET: trailer %v", res.Trailer)
+	}
+
+	// and HEAD only on request
+	req, _ = http.NewRequest(http.MethodHead, ts.URL+"/file.txt", nil)
+	req.Header.Set(digest.WantHeader, "sha-256=1")
+
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if !bytes.Equal(digest.Parse(res.Header.Get(digest.Header)), sum) {
+		t.Errorf("HEAD: digest %q", res.Header.Get(digest.Header))
+	}
+}
+
+func TestXAttr(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	err := ioutil.WriteFile(path.Join(dirroot, "file.txt"), []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, query string, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+"/file.txt?xattr="+query, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := do(http.MethodGet, "user.tag", "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("Xattr-Missing") == "" {
+		t.Errorf("GET missing attribute: %s", res.Status)
+	}
+
+	// macOS style names aren't supported natively on linux and go
+	// to the sidecar
+	for _, attr := range []string{"user.tag", "com.apple.FinderInfo"} {
+		res = do(http.MethodPut, attr, "red")
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("PUT %s: %s", attr, res.Status)
+		}
+
+		res = do(http.MethodGet, attr, "")
+		value, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if string(value) != "red" {
+			t.Errorf("GET %s: %q", attr, value)
+		}
+	}
+
+	res = do(http.MethodGet, "", "")
+	names := []string{}
+	json.NewDecoder(res.Body).Decode(&names)
+	res.Body.Close()
+	if len(names) != 2 {
+		t.Errorf("list: %v", names)
+	}
+
+	// the sidecar isn't part of listings
+	res, err = http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing := make(map[string]os.FileMode)
+	json.NewDecoder(res.Body).Decode(&listing)
+	res.Body.Close()
+	if len(listing) != 1 {
+		t.Errorf("listing: %v", listing)
+	}
+
+	res = do(http.MethodDelete, "user.tag", "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("DELETE: %s", res.Status)
+	}
+
+	res = do(http.MethodDelete, "user.tag", "")
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("DELETE twice: %s", res.Status)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	filename := path.Join(dirroot, "big.log")
+	err := ioutil.WriteFile(filename, bytes.Repeat([]byte("log line\n"), 1000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int64{10, 0, 4096} {
+		u := ts.URL + "/big.log?op=truncate&size=" + strconv.FormatInt(size, 10)
+		req, _ := http.NewRequest(http.MethodPatch, u, nil)
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("truncate %d: %s", size, res.Status)
+		}
+
+		stat, _ := os.Stat(filename)
+		if stat.Size() != size {
+			t.Errorf("truncate %d: size %d", size, stat.Size())
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodPatch, ts.URL+"/big.log?op=truncate&size=-1", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("negative size: %s", res.Status)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	do := func(method, u string, body string, header map[string]string) int {
+		req, _ := http.NewRequest(method, ts.URL+u, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	// an upload which is on disk when it is answered
+	status := do(http.MethodPut, "/db.sqlite", "pages", map[string]string{"File-Mode": "644", "Sync": "T"})
+	if status != http.StatusOK {
+		t.Fatalf("put: %d", status)
+	}
+
+	byt, _ := ioutil.ReadFile(path.Join(dirroot, "db.sqlite"))
+	if string(byt) != "pages" {
+		t.Errorf("put wrote %q", byt)
+	}
+
+	// and a file which is already there
+	if status := do(http.MethodPatch, "/db.sqlite?op=sync", "", nil); status != http.StatusOK {
+		t.Errorf("sync: %d", status)
+	}
+
+	if status := do(http.MethodPatch, "/missing?op=sync", "", nil); status != http.StatusNotFound {
+		t.Errorf("sync of a missing file: %d", status)
+	}
+}
+
+func postBatch(t *testing.T, ts *httptest.Server, req batch.Request) batch.Response {
+	byt, _ := json.Marshal(req)
+
+	res, err := http.Post(ts.URL+"/?batch", "application/json", bytes.NewReader(byt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("batch: %s", res.Status)
+	}
+
+	var ret batch.Response
+	err = json.NewDecoder(res.Body).Decode(&ret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ret
+}
+
+func TestBatch(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	err := ioutil.WriteFile(path.Join(dirroot, "old.txt"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := int64(1500000000)
+
+	res := postBatch(t, ts, batch.Request{Ops: []batch.Op{
+		{Op: batch.Mkdir, Path: "/dir"},
+		{Op: batch.Create, Path: "/dir/a.txt", Data: []byte("hello")},
+		{Op: batch.SetAttr, Path: "/dir/a.txt", Mode: "600", Mtime: &mtime},
+		{Op: batch.Rename, Path: "/dir/a.txt", To: "/dir/b.txt"},
+		{Op: batch.Stat, Path: "/dir/b.txt"},
+		{Op: batch.Delete, Path: "/missing.txt"},
+		{Op: batch.Delete, Path: "/old.txt"},
+	}})
+
+	want := []int{200, 200, 200, 200, 200, 404, 200}
+	for i, r := range res.Results {
+		if r.Status != want[i] {
+			t.Errorf("op %d: status %d %s", i, r.Status, r.Error)
+		}
+	}
+
+	attr := res.Results[4].Attr
+	if attr == nil || attr.Size != 5 || attr.Mtime != mtime || attr.Mode&0777 != 0600 {
+		t.Errorf("stat: %+v", attr)
+	}
+
+	if _, err := os.Stat(path.Join(dirroot, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("old.txt not deleted: %v", err)
+	}
+}
+
+func TestBatchAtomic(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "b"} {
+		err := ioutil.WriteFile(path.Join(dirroot, name), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mtime := int64(1500000000)
+
+	// the create fails as a.txt is back in place after the rename
+	res := postBatch(t, ts, batch.Request{Atomic: true, Ops: []batch.Op{
+		{Op: batch.Mkdir, Path: "/dir"},
+		{Op: batch.SetAttr, Path: "/b.txt", Mtime: &mtime},
+		{Op: batch.Rename, Path: "/a.txt", To: "/b.txt"},
+		{Op: batch.Delete, Path: "/b.txt"},
+		{Op: batch.Create, Path: "/dir/c.txt", Data: []byte("c")},
+		{Op: batch.Create, Path: "/dir/c.txt", Data: []byte("c")},
+		{Op: batch.Stat, Path: "/b.txt"},
+	}})
+
+	if res.Committed {
+		t.Fatal("failed batch committed")
+	}
+
+	want := []int{424, 424, 424, 424, 424, 409, 424}
+	for i, r := range res.Results {
+		if r.Status != want[i] {
+			t.Errorf("op %d: status %d %s", i, r.Status, r.Error)
+		}
+	}
+
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "b"} {
+		byt, err := ioutil.ReadFile(path.Join(dirroot, name))
+		if err != nil || string(byt) != content {
+			t.Errorf("%s not restored: %q %v", name, byt, err)
+		}
+	}
+
+	stat, _ := os.Stat(path.Join(dirroot, "b.txt"))
+	if stat.ModTime().Unix() == mtime {
+		t.Error("setattr not undone")
+	}
+
+	entries, _ := ioutil.ReadDir(dirroot)
+	if len(entries) != 2 {
+		t.Errorf("leftover files %d", len(entries))
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	names := []string{xattrSidecarPrefix + "a.txt", uploadTempPrefix + "0badc0de", batchTrashPrefix + "c0ffee00"}
+	for _, name := range append(names, "a.txt") {
+		err := ioutil.WriteFile(path.Join(dirroot, name), []byte("x"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	do := func(method, p string) int {
+		req, _ := http.NewRequest(method, ts.URL+p, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	// the server's files don't exist to clients, nor can they be
+	// moved to or from
+	for _, name := range names {
+		for _, method := range []string{http.MethodHead, http.MethodGet, http.MethodDelete} {
+			if status := do(method, "/"+name); status != http.StatusNotFound {
+				t.Errorf("%s %s: %d", method, name, status)
+			}
+		}
+
+		// nor can they be changed in place or have attributes
+		for _, p := range []string{
+			"?op=truncate&size=0",
+			"?op=allocate&offset=0&length=4096",
+			"?op=setattr&mode=600",
+			"?op=sync",
+		} {
+			if status := do(http.MethodPatch, "/"+name+p); status != http.StatusNotFound {
+				t.Errorf("PATCH %s%s: %d", name, p, status)
+			}
+		}
+		if status := do(http.MethodOptions, "/"+name); status != http.StatusNotFound {
+			t.Errorf("OPTIONS %s: %d", name, status)
+		}
+		for _, method := range []string{http.MethodGet, http.MethodPut, http.MethodDelete} {
+			if status := do(method, "/"+name+"?xattr=user.tag"); status != http.StatusNotFound {
+				t.Errorf("%s %s?xattr: %d", method, name, status)
+			}
+		}
+		if status := do(http.MethodGet, "/"+name+"?xattr"); status != http.StatusNotFound {
+			t.Errorf("list xattr %s: %d", name, status)
+		}
+
+		if status := do(http.MethodPatch, "/"+name+"?op=rename&to=/b.txt"); status != http.StatusBadRequest {
+			t.Errorf("rename from %s: %d", name, status)
+		}
+		if status := do(http.MethodPatch, "/a.txt?op=rename&to=/"+name); status != http.StatusBadRequest {
+			t.Errorf("rename to %s: %d", name, status)
+		}
+
+		fi, err := os.Stat(path.Join(dirroot, name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if fi.Size() != 1 || fi.Mode().Perm() != 0644 {
+			t.Errorf("%s changed: %d %v", name, fi.Size(), fi.Mode())
+		}
+	}
+
+	// batches still go through their trash
+	res := postBatch(t, ts, batch.Request{Atomic: true, Ops: []batch.Op{
+		{Op: batch.Delete, Path: "/a.txt"},
+	}})
+	if !res.Committed || res.Results[0].Status != http.StatusOK {
+		t.Errorf("batch delete: %+v", res)
+	}
+	if _, err := os.Stat(path.Join(dirroot, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt after the batch: %v", err)
+	}
+}
+
+func copyRequest(t *testing.T, ts *httptest.Server, src, dst string, header map[string]string) int {
+	req, _ := http.NewRequest("COPY", ts.URL+src, nil)
+	req.Header.Set("Destination", dst)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	return res.StatusCode
+}
+
+func TestCopy(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	err := os.MkdirAll(path.Join(dirroot, "src/sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"src/a.txt":     "a",
+		"src/sub/b.txt": "b",
+	}
+	for name, content := range files {
+		err := ioutil.WriteFile(path.Join(dirroot, name), []byte(content), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	os.Chtimes(path.Join(dirroot, "src/a.txt"), mtime, mtime)
+
+	if status := copyRequest(t, ts, "/src", "/dst", map[string]string{"Preserve": "T"}); status != http.StatusOK {
+		t.Fatalf("copy: %d", status)
+	}
+
+	for name, content := range files {
+		name = "dst" + strings.TrimPrefix(name, "src")
+		byt, err := ioutil.ReadFile(path.Join(dirroot, name))
+		if err != nil || string(byt) != content {
+			t.Errorf("%s: %q %v", name, byt, err)
+		}
+	}
+
+	stat, err := os.Stat(path.Join(dirroot, "dst/a.txt"))
+	if err != nil || !stat.ModTime().Equal(mtime) || stat.Mode().Perm() != 0640 {
+		t.Errorf("attributes not preserved: %v %v", stat.ModTime(), stat.Mode())
+	}
+
+	if status := copyRequest(t, ts, "/src/a.txt", ts.URL+"/dst/sub/b.txt", map[string]string{"Overwrite": "F"}); status != http.StatusConflict {
+		t.Errorf("copy without overwrite: %d", status)
+	}
+
+	if status := copyRequest(t, ts, "/src/a.txt", "/dst/sub/b.txt", nil); status != http.StatusOK {
+		t.Errorf("copy with overwrite: %d", status)
+	}
+
+	byt, _ := ioutil.ReadFile(path.Join(dirroot, "dst/sub/b.txt"))
+	if string(byt) != "a" {
+		t.Errorf("overwritten content %q", byt)
+	}
+
+	if status := copyRequest(t, ts, "/src", "/empty", map[string]string{"Depth": "0"}); status != http.StatusOK {
+		t.Errorf("shallow copy: %d", status)
+	}
+
+	entries, _ := ioutil.ReadDir(path.Join(dirroot, "empty"))
+	if len(entries) != 0 {
+		t.Errorf("shallow copy has %d entries", len(entries))
+	}
+
+	if status := copyRequest(t, ts, "/src", "/src/sub/src", nil); status != http.StatusBadRequest {
+		t.Errorf("copy into itself: %d", status)
+	}
+
+	// a directory replaces a full one
+	if status := copyRequest(t, ts, "/src/sub", "/dst", nil); status != http.StatusOK {
+		t.Errorf("copy over a directory: %d", status)
+	}
+	if byt, _ := ioutil.ReadFile(path.Join(dirroot, "dst/b.txt")); string(byt) != "b" {
+		t.Errorf("copied over a directory %q", byt)
+	}
+
+	// a copy failing at the link leaves the destination alone
+	os.Symlink("a.txt", path.Join(dirroot, "src/z"))
+	if status := copyRequest(t, ts, "/src", "/dst", nil); status == http.StatusOK {
+		t.Errorf("copy of a link: %d", status)
+	}
+	if byt, _ := ioutil.ReadFile(path.Join(dirroot, "dst/b.txt")); string(byt) != "b" {
+		t.Errorf("a failed copy left %q", byt)
+	}
+
+	entries, _ = ioutil.ReadDir(dirroot)
+	for _, e := range entries {
+		if isReserved(e.Name()) {
+			t.Errorf("temporary left: %s", e.Name())
+		}
+	}
+}
+
+func TestCopyBasePath(t *testing.T) {
+	dirroot := t.TempDir()
+
+	mux := http.NewServeMux()
+	FsMount("/files", dirroot, &R3stFsHandler{}).mount(mux)
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	err := ioutil.WriteFile(path.Join(dirroot, "a.txt"), []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a destination only sharing the base path's prefix is outside it
+	if status := copyRequest(t, ts, "/files/a.txt", "/filesX/b.txt", nil); status != http.StatusBadRequest {
+		t.Errorf("copy to /filesX: %d", status)
+	}
+	if _, err := os.Stat(path.Join(dirroot, "X")); !os.IsNotExist(err) {
+		t.Errorf("copied outside the base path: %v", err)
+	}
+
+	if status := copyRequest(t, ts, "/files/a.txt", ts.URL+"/files/b.txt", nil); status != http.StatusOK {
+		t.Errorf("copy: %d", status)
+	}
+	if byt, _ := ioutil.ReadFile(path.Join(dirroot, "b.txt")); string(byt) != "a" {
+		t.Errorf("copied %q", byt)
+	}
+}
+
+func TestUserFsMount(t *testing.T) {
+	root := t.TempDir()
+	for _, user := range []string{"julio", "ana"} {
+		err := os.Mkdir(path.Join(root, user), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(path.Join(root, "ana", "secret.txt"), []byte("ana's"), 0600)
+
+	users, err := sandbox.NewUserStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	db := NewUserDB(map[string]string{"julio": "secret", "ana": "other"})
+	UserFsMount("", users, &R3stFsHandler{}, db).mount(mux)
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	do := func(method, p, pass, body string) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+p, strings.NewReader(body))
+		if pass != "" {
+			req.SetBasicAuth("julio", pass)
+		}
+		req.Header.Set("File-Mode", "644")
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	for _, pass := range []string{"", "wrong"} {
+		res := do(http.MethodPut, "/a.txt", pass, "a")
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("put with password %q: %s", pass, res.Status)
+		}
+	}
+
+	res := do(http.MethodPut, "/a.txt", "secret", "a")
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("put: %s", res.Status)
+	}
+	if byt, _ := ioutil.ReadFile(path.Join(root, "julio", "a.txt")); string(byt) != "a" {
+		t.Errorf("julio's store has %q", byt)
+	}
+
+	// the store of another user is out of reach
+	for _, p := range []string{"/ana/secret.txt", "/../ana/secret.txt"} {
+		res = do(http.MethodGet, p, "secret", "")
+		byt, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET %s: %s %q", p, res.Status, byt)
+		}
+	}
+}
@@ -1,11 +1,10 @@
 package server
 
 import (
-	"net/http"
 	"fmt"
+	"net/http"
 	"syscall"
 	"strconv"
-	"time"
 	"os"
 )
 
@@ -14,52 +13,69 @@ HEAD /dir/file.txt
 
 200
 File-Mode: 0777
+Is-Dir: false
+File-Size: 1024
+ETag: "14c5e3b0a8f2e000-400" // changes with the content
 Last-Modified: Mon, 02 Jan 2006 15:04:05 MST //rfc 1123
 Atime: 15324230 // Unix time
 Mtime: 15324230 // Unix time
 */
 
-// write file attributes to passed ResponseWriter's header
-//
-// writeHead will make one write to the errc channel
-// a signal to the caller to proceed with io
-// 		if it is not nil don't do io
-// and a read
-//		this is to hang until the caller is done with io before
-//		asserting the old mtime and atime
+// write file attributes to the passed header
+func writeHead(header http.Header, fi os.FileInfo) {
+	mode, atime, mtime := fileAttr(fi)
 
-// write header based on specific file
-func writeHead(header *http.Header, localFile string) (error) {
-	header.Set("Trailer", "File-Mode Last-Modified Mtime Atime")
+	header.Set("File-Mode", strconv.FormatUint(uint64(mode), 8))
+	header.Set("Is-Dir", strconv.FormatBool(fi.IsDir()))
+	header.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	header.Set("Mtime", strconv.FormatInt(mtime, 10))
+	header.Set("Atime", strconv.FormatInt(atime, 10))
 
-	fi, err := os.Stat(localFile)
-	if err != nil {
-		fmt.Println("wh there was error")
-		return err
+	// the size of the file, unlike Content-Length it is not
+	// changed by content codings
+	if fi.Mode().IsRegular() {
+		header.Set("File-Size", strconv.FormatInt(fi.Size(), 10))
+		header.Set("ETag", etag(fi))
 	}
-	// signal the caller it is okay to access files
+}
+
+// the ETag of a file, it is not an md5 so s3 clients shouldn't
+// check it against one, the dash tells them so like the ETags of
+// multipart uploads
+func etag(fi os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
 
-	stat, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		fmt.Println("wh there was error")
-		return err
+// the mode bits and unix times of a file
+//
+// file infos from the os carry a syscall.Stat_t which has the
+// real mode bits and access time, other file infos, like the
+// ones from an io/fs.FS, only have a modification time
+func fileAttr(fi os.FileInfo) (mode uint32, atime, mtime int64) {
+	mode = unixMode(fi.Mode())
+	mtime = fi.ModTime().Unix()
+	atime = mtime
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		mode = uint32(stat.Mode)
+		atime, mtime = statTimes(stat)
 	}
 
-	atime := stat.Atimespec.Sec
-	mtime := stat.Mtimespec.Sec
+	return
+}
 
-	header.Set("File-Mode", strconv.FormatUint(uint64(stat.Mode), 8))
-	header.Set("Last-Modified", fi.ModTime().Format(time.RFC1123))
-	header.Set("Mtime", strconv.FormatInt(mtime, 10))
-	header.Set("Atime", strconv.FormatInt(atime, 10))
+// convert an os.FileMode to the mode bits of a stat call
+func unixMode(m os.FileMode) uint32 {
+	mode := uint32(m.Perm())
 
-	/* should be handled in specific handlers
-	if !fi.IsDir() {
-		header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	switch {
+	case m.IsDir():
+		mode |= syscall.S_IFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= syscall.S_IFLNK
+	case m.IsRegular():
+		mode |= syscall.S_IFREG
 	}
-	*/
-
-	fmt.Println("header written\n", header)
 
-	return nil
-}
\ No newline at end of file
+	return mode
+}
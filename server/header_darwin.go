@@ -0,0 +1,7 @@
+package server
+
+import "syscall"
+
+func statTimes(stat *syscall.Stat_t) (atime, mtime int64) {
+	return stat.Atimespec.Sec, stat.Mtimespec.Sec
+}
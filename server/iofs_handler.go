@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net/http"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/ear7h/r3stfs/sparse"
+)
+
+// IoFsHandler serves a read only io/fs.FS, like an embed.FS, a zip
+// archive or an os.DirFS snapshot, any write is answered with a
+// ReadOnlyError
+type IoFsHandler struct {
+	fsys fs.FS
+}
+
+func NewIoFsHandler(fsys fs.FS) *IoFsHandler {
+	return &IoFsHandler{fsys: fsys}
+}
+
+// io/fs names are unrooted and never empty
+func fsName(filename string) string {
+	name := strings.TrimPrefix(path.Clean("/"+filename), "/")
+	if name == "" {
+		return "."
+	}
+
+	return name
+}
+
+func (h *IoFsHandler) HandleHead(header http.Header, filename string) (os.FileInfo, error) {
+	return fs.Stat(h.fsys, fsName(filename))
+}
+
+func (h *IoFsHandler) HandleGet(header http.Header, filename string) (io.ReadCloser, error) {
+	name := fsName(filename)
+
+	stat, err := fs.Stat(h.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mode := stat.Mode(); mode & os.ModeType {
+	case 0: // file
+		return h.fsys.Open(name)
+
+	case os.ModeDir: // dir
+		dir, err := fs.ReadDir(h.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+
+		data := make(map[string]os.FileMode)
+		for _, node := range dir {
+			info, err := node.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			data[node.Name()] = info.Mode()
+		}
+
+		ret, err := jsonReader(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.NopCloser(ret), nil
+
+	default:
+		return nil, NewNotImplementedError("mode " + mode.String() + " not implemented")
+	}
+}
+
+func (h *IoFsHandler) HandlePut(header http.Header, filename string, body io.Reader) (int, error) {
+	return 0, NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandlePost(header http.Header, filename string, body io.Reader) (int, error) {
+	return 0, NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleDelete(header http.Header, filename string) (error) {
+	return NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleOptions(header http.Header, filename string) (io.ReadCloser, error) {
+	stat, err := fs.Stat(h.fsys, fsName(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	value := map[string]string{
+		"GET":    "response body contains file",
+		"HEAD":   "response header contains file attributes",
+		"POST":   "not allowed, read only",
+		"PUT":    "not allowed, read only",
+		"DELETE": "not allowed, read only",
+	}
+
+	if stat.IsDir() {
+		value["GET"] = "response body contains a json object with file keys and file mode values"
+	}
+
+	ret, err := jsonReader(value)
+
+	return ioutil.NopCloser(ret), err
+}
+
+func (h *IoFsHandler) HandleTruncate(header http.Header, filename string, size int64) error {
+	return NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleAllocate(header http.Header, filename string, offset, length int64, mode sparse.AllocMode) error {
+	return NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleRename(header http.Header, oldname, newname string) error {
+	return NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleSetAttr(header http.Header, filename string, attr Attr) error {
+	return NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleCopy(header http.Header, src, dst string, opts CopyOptions) error {
+	return NewReadOnlyError("read only file system")
+}
+
+// nothing is written, what there is stays
+func (h *IoFsHandler) HandleSync(header http.Header, filename string) error {
+	_, err := fs.Stat(h.fsys, fsName(filename))
+	return err
+}
+
+func (h *IoFsHandler) HandleGetXAttr(header http.Header, filename, attr string) ([]byte, error) {
+	_, err := fs.Stat(h.fsys, fsName(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, NewNoAttrError("no attribute " + attr)
+}
+
+func (h *IoFsHandler) HandleListXAttr(header http.Header, filename string) ([]string, error) {
+	_, err := fs.Stat(h.fsys, fsName(filename))
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{}, nil
+}
+
+func (h *IoFsHandler) HandleSetXAttr(header http.Header, filename, attr string, value []byte) error {
+	return NewReadOnlyError("read only file system")
+}
+
+func (h *IoFsHandler) HandleRemoveXAttr(header http.Header, filename, attr string) error {
+	return NewReadOnlyError("read only file system")
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestIoFsMount(t *testing.T) {
+	fsys := fstest.MapFS{
+		"hello.txt":     {Data: []byte("hello"), Mode: 0444},
+		"docs/index.md": {Data: []byte("# docs"), Mode: 0444},
+	}
+
+	mux := http.NewServeMux()
+	IoFsMount("/ro", fsys).mount(mux)
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/ro/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || string(body) != "hello" {
+		t.Errorf("GET file: %s %q", res.Status, body)
+	}
+	if res.Header.Get("Is-Dir") != "false" {
+		t.Errorf("GET file: Is-Dir %q", res.Header.Get("Is-Dir"))
+	}
+
+	res, err = http.Head(ts.URL + "/ro/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK || res.Header.Get("Is-Dir") != "true" {
+		t.Errorf("HEAD dir: %s Is-Dir %q", res.Status, res.Header.Get("Is-Dir"))
+	}
+
+	res, err = http.Get(ts.URL + "/ro/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing := make(map[string]os.FileMode)
+	err = json.NewDecoder(res.Body).Decode(&listing)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !listing["docs"].IsDir() || listing["hello.txt"] != 0444 {
+		t.Errorf("listing: %v", listing)
+	}
+
+	res, err = http.Get(ts.URL + "/ro/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET missing: %s", res.Status)
+	}
+
+	for _, method := range []string{http.MethodPut, http.MethodPost, http.MethodDelete} {
+		req, _ := http.NewRequest(method, ts.URL+"/ro/hello.txt", strings.NewReader("bye"))
+		req.Header.Set("File-Mode", "644")
+
+		res, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("%s: %s", method, res.Status)
+		}
+	}
+}
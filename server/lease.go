@@ -0,0 +1,434 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/lease"
+)
+
+/*
+the leases of the r3stfs api, see the lease package for the protocol.
+They are kept in memory, clients of a restarted server lost their
+streams and with them their leases
+
+the front ends sharing a R3stFsHandler share its table, writes over
+webdav, s3 and 9p recall the leases of rest clients like theirs do.
+Those front ends hold no leases themselves. The rest clients of
+different users are kept apart in it, their ids are prefixed with the
+user
+*/
+
+// the client of the front ends without leases, their accesses
+// conflict with the leases of every client
+const noLeaseClient = ""
+
+// recalls a client hasn't read yet, a client which falls this far
+// behind loses the leases instead
+const recallBacklog = 256
+
+type heldLease struct {
+	id       int64
+	client   string
+	kind     string
+	filename string
+	// the file as the client named it, for the recall
+	path     string
+	recalled bool
+	// closed once the lease is given back or broken
+	done chan struct{}
+}
+
+type leaseClient struct {
+	id      string
+	recalls chan lease.Recall
+	// closed when another stream of the same client replaces it
+	gone chan struct{}
+}
+
+type leaseTable struct {
+	mu      sync.Mutex
+	next    int64
+	leases  map[int64]*heldLease
+	files   map[string]map[int64]*heldLease
+	clients map[string]*leaseClient
+	// the writes in flight by file, a key ending in / stands for a
+	// write to the files under it
+	writes map[string]int
+}
+
+// the lease table of the front ends serving handler, a handler other
+// than a R3stFsHandler gets one of its own
+func leasesOf(handler FsHandler) *leaseTable {
+	if h, ok := handler.(*R3stFsHandler); ok {
+		return h.leaseTable()
+	}
+
+	return newLeaseTable()
+}
+
+func (h *R3stFsHandler) leaseTable() *leaseTable {
+	h.leasesOnce.Do(func() {
+		h.leases = newLeaseTable()
+	})
+
+	return h.leases
+}
+
+func newLeaseTable() *leaseTable {
+	return &leaseTable{
+		leases:  make(map[int64]*heldLease),
+		files:   make(map[string]map[int64]*heldLease),
+		clients: make(map[string]*leaseClient),
+		writes:  make(map[string]int),
+	}
+}
+
+// the recall stream of client id, a previous one is dropped with its
+// leases
+func (t *leaseTable) connect(id string) *leaseClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old := t.clients[id]; old != nil {
+		t.dropClient(old)
+	}
+
+	c := &leaseClient{
+		id:      id,
+		recalls: make(chan lease.Recall, recallBacklog),
+		gone:    make(chan struct{}),
+	}
+	t.clients[id] = c
+	return c
+}
+
+// the stream of c ended, its leases end with it
+func (t *leaseTable) disconnect(c *leaseClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients[c.id] == c {
+		t.dropClient(c)
+	}
+}
+
+// t.mu is held
+func (t *leaseTable) dropClient(c *leaseClient) {
+	delete(t.clients, c.id)
+	close(c.gone)
+
+	for _, l := range t.leases {
+		if l.client == c.id {
+			t.remove(l)
+		}
+	}
+}
+
+// t.mu is held
+func (t *leaseTable) remove(l *heldLease) {
+	if t.leases[l.id] != l {
+		return
+	}
+
+	delete(t.leases, l.id)
+	delete(t.files[l.filename], l.id)
+	if len(t.files[l.filename]) == 0 {
+		delete(t.files, l.filename)
+	}
+	close(l.done)
+}
+
+// the leases of other clients than client on filename which an access
+// conflicts with, with subtree those of the files under it too. t.mu
+// is held
+func (t *leaseTable) conflicts(client, filename string, subtree, write bool) []*heldLease {
+	var held []*heldLease
+	add := func(m map[int64]*heldLease) {
+		for _, l := range m {
+			if l.client != client && (write || l.kind == lease.Write) {
+				held = append(held, l)
+			}
+		}
+	}
+
+	add(t.files[filename])
+	if subtree {
+		prefix := strings.TrimSuffix(filename, "/") + "/"
+		for name, m := range t.files {
+			if strings.HasPrefix(name, prefix) {
+				add(m)
+			}
+		}
+	}
+
+	return held
+}
+
+// recall the leases an access of client to filename conflicts with
+// and wait until they are given back, or break them after
+// lease.RecallTimeout. Writes conflict with all leases, reads with
+// write leases, subtree covers the files under filename
+func (t *leaseTable) access(client, filename string, subtree, write bool) {
+	t.mu.Lock()
+	held := t.conflicts(client, filename, subtree, write)
+	for _, l := range held {
+		if l.recalled {
+			continue
+		}
+		l.recalled = true
+
+		select {
+		case t.clients[l.client].recalls <- lease.Recall{Path: l.path, ID: l.id}:
+		default:
+			t.remove(l)
+		}
+	}
+
+	// the client's own leases of files it removes or renames go
+	if subtree && write {
+		prefix := strings.TrimSuffix(filename, "/") + "/"
+		for _, l := range t.leases {
+			if l.client == client && (l.filename == filename || strings.HasPrefix(l.filename, prefix)) {
+				t.remove(l)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	if len(held) == 0 {
+		return
+	}
+
+	timer := time.NewTimer(lease.RecallTimeout)
+	defer timer.Stop()
+
+	for _, l := range held {
+		select {
+		case <-l.done:
+		case <-timer.C:
+			t.mu.Lock()
+			for _, l := range held {
+				t.remove(l)
+			}
+			t.mu.Unlock()
+			return
+		}
+	}
+}
+
+// begin a write of client to filename, with subtree to the files under
+// it too: the leases it conflicts with are recalled and none are
+// granted until the returned function ends the write
+func (t *leaseTable) write(client, filename string, subtree bool) func() {
+	key := filename
+	if subtree {
+		key = strings.TrimSuffix(filename, "/") + "/"
+	}
+
+	t.mu.Lock()
+	t.writes[key]++
+	t.mu.Unlock()
+
+	t.access(client, filename, subtree, true)
+
+	return func() {
+		t.mu.Lock()
+		t.writes[key]--
+		if t.writes[key] == 0 {
+			delete(t.writes, key)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// whether a write to filename or a directory above it is in flight.
+// t.mu is held
+func (t *leaseTable) writing(filename string) bool {
+	if t.writes[filename] > 0 {
+		return true
+	}
+
+	for dir := filename; ; dir = path.Dir(dir) {
+		if t.writes[strings.TrimSuffix(dir, "/")+"/"] > 0 {
+			return true
+		}
+		if dir == path.Dir(dir) {
+			return false
+		}
+	}
+}
+
+// a lease of kind on filename for client, nil if it can't have one.
+// The caller recalled the conflicting leases first
+func (t *leaseTable) grant(client, filename, path, kind string) *heldLease {
+	if kind != lease.Read && kind != lease.Write {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// without a stream the lease couldn't be recalled
+	if t.clients[client] == nil {
+		return nil
+	}
+
+	// another client was quicker, or a write would change the file
+	// under the lease
+	if t.writing(filename) || len(t.conflicts(client, filename, false, kind == lease.Write)) > 0 {
+		return nil
+	}
+
+	for _, l := range t.files[filename] {
+		if l.client != client {
+			continue
+		}
+		if l.kind == lease.Write || kind == lease.Read {
+			return l
+		}
+
+		// a read lease becomes a write lease
+		t.remove(l)
+		break
+	}
+
+	t.next++
+	l := &heldLease{
+		id:       t.next,
+		client:   client,
+		kind:     kind,
+		filename: filename,
+		path:     path,
+		done:     make(chan struct{}),
+	}
+
+	t.leases[l.id] = l
+	if t.files[filename] == nil {
+		t.files[filename] = make(map[int64]*heldLease)
+	}
+	t.files[filename][l.id] = l
+
+	return l
+}
+
+// client gives its lease id back
+func (t *leaseTable) release(client string, id int64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l := t.leases[id]
+	if l == nil || l.client != client {
+		return false
+	}
+
+	t.remove(l)
+	return true
+}
+
+// give back a lease granted for a request which failed
+func (t *leaseTable) releaseLease(l *heldLease) {
+	t.mu.Lock()
+	t.remove(l)
+	t.mu.Unlock()
+}
+
+// the lease client of a request, that of a user's wrapper is prefixed
+// with the user
+func (h *fsHandlerWrapper) leaseClient(r *http.Request) string {
+	id := r.Header.Get(lease.ClientHeader)
+	if id == "" || h.user == "" {
+		return id
+	}
+
+	return h.user + "/" + id
+}
+
+// GET /?leases streams the recalls of a client's leases
+func (h *fsHandlerWrapper) serveLeases(w http.ResponseWriter, r *http.Request) {
+	id := h.leaseClient(r)
+	if r.Method != http.MethodGet || id == "" {
+		http.Error(w, "leases need a GET with "+lease.ClientHeader, http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusNotImplemented)
+		return
+	}
+
+	c := h.leases.connect(id)
+	defer h.leases.disconnect(c)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(lease.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case rc := <-c.recalls:
+			err = enc.Encode(rc)
+		case <-heartbeat.C:
+			_, err = w.Write([]byte("\n"))
+		case <-c.gone:
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// DELETE /path?lease=ID gives a lease back
+func (h *fsHandlerWrapper) serveLeaseRelease(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("lease"), 10, 64)
+	if r.Method != http.MethodDelete || err != nil {
+		http.Error(w, "invalid lease release", http.StatusBadRequest)
+		return
+	}
+
+	if !h.leases.release(h.leaseClient(r), id) {
+		http.Error(w, "no such lease", http.StatusNotFound)
+	}
+}
+
+// recall the leases the ops of a batch conflict with, the returned
+// function ends its writes
+func (h *fsHandlerWrapper) batchAccess(client string, ops []batch.Op) func() {
+	var done []func()
+	for _, op := range ops {
+		switch op.Op {
+		case batch.Stat:
+			h.leases.access(client, h.filename(op.Path), false, false)
+		case batch.Delete, batch.Rename:
+			done = append(done, h.leases.write(client, h.filename(op.Path), true))
+			if op.To != "" {
+				done = append(done, h.leases.write(client, h.filename(op.To), true))
+			}
+		default:
+			done = append(done, h.leases.write(client, h.filename(op.Path), false))
+		}
+	}
+
+	return func() {
+		for _, f := range done {
+			f()
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/ear7h/r3stfs/lease"
+)
+
+func TestLeaseTable(t *testing.T) {
+	table := newLeaseTable()
+	a := table.connect("a")
+	b := table.connect("b")
+
+	// without a stream there are no leases
+	if l := table.grant("c", "/f", "/f", lease.Read); l != nil {
+		t.Fatalf("granted %v to a client without a stream", l)
+	}
+
+	// read leases are shared
+	ra := table.grant("a", "/f", "/f", lease.Read)
+	rb := table.grant("b", "/f", "/f", lease.Read)
+	if ra == nil || rb == nil {
+		t.Fatalf("read leases: %v %v", ra, rb)
+	}
+	if l := table.grant("a", "/f", "/f", lease.Read); l != ra {
+		t.Errorf("a's second read lease %v, want %v", l, ra)
+	}
+
+	// a write lease isn't
+	if l := table.grant("a", "/f", "/f", lease.Write); l != nil {
+		t.Fatalf("granted write lease %v besides b's read lease", l)
+	}
+
+	// a's write recalls b's lease and waits until it is given back
+	accessed := make(chan struct{})
+	go func() {
+		table.access("a", "/f", false, true)
+		close(accessed)
+	}()
+
+	select {
+	case rc := <-b.recalls:
+		if rc.ID != rb.id || rc.Path != "/f" {
+			t.Errorf("recall %v, want %d of /f", rc, rb.id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("b's lease wasn't recalled")
+	}
+
+	select {
+	case <-accessed:
+		t.Fatal("the write didn't wait for b's lease")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if !table.release("b", rb.id) {
+		t.Fatal("b couldn't give its lease back")
+	}
+	<-accessed
+
+	// a's own read lease becomes a write lease
+	wa := table.grant("a", "/f", "/f", lease.Write)
+	if wa == nil || wa.id == ra.id {
+		t.Fatalf("a's write lease %v", wa)
+	}
+	if table.leases[ra.id] != nil {
+		t.Error("a's read lease outlived its upgrade")
+	}
+
+	// reads of others conflict with it, removing the parent drops it
+	if l := table.grant("b", "/f", "/f", lease.Read); l != nil {
+		t.Errorf("granted read lease %v besides a's write lease", l)
+	}
+	table.access("a", "/", true, true)
+	if len(table.leases) != 0 {
+		t.Errorf("leases after a removed their directory: %v", table.leases)
+	}
+	select {
+	case rc := <-a.recalls:
+		t.Errorf("a was recalled %v for its own write", rc)
+	default:
+	}
+
+	// leases end with the stream
+	rb = table.grant("b", "/g", "/g", lease.Read)
+	table.disconnect(b)
+	select {
+	case <-rb.done:
+	default:
+		t.Error("b's lease outlived its stream")
+	}
+	if table.release("b", rb.id) {
+		t.Error("b gave back a lease it lost")
+	}
+
+	// as they do with a new stream of the same client
+	wa = table.grant("a", "/g", "/g", lease.Write)
+	table.connect("a")
+	select {
+	case <-a.gone:
+	default:
+		t.Error("a's old stream wasn't closed")
+	}
+	if table.leases[wa.id] != nil {
+		t.Error("a's lease outlived its stream")
+	}
+}
+
+func TestLeaseRename(t *testing.T) {
+	dirroot := t.TempDir()
+	err := os.MkdirAll(filepath.Join(dirroot, "d"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dirroot, "f"), []byte("f"), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &fsHandlerWrapper{
+		FsHandler: &R3stFsHandler{},
+		dirroot:   dirroot,
+		leases:    newLeaseTable(),
+	}
+	b := h.leases.connect("b")
+
+	// a rename recalls the leases under both of its ends
+	from := h.leases.grant("b", filepath.Join(dirroot, "f"), "/f", lease.Read)
+	to := h.leases.grant("b", filepath.Join(dirroot, "d/g/f"), "/d/g/f", lease.Read)
+	if from == nil || to == nil {
+		t.Fatalf("read leases: %v %v", from, to)
+	}
+
+	done := make(chan int)
+	go func() {
+		r := httptest.NewRequest(http.MethodPatch, "/f?op=rename&to=/d/g", nil)
+		r.Header.Set(lease.ClientHeader, "a")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		done <- w.Code
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case rc := <-b.recalls:
+			h.leases.release("b", rc.ID)
+		case <-time.After(time.Second):
+			t.Fatalf("%d of b's leases were recalled, want 2", i)
+		}
+	}
+
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("rename answered %d", code)
+	}
+}
+
+func TestLeaseWrites(t *testing.T) {
+	table := newLeaseTable()
+	table.connect("b")
+
+	// no leases are granted on files a write in flight changes
+	file := table.write("a", "/f", false)
+	dir := table.write("a", "/d", true)
+
+	for _, name := range []string{"/f", "/d", "/d/e/f"} {
+		if l := table.grant("b", name, name, lease.Read); l != nil {
+			t.Errorf("granted %v during a write to %s", l, name)
+		}
+	}
+	if l := table.grant("b", "/g", "/g", lease.Read); l == nil {
+		t.Error("a write to another file kept /g from a lease")
+	}
+
+	file()
+	dir()
+	if l := table.grant("b", "/d/e/f", "/d/e/f", lease.Read); l == nil {
+		t.Error("no lease after the writes ended")
+	}
+	if len(table.writes) != 0 {
+		t.Errorf("writes after they ended: %v", table.writes)
+	}
+}
+
+func TestLeaseFrontEnds(t *testing.T) {
+	dirroot := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dirroot, "f"), []byte("f"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := &R3stFsHandler{}
+	table := handler.leaseTable()
+	if leasesOf(handler) != table {
+		t.Fatal("the front ends of a handler don't share its leases")
+	}
+
+	b := table.connect("julio/b")
+	filename := filepath.Join(dirroot, "f")
+	if table.grant("julio/b", filename, "/f", lease.Read) == nil {
+		t.Fatal("no read lease")
+	}
+
+	// a webdav write recalls the lease and holds off new ones until
+	// the file is closed
+	fs := davFS{webdav.Dir(dirroot), handler}
+	opened := make(chan webdav.File)
+	go func() {
+		f, err := fs.OpenFile(context.Background(), "/f", os.O_WRONLY|os.O_TRUNC, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- f
+	}()
+
+	select {
+	case rc := <-b.recalls:
+		table.release("julio/b", rc.ID)
+	case <-time.After(time.Second):
+		t.Fatal("the lease wasn't recalled")
+	}
+
+	f := <-opened
+	if l := table.grant("julio/b", filename, "/f", lease.Read); l != nil {
+		t.Errorf("granted %v while webdav writes the file", l)
+	}
+	f.Close()
+	if table.grant("julio/b", filename, "/f", lease.Read) == nil {
+		t.Error("no read lease after the file was closed")
+	}
+
+	// the clients of a user's requests are the user's
+	h := &fsHandlerWrapper{user: "julio"}
+	r := httptest.NewRequest(http.MethodGet, "/f", nil)
+	r.Header.Set(lease.ClientHeader, "b")
+	if id := h.leaseClient(r); id != "julio/b" {
+		t.Errorf("lease client %q, want julio/b", id)
+	}
+}
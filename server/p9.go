@@ -0,0 +1,1344 @@
+package server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ear7h/r3stfs/p9"
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+/*
+the 9p server exports each user's sandbox root over 9P2000.L, for
+the v9fs client of linux and 9p clients in go
+
+mount -t 9p -o trans=tcp,port=5640,version=9p2000.L,uname=julio,access=any host /mnt
+
+attaches pick the user's store with uname, aname may name a
+directory in it to serve instead of the root. With a UserDB attaches
+need an afid the user's secret was written to, v9fs doesn't do
+authentication so those servers are for go clients. Without one
+anyone who reaches the listener attaches as any user, the listener
+should be a unix socket or on a trusted network
+
+the files the rest handlers keep next to a user's files are hidden
+and move with the files, like in the webdav mount. Changes recall the
+leases rest clients hold, those of a file opened to write until its
+fid is clunked.
+
+a file opened to truncate it, or created, is written to a temporary
+which is renamed over it when the fid is clunked or synced, see
+upload.go. Until then other fids read what it had, and a file removed
+or renamed by another client meanwhile doesn't come back. Changes take
+the path locks of the rest handlers, see pathlock.go, writes to a
+file in place each hold it alone. Symlinks,
+devices, hard links, extended attributes and locks are not supported
+*/
+
+// the largest message of a connection, a Twrite of a megabyte
+const p9MaxMsize = 1<<20 + p9.IOHeaderSize
+
+type P9Server struct {
+	users   *sandbox.UserStore
+	handler *R3stFsHandler
+	leases  *leaseTable
+	db      *UserDB
+}
+
+// NewP9Server serves the stores in users sharing the leases of
+// handler with the other front ends, db may be nil to attach without
+// authentication
+func NewP9Server(users *sandbox.UserStore, handler *R3stFsHandler, db *UserDB) *P9Server {
+	return &P9Server{users: users, handler: handler, leases: handler.leaseTable(), db: db}
+}
+
+// ServeP9 listens on the network address and serves 9p connections
+func ServeP9(network, addr string, users *sandbox.UserStore, handler *R3stFsHandler, db *UserDB) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+
+	return NewP9Server(users, handler, db).Serve(l)
+}
+
+// Serve 9p connections accepted from l until it fails
+func (s *P9Server) Serve(l net.Listener) error {
+	defer l.Close()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// a file of a connection
+type p9Fid struct {
+	// the directory the fid was attached to, walks don't leave it
+	root string
+	path string
+
+	// set by Tlopen and Tlcreate
+	file   *os.File
+	append bool
+	// the temporary file writes to, put in place of path at the clunk
+	tmp string
+	// ends the write of a file opened to write
+	done func()
+	// entries of an open directory, read at offset 0
+	dirents []p9.Dirent
+
+	// set for the afids of Tauth
+	auth *p9Auth
+}
+
+type p9Auth struct {
+	user   string
+	secret []byte
+}
+
+type p9Conn struct {
+	srv  *P9Server
+	conn net.Conn
+
+	msize uint32
+
+	// replies are written whole by one request at a time
+	wlock sync.Mutex
+
+	lock sync.Mutex
+	fids map[uint32]*p9Fid
+	// requests being handled, closed once they are answered
+	inflight map[uint16]chan struct{}
+}
+
+func (s *P9Server) serveConn(conn net.Conn) {
+	c := &p9Conn{
+		srv:      s,
+		conn:     conn,
+		msize:    p9MaxMsize,
+		fids:     make(map[uint32]*p9Fid),
+		inflight: make(map[uint16]chan struct{}),
+	}
+
+	defer func() {
+		conn.Close()
+		c.clunkAll()
+	}()
+
+	for {
+		tag, m, err := p9.ReadMsg(conn, c.msize)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("9p %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+
+		switch m := m.(type) {
+		case *p9.Tversion:
+			// a new session, the requests of the old one are done
+			c.wait()
+			c.reply(tag, c.version(m))
+		case *p9.Tflush:
+			c.lock.Lock()
+			done, ok := c.inflight[m.OldTag]
+			c.lock.Unlock()
+
+			// the flushed request answers first, there is no
+			// canceling a system call
+			go func() {
+				if ok {
+					<-done
+				}
+				c.reply(tag, &p9.Rflush{})
+			}()
+		default:
+			done := make(chan struct{})
+
+			c.lock.Lock()
+			c.inflight[tag] = done
+			c.lock.Unlock()
+
+			go func() {
+				c.reply(tag, c.handle(m))
+
+				c.lock.Lock()
+				delete(c.inflight, tag)
+				c.lock.Unlock()
+				close(done)
+			}()
+		}
+	}
+}
+
+func (c *p9Conn) reply(tag uint16, m p9.Msg) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	err := p9.WriteMsg(c.conn, tag, m)
+	if err != nil {
+		log.Printf("9p %s: %v", c.conn.RemoteAddr(), err)
+	}
+}
+
+// wait for the requests being handled
+func (c *p9Conn) wait() {
+	c.lock.Lock()
+	var pending []chan struct{}
+	for _, done := range c.inflight {
+		pending = append(pending, done)
+	}
+	c.lock.Unlock()
+
+	for _, done := range pending {
+		<-done
+	}
+}
+
+func (c *p9Conn) clunkAll() {
+	c.wait()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for fid, f := range c.fids {
+		c.close(f)
+		delete(c.fids, fid)
+	}
+}
+
+func (c *p9Conn) version(m *p9.Tversion) p9.Msg {
+	c.clunkAll()
+
+	if m.Msize < c.msize {
+		c.msize = m.Msize
+	}
+
+	if m.Version != p9.Version {
+		return &p9.Rversion{Msize: c.msize, Version: "unknown"}
+	}
+
+	return &p9.Rversion{Msize: c.msize, Version: p9.Version}
+}
+
+func (c *p9Conn) handle(m p9.Msg) p9.Msg {
+	var ret p9.Msg
+	var err error
+
+	switch m := m.(type) {
+	case *p9.Tauth:
+		ret, err = c.auth(m)
+	case *p9.Tattach:
+		ret, err = c.attach(m)
+	case *p9.Twalk:
+		ret, err = c.walk(m)
+	case *p9.Tclunk:
+		err = c.clunk(m.Fid)
+		ret = &p9.Rclunk{}
+	case *p9.Tremove:
+		ret, err = c.remove(m)
+	case *p9.Tgetattr:
+		ret, err = c.getattr(m)
+	case *p9.Tsetattr:
+		ret, err = c.setattr(m)
+	case *p9.Tstatfs:
+		ret, err = c.statfs(m)
+	case *p9.Tlopen:
+		ret, err = c.open(m)
+	case *p9.Tlcreate:
+		ret, err = c.create(m)
+	case *p9.Tmkdir:
+		ret, err = c.mkdir(m)
+	case *p9.Tread:
+		ret, err = c.read(m)
+	case *p9.Twrite:
+		ret, err = c.write(m)
+	case *p9.Treaddir:
+		ret, err = c.readdir(m)
+	case *p9.Tfsync:
+		ret, err = c.fsync(m)
+	case *p9.Treadlink:
+		ret, err = c.readlink(m)
+	case *p9.Trename:
+		ret, err = c.rename(m)
+	case *p9.Trenameat:
+		ret, err = c.renameat(m)
+	case *p9.Tunlinkat:
+		ret, err = c.unlinkat(m)
+	default:
+		err = p9.EOPNOTSUPP
+	}
+
+	if err != nil {
+		return &p9.Rlerror{Ecode: p9Errno(err)}
+	}
+
+	return ret
+}
+
+func (c *p9Conn) fid(fid uint32) (*p9Fid, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	f, ok := c.fids[fid]
+	if !ok {
+		return nil, p9.EBADF
+	}
+
+	return f, nil
+}
+
+// a fid of a directory, to make or remove files in
+func (c *p9Conn) dirFid(fid uint32) (*p9Fid, error) {
+	f, err := c.fid(fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil {
+		return nil, p9.EBADF
+	}
+
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, p9.ENOTDIR
+	}
+
+	return f, nil
+}
+
+// add a fid, the number must be unused
+func (c *p9Conn) newFid(fid uint32, f *p9Fid) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.fids[fid]; ok || fid == p9.NoFid {
+		return p9.EBADF
+	}
+
+	c.fids[fid] = f
+	return nil
+}
+
+func (c *p9Conn) auth(m *p9.Tauth) (p9.Msg, error) {
+	if c.srv.db == nil {
+		return nil, p9.EOPNOTSUPP
+	}
+
+	if _, ok := c.srv.db.Secret(m.Uname); !ok {
+		return nil, p9.EACCES
+	}
+
+	err := c.newFid(m.Afid, &p9Fid{auth: &p9Auth{user: m.Uname}})
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rauth{Aqid: p9.Qid{Type: p9.QTAuth}}, nil
+}
+
+func (c *p9Conn) attach(m *p9.Tattach) (p9.Msg, error) {
+	if c.srv.db != nil {
+		af, err := c.fid(m.Afid)
+		if err != nil || af.auth == nil || af.auth.user != m.Uname {
+			return nil, p9.EACCES
+		}
+
+		secret, _ := c.srv.db.Secret(m.Uname)
+		if subtle.ConstantTimeCompare([]byte(secret), af.auth.secret) != 1 {
+			return nil, p9.EACCES
+		}
+	}
+
+	if m.Uname == "" || strings.Contains(m.Uname, "/") || m.Uname == "." || m.Uname == ".." {
+		return nil, p9.EACCES
+	}
+
+	store, err := c.srv.users.User(m.Uname)
+	if err != nil {
+		return nil, p9.EACCES
+	}
+
+	root := store.Abs(path.Clean("/" + m.Aname))
+	if isReserved(root) {
+		return nil, p9.ENOENT
+	}
+
+	fi, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, p9.ENOTDIR
+	}
+
+	err = c.newFid(m.Fid, &p9Fid{root: root, path: root})
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rattach{Qid: p9Qid(fi)}, nil
+}
+
+func (c *p9Conn) walk(m *p9.Twalk) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil || f.file != nil {
+		return nil, p9.EBADF
+	}
+
+	p := f.path
+	qids := []p9.Qid{}
+
+	for i, name := range m.Names {
+		switch {
+		case name == "..":
+			if p != f.root {
+				p = path.Dir(p)
+			}
+		case name == ".":
+		case validName(name) != nil:
+			err = p9.ENOENT
+		default:
+			p = path.Join(p, name)
+		}
+
+		var fi os.FileInfo
+		if err == nil {
+			fi, err = os.Lstat(p)
+		}
+		if err != nil {
+			// the walk stops at the first name missing
+			if i == 0 {
+				return nil, err
+			}
+			return &p9.Rwalk{Qids: qids}, nil
+		}
+
+		qids = append(qids, p9Qid(fi))
+
+		// symlinks are resolved by the client, walking through
+		// one would leave the store
+		if fi.Mode()&os.ModeSymlink != 0 && i < len(m.Names)-1 {
+			return &p9.Rwalk{Qids: qids}, nil
+		}
+	}
+
+	nf := &p9Fid{root: f.root, path: p}
+	if m.NewFid == m.Fid {
+		c.lock.Lock()
+		c.fids[m.Fid] = nf
+		c.lock.Unlock()
+	} else {
+		err = c.newFid(m.NewFid, nf)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &p9.Rwalk{Qids: qids}, nil
+}
+
+func (c *p9Conn) clunk(fid uint32) error {
+	c.lock.Lock()
+	f, ok := c.fids[fid]
+	delete(c.fids, fid)
+	c.lock.Unlock()
+
+	if !ok {
+		return p9.EBADF
+	}
+
+	return c.close(f)
+}
+
+// close the file of f, putting its temporary in place and ending its
+// write
+func (c *p9Conn) close(f *p9Fid) error {
+	if f.done != nil {
+		defer f.done()
+	}
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	if f.tmp == "" {
+		return err
+	}
+
+	if err == nil {
+		err = c.commit(f.path, f.tmp)
+	}
+	if err != nil {
+		os.Remove(f.tmp)
+	}
+
+	return err
+}
+
+// put tmp in place of filename, unless filename was removed or renamed
+// since it was opened
+func (c *p9Conn) commit(filename, tmp string) error {
+	_, err := os.Lstat(filename)
+	switch {
+	case os.IsNotExist(err):
+		// like the content of an unlinked file it is gone
+		os.Remove(tmp)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	return c.srv.handler.replace(filename, tmp)
+}
+
+// open a temporary to write filename anew in, nil for a file which
+// isn't regular. fi is filename's
+func (c *p9Conn) openTemp(filename string) (file *os.File, fi os.FileInfo, err error) {
+	fi, err = os.Lstat(filename)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil, fi, err
+	}
+
+	file, err = c.srv.handler.openTemp(filename, fi.Mode().Perm())
+	return file, fi, err
+}
+
+func (c *p9Conn) remove(m *p9.Tremove) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.auth == nil && f.path != f.root {
+		fi, e := os.Lstat(f.path)
+		if e == nil {
+			e = c.unlink(f.path, fi.IsDir())
+		}
+		err = e
+	} else {
+		err = p9.EACCES
+	}
+
+	c.clunk(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rremove{}, nil
+}
+
+func (c *p9Conn) getattr(m *p9.Tgetattr) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil {
+		return nil, p9.EBADF
+	}
+
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	attr := p9Attr(fi)
+
+	// a file written anew has the size and times of what was written,
+	// and keeps its qid
+	c.lock.Lock()
+	file, tmp := f.file, f.tmp
+	c.lock.Unlock()
+
+	if tmp != "" {
+		fi, err = file.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		qid := attr.Qid
+		attr = p9Attr(fi)
+		attr.Qid = qid
+	}
+
+	return attr, nil
+}
+
+func (c *p9Conn) setattr(m *p9.Tsetattr) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil {
+		return nil, p9.EBADF
+	}
+
+	defer c.srv.leases.write(noLeaseClient, f.path, false)()
+	defer c.srv.handler.locks.write(f.path)()
+
+	if m.Valid&p9.SetattrMode != 0 {
+		err = os.Chmod(f.path, os.FileMode(m.Mode&0777))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Valid&(p9.SetattrUid|p9.SetattrGid) != 0 {
+		uid, gid := -1, -1
+		if m.Valid&p9.SetattrUid != 0 {
+			uid = int(m.Uid)
+		}
+		if m.Valid&p9.SetattrGid != 0 {
+			gid = int(m.Gid)
+		}
+
+		err = os.Lchown(f.path, uid, gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// a file written anew has the size and times of its temporary,
+	// which keeps what it had but those
+	c.lock.Lock()
+	target := f.path
+	if f.tmp != "" {
+		target = f.tmp
+	}
+	c.lock.Unlock()
+
+	if m.Valid&p9.SetattrSize != 0 {
+		err = os.Truncate(target, int64(m.Size))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.Valid&(p9.SetattrAtime|p9.SetattrMtime) != 0 {
+		fi, err := os.Lstat(target)
+		if err != nil {
+			return nil, err
+		}
+
+		// darwin has no UTIME_OMIT, the times left alone are set
+		// to what they are
+		attr, now := p9Attr(fi), time.Now().UnixNano()
+		ts := []unix.Timespec{
+			p9Time(m.Valid, p9.SetattrAtime, p9.SetattrAtimeSet, m.AtimeSec, m.AtimeNsec, attr.AtimeSec, attr.AtimeNsec, now),
+			p9Time(m.Valid, p9.SetattrMtime, p9.SetattrMtimeSet, m.MtimeSec, m.MtimeNsec, attr.MtimeSec, attr.MtimeNsec, now),
+		}
+
+		err = unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &p9.Rsetattr{}, nil
+}
+
+// a time of Tsetattr, left at cur, set to now or set to sec and nsec
+func p9Time(valid, bit, setBit uint32, sec, nsec, curSec, curNsec uint64, now int64) unix.Timespec {
+	switch {
+	case valid&bit == 0:
+		sec, nsec = curSec, curNsec
+	case valid&setBit == 0:
+		return unix.NsecToTimespec(now)
+	}
+
+	return unix.NsecToTimespec(int64(sec)*1e9 + int64(nsec))
+}
+
+func (c *p9Conn) statfs(m *p9.Tstatfs) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil {
+		return nil, p9.EBADF
+	}
+
+	return p9Statfs(f.path)
+}
+
+func (c *p9Conn) open(m *p9.Tlopen) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil || f.file != nil {
+		return nil, p9.EBADF
+	}
+
+	flags := p9OpenFlags(m.Flags) &^ os.O_CREATE
+
+	done := func() {}
+	if flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC) != 0 {
+		done = c.srv.leases.write(noLeaseClient, f.path, false)
+	} else {
+		c.srv.leases.access(noLeaseClient, f.path, false, false)
+	}
+
+	// a truncated file is written anew
+	var file *os.File
+	var fi os.FileInfo
+	if flags&os.O_TRUNC != 0 && flags&(os.O_WRONLY|os.O_RDWR) != 0 {
+		file, fi, err = c.openTemp(f.path)
+	}
+	tmp := ""
+	switch {
+	case err != nil:
+	case file != nil:
+		tmp = file.Name()
+	default:
+		unlock := c.srv.handler.locks.read(f.path)
+		file, err = os.OpenFile(f.path, flags, 0)
+		unlock()
+		if err == nil {
+			fi, err = file.Stat()
+			if err != nil {
+				file.Close()
+			}
+		}
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	c.lock.Lock()
+	f.file, f.append, f.tmp, f.done = file, m.Flags&p9.OAppend != 0, tmp, done
+	c.lock.Unlock()
+
+	return &p9.Rlopen{Qid: p9Qid(fi), Iounit: c.msize - p9.IOHeaderSize}, nil
+}
+
+func (c *p9Conn) create(m *p9.Tlcreate) (p9.Msg, error) {
+	f, err := c.dirFid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.file != nil {
+		return nil, p9.EBADF
+	}
+
+	err = validName(m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := path.Join(f.path, m.Name)
+	done := c.srv.leases.write(noLeaseClient, p, false)
+
+	// the name is made here, what is written to it is written anew
+	// unless it had content which isn't truncated
+	flags := p9OpenFlags(m.Flags) | os.O_CREATE
+	unlock := c.srv.handler.locks.write(p)
+	file, err := os.OpenFile(p, flags&^os.O_TRUNC, os.FileMode(m.Mode&0777))
+	unlock()
+	if err != nil {
+		done()
+		return nil, err
+	}
+
+	fi, err := file.Stat()
+	tmp := ""
+	if err == nil && flags&(os.O_WRONLY|os.O_RDWR) != 0 && fi.Mode().IsRegular() && (fi.Size() == 0 || flags&os.O_TRUNC != 0) {
+		var t *os.File
+		t, err = c.srv.handler.openTemp(p, fi.Mode().Perm())
+		if err == nil {
+			file.Close()
+			file, tmp = t, t.Name()
+		}
+	}
+	if err != nil {
+		file.Close()
+		done()
+		return nil, err
+	}
+
+	// the fid is now the new file
+	c.lock.Lock()
+	f.path, f.file, f.append, f.tmp, f.done = p, file, m.Flags&p9.OAppend != 0, tmp, done
+	c.lock.Unlock()
+
+	return &p9.Rlcreate{Qid: p9Qid(fi), Iounit: c.msize - p9.IOHeaderSize}, nil
+}
+
+func (c *p9Conn) mkdir(m *p9.Tmkdir) (p9.Msg, error) {
+	f, err := c.dirFid(m.Dfid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validName(m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	p := path.Join(f.path, m.Name)
+	defer c.srv.leases.write(noLeaseClient, p, false)()
+	defer c.srv.handler.locks.write(p)()
+
+	err = os.Mkdir(p, os.FileMode(m.Mode&0777))
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rmkdir{Qid: p9Qid(fi)}, nil
+}
+
+func (c *p9Conn) read(m *p9.Tread) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing to read from an afid
+	if f.auth != nil {
+		return &p9.Rread{}, nil
+	}
+	if f.file == nil {
+		return nil, p9.EBADF
+	}
+	if m.Count > c.msize-p9.IOHeaderSize {
+		m.Count = c.msize - p9.IOHeaderSize
+	}
+
+	buf := make([]byte, m.Count)
+	n, err := f.file.ReadAt(buf, int64(m.Offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return &p9.Rread{Data: buf[:n]}, nil
+}
+
+func (c *p9Conn) write(m *p9.Twrite) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.auth != nil {
+		c.lock.Lock()
+		f.auth.secret = append(f.auth.secret, m.Data...)
+		c.lock.Unlock()
+		return &p9.Rwrite{Count: uint32(len(m.Data))}, nil
+	}
+	if f.file == nil {
+		return nil, p9.EBADF
+	}
+
+	// a file written in place is held alone, a temporary is the fid's
+	c.lock.Lock()
+	tmp := f.tmp
+	c.lock.Unlock()
+	if tmp == "" {
+		defer c.srv.handler.locks.write(f.path)()
+	}
+
+	var n int
+	if f.append {
+		// WriteAt refuses files opened to append
+		n, err = f.file.Write(m.Data)
+	} else {
+		n, err = f.file.WriteAt(m.Data, int64(m.Offset))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rwrite{Count: uint32(n)}, nil
+}
+
+func (c *p9Conn) readdir(m *p9.Treaddir) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.file == nil {
+		return nil, p9.EBADF
+	}
+
+	c.lock.Lock()
+	dirents := f.dirents
+	c.lock.Unlock()
+
+	// the listing is read again when it starts over
+	if m.Offset == 0 || dirents == nil {
+		dirents, err = c.listDir(f)
+		if err != nil {
+			return nil, err
+		}
+
+		c.lock.Lock()
+		f.dirents = dirents
+		c.lock.Unlock()
+	}
+
+	if m.Count > c.msize-p9.IOHeaderSize {
+		m.Count = c.msize - p9.IOHeaderSize
+	}
+
+	var data []byte
+	for i := int(m.Offset); i < len(dirents); i++ {
+		if len(data)+p9.DirentSize(dirents[i]) > int(m.Count) {
+			break
+		}
+		data = p9.AppendDirent(data, dirents[i])
+	}
+
+	return &p9.Rreaddir{Data: data}, nil
+}
+
+// the entries of the directory of f, the offset of an entry is its
+// index plus one
+func (c *p9Conn) listDir(f *p9Fid) ([]p9.Dirent, error) {
+	_, err := f.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := f.file.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	self, err := f.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	parent := self
+	if f.path != f.root {
+		parent, err = os.Lstat(path.Dir(f.path))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dirents := []p9.Dirent{
+		p9Dirent(".", self),
+		p9Dirent("..", parent),
+	}
+	for _, fi := range fis {
+		if !isReserved(fi.Name()) {
+			dirents = append(dirents, p9Dirent(fi.Name(), fi))
+		}
+	}
+
+	for i := range dirents {
+		dirents[i].Offset = uint64(i + 1)
+	}
+
+	return dirents, nil
+}
+
+func (c *p9Conn) fsync(m *p9.Tfsync) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.file == nil {
+		return nil, p9.EBADF
+	}
+
+	err = f.file.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	// what was written anew is put in place, on the disk too. Later
+	// writes change the file in place
+	c.lock.Lock()
+	tmp := f.tmp
+	f.tmp = ""
+	c.lock.Unlock()
+
+	if tmp != "" {
+		err = c.commit(f.path, tmp)
+		if err != nil {
+			// the clunk tries again
+			c.lock.Lock()
+			f.tmp = tmp
+			c.lock.Unlock()
+			return nil, err
+		}
+
+		err = syncDir(path.Dir(f.path))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &p9.Rfsync{}, nil
+}
+
+func (c *p9Conn) readlink(m *p9.Treadlink) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil {
+		return nil, p9.EBADF
+	}
+
+	target, err := os.Readlink(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rreadlink{Target: target}, nil
+}
+
+func (c *p9Conn) rename(m *p9.Trename) (p9.Msg, error) {
+	f, err := c.fid(m.Fid)
+	if err != nil {
+		return nil, err
+	}
+	if f.auth != nil || f.path == f.root {
+		return nil, p9.EBADF
+	}
+
+	dir, err := c.dirFid(m.Dfid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validName(m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.move(f.path, path.Join(dir.path, m.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rrename{}, nil
+}
+
+func (c *p9Conn) renameat(m *p9.Trenameat) (p9.Msg, error) {
+	olddir, err := c.dirFid(m.OldDirFid)
+	if err != nil {
+		return nil, err
+	}
+
+	newdir, err := c.dirFid(m.NewDirFid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range []string{m.OldName, m.NewName} {
+		err = validName(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.move(path.Join(olddir.path, m.OldName), path.Join(newdir.path, m.NewName))
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rrenameat{}, nil
+}
+
+// rename a file and the fids walked to it or into it
+func (c *p9Conn) move(oldname, newname string) error {
+	defer c.srv.leases.write(noLeaseClient, oldname, true)()
+	defer c.srv.leases.write(noLeaseClient, newname, true)()
+
+	err := c.srv.handler.rename(oldname, newname)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, f := range c.fids {
+		if f.path == oldname || strings.HasPrefix(f.path, oldname+"/") {
+			f.path = newname + strings.TrimPrefix(f.path, oldname)
+		}
+		// temporaries move with their directory
+		if strings.HasPrefix(f.tmp, oldname+"/") {
+			f.tmp = newname + strings.TrimPrefix(f.tmp, oldname)
+		}
+	}
+
+	return nil
+}
+
+func (c *p9Conn) unlinkat(m *p9.Tunlinkat) (p9.Msg, error) {
+	dir, err := c.dirFid(m.DirFid)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validName(m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.unlink(path.Join(dir.path, m.Name), m.Flags&p9.AtRemoveDir != 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Runlinkat{}, nil
+}
+
+// removeFile holding the lock of filename, after its leases were
+// recalled
+func (c *p9Conn) unlink(filename string, isDir bool) error {
+	defer c.srv.leases.write(noLeaseClient, filename, true)()
+	defer c.srv.handler.locks.write(filename)()
+
+	return removeFile(filename, isDir)
+}
+
+// remove a file or an empty directory, and the files the server
+// keeps for it. A directory holding only those is empty to clients
+func removeFile(filename string, isDir bool) error {
+	if isDir {
+		names, err := readDirNames(filename)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if !isReserved(name) {
+				return p9.ENOTEMPTY
+			}
+		}
+
+		for _, name := range names {
+			os.RemoveAll(path.Join(filename, name))
+		}
+
+		err = syscall.Rmdir(filename)
+		if err != nil {
+			return &os.PathError{Op: "rmdir", Path: filename, Err: err}
+		}
+	} else {
+		err := syscall.Unlink(filename)
+		if err != nil {
+			return &os.PathError{Op: "unlink", Path: filename, Err: err}
+		}
+	}
+
+	// attributes go with the file
+	os.Remove(sidecarName(filename))
+	return nil
+}
+
+func readDirNames(dirname string) ([]string, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdirnames(-1)
+}
+
+// names made or walked to are single path elements and can't be the
+// server's files
+func validName(name string) error {
+	switch {
+	case name == "" || name == "." || name == ".." || strings.Contains(name, "/"):
+		return p9.EINVAL
+	case isReserved(name):
+		return p9.EACCES
+	}
+
+	return nil
+}
+
+func p9Qid(fi os.FileInfo) p9.Qid {
+	qid := p9.Qid{
+		// changes with the file, clients with caches check it
+		Version: uint32(fi.ModTime().UnixNano()) ^ uint32(fi.Size()),
+	}
+
+	switch {
+	case fi.IsDir():
+		qid.Type = p9.QTDir
+	case fi.Mode()&os.ModeSymlink != 0:
+		qid.Type = p9.QTSymlink
+	}
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		qid.Path = uint64(stat.Ino)
+	}
+
+	return qid
+}
+
+func p9Dirent(name string, fi os.FileInfo) p9.Dirent {
+	qid := p9Qid(fi)
+
+	// the d_type of the entry
+	typ := uint8(unix.DT_REG)
+	switch {
+	case fi.IsDir():
+		typ = unix.DT_DIR
+	case fi.Mode()&os.ModeSymlink != 0:
+		typ = unix.DT_LNK
+	}
+
+	return p9.Dirent{Qid: qid, Type: typ, Name: name}
+}
+
+// the attributes of a file, the fields of the stat call are set by
+// p9StatAttr
+func p9Attr(fi os.FileInfo) *p9.Rgetattr {
+	attr := &p9.Rgetattr{
+		Valid:     p9.GetattrBasic,
+		Qid:       p9Qid(fi),
+		Mode:      unixMode(fi.Mode()),
+		Nlink:     1,
+		Size:      uint64(fi.Size()),
+		MtimeSec:  uint64(fi.ModTime().Unix()),
+		MtimeNsec: uint64(fi.ModTime().Nanosecond()),
+	}
+
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		p9StatAttr(attr, stat)
+	}
+
+	return attr
+}
+
+// open flags of 9P2000.L, they are linux's, to the system's
+func p9OpenFlags(flags uint32) int {
+	var ret int
+
+	switch flags & p9.OAccMode {
+	case p9.OWronly:
+		ret = os.O_WRONLY
+	case p9.ORdwr:
+		ret = os.O_RDWR
+	default:
+		ret = os.O_RDONLY
+	}
+
+	for bit, flag := range map[uint32]int{
+		p9.OCreate: os.O_CREATE,
+		p9.OExcl:   os.O_EXCL,
+		p9.OTrunc:  os.O_TRUNC,
+		p9.OAppend: os.O_APPEND,
+	} {
+		if flags&bit != 0 {
+			ret |= flag
+		}
+	}
+
+	// the fid may be a symlink, the client resolves those
+	return ret | syscall.O_NOFOLLOW
+}
+
+// the linux errno of an error
+func p9Errno(err error) p9.Errno {
+	var p9err p9.Errno
+	if errors.As(err, &p9err) {
+		return p9err
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		switch {
+		case os.IsNotExist(err):
+			return p9.ENOENT
+		case os.IsExist(err):
+			return p9.EEXIST
+		case os.IsPermission(err):
+			return p9.EACCES
+		}
+
+		return p9.EIO
+	}
+
+	// the same errno as EOPNOTSUPP on linux, not on darwin
+	if errno == syscall.ENOTSUP {
+		return p9.EOPNOTSUPP
+	}
+
+	switch errno {
+	case syscall.EPERM:
+		return p9.EPERM
+	case syscall.ENOENT:
+		return p9.ENOENT
+	case syscall.EBADF:
+		return p9.EBADF
+	case syscall.EAGAIN:
+		return p9.EAGAIN
+	case syscall.EACCES:
+		return p9.EACCES
+	case syscall.EBUSY:
+		return p9.EBUSY
+	case syscall.EEXIST:
+		return p9.EEXIST
+	case syscall.EXDEV:
+		return p9.EXDEV
+	case syscall.ENOTDIR:
+		return p9.ENOTDIR
+	case syscall.EISDIR:
+		return p9.EISDIR
+	case syscall.EINVAL:
+		return p9.EINVAL
+	case syscall.EFBIG:
+		return p9.EFBIG
+	case syscall.ENOSPC:
+		return p9.ENOSPC
+	case syscall.EROFS:
+		return p9.EROFS
+	case syscall.EMLINK:
+		return p9.EMLINK
+	case syscall.ERANGE:
+		return p9.ERANGE
+	case syscall.ENAMETOOLONG:
+		return p9.ENAMETOOLONG
+	case syscall.ENOSYS:
+		return p9.ENOSYS
+	case syscall.ENOTEMPTY:
+		return p9.ENOTEMPTY
+	case syscall.ELOOP:
+		return p9.ELOOP
+	case syscall.EOPNOTSUPP:
+		return p9.EOPNOTSUPP
+	case syscall.EDQUOT:
+		return p9.EDQUOT
+	}
+
+	return p9.EIO
+}
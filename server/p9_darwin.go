@@ -0,0 +1,40 @@
+package server
+
+import (
+	"syscall"
+
+	"github.com/ear7h/r3stfs/p9"
+)
+
+func p9StatAttr(attr *p9.Rgetattr, stat *syscall.Stat_t) {
+	attr.Mode = uint32(stat.Mode)
+	attr.Uid, attr.Gid = stat.Uid, stat.Gid
+	attr.Nlink = uint64(stat.Nlink)
+	attr.Rdev = uint64(stat.Rdev)
+	attr.Blksize = uint64(stat.Blksize)
+	attr.Blocks = uint64(stat.Blocks)
+	attr.AtimeSec, attr.AtimeNsec = uint64(stat.Atimespec.Sec), uint64(stat.Atimespec.Nsec)
+	attr.MtimeSec, attr.MtimeNsec = uint64(stat.Mtimespec.Sec), uint64(stat.Mtimespec.Nsec)
+	attr.CtimeSec, attr.CtimeNsec = uint64(stat.Ctimespec.Sec), uint64(stat.Ctimespec.Nsec)
+}
+
+func p9Statfs(filename string) (*p9.Rstatfs, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(filename, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rstatfs{
+		FsType: st.Type,
+		Bsize:  st.Bsize,
+		Blocks: st.Blocks,
+		Bfree:  st.Bfree,
+		Bavail: st.Bavail,
+		Files:  st.Files,
+		Ffree:  st.Ffree,
+		Fsid:   uint64(uint32(st.Fsid.Val[0])) | uint64(uint32(st.Fsid.Val[1]))<<32,
+		// darwin has no limit in statfs, its file systems take 255
+		Namelen: 255,
+	}, nil
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"syscall"
+
+	"github.com/ear7h/r3stfs/p9"
+)
+
+func p9StatAttr(attr *p9.Rgetattr, stat *syscall.Stat_t) {
+	attr.Mode = stat.Mode
+	attr.Uid, attr.Gid = stat.Uid, stat.Gid
+	attr.Nlink = uint64(stat.Nlink)
+	attr.Rdev = uint64(stat.Rdev)
+	attr.Blksize = uint64(stat.Blksize)
+	attr.Blocks = uint64(stat.Blocks)
+	attr.AtimeSec, attr.AtimeNsec = uint64(stat.Atim.Sec), uint64(stat.Atim.Nsec)
+	attr.MtimeSec, attr.MtimeNsec = uint64(stat.Mtim.Sec), uint64(stat.Mtim.Nsec)
+	attr.CtimeSec, attr.CtimeNsec = uint64(stat.Ctim.Sec), uint64(stat.Ctim.Nsec)
+}
+
+func p9Statfs(filename string) (*p9.Rstatfs, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(filename, &st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p9.Rstatfs{
+		FsType:  uint32(st.Type),
+		Bsize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		Namelen: uint32(st.Namelen),
+	}, nil
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ear7h/r3stfs/p9"
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+// send a request and read its reply
+func p9Rpc(t *testing.T, conn net.Conn, m p9.Msg) p9.Msg {
+	t.Helper()
+
+	err := p9.WriteMsg(conn, 1, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, ret, err := p9.ReadMsg(conn, p9MaxMsize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != 1 {
+		t.Fatalf("reply tag %d", tag)
+	}
+
+	return ret
+}
+
+// like p9Rpc, failing the test with Rlerror
+func p9Call(t *testing.T, conn net.Conn, m p9.Msg) p9.Msg {
+	t.Helper()
+
+	ret := p9Rpc(t, conn, m)
+	if e, ok := ret.(*p9.Rlerror); ok {
+		t.Fatalf("%T: %v", m, e.Ecode)
+	}
+
+	return ret
+}
+
+func p9Errcode(t *testing.T, conn net.Conn, m p9.Msg) p9.Errno {
+	t.Helper()
+
+	ret := p9Rpc(t, conn, m)
+	e, ok := ret.(*p9.Rlerror)
+	if !ok {
+		t.Fatalf("%T: unexpected %T", m, ret)
+	}
+
+	return e.Ecode
+}
+
+func TestP9(t *testing.T) {
+	root := t.TempDir()
+	userRoot := path.Join(root, "julio")
+
+	err := os.Mkdir(userRoot, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := sandbox.NewUserStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	go NewP9Server(users, &R3stFsHandler{}, NewUserDB(map[string]string{"julio": "secret"})).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	rv := p9Call(t, conn, &p9.Tversion{Msize: 8192, Version: p9.Version}).(*p9.Rversion)
+	if rv.Msize != 8192 || rv.Version != p9.Version {
+		t.Fatalf("version: %+v", rv)
+	}
+
+	if e := p9Errcode(t, conn, &p9.Tattach{Fid: 0, Afid: p9.NoFid, Uname: "julio"}); e != p9.EACCES {
+		t.Errorf("attach without auth: %v", e)
+	}
+
+	p9Call(t, conn, &p9.Tauth{Afid: 100, Uname: "julio"})
+	p9Call(t, conn, &p9.Twrite{Fid: 100, Data: []byte("secret")})
+	p9Call(t, conn, &p9.Tattach{Fid: 0, Afid: 100, Uname: "julio"})
+	p9Call(t, conn, &p9.Tclunk{Fid: 100})
+
+	// walks stay in the store and don't see sidecars
+	rw := p9Call(t, conn, &p9.Twalk{Fid: 0, NewFid: 1, Names: []string{"..", ".."}}).(*p9.Rwalk)
+	if len(rw.Qids) != 2 || rw.Qids[1].Type != p9.QTDir {
+		t.Errorf("walk to ..: %+v", rw)
+	}
+
+	if e := p9Errcode(t, conn, &p9.Twalk{Fid: 0, NewFid: 2, Names: []string{xattrSidecarPrefix + "a.txt"}}); e != p9.ENOENT {
+		t.Errorf("walk to a sidecar: %v", e)
+	}
+
+	p9Call(t, conn, &p9.Tmkdir{Dfid: 0, Name: "dir", Mode: 0755})
+
+	p9Call(t, conn, &p9.Twalk{Fid: 0, NewFid: 2, Names: []string{"dir"}})
+	p9Call(t, conn, &p9.Tlcreate{Fid: 2, Name: "a.txt", Flags: p9.ORdwr, Mode: 0640})
+
+	rwr := p9Call(t, conn, &p9.Twrite{Fid: 2, Offset: 0, Data: []byte("hello world")}).(*p9.Rwrite)
+	if rwr.Count != 11 {
+		t.Errorf("write count %d", rwr.Count)
+	}
+
+	rr := p9Call(t, conn, &p9.Tread{Fid: 2, Offset: 6, Count: 100}).(*p9.Rread)
+	if string(rr.Data) != "world" {
+		t.Errorf("read %q", rr.Data)
+	}
+
+	ra := p9Call(t, conn, &p9.Tgetattr{Fid: 2, Mask: p9.GetattrBasic}).(*p9.Rgetattr)
+	if ra.Size != 11 || ra.Mode&0777 != 0640 || ra.Qid.Type != p9.QTFile {
+		t.Errorf("getattr: %+v", ra)
+	}
+
+	p9Call(t, conn, &p9.Tsetattr{
+		Fid:   2,
+		Valid: p9.SetattrMode | p9.SetattrSize | p9.SetattrMtime | p9.SetattrMtimeSet,
+		Mode:  0600, Size: 5, MtimeSec: 1500000000,
+	})
+	p9Call(t, conn, &p9.Tclunk{Fid: 2})
+
+	fi, err := os.Stat(path.Join(userRoot, "dir/a.txt"))
+	if err != nil || fi.Size() != 5 || fi.Mode().Perm() != 0600 || fi.ModTime().Unix() != 1500000000 {
+		t.Errorf("setattr on disk: %v %v", fi, err)
+	}
+
+	// a truncated file is replaced at the clunk, until then it has
+	// what it had
+	p9Call(t, conn, &p9.Twalk{Fid: 0, NewFid: 2, Names: []string{"dir", "a.txt"}})
+	p9Call(t, conn, &p9.Tlopen{Fid: 2, Flags: p9.OWronly | p9.OTrunc})
+	p9Call(t, conn, &p9.Twrite{Fid: 2, Offset: 0, Data: []byte("bye")})
+
+	if byt, _ := ioutil.ReadFile(path.Join(userRoot, "dir/a.txt")); string(byt) != "hello" {
+		t.Errorf("a.txt before the clunk: %q", byt)
+	}
+	p9Call(t, conn, &p9.Tclunk{Fid: 2})
+
+	fi, err = os.Stat(path.Join(userRoot, "dir/a.txt"))
+	if byt, _ := ioutil.ReadFile(path.Join(userRoot, "dir/a.txt")); string(byt) != "bye" || fi.Mode().Perm() != 0600 {
+		t.Errorf("a.txt after the clunk: %q %v", byt, fi.Mode())
+	}
+	if names := uploadTemps(t, path.Join(userRoot, "dir")); len(names) != 0 {
+		t.Errorf("temporaries left: %v", names)
+	}
+
+	// an attribute the rest handler would have set
+	err = ioutil.WriteFile(path.Join(userRoot, "dir", xattrSidecarPrefix+"a.txt"), []byte(`{}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p9Call(t, conn, &p9.Twalk{Fid: 0, NewFid: 3, Names: []string{"dir"}})
+	p9Call(t, conn, &p9.Trenameat{OldDirFid: 3, OldName: "a.txt", NewDirFid: 3, NewName: "b.txt"})
+
+	if _, err := os.Stat(path.Join(userRoot, "dir", xattrSidecarPrefix+"b.txt")); err != nil {
+		t.Errorf("sidecar didn't move: %v", err)
+	}
+
+	p9Call(t, conn, &p9.Tlopen{Fid: 3, Flags: p9.ORdonly})
+	rd := p9Call(t, conn, &p9.Treaddir{Fid: 3, Offset: 0, Count: 4096}).(*p9.Rreaddir)
+
+	dirents, err := p9.ParseDirents(rd.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, d := range dirents {
+		names = append(names, d.Name)
+	}
+	if len(names) != 3 || names[0] != "." || names[1] != ".." || names[2] != "b.txt" {
+		t.Errorf("readdir: %v", names)
+	}
+
+	last := dirents[len(dirents)-1].Offset
+	rd = p9Call(t, conn, &p9.Treaddir{Fid: 3, Offset: last, Count: 4096}).(*p9.Rreaddir)
+	if len(rd.Data) != 0 {
+		t.Errorf("readdir past the end: %d bytes", len(rd.Data))
+	}
+	p9Call(t, conn, &p9.Tclunk{Fid: 3})
+
+	if e := p9Errcode(t, conn, &p9.Tunlinkat{DirFid: 0, Name: "dir", Flags: p9.AtRemoveDir}); e != p9.ENOTEMPTY {
+		t.Errorf("rmdir of a full directory: %v", e)
+	}
+
+	p9Call(t, conn, &p9.Twalk{Fid: 0, NewFid: 4, Names: []string{"dir"}})
+	p9Call(t, conn, &p9.Tunlinkat{DirFid: 4, Name: "b.txt"})
+	p9Call(t, conn, &p9.Tclunk{Fid: 4})
+
+	// only the sidecar of the removed file would be left
+	p9Call(t, conn, &p9.Tunlinkat{DirFid: 0, Name: "dir", Flags: p9.AtRemoveDir})
+
+	if _, err := os.Stat(path.Join(userRoot, "dir")); !os.IsNotExist(err) {
+		t.Errorf("dir wasn't removed: %v", err)
+	}
+
+	if _, ok := p9Rpc(t, conn, &p9.Tstatfs{Fid: 0}).(*p9.Rstatfs); !ok {
+		t.Errorf("statfs failed")
+	}
+}
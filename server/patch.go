@@ -0,0 +1,131 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ear7h/r3stfs/sparse"
+)
+
+/*
+PATCH changes a file in place, the op query picks the change
+
+PATCH /dir/file.img?op=allocate&offset=0&length=4096&mode=keep-size,punch-hole
+PATCH /dir/file.log?op=truncate&size=0
+PATCH /dir/file.txt?op=rename&to=/other/file.txt
+PATCH /dir/file.txt?op=setattr&mode=644&atime=1500000000&mtime=1500000000
+PATCH /dir/file.txt?op=sync
+
+the to path is relative to the base path like the url, setattr
+leaves out attributes which are missing from the query. sync answers
+once the file and its directory entry are on disk, like uploads with
+Sync: T do
+*/
+
+func (h *fsHandlerWrapper) handlePatch(r *http.Request, filename string) error {
+	q := r.URL.Query()
+
+	switch op := q.Get("op"); op {
+	case "allocate":
+		offset, err := queryInt(q, "offset")
+		if err != nil {
+			return err
+		}
+
+		length, err := queryInt(q, "length")
+		if err != nil {
+			return err
+		}
+
+		mode, err := sparse.ParseAllocMode(q.Get("mode"))
+		if err != nil {
+			return WrapUserError(err)
+		}
+
+		return h.HandleAllocate(r.Header, filename, offset, length, mode)
+
+	case "truncate":
+		size, err := queryInt(q, "size")
+		if err != nil {
+			return err
+		}
+
+		return h.HandleTruncate(r.Header, filename, size)
+
+	case "rename":
+		to := q.Get("to")
+		if to == "" {
+			return NewUserError("missing to")
+		}
+
+		return h.HandleRename(r.Header, filename, h.filename(to))
+
+	case "setattr":
+		attr, err := queryAttr(q)
+		if err != nil {
+			return err
+		}
+
+		return h.HandleSetAttr(r.Header, filename, attr)
+
+	case "sync":
+		return h.HandleSync(r.Header, filename)
+
+	default:
+		return NewUserError("unknown patch op " + op)
+	}
+}
+
+// parse a non negative integer query parameter
+func queryInt(q url.Values, key string) (int64, error) {
+	i, err := strconv.ParseInt(q.Get(key), 10, 64)
+	if err != nil || i < 0 {
+		return 0, NewUserError("invalid " + key)
+	}
+
+	return i, nil
+}
+
+// parse the attributes of a setattr
+func queryAttr(q url.Values) (attr Attr, err error) {
+	if s := q.Get("mode"); s != "" {
+		mode, err := parseMode(s)
+		if err != nil {
+			return attr, err
+		}
+		attr.Mode = &mode
+	}
+
+	if q.Get("atime") != "" {
+		sec, err := queryInt(q, "atime")
+		if err != nil {
+			return attr, err
+		}
+		t := time.Unix(sec, 0)
+		attr.Atime = &t
+	}
+
+	if q.Get("mtime") != "" {
+		sec, err := queryInt(q, "mtime")
+		if err != nil {
+			return attr, err
+		}
+		t := time.Unix(sec, 0)
+		attr.Mtime = &t
+	}
+
+	return
+}
+
+// parse an octal os.FileMode, the format of File-Mode headers
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, NewUserError("invalid mode " + s)
+	}
+
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+/*
+the R3stFsHandler locks the paths a request touches. Reads share the
+lock of their path, changes hold it alone, and either way the
+directories above it are shared: a change of a directory, like its
+rename or removal, waits for the requests under it and they wait for
+it. A request which changes an entry holds it alone and shares its
+directory, entries of one directory change side by side
+
+a request takes all of its locks at once in the order of their paths,
+so two renames crossing each other can't each hold what the other
+waits for. Uploads are written before their lock is taken, only their
+rename into place holds it
+
+the front ends sharing the handler take part too, s3 and batches go
+through the handler and webdav and 9p take its locks themselves
+*/
+
+type pathLock struct {
+	sync.RWMutex
+	// requests holding or waiting for it
+	refs int
+}
+
+// pathLocks hands out the locks of paths, its zero value has none
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+// lock reads shared and writes alone, the directories above them
+// shared, and return the function giving them back
+func (l *pathLocks) lock(reads, writes []string) func() {
+	// a path taken alone and shared is taken alone
+	alone := make(map[string]bool)
+	add := func(name string, write bool) {
+		alone[name] = alone[name] || write
+		for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+			if _, ok := alone[dir]; !ok {
+				alone[dir] = false
+			}
+			if dir == filepath.Dir(dir) {
+				break
+			}
+		}
+	}
+
+	for _, name := range reads {
+		add(filepath.Clean(name), false)
+	}
+	for _, name := range writes {
+		add(filepath.Clean(name), true)
+	}
+
+	names := make([]string, 0, len(alone))
+	for name := range alone {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	held := make([]*pathLock, len(names))
+	for i, name := range names {
+		held[i] = l.get(name)
+		if alone[name] {
+			held[i].Lock()
+		} else {
+			held[i].RLock()
+		}
+	}
+
+	return func() {
+		for i := len(names) - 1; i >= 0; i-- {
+			if alone[names[i]] {
+				held[i].Unlock()
+			} else {
+				held[i].RUnlock()
+			}
+			l.put(names[i], held[i])
+		}
+	}
+}
+
+// the lock of name, counted until it is put back
+func (l *pathLocks) get(name string) *pathLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.locks == nil {
+		l.locks = make(map[string]*pathLock)
+	}
+
+	pl := l.locks[name]
+	if pl == nil {
+		pl = &pathLock{}
+		l.locks[name] = pl
+	}
+	pl.refs++
+
+	return pl
+}
+
+func (l *pathLocks) put(name string, pl *pathLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	pl.refs--
+	if pl.refs == 0 {
+		delete(l.locks, name)
+	}
+}
+
+// share name
+func (l *pathLocks) read(name string) func() {
+	return l.lock([]string{name}, nil)
+}
+
+// hold name alone
+func (l *pathLocks) write(name string) func() {
+	return l.lock(nil, []string{name})
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+func TestPathLocks(t *testing.T) {
+	var l pathLocks
+
+	// a change of a directory waits for the requests under it
+	unlock := l.read("/d/e/f")
+	changed := make(chan struct{})
+	go func() {
+		l.write("/d")()
+		close(changed)
+	}()
+
+	select {
+	case <-changed:
+		t.Fatal("/d changed while /d/e/f was read")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-changed
+
+	// entries of one directory change side by side
+	unlock = l.write("/d/a")
+	l.write("/d/b")()
+	unlock()
+
+	// renames crossing each other don't wait for each other forever
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			from, to := "/x/a", "/y/b"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			for j := 0; j < 1000; j++ {
+				l.lock(nil, []string{from, to})()
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("crossing renames deadlocked")
+	}
+
+	if len(l.locks) != 0 {
+		t.Errorf("locks left: %v", l.locks)
+	}
+}
+
+func TestConcurrentPuts(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	const writers = 16
+	const size = 256 * 1024
+
+	// each writer's content is its own byte, a mix of two is torn
+	content := func(w int) []byte {
+		return bytes.Repeat([]byte{byte('a' + w)}, size)
+	}
+	whole := func(byt []byte) bool {
+		return len(byt) == size && bytes.Count(byt, byt[:1]) == size
+	}
+
+	do := func(method, p string, body []byte, header map[string]string) (*http.Response, []byte, error) {
+		req, _ := http.NewRequest(method, ts.URL+p, bytes.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer res.Body.Close()
+
+		byt, err := ioutil.ReadAll(res.Body)
+		return res, byt, err
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1024)
+	stop := make(chan struct{})
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < 20; i++ {
+				res, _, err := do(http.MethodPut, "/f", content(w), map[string]string{"File-Mode": "644"})
+				if err != nil {
+					errs <- err
+					return
+				}
+				if res.StatusCode != http.StatusOK {
+					errs <- fmt.Errorf("put %d: %s", w, res.Status)
+				}
+			}
+		}(w)
+	}
+
+	// readers, and renames moving the file away and back
+	var others sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		others.Add(1)
+		go func(r int) {
+			defer others.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if r == 0 {
+					do(http.MethodPatch, "/f?op=rename&to=/g", nil, nil)
+					do(http.MethodPatch, "/g?op=rename&to=/f", nil, nil)
+					continue
+				}
+
+				res, byt, err := do(http.MethodGet, "/f", nil, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if res.StatusCode == http.StatusOK && !whole(byt) {
+					errs <- fmt.Errorf("read %d bytes of a torn file", len(byt))
+				}
+			}
+		}(r)
+	}
+
+	wg.Wait()
+	close(stop)
+	others.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// the rename back may have lost to the last put
+	byt, err := ioutil.ReadFile(path.Join(dirroot, "f"))
+	if err != nil {
+		byt, err = ioutil.ReadFile(path.Join(dirroot, "g"))
+	}
+	if err != nil || !whole(byt) {
+		t.Errorf("the file is %d torn bytes: %v", len(byt), err)
+	}
+
+	if names := uploadTemps(t, dirroot); len(names) != 0 {
+		t.Errorf("temporaries left: %v", names)
+	}
+}
+
+func TestFrontEndLocks(t *testing.T) {
+	dirroot := t.TempDir()
+	for _, name := range []string{"a", "b"} {
+		err := ioutil.WriteFile(path.Join(dirroot, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := &R3stFsHandler{}
+	dav := davFS{webdav.Dir(dirroot), h}
+	p9 := &p9Conn{srv: &P9Server{handler: h, leases: h.leaseTable()}, fids: make(map[uint32]*p9Fid)}
+
+	// webdav and 9p changes wait for the requests of the rest api
+	changes := []struct {
+		name, file string
+		change     func() error
+	}{{
+		"webdav rename", "a", func() error {
+			return dav.Rename(context.Background(), "/a", "/c")
+		},
+	}, {
+		"9p rename", "b", func() error {
+			return p9.move(path.Join(dirroot, "b"), path.Join(dirroot, "d"))
+		},
+	}}
+
+	for _, c := range changes {
+		unlock := h.locks.read(path.Join(dirroot, c.file))
+		done := make(chan error)
+		go func() {
+			done <- c.change()
+		}()
+
+		select {
+		case <-done:
+			t.Fatalf("%s while %s was read", c.name, c.file)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		unlock()
+		if err := <-done; err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+	}
+}
@@ -9,12 +9,40 @@ import (
 	"bytes"
 	"fmt"
 	"encoding/json"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ear7h/r3stfs/sparse"
 )
 
 type R3stFsHandler struct {
+	// of the paths requests touch, see pathlock.go
+	locks pathLocks
+
+	// of all the front ends serving the handler, see lease.go
+	leasesOnce sync.Once
+	leases     *leaseTable
+}
+
+func (h *R3stFsHandler) HandleHead(header http.Header, filename string) (os.FileInfo, error) {
+	if isReserved(filename) {
+		return nil, notExist("stat", filename)
+	}
+
+	defer h.locks.read(filename)()
+
+	return os.Stat(filename)
 }
 
 func (h *R3stFsHandler) HandleGet(header http.Header, filename string) (io.ReadCloser, error) {
+	if isReserved(filename) {
+		return nil, notExist("open", filename)
+	}
+
+	// an open file reads on after a put replaced it
+	defer h.locks.read(filename)()
+
 	var mode os.FileMode
 
 	modeStr := header.Get("File-Mode")
@@ -36,7 +64,7 @@ func (h *R3stFsHandler) HandleGet(header http.Header, filename string) (io.ReadC
 		mode = os.FileMode(modeUint)
 	}
 
-	switch mode | os.ModeType {
+	switch mode & os.ModeType {
 	case 0: // file
 		file, err := os.OpenFile(filename, os.O_RDONLY, mode)
 		if err != nil {
@@ -51,15 +79,15 @@ func (h *R3stFsHandler) HandleGet(header http.Header, filename string) (io.ReadC
 			return nil, err
 		}
 
-		ret := bytes.NewBuffer(make([]byte, 20))
-		encoder := json.NewEncoder(ret)
-
 		data := make(map[string]os.FileMode)
 		for _, node := range dir {
+			if isReserved(node.Name()) {
+				continue
+			}
 			data[node.Name()] = node.Mode()
 		}
 
-		err = encoder.Encode(data)
+		ret, err := jsonReader(data)
 		if err != nil {
 			return nil, err
 		}
@@ -83,24 +111,23 @@ func (h *R3stFsHandler) HandlePut(header http.Header, filename string, body io.R
 		return 0, NewUserError("use POST to create directory")
 	}
 
+	if isReserved(filename) {
+		return 0, NewUserError("reserved file name")
+	}
+
 	modeStr := header.Get("File-Mode")
 	modeUint, err := strconv.ParseUint(modeStr, 8, 32)
 	if err != nil {
 		return 0, WrapUserError(err)
 	}
 
-	switch mode := os.FileMode(modeUint); mode | os.ModeType {
+	switch mode := os.FileMode(modeUint); mode & os.ModeType {
 	case 0: //file
-		f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
-		if err != nil {
-			return 0, err
-		}
-
-		num, err := io.Copy(f, body)
+		// replaced once the whole body is there, see upload.go
+		num, err := h.putFile(header, filename, mode, body)
 		if err != nil {
 			return 0, err
 		}
-		f.Close()
 
 		return int(num), nil
 
@@ -121,26 +148,37 @@ func (h *R3stFsHandler) HandlePut(header http.Header, filename string, body io.R
 
 // Exclusive create
 func (h *R3stFsHandler) HandlePost(header http.Header, filename string, body io.Reader) (int, error) {
+	if isReserved(filename) {
+		return 0, NewUserError("reserved file name")
+	}
+
+	// the new file is written in place, it isn't read before it's all there
+	defer h.locks.write(filename)()
+
 	modeStr := header.Get("File-Mode")
 	modeUint, err := strconv.ParseUint(modeStr, 8, 32)
 	if err != nil {
 		return 0, WrapUserError(err)
 	}
 
-	switch mode := os.FileMode(modeUint); mode | os.ModeType {
+	switch mode := os.FileMode(modeUint); mode & os.ModeType {
 	case 0: //file
 		f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
 		if err != nil {
 			return 0, err
 		}
 
-		num, err := io.Copy(f, body)
+		num, err := writeContent(header, f, body)
+		if err == nil {
+			err = syncContent(header, f)
+		}
+		f.Close()
 		if err != nil {
+			// don't leave a partial file behind
+			os.Remove(filename)
 			return 0, err
 		}
 
-		f.Close()
-
 		return int(num), nil
 	case os.ModeDir:
 		err := os.Mkdir(filename, mode)
@@ -162,17 +200,49 @@ func (h *R3stFsHandler) HandlePost(header http.Header, filename string, body io.
 }
 
 func (h *R3stFsHandler) HandleDelete(header http.Header, filename string) (error) {
+	if isReserved(filename) {
+		return notExist("remove", filename)
+	}
+
+	return h.remove(header, filename)
+}
+
+// remove filename, reserved or not. Batches delete their trash with it
+func (h *R3stFsHandler) remove(header http.Header, filename string) error {
+	defer h.locks.write(filename)()
+
+	var mode os.FileMode
+
 	modeStr := header.Get("File-Mode")
-	modeUint, err := strconv.ParseUint(modeStr, 8, 32)
-	if err != nil {
-		return WrapUserError(err)
+	// if no file mode provided imply an existing file
+	if modeStr == "" {
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+
+		mode = stat.Mode()
+	} else {
+		modeUint, err := strconv.ParseUint(modeStr, 8, 32)
+		if err != nil {
+			return WrapUserError(err)
+		}
+
+		mode = os.FileMode(modeUint)
 	}
 
-	switch mode := os.FileMode(modeUint); mode | os.ModeType {
+	switch mode & os.ModeType {
 	case 0: //file
 		fallthrough
 	case os.ModeDir:
-		return os.Remove(filename)
+		err := os.Remove(filename)
+		if err != nil {
+			return err
+		}
+
+		// attributes go with the file
+		os.Remove(sidecarName(filename))
+		return nil
 
 	case os.ModeSymlink: // TODO: handle other modes
 		fallthrough
@@ -187,6 +257,12 @@ func (h *R3stFsHandler) HandleDelete(header http.Header, filename string) (error
 }
 
 func (h *R3stFsHandler) HandleOptions(header http.Header, filename string) (io.ReadCloser, error) {
+	if isReserved(filename) {
+		return nil, notExist("stat", filename)
+	}
+
+	defer h.locks.read(filename)()
+
 	var mode os.FileMode
 
 	modeStr := header.Get("File-Mode")
@@ -225,14 +301,14 @@ func (h *R3stFsHandler) HandleOptions(header http.Header, filename string) (io.R
 		// if the user specified mode and the actual
 		// file mode are not the same
 		// return an error
-		if (stat.Mode() ^ mode) | os.ModeType == 0 {
+		if (stat.Mode() ^ mode) & os.ModeType != 0 {
 			return nil, NewUserError("specified mode does not match file mode")
 		}
 	}
 
 	var value interface{}
 
-	switch mode | os.ModeType {
+	switch mode & os.ModeType {
 	case 0: //file
 		value = map[string]string{
 			"GET":    "response body contains file",
@@ -269,9 +345,220 @@ func (h *R3stFsHandler) HandleOptions(header http.Header, filename string) (io.R
 
 }
 
+func (h *R3stFsHandler) HandleTruncate(header http.Header, filename string, size int64) error {
+	if isReserved(filename) {
+		return notExist("truncate", filename)
+	}
+
+	defer h.locks.write(filename)()
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	if !stat.Mode().IsRegular() {
+		return NewUserError("only files can be truncated")
+	}
+
+	return os.Truncate(filename, size)
+}
+
+func (h *R3stFsHandler) HandleAllocate(header http.Header, filename string, offset, length int64, mode sparse.AllocMode) error {
+	if isReserved(filename) {
+		return notExist("open", filename)
+	}
+
+	defer h.locks.write(filename)()
+
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return sparse.Allocate(f, offset, length, mode)
+}
+
+func (h *R3stFsHandler) HandleRename(header http.Header, oldname, newname string) error {
+	if isReserved(oldname) || isReserved(newname) {
+		return NewUserError("reserved file name")
+	}
+
+	return h.rename(oldname, newname)
+}
+
+// rename oldname, reserved or not. Batches move their trash with it
+func (h *R3stFsHandler) rename(oldname, newname string) error {
+	defer h.locks.lock(nil, []string{oldname, newname})()
+
+	err := os.Rename(oldname, newname)
+	if err != nil {
+		return err
+	}
+
+	moveSidecar(oldname, newname)
+	return nil
+}
+
+func (h *R3stFsHandler) HandleSetAttr(header http.Header, filename string, attr Attr) error {
+	if isReserved(filename) {
+		return notExist("stat", filename)
+	}
+
+	defer h.locks.write(filename)()
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	if attr.Mode != nil {
+		err = os.Chmod(filename, *attr.Mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	if attr.Atime == nil && attr.Mtime == nil {
+		return nil
+	}
+
+	// Chtimes sets both, keep the one which isn't changing
+	_, atime, mtime := fileAttr(stat)
+	a, m := time.Unix(atime, 0), time.Unix(mtime, 0)
+	if attr.Atime != nil {
+		a = *attr.Atime
+	}
+	if attr.Mtime != nil {
+		m = *attr.Mtime
+	}
+
+	return os.Chtimes(filename, a, m)
+}
+
+func (h *R3stFsHandler) HandleCopy(header http.Header, src, dst string, opts CopyOptions) error {
+	if isReserved(src) || isReserved(dst) {
+		return NewUserError("reserved file name")
+	}
+
+	defer h.locks.lock([]string{src}, []string{dst})()
+
+	return copyPath(src, dst, opts)
+}
+
+func (h *R3stFsHandler) HandleSync(header http.Header, filename string) error {
+	if isReserved(filename) {
+		return notExist("open", filename)
+	}
+
+	defer h.locks.read(filename)()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(filename))
+}
+
+func (h *R3stFsHandler) HandleGetXAttr(header http.Header, filename, attr string) ([]byte, error) {
+	if isReserved(filename) {
+		return nil, notExist("getxattr", filename)
+	}
+
+	defer h.locks.read(filename)()
+
+	return getXAttr(filename, attr)
+}
+
+func (h *R3stFsHandler) HandleListXAttr(header http.Header, filename string) ([]string, error) {
+	if isReserved(filename) {
+		return nil, notExist("listxattr", filename)
+	}
+
+	defer h.locks.read(filename)()
+
+	return listXAttr(filename)
+}
+
+func (h *R3stFsHandler) HandleSetXAttr(header http.Header, filename, attr string, value []byte) error {
+	if isReserved(filename) {
+		return notExist("setxattr", filename)
+	}
+
+	defer h.locks.write(filename)()
+
+	return setXAttr(filename, attr, value, header.Get("Xattr-Flags"))
+}
+
+func (h *R3stFsHandler) HandleRemoveXAttr(header http.Header, filename, attr string) error {
+	if isReserved(filename) {
+		return notExist("removexattr", filename)
+	}
+
+	defer h.locks.write(filename)()
+
+	return removeXAttr(filename, attr)
+}
+
+// write an upload to an empty file, sparse uploads keep their holes
+func writeContent(header http.Header, f *os.File, body io.Reader) (int64, error) {
+	if header.Get("Content-Type") != sparse.ContentType {
+		return io.Copy(f, body)
+	}
+
+	w := sparse.NewWriter(f)
+
+	num, err := io.Copy(w, body)
+	if err != nil {
+		return num, err
+	}
+
+	return num, w.Close()
+}
+
+// write an upload and its directory entry to disk before it is
+// acknowledged, if the client asked with Sync: T
+func syncContent(header http.Header, f *os.File) error {
+	if header.Get("Sync") != "T" {
+		return nil
+	}
+
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(f.Name()))
+}
+
+// write the entries of a directory to disk, a new file's name is lost
+// without it
+func syncDir(name string) error {
+	d, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// reserved names are hidden, to clients they don't exist
+func notExist(op, filename string) error {
+	return &os.PathError{Op: op, Path: filename, Err: os.ErrNotExist}
+}
+
 // helper function
 func jsonReader(v interface{}) (io.Reader, error) {
-	ret := bytes.NewBuffer(make([]byte, 20))
+	ret := bytes.NewBuffer(make([]byte, 0, 20))
 	encoder := json.NewEncoder(ret)
 
 	err := encoder.Encode(v)
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ear7h/r3stfs/digest"
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+/*
+the s3 mount serves each user's sandbox root as a bucket named
+after the user, with path style urls
+
+GET    /			ListBuckets
+HEAD   /julio			HeadBucket
+GET    /julio?location		GetBucketLocation
+GET    /julio?list-type=2	ListObjectsV2
+GET    /julio/dir/a.txt		GetObject, Range is honored
+HEAD   /julio/dir/a.txt		HeadObject
+PUT    /julio/dir/a.txt		PutObject
+DELETE /julio/dir/a.txt		DeleteObject
+POST   /julio/big.img?uploads			CreateMultipartUpload
+PUT    /julio/big.img?partNumber=1&uploadId=...	UploadPart
+POST   /julio/big.img?uploadId=...		CompleteMultipartUpload
+DELETE /julio/big.img?uploadId=...		AbortMultipartUpload
+
+requests are signed with sigv4 against the UserDB, users only see
+their own bucket. Objects are the files of the store and go through
+the same FsHandler as the rest protocol, the directories of keys
+with slashes are made as needed and listed as common prefixes
+*/
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// the mode of files and directories made by s3 requests
+const (
+	s3FileMode = 0644
+	s3DirMode  = os.ModeDir | 0755
+)
+
+type s3Mount struct {
+	basepath string
+	users    *sandbox.UserStore
+	handler  FsHandler
+	db       *UserDB
+	// shared with the other front ends of handler
+	leases *leaseTable
+
+	// multipart uploads in progress, their parts wait in partsDir
+	lock     sync.Mutex
+	uploads  map[string]*s3Upload
+	partsDir string
+}
+
+// S3Mount serves the stores in users as s3 buckets under basepath,
+// most s3 clients only talk to a server at the root of a host
+func S3Mount(basepath string, users *sandbox.UserStore, handler FsHandler, db *UserDB) Mount {
+	return &s3Mount{
+		basepath: strings.TrimSuffix(path.Join("/", basepath), "/"),
+		users:    users,
+		handler:  handler,
+		db:       db,
+		leases:   leasesOf(handler),
+		uploads:  make(map[string]*s3Upload),
+	}
+}
+
+func (m *s3Mount) mount(mux *http.ServeMux) {
+	mux.Handle(m.basepath+"/", m)
+}
+
+func (m *s3Mount) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sig, err := m.db.verifyV4(r)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+
+	arr := strings.SplitN(strings.TrimPrefix(r.URL.Path, m.basepath+"/"), "/", 2)
+	bucket, key := arr[0], ""
+	if len(arr) == 2 {
+		key = arr[1]
+	}
+
+	switch {
+	case bucket == "" && r.Method == http.MethodGet:
+		err = m.listBuckets(w, sig.user)
+	case bucket == "":
+		err = errS3Method
+	case bucket != sig.user:
+		err = errS3AccessDenied
+	default:
+		var store sandbox.Store
+		store, err = m.users.User(sig.user)
+		if err != nil {
+			err = errS3NoSuchBucket
+			break
+		}
+
+		err = m.serve(w, r, sig, store.Abs("/"), key)
+	}
+
+	if err != nil {
+		writeS3Error(w, r, err)
+	}
+}
+
+// serve a request to the bucket at root
+func (m *s3Mount) serve(w http.ResponseWriter, r *http.Request, sig *sigV4, root, key string) error {
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	uploadID := q.Get("uploadId")
+
+	// keys are file names, they can't climb out of the bucket
+	if key != "" && path.Clean("/" + key)[1:] != strings.TrimSuffix(key, "/") {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid key"}
+	}
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		return nil
+	case key == "" && r.Method == http.MethodGet:
+		if _, ok := q["location"]; ok {
+			// an empty constraint is us-east-1, any region signs
+			return writeXML(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+		}
+		if q.Get("list-type") != "2" {
+			return NewNotImplementedError("only ListObjectsV2 is supported")
+		}
+		return m.listObjects(w, r, sig.user, root)
+	case key == "":
+		return errS3Method
+
+	case uploads && r.Method == http.MethodPost:
+		return m.createUpload(w, sig.user, key)
+	case uploadID != "" && r.Method == http.MethodPut:
+		return m.uploadPart(w, r, sig, key)
+	case uploadID != "" && r.Method == http.MethodPost:
+		return m.completeUpload(w, r, sig, root, key)
+	case uploadID != "" && r.Method == http.MethodDelete:
+		return m.abortUpload(w, sig.user, key, uploadID)
+	case uploadID != "":
+		return NewNotImplementedError("multipart operation not supported")
+	}
+
+	filename := path.Join(root, key)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return m.getObject(w, r, filename)
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return NewNotImplementedError("CopyObject is not supported")
+		}
+		return m.putObject(w, r, sig, root, key)
+	case http.MethodDelete:
+		defer m.leases.write(noLeaseClient, filename, true)()
+
+		err := m.handler.HandleDelete(http.Header{}, filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		return errS3Method
+	}
+}
+
+func (m *s3Mount) getObject(w http.ResponseWriter, r *http.Request, filename string) error {
+	// what rest clients are writing is sent first
+	m.leases.access(noLeaseClient, filename, false, false)
+
+	fi, err := m.handler.HandleHead(http.Header{}, filename)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return errS3NoSuchKey
+	}
+
+	header := w.Header()
+	header.Set("ETag", etag(fi))
+	header.Set("Content-Type", s3ContentType(filename))
+
+	if r.Method == http.MethodHead {
+		header.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+		return nil
+	}
+
+	rc, err := m.handler.HandleGet(http.Header{}, filename)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// ranges and conditional requests need to seek
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", fi.ModTime(), rs)
+		return nil
+	}
+
+	header.Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	header.Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		log.Printf("error writing response %v", err)
+	}
+
+	return nil
+}
+
+func (m *s3Mount) putObject(w http.ResponseWriter, r *http.Request, sig *sigV4, root, key string) error {
+	body, err := sig.body(r)
+	if err != nil {
+		return err
+	}
+
+	// folder markers, the empty objects s3 consoles make
+	if strings.HasSuffix(key, "/") {
+		_, err = io.Copy(io.Discard, body)
+		if err != nil {
+			return err
+		}
+
+		return m.mkdirs(root, key)
+	}
+
+	fi, err := m.writeObject(root, key, body)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", etag(fi))
+	return nil
+}
+
+// write the content of an object, making its directories
+func (m *s3Mount) writeObject(root, key string, body io.Reader) (os.FileInfo, error) {
+	err := m.mkdirs(root, path.Dir(key))
+	if err != nil {
+		return nil, err
+	}
+
+	filename := path.Join(root, key)
+
+	header := http.Header{}
+	header.Set("File-Mode", strconv.FormatUint(uint64(s3FileMode), 8))
+
+	defer m.leases.write(noLeaseClient, filename, false)()
+
+	_, err = m.handler.HandlePut(header, filename, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.handler.HandleHead(http.Header{}, filename)
+}
+
+// make the directories of dir which don't exist
+func (m *s3Mount) mkdirs(root, dir string) error {
+	header := http.Header{}
+	header.Set("File-Mode", strconv.FormatUint(uint64(s3DirMode), 8))
+
+	p := root
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		p = path.Join(p, name)
+
+		fi, err := m.handler.HandleHead(http.Header{}, p)
+		switch {
+		case os.IsNotExist(err):
+			done := m.leases.write(noLeaseClient, p, false)
+			_, err = m.handler.HandlePost(header, p, strings.NewReader(""))
+			done()
+			if err != nil && !os.IsExist(err) {
+				return err
+			}
+		case err != nil:
+			return err
+		case !fi.IsDir():
+			return &s3Error{http.StatusConflict, "InvalidArgument", "a parent of the key is an object"}
+		}
+	}
+
+	return nil
+}
+
+func (m *s3Mount) listBuckets(w http.ResponseWriter, user string) error {
+	store, err := m.users.User(user)
+	if err != nil {
+		return errS3NoSuchBucket
+	}
+
+	fi, err := os.Stat(store.Abs("/"))
+	if err != nil {
+		return err
+	}
+
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+
+	return writeXML(w, struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{
+		Xmlns:   s3Namespace,
+		Owner:   struct{ ID, DisplayName string }{user, user},
+		Buckets: []bucket{{user, s3Time(fi.ModTime())}},
+	})
+}
+
+func s3ContentType(filename string) string {
+	if ct := mime.TypeByExtension(path.Ext(filename)); ct != "" {
+		return ct
+	}
+
+	return "application/octet-stream"
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// s3Error is an error in the form s3 clients expect
+type s3Error struct {
+	status        int
+	code, message string
+}
+
+func (e *s3Error) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errS3AccessDenied = &s3Error{http.StatusForbidden, "AccessDenied", "access denied"}
+	errS3AccessKey    = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "unknown access key"}
+	errS3AuthHeader   = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed authorization header"}
+	errS3Signature    = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "the signature does not match"}
+	errS3TimeSkewed   = &s3Error{http.StatusForbidden, "RequestTimeTooSkewed", "the request time is too far from the server's"}
+	errS3MissingSHA   = &s3Error{http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256"}
+	errS3ContentSHA   = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the content does not match x-amz-content-sha256"}
+	errS3Chunk        = &s3Error{http.StatusBadRequest, "IncompleteBody", "malformed aws-chunked body"}
+	errS3Method       = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed"}
+	errS3NoSuchBucket = &s3Error{http.StatusNotFound, "NoSuchBucket", "no such bucket"}
+	errS3NoSuchKey    = &s3Error{http.StatusNotFound, "NoSuchKey", "no such key"}
+	errS3NoSuchUpload = &s3Error{http.StatusNotFound, "NoSuchUpload", "no such upload"}
+	errS3InvalidPart  = &s3Error{http.StatusBadRequest, "InvalidPart", "a part is missing or its ETag does not match"}
+	errS3PartOrder    = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "parts must be in ascending order"}
+	errS3MalformedXML = &s3Error{http.StatusBadRequest, "MalformedXML", "malformed xml body"}
+)
+
+// convert the errors of the handlers
+func toS3Error(err error) *s3Error {
+	var e *s3Error
+
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, digest.ErrMismatch):
+		return errS3ContentSHA
+	case os.IsNotExist(err):
+		return errS3NoSuchKey
+	case os.IsPermission(err), IsReadOnly(err), errors.Is(err, syscall.EROFS):
+		return errS3AccessDenied
+	case IsNotImplemented(err):
+		return &s3Error{http.StatusNotImplemented, "NotImplemented", err.Error()}
+	case IsUser(err):
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", err.Error()}
+	default:
+		log.Printf("unexpected error %v", err)
+		return &s3Error{http.StatusInternalServerError, "InternalError", "internal error"}
+	}
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	e := toS3Error(err)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.status)
+
+	// head responses have no body to explain the error
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{
+		Code:     e.code,
+		Message:  e.message,
+		Resource: r.URL.Path,
+	})
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// most keys in a list response, the s3 limit
+const s3MaxKeys = 1000
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3Prefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	MaxKeys               int
+	KeyCount              int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3Prefix
+}
+
+// list the objects of the bucket at root, the continuation token
+// is the last key of the previous page
+func (m *s3Mount) listObjects(w http.ResponseWriter, r *http.Request, bucket, root string) error {
+	q := r.URL.Query()
+
+	res := s3ListResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		MaxKeys:           s3MaxKeys,
+	}
+
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid max-keys"}
+		}
+		if n < res.MaxKeys {
+			res.MaxKeys = n
+		}
+	}
+
+	after := res.StartAfter
+	if res.ContinuationToken != "" {
+		byt, err := base64.StdEncoding.DecodeString(res.ContinuationToken)
+		if err != nil {
+			return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid continuation-token"}
+		}
+		after = string(byt)
+	}
+
+	var entries []s3Entry
+	err := m.walk(root, "", res.Prefix, res.Delimiter, &entries)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	if res.Delimiter != "" && res.Delimiter != "/" {
+		entries = groupPrefixes(entries, res.Prefix, res.Delimiter)
+	}
+
+	for _, e := range entries {
+		if e.key <= after {
+			continue
+		}
+
+		if res.KeyCount == res.MaxKeys {
+			res.IsTruncated = true
+			break
+		}
+
+		if e.fi == nil {
+			res.CommonPrefixes = append(res.CommonPrefixes, s3Prefix{e.key})
+		} else {
+			res.Contents = append(res.Contents, s3Object{
+				Key:          e.key,
+				LastModified: s3Time(e.fi.ModTime()),
+				ETag:         etag(e.fi),
+				Size:         e.fi.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+
+		res.KeyCount++
+		after = e.key
+	}
+
+	if res.IsTruncated {
+		res.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(after))
+	}
+
+	return writeXML(w, res)
+}
+
+// an object, or a common prefix if fi is nil
+type s3Entry struct {
+	key string
+	fi  os.FileInfo
+}
+
+// collect the objects of dir whose keys start with prefix, with a
+// "/" delimiter the directories under prefix are common prefixes
+func (m *s3Mount) walk(root, dir, prefix, delimiter string, entries *[]s3Entry) error {
+	rc, err := m.handler.HandleGet(http.Header{}, path.Join(root, dir))
+	if err != nil {
+		return err
+	}
+
+	var names map[string]os.FileMode
+	err = json.NewDecoder(rc).Decode(&names)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	for name, mode := range names {
+		key := strings.TrimPrefix(path.Join(dir, name), "/")
+
+		if mode.IsDir() {
+			switch {
+			case strings.HasPrefix(prefix, key+"/"):
+				err = m.walk(root, key, prefix, delimiter, entries)
+			case !strings.HasPrefix(key+"/", prefix):
+			case delimiter == "/":
+				*entries = append(*entries, s3Entry{key: key + "/"})
+			default:
+				err = m.walk(root, key, prefix, delimiter, entries)
+			}
+
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+
+		if !mode.IsRegular() || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		fi, err := m.handler.HandleHead(http.Header{}, path.Join(root, key))
+		if err != nil {
+			// removed since the listing
+			continue
+		}
+
+		*entries = append(*entries, s3Entry{key: key, fi: fi})
+	}
+
+	return nil
+}
+
+// fold the keys holding delimiter after prefix into common prefixes,
+// the entries are sorted
+func groupPrefixes(entries []s3Entry, prefix, delimiter string) []s3Entry {
+	ret := entries[:0]
+
+	for _, e := range entries {
+		i := strings.Index(e.key[len(prefix):], delimiter)
+		if e.fi == nil || i < 0 {
+			ret = append(ret, e)
+			continue
+		}
+
+		common := e.key[:len(prefix)+i+len(delimiter)]
+		if len(ret) == 0 || ret[len(ret)-1].key != common {
+			ret = append(ret, s3Entry{key: common})
+		}
+	}
+
+	return ret
+}
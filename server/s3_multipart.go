@@ -0,0 +1,232 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+)
+
+/*
+the parts of multipart uploads are kept in a temporary directory
+of the server until the upload completes, then they are written to
+the store as one file through the FsHandler. Uploads in progress
+don't survive a restart
+*/
+
+// the highest part number, the s3 limit
+const s3MaxParts = 10000
+
+type s3Upload struct {
+	user, key string
+	dir       string
+	// quoted md5 of each part, the ETags sent back for them
+	etags map[int]string
+}
+
+func (m *s3Mount) createUpload(w http.ResponseWriter, user, key string) error {
+	var rnd [16]byte
+	_, err := rand.Read(rnd[:])
+	if err != nil {
+		return err
+	}
+	id := hex.EncodeToString(rnd[:])
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.partsDir == "" {
+		m.partsDir, err = ioutil.TempDir("", "r3stfs-s3-")
+		if err != nil {
+			return err
+		}
+	}
+
+	dir := path.Join(m.partsDir, id)
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	m.uploads[id] = &s3Upload{
+		user:  user,
+		key:   key,
+		dir:   dir,
+		etags: make(map[int]string),
+	}
+
+	return writeXML(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{
+		Xmlns:    s3Namespace,
+		Bucket:   user,
+		Key:      key,
+		UploadId: id,
+	})
+}
+
+// the upload of a request, it has to be the user's and for the key
+func (m *s3Mount) upload(user, key, id string) (*s3Upload, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	u, ok := m.uploads[id]
+	if !ok || u.user != user || u.key != key {
+		return nil, errS3NoSuchUpload
+	}
+
+	return u, nil
+}
+
+func (m *s3Mount) uploadPart(w http.ResponseWriter, r *http.Request, sig *sigV4, key string) error {
+	q := r.URL.Query()
+
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > s3MaxParts {
+		return &s3Error{http.StatusBadRequest, "InvalidArgument", "invalid partNumber"}
+	}
+
+	u, err := m.upload(sig.user, key, q.Get("uploadId"))
+	if err != nil {
+		return err
+	}
+
+	body, err := sig.body(r)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path.Join(u.dir, strconv.Itoa(n)))
+	if err != nil {
+		return err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(f, io.TeeReader(body, hash))
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+
+	m.lock.Lock()
+	u.etags[n] = etag
+	m.lock.Unlock()
+
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+func (m *s3Mount) completeUpload(w http.ResponseWriter, r *http.Request, sig *sigV4, root, key string) error {
+	id := r.URL.Query().Get("uploadId")
+
+	u, err := m.upload(sig.user, key, id)
+	if err != nil {
+		return err
+	}
+
+	body, err := sig.body(r)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+
+	err = xml.NewDecoder(body).Decode(&req)
+	if err != nil || len(req.Parts) == 0 {
+		return errS3MalformedXML
+	}
+
+	var readers []io.Reader
+	defer func() {
+		for _, r := range readers {
+			r.(*os.File).Close()
+		}
+	}()
+
+	m.lock.Lock()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			m.lock.Unlock()
+			return errS3PartOrder
+		}
+
+		// clients may leave the quotes out
+		if etag, ok := u.etags[p.PartNumber]; !ok || (etag != p.ETag && etag != `"`+p.ETag+`"`) {
+			m.lock.Unlock()
+			return errS3InvalidPart
+		}
+	}
+	m.lock.Unlock()
+
+	for _, p := range req.Parts {
+		f, err := os.Open(path.Join(u.dir, strconv.Itoa(p.PartNumber)))
+		if err != nil {
+			return err
+		}
+		readers = append(readers, f)
+	}
+
+	fi, err := m.writeObject(root, key, io.MultiReader(readers...))
+	if err != nil {
+		return err
+	}
+
+	m.removeUpload(id)
+
+	return writeXML(w, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Xmlns:    s3Namespace,
+		Location: r.URL.Path,
+		Bucket:   sig.user,
+		Key:      key,
+		ETag:     etag(fi),
+	})
+}
+
+func (m *s3Mount) abortUpload(w http.ResponseWriter, user, key, id string) error {
+	_, err := m.upload(user, key, id)
+	if err != nil {
+		return err
+	}
+
+	m.removeUpload(id)
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (m *s3Mount) removeUpload(id string) {
+	m.lock.Lock()
+	u, ok := m.uploads[id]
+	delete(m.uploads, id)
+	m.lock.Unlock()
+
+	if ok {
+		os.RemoveAll(u.dir)
+	}
+}
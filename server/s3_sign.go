@@ -0,0 +1,314 @@
+package server
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ear7h/r3stfs/digest"
+)
+
+/*
+signature version 4 of aws, the s3 mount only takes signatures in
+the Authorization header
+
+Authorization: AWS4-HMAC-SHA256 Credential=julio/20170802/us-east-1/s3/aws4_request,
+	SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=...
+
+the access key is the user name. Bodies are checked against the
+x-amz-content-sha256 header, or chunk by chunk when they are sent
+as aws-chunked streams
+*/
+
+const (
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+
+	maxClockSkew = 15 * time.Minute
+	// largest chunk of an aws-chunked body, they are checked whole
+	maxChunkSize = 16 * 1024 * 1024
+)
+
+// hex sha-256 of an empty string
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// a verified request, chunked bodies continue its signature chain
+type sigV4 struct {
+	user      string
+	date      string // x-amz-date
+	scope     string // date/region/service/aws4_request
+	key       []byte
+	signature string
+}
+
+// check the signature of an s3 request
+func (db *UserDB) verifyV4(r *http.Request) (*sigV4, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, sigAlgorithm+" ") {
+		return nil, errS3AccessDenied
+	}
+
+	fields := make(map[string]string)
+	for _, kv := range strings.Split(auth[len(sigAlgorithm)+1:], ",") {
+		arr := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(arr) == 2 {
+			fields[arr[0]] = arr[1]
+		}
+	}
+
+	// access key, date, region, service, aws4_request
+	cred := strings.Split(fields["Credential"], "/")
+	if len(cred) != 5 || cred[4] != "aws4_request" || fields["SignedHeaders"] == "" {
+		return nil, errS3AuthHeader
+	}
+
+	secret, ok := db.Secret(cred[0])
+	if !ok {
+		return nil, errS3AccessKey
+	}
+
+	date := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, date)
+	if err != nil || !strings.HasPrefix(date, cred[1]) {
+		return nil, errS3AuthHeader
+	}
+
+	if skew := time.Since(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errS3TimeSkewed
+	}
+
+	if r.Header.Get("X-Amz-Content-Sha256") == "" {
+		return nil, errS3MissingSHA
+	}
+
+	sig := &sigV4{
+		user:  cred[0],
+		date:  date,
+		scope: strings.Join(cred[1:], "/"),
+		key:   signingKey(secret, cred[1], cred[2], cred[3]),
+	}
+
+	canonical := canonicalRequest(r, strings.Split(fields["SignedHeaders"], ";"))
+	sig.signature = sig.sign(sigAlgorithm, hexSHA256([]byte(canonical)))
+
+	if !hmac.Equal([]byte(sig.signature), []byte(fields["Signature"])) {
+		return nil, errS3Signature
+	}
+
+	return sig, nil
+}
+
+// sign the string made of the algorithm, date, scope and lines
+func (sig *sigV4) sign(algorithm string, lines ...string) string {
+	sts := strings.Join(append([]string{algorithm, sig.date, sig.scope}, lines...), "\n")
+	return hex.EncodeToString(hmacSHA256(sig.key, sts))
+}
+
+// body of a request, verified against the signed payload hash
+func (sig *sigV4) body(r *http.Request) (io.Reader, error) {
+	switch sha := r.Header.Get("X-Amz-Content-Sha256"); sha {
+	case unsignedPayload:
+		return r.Body, nil
+	case streamingPayload:
+		return &chunkedReader{r: bufio.NewReader(r.Body), sig: sig, prev: sig.signature}, nil
+	case streamingUnsignedTrailer:
+		return &chunkedReader{r: bufio.NewReader(r.Body)}, nil
+	default:
+		want, err := hex.DecodeString(sha)
+		if err != nil || len(want) != sha256.Size {
+			return nil, errS3ContentSHA
+		}
+
+		// fails with digest.ErrMismatch at the end of a bad body
+		return digest.NewReader(r.Body, want), nil
+	}
+}
+
+func canonicalRequest(r *http.Request, signed []string) string {
+	var headers strings.Builder
+	for _, name := range signed {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")
+		}
+
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(r.URL.Path, false),
+		canonicalQuery(r),
+		headers.String(),
+		strings.Join(signed, ";"),
+		r.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+}
+
+func canonicalQuery(r *http.Request) string {
+	var pairs []string
+	for k, values := range r.URL.Query() {
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// percent encode everything but the unreserved characters of rfc 3986
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+
+	return b.String()
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+/*
+aws-chunked bodies are a list of chunks ending with an empty one,
+signed chunks carry a signature chained from the request's
+
+10000;chunk-signature=...\r\n
+<65536 bytes>\r\n
+0;chunk-signature=...\r\n
+\r\n
+
+unsigned ones leave the signature out and may end with trailers
+*/
+
+type chunkedReader struct {
+	r *bufio.Reader
+	// nil for unsigned chunks
+	sig  *sigV4
+	prev string // signature of the previous chunk
+
+	buf  []byte
+	done bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+
+		err := cr.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+// read and check the next chunk
+func (cr *chunkedReader) next() error {
+	line, err := cr.line()
+	if err != nil {
+		return err
+	}
+
+	arr := strings.SplitN(line, ";", 2)
+	size, err := strconv.ParseInt(arr[0], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errS3Chunk
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(cr.r, data)
+	if err != nil {
+		return errS3Chunk
+	}
+
+	if cr.sig != nil {
+		if len(arr) != 2 || !strings.HasPrefix(arr[1], "chunk-signature=") {
+			return errS3Chunk
+		}
+
+		want := cr.sig.sign(sigAlgorithm+"-PAYLOAD", cr.prev, emptySHA256, hexSHA256(data))
+		got := strings.TrimPrefix(arr[1], "chunk-signature=")
+		if !hmac.Equal([]byte(want), []byte(got)) {
+			return errS3Signature
+		}
+		cr.prev = got
+	}
+
+	if size > 0 {
+		if line, err := cr.line(); err != nil || line != "" {
+			return errS3Chunk
+		}
+
+		cr.buf = data
+		return nil
+	}
+
+	// trailers up to the empty line closing the body
+	for {
+		line, err := cr.line()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+	}
+
+	cr.done = true
+	return nil
+}
+
+func (cr *chunkedReader) line() (string, error) {
+	line, err := cr.r.ReadString('\n')
+	if err != nil {
+		return "", errS3Chunk
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+
+	"github.com/ear7h/r3stfs/sandbox"
+)
+
+func TestS3(t *testing.T) {
+	root := t.TempDir()
+	userRoot := path.Join(root, "julio")
+
+	err := os.Mkdir(userRoot, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := sandbox.NewUserStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	S3Mount("", users, &R3stFsHandler{}, NewUserDB(map[string]string{"julio": "secret"})).mount(mux)
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds: credentials.NewStaticV4("julio", "secret", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	ok, err := client.BucketExists(ctx, "julio")
+	if err != nil || !ok {
+		t.Fatalf("bucket exists: %v %v", ok, err)
+	}
+
+	// the signature checks the secret
+	bad, _ := minio.New(u.Host, &minio.Options{
+		Creds: credentials.NewStaticV4("julio", "wrong", ""),
+	})
+	_, err = bad.StatObject(ctx, "julio", "a.txt", minio.StatObjectOptions{})
+	if minio.ToErrorResponse(err).StatusCode != http.StatusForbidden {
+		t.Errorf("wrong secret: %v", err)
+	}
+
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/sub/c.txt"} {
+		data := []byte("hello " + key)
+		_, err = client.PutObject(ctx, "julio", key, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{})
+		if err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+
+	byt, err := ioutil.ReadFile(path.Join(userRoot, "dir/sub/c.txt"))
+	if err != nil || string(byt) != "hello dir/sub/c.txt" {
+		t.Errorf("c.txt on disk: %q %v", byt, err)
+	}
+
+	opts := minio.GetObjectOptions{}
+	opts.SetRange(6, 10)
+	obj, err := client.GetObject(ctx, "julio", "dir/b.txt", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byt, err = ioutil.ReadAll(obj)
+	obj.Close()
+	if err != nil || string(byt) != "dir/b" {
+		t.Errorf("range: %q %v", byt, err)
+	}
+
+	info, err := client.StatObject(ctx, "julio", "a.txt", minio.StatObjectOptions{})
+	if err != nil || info.Size != int64(len("hello a.txt")) {
+		t.Errorf("stat: %+v %v", info, err)
+	}
+
+	var keys []string
+	for obj := range client.ListObjects(ctx, "julio", minio.ListObjectsOptions{Prefix: "dir/"}) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+	if len(keys) != 2 || keys[0] != "dir/b.txt" || keys[1] != "dir/sub/" {
+		t.Errorf("list with delimiter: %v", keys)
+	}
+
+	keys = nil
+	for obj := range client.ListObjects(ctx, "julio", minio.ListObjectsOptions{Recursive: true, MaxKeys: 1}) {
+		if obj.Err != nil {
+			t.Fatal(obj.Err)
+		}
+		keys = append(keys, obj.Key)
+	}
+	if len(keys) != 3 || keys[2] != "dir/sub/c.txt" {
+		t.Errorf("recursive list: %v", keys)
+	}
+
+	err = client.RemoveObject(ctx, "julio", "a.txt", minio.RemoveObjectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(userRoot, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("a.txt wasn't removed: %v", err)
+	}
+
+	// two parts of 5 MiB, the smallest minio-go uploads
+	big := bytes.Repeat([]byte("0123456789abcdef"), 5<<16+1)
+	_, err = client.PutObject(ctx, "julio", "big/file.bin", bytes.NewReader(big), int64(len(big)), minio.PutObjectOptions{
+		PartSize: 5 << 20,
+	})
+	if err != nil {
+		t.Fatalf("multipart: %v", err)
+	}
+
+	byt, err = ioutil.ReadFile(path.Join(userRoot, "big/file.bin"))
+	if err != nil || !bytes.Equal(byt, big) {
+		t.Errorf("multipart on disk: %d bytes %v", len(byt), err)
+	}
+
+	_, err = client.StatObject(ctx, "julio", "../escape", minio.StatObjectOptions{})
+	if err == nil {
+		t.Errorf("key out of the bucket")
+	}
+}
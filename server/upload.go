@@ -0,0 +1,203 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+a PUT is written to a temporary file in the directory of the file and
+renamed over it once the whole body was received and checked against
+its digest, readers see the old file or the new one and a dropped
+upload leaves the old one. Only the rename holds the lock of the file,
+of concurrent puts the last to finish wins. The file keeps the mode
+and extended attributes it had, other links to it keep the old content
+
+a PUT over webdav and a file opened over 9p to truncate it are
+written to a temporary the same way, renamed over the file when it is
+closed. One whose upload broke off is removed instead
+
+a server which stopped during an upload or a copy leaves its
+temporary, ServeFs removes those older than the server when it starts
+*/
+
+const uploadTempPrefix = ".r3stfs-upload."
+
+// upload temporaries are hidden from clients
+func isUploadTemp(filename string) bool {
+	return strings.HasPrefix(path.Base(filename), uploadTempPrefix)
+}
+
+// write body to filename in place of its content, perm is the mode of
+// a new file
+func (h *R3stFsHandler) putFile(header http.Header, filename string, perm os.FileMode, body io.Reader) (int64, error) {
+	if fi, err := os.Stat(filename); err == nil && !fi.Mode().IsRegular() {
+		return 0, &os.PathError{Op: "put", Path: filename, Err: unix.EISDIR}
+	}
+
+	tmp, num, err := h.writeTemp(header, filename, perm, body)
+	if err == nil {
+		err = h.replace(filename, tmp)
+	}
+	if err != nil {
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		return 0, err
+	}
+
+	// the rename is on disk too
+	if header.Get("Sync") == "T" {
+		err = syncDir(path.Dir(filename))
+	}
+
+	return num, err
+}
+
+// write body to a temporary beside filename, its directory stays
+// where it is meanwhile
+func (h *R3stFsHandler) writeTemp(header http.Header, filename string, perm os.FileMode, body io.Reader) (string, int64, error) {
+	defer h.locks.read(path.Dir(filename))()
+
+	f, err := createTemp(filename, perm)
+	if err != nil {
+		return "", 0, err
+	}
+	tmp := f.Name()
+
+	num, err := writeContent(header, f, body)
+	if err == nil && header.Get("Sync") == "T" {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return tmp, num, err
+}
+
+// open a temporary beside filename for content replace puts in its
+// place, its directory is only held while it is made
+func (h *R3stFsHandler) openTemp(filename string, perm os.FileMode) (*os.File, error) {
+	defer h.locks.read(path.Dir(filename))()
+
+	return createTemp(filename, perm)
+}
+
+func createTemp(filename string, perm os.FileMode) (*os.File, error) {
+	tmp, err := tempName(filename, uploadTempPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_RDWR, perm)
+}
+
+// rename tmp over filename, which keeps what it had but its content
+func (h *R3stFsHandler) replace(filename, tmp string) error {
+	defer h.locks.write(filename)()
+
+	old, err := os.Stat(filename)
+	switch {
+	case err == nil && !old.Mode().IsRegular():
+		return &os.PathError{Op: "put", Path: filename, Err: unix.EISDIR}
+	case err == nil:
+		err = keepAttrs(filename, tmp, old.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	return os.Rename(tmp, filename)
+}
+
+// give tmp the mode and extended attributes of filename, attributes of
+// sidecars stay with the name
+func keepAttrs(filename, tmp string, perm os.FileMode) error {
+	// the umask may have taken bits away
+	err := os.Chmod(tmp, perm)
+	if err != nil {
+		return err
+	}
+
+	size, err := unix.Listxattr(filename, nil)
+	if notSupported(err) || size == 0 {
+		return nil
+	}
+	if err != nil {
+		return xattrError(filename, "", err)
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Listxattr(filename, buf)
+	if err != nil {
+		return xattrError(filename, "", err)
+	}
+
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		value, err := getXAttr(filename, name)
+		if err != nil {
+			return err
+		}
+
+		// those of the system, like security.selinux, may be denied
+		err = unix.Setxattr(tmp, name, value, 0)
+		if err != nil && err != unix.EPERM {
+			return xattrError(tmp, name, err)
+		}
+	}
+
+	return nil
+}
+
+// remove the upload and copy temporaries under root last changed
+// before started, they ended with a previous server
+func removeTemps(root string, started time.Time) {
+	n := 0
+	err := filepath.Walk(root, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// unreadable directories are left alone
+			return nil
+		}
+
+		switch {
+		case !fi.ModTime().Before(started):
+			return nil
+		case fi.Mode().IsRegular() && isUploadTemp(name):
+			if os.Remove(name) == nil {
+				n++
+			}
+		case isCopyTemp(name):
+			// a copy of a directory goes with all of its content
+			if os.RemoveAll(name) == nil {
+				n++
+			}
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		fmt.Println("temporaries: ", err)
+	}
+	if n > 0 {
+		fmt.Printf("removed %d temporaries of interrupted uploads and copies\n", n)
+	}
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ear7h/r3stfs/digest"
+)
+
+// the upload temporaries left in dir
+func uploadTemps(t *testing.T, dir string) []string {
+	names, err := filepath.Glob(path.Join(dir, uploadTempPrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return names
+}
+
+func TestAtomicPut(t *testing.T) {
+	ts, dirroot := startTestServer(t)
+
+	filename := path.Join(dirroot, "app.conf")
+	err := ioutil.WriteFile(filename, []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xattrs := unix.Setxattr(filename, "user.tag", []byte("blue"), 0) == nil
+
+	put := func(body []byte, sum []byte) int {
+		req, _ := http.NewRequest(http.MethodPut, ts.URL+"/app.conf", bytes.NewReader(body))
+		req.Header.Set("File-Mode", "644")
+		req.Header.Set(digest.Header, digest.Format(sum))
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+
+		return res.StatusCode
+	}
+
+	// a body which doesn't match its digest leaves the file alone
+	if status := put([]byte("corrupt"), make([]byte, 32)); status != http.StatusBadRequest {
+		t.Errorf("bad digest: %d", status)
+	}
+	if byt, _ := ioutil.ReadFile(filename); string(byt) != "old" {
+		t.Errorf("a refused upload left %q", byt)
+	}
+
+	// as does an upload which stops half way
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "PUT /app.conf HTTP/1.1\r\nHost: x\r\nFile-Mode: 644\r\nContent-Length: 100\r\n\r\nhalf")
+	conn.Close()
+
+	for i := 0; len(uploadTemps(t, dirroot)) > 0; i++ {
+		if i == 100 {
+			t.Fatal("the dropped upload's temporary stayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if byt, _ := ioutil.ReadFile(filename); string(byt) != "old" {
+		t.Errorf("a dropped upload left %q", byt)
+	}
+
+	// a reader of the old file keeps reading it
+	reader, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	body := []byte("new")
+	sum, _ := digest.Sum(bytes.NewReader(body))
+	if status := put(body, sum); status != http.StatusOK {
+		t.Fatalf("put: %d", status)
+	}
+
+	if byt, _ := ioutil.ReadFile(filename); string(byt) != "new" {
+		t.Errorf("put stored %q", byt)
+	}
+	if byt, _ := ioutil.ReadAll(reader); string(byt) != "old" {
+		t.Errorf("the open file read %q", byt)
+	}
+
+	// the file is the same but for its content
+	fi, _ := os.Stat(filename)
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode %v after the put", fi.Mode())
+	}
+	if value, err := getXAttr(filename, "user.tag"); xattrs && string(value) != "blue" {
+		t.Errorf("user.tag %q after the put: %v", value, err)
+	}
+
+	if names := uploadTemps(t, dirroot); len(names) != 0 {
+		t.Errorf("temporaries left: %v", names)
+	}
+}
+
+func TestRemoveTemps(t *testing.T) {
+	dir := t.TempDir()
+	os.Mkdir(path.Join(dir, "sub"), 0700)
+
+	orphan := path.Join(dir, "sub", uploadTempPrefix+"0badc0de")
+	current := path.Join(dir, uploadTempPrefix+"c0ffee00")
+	kept := path.Join(dir, "keep.txt")
+	copied := path.Join(dir, copyTempPrefix+"feedf00d")
+	os.Mkdir(copied, 0700)
+
+	for _, name := range []string{orphan, current, kept, path.Join(copied, "a.txt")} {
+		err := ioutil.WriteFile(name, []byte("x"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the orphan is from before the server started
+	started := time.Now()
+	old := started.Add(-time.Hour)
+	os.Chtimes(orphan, old, old)
+	os.Chtimes(kept, old, old)
+	os.Chtimes(copied, old, old)
+	later := started.Add(time.Second)
+	os.Chtimes(current, later, later)
+
+	removeTemps(dir, started)
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan: %v", err)
+	}
+	if _, err := os.Stat(copied); !os.IsNotExist(err) {
+		t.Errorf("the copy: %v", err)
+	}
+	if _, err := os.Stat(current); err != nil {
+		t.Errorf("the temporary of a running upload: %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("a file: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+)
+
+/*
+the user database is a json object of user names and secrets
+
+{"julio": "correct horse battery staple"}
+
+the secret is the password of basic auth and the secret key of
+signed requests, those need it in the clear to check signatures
+*/
+
+// UserDB holds the secrets of the users of the front ends which
+// authenticate, like the webdav mount
+type UserDB struct {
+	secrets map[string]string
+}
+
+func NewUserDB(secrets map[string]string) *UserDB {
+	return &UserDB{secrets: secrets}
+}
+
+// LoadUserDB reads a user database file
+func LoadUserDB(filename string) (*UserDB, error) {
+	byt, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	err = json.Unmarshal(byt, &secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewUserDB(secrets), nil
+}
+
+// Secret of user, false if there is no such user
+func (db *UserDB) Secret(user string) (string, bool) {
+	secret, ok := db.secrets[user]
+	return secret, ok
+}
+
+// the user of a request with basic auth, false if the credentials
+// are missing or wrong
+func (db *UserDB) basicAuth(r *http.Request) (string, bool) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	secret, ok := db.Secret(user)
+	if !ok || subtle.ConstantTimeCompare([]byte(secret), []byte(pass)) != 1 {
+		return "", false
+	}
+
+	return user, true
+}
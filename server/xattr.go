@@ -0,0 +1,298 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+GET /dir/file.txt?xattr=user.tag	value of the attribute
+GET /dir/file.txt?xattr			json array of attribute names
+PUT /dir/file.txt?xattr=user.tag	set the attribute to the body
+	Xattr-Flags: create | replace
+DELETE /dir/file.txt?xattr=user.tag	remove the attribute
+
+a missing attribute is answered with a 404 and an Xattr-Missing
+header, so the client can tell it apart from a missing file
+*/
+
+// largest attribute value accepted, the linux limit
+const maxXAttrSize = 64 * 1024
+
+func (h *fsHandlerWrapper) serveXAttr(w http.ResponseWriter, r *http.Request, filename string) {
+	attr := r.URL.Query().Get("xattr")
+
+	if attr == "" && r.Method != http.MethodGet {
+		http.Error(w, "missing attribute name", http.StatusBadRequest)
+		return
+	}
+
+	var res []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		if attr == "" {
+			var names []string
+			names, err = h.HandleListXAttr(r.Header, filename)
+			if err == nil {
+				res, err = json.Marshal(names)
+			}
+		} else {
+			res, err = h.HandleGetXAttr(r.Header, filename, attr)
+		}
+	case http.MethodPut:
+		var value []byte
+		value, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxXAttrSize+1))
+		if err == nil && len(value) > maxXAttrSize {
+			err = NewUserError("attribute value too large")
+		}
+		if err == nil {
+			err = h.HandleSetXAttr(r.Header, filename, attr, value)
+		}
+	case http.MethodDelete:
+		err = h.HandleRemoveXAttr(r.Header, filename, attr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		if IsNoAttr(err) {
+			w.Header().Set("Xattr-Missing", attr)
+		}
+		writeError(w, r, filename, err)
+		return
+	}
+
+	w.Write(res)
+}
+
+/*
+extended attributes are stored natively when the server's file
+system supports them, attributes the file system refuses (like
+macOS names on linux) go to a sidecar json file next to the file
+
+/dir/file.txt
+/dir/.r3stfs-xattr.file.txt
+*/
+
+const xattrSidecarPrefix = ".r3stfs-xattr."
+
+func sidecarName(filename string) string {
+	dir, base := path.Split(filename)
+	return path.Join(dir, xattrSidecarPrefix+base)
+}
+
+// move the attributes of a renamed file, a replaced file's go away
+func moveSidecar(oldname, newname string) {
+	err := os.Rename(sidecarName(oldname), sidecarName(newname))
+	if os.IsNotExist(err) {
+		os.Remove(sidecarName(newname))
+	}
+}
+
+// sidecars are hidden from clients
+func isSidecar(filename string) bool {
+	return strings.HasPrefix(path.Base(filename), xattrSidecarPrefix)
+}
+
+func readSidecar(filename string) (map[string][]byte, error) {
+	attrs := make(map[string][]byte)
+
+	byt, err := ioutil.ReadFile(sidecarName(filename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return attrs, nil
+		}
+		return nil, err
+	}
+
+	err = json.Unmarshal(byt, &attrs)
+	return attrs, err
+}
+
+func writeSidecar(filename string, attrs map[string][]byte) error {
+	if len(attrs) == 0 {
+		err := os.Remove(sidecarName(filename))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	byt, err := json.Marshal(attrs)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(sidecarName(filename), byt, 0600)
+}
+
+func notSupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// convert the errors of xattr syscalls
+func xattrError(filename, attr string, err error) error {
+	switch {
+	case errors.Is(err, errNoAttr):
+		return NewNoAttrError(fmt.Sprintf("no attribute %s", attr))
+	case errors.Is(err, unix.E2BIG), errors.Is(err, unix.ERANGE):
+		return NewUserError("attribute value too large")
+	default:
+		return &os.PathError{Op: "xattr", Path: filename, Err: err}
+	}
+}
+
+func getXAttr(filename, attr string) ([]byte, error) {
+	// the sidecar can't tell if the file exists
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	for {
+		size, err := unix.Getxattr(filename, attr, nil)
+		if notSupported(err) {
+			break
+		}
+		if err != nil {
+			return nil, xattrError(filename, attr, err)
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Getxattr(filename, attr, buf)
+		if errors.Is(err, unix.ERANGE) {
+			// the value grew in between the calls
+			continue
+		}
+		if err != nil {
+			return nil, xattrError(filename, attr, err)
+		}
+
+		return buf[:size], nil
+	}
+
+	attrs, err := readSidecar(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	value, ok := attrs[attr]
+	if !ok {
+		return nil, xattrError(filename, attr, errNoAttr)
+	}
+
+	return value, nil
+}
+
+func listXAttr(filename string) ([]string, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	size, err := unix.Listxattr(filename, nil)
+	if err == nil && size > 0 {
+		buf := make([]byte, size)
+		size, err = unix.Listxattr(filename, buf)
+		if err == nil {
+			for _, name := range strings.Split(string(buf[:size]), "\x00") {
+				if name != "" {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	if err != nil && !notSupported(err) {
+		return nil, xattrError(filename, "", err)
+	}
+
+	attrs, err := readSidecar(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range attrs {
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// flags are the Xattr-Flags header value
+func setXAttr(filename, attr string, value []byte, flags string) error {
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+
+	var flag int
+	switch flags {
+	case "":
+	case "create":
+		flag = unix.XATTR_CREATE
+	case "replace":
+		flag = unix.XATTR_REPLACE
+	default:
+		return NewUserError("invalid Xattr-Flags " + flags)
+	}
+
+	err := unix.Setxattr(filename, attr, value, flag)
+	if !notSupported(err) {
+		if err != nil {
+			return xattrError(filename, attr, err)
+		}
+		return nil
+	}
+
+	attrs, err := readSidecar(filename)
+	if err != nil {
+		return err
+	}
+
+	_, ok := attrs[attr]
+	switch {
+	case ok && flag == unix.XATTR_CREATE:
+		return &os.PathError{Op: "xattr", Path: filename, Err: os.ErrExist}
+	case !ok && flag == unix.XATTR_REPLACE:
+		return xattrError(filename, attr, errNoAttr)
+	}
+
+	attrs[attr] = value
+	return writeSidecar(filename, attrs)
+}
+
+func removeXAttr(filename, attr string) error {
+	if _, err := os.Stat(filename); err != nil {
+		return err
+	}
+
+	err := unix.Removexattr(filename, attr)
+	if !notSupported(err) {
+		if err != nil {
+			return xattrError(filename, attr, err)
+		}
+		return nil
+	}
+
+	attrs, err := readSidecar(filename)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := attrs[attr]; !ok {
+		return xattrError(filename, attr, errNoAttr)
+	}
+
+	delete(attrs, attr)
+	return writeSidecar(filename, attrs)
+}
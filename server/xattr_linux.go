@@ -0,0 +1,6 @@
+package server
+
+import "golang.org/x/sys/unix"
+
+// the errno of a missing attribute
+const errNoAttr = unix.ENODATA
@@ -0,0 +1,69 @@
+package sparse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// AllocMode holds the flags of an allocate request, the zero value
+// preallocates the range and grows the file to cover it
+type AllocMode uint32
+
+const (
+	// don't change the size of the file
+	KeepSize AllocMode = 1 << iota
+	// deallocate the range, it reads as zeros after
+	PunchHole
+	// zero the range, keeping it allocated
+	ZeroRange
+)
+
+var allocModeNames = []struct {
+	mode AllocMode
+	name string
+}{
+	{KeepSize, "keep-size"},
+	{PunchHole, "punch-hole"},
+	{ZeroRange, "zero-range"},
+}
+
+// String returns the comma separated flag names sent over the wire
+func (m AllocMode) String() string {
+	var names []string
+	for _, v := range allocModeNames {
+		if m&v.mode != 0 {
+			names = append(names, v.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+func ParseAllocMode(str string) (AllocMode, error) {
+	var m AllocMode
+
+	for _, name := range strings.Split(str, ",") {
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, v := range allocModeNames {
+			if v.name == name {
+				m |= v.mode
+				found = true
+			}
+		}
+
+		if !found {
+			return 0, fmt.Errorf("unknown allocate flag %q", name)
+		}
+	}
+
+	// a punched hole never changes the size, as in fallocate(2)
+	if m&PunchHole != 0 && m&KeepSize == 0 {
+		return 0, fmt.Errorf("punch-hole requires keep-size")
+	}
+
+	return m, nil
+}
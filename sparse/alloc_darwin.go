@@ -0,0 +1,70 @@
+package sparse
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allocate preallocates, zeros or punches a hole in a range of f
+//
+// darwin has no fallocate, F_PUNCHHOLE and F_PREALLOCATE are used
+// instead and the size is set by hand
+func Allocate(f *os.File, off, length int64, mode AllocMode) error {
+	fail := func(err error) error {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+
+	if mode&(PunchHole|ZeroRange) != 0 {
+		// from `man fcntl`, struct fpunchhole
+		k := struct {
+			Flags    uint32
+			Reserved uint32
+			Offset   int64
+			Length   int64
+		}{0, 0, off, length}
+
+		_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), uintptr(unix.F_PUNCHHOLE), uintptr(unsafe.Pointer(&k)))
+		if errno != 0 {
+			return fail(errno)
+		}
+
+		if mode&PunchHole != 0 {
+			return nil
+		}
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// F_PEOFPOSMODE allocates past the physical end of the file
+	if need := off + length - stat.Size(); need > 0 {
+		k := unix.Fstore_t{
+			Flags:   unix.F_ALLOCATEALL,
+			Posmode: unix.F_PEOFPOSMODE,
+			Offset:  0,
+			Length:  need,
+		}
+
+		err = unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, &k)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if mode&KeepSize == 0 && stat.Size() < off+length {
+		return f.Truncate(off + length)
+	}
+
+	return nil
+}
+
+// ModeFromFallocate converts the mode of an allocate call, on darwin
+// it is only ever a plain preallocation
+func ModeFromFallocate(mode uint32) AllocMode {
+	return 0
+}
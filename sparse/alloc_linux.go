@@ -0,0 +1,44 @@
+package sparse
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allocate preallocates, zeros or punches a hole in a range of f
+func Allocate(f *os.File, off, length int64, mode AllocMode) error {
+	var flags uint32
+	if mode&KeepSize != 0 {
+		flags |= unix.FALLOC_FL_KEEP_SIZE
+	}
+	if mode&PunchHole != 0 {
+		flags |= unix.FALLOC_FL_PUNCH_HOLE
+	}
+	if mode&ZeroRange != 0 {
+		flags |= unix.FALLOC_FL_ZERO_RANGE
+	}
+
+	err := unix.Fallocate(int(f.Fd()), flags, off, length)
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+
+	return nil
+}
+
+// ModeFromFallocate converts the mode of a fallocate(2) call
+func ModeFromFallocate(mode uint32) AllocMode {
+	var m AllocMode
+	if mode&unix.FALLOC_FL_KEEP_SIZE != 0 {
+		m |= KeepSize
+	}
+	if mode&unix.FALLOC_FL_PUNCH_HOLE != 0 {
+		m |= PunchHole
+	}
+	if mode&unix.FALLOC_FL_ZERO_RANGE != 0 {
+		m |= ZeroRange
+	}
+
+	return m
+}
@@ -0,0 +1,327 @@
+// Copyright 2017 Julio. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+/*
+This package transfers files without their holes and keeps the holes
+when writing them back, so sparse files like vm images and databases
+don't expand to their full size on either end
+
+a sparse body starts with the size of the file followed by the data
+extents of the file, holes are left out
+
+| size int64 | offset int64 | length int64 | length bytes | offset ...
+
+all integers are big endian, the extents are in increasing order
+*/
+
+package sparse
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ContentType of a sparse body, used in Accept and Content-Type
+const ContentType = "application/x-r3stfs-sparse"
+
+// files are scanned for zeros in blocks of this size
+const blockSize = 4096
+
+var ErrFormat = errors.New("malformed sparse body")
+
+// Extent is a range of a file which holds data
+type Extent struct {
+	Offset, Length int64
+}
+
+// Extents lists the data extents of f using SEEK_DATA and SEEK_HOLE,
+// file systems without holes report the whole file as one extent
+func Extents(f *os.File) (size int64, extents []Extent, err error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	size = stat.Size()
+
+	for off := int64(0); off < size; {
+		data, err := f.Seek(off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// only a hole is left
+			break
+		}
+		if err != nil {
+			// no SEEK_DATA support
+			extents = append(extents[:0], Extent{0, size})
+			break
+		}
+
+		hole, err := f.Seek(data, unix.SEEK_HOLE)
+		if err != nil || hole > size {
+			hole = size
+		}
+
+		extents = append(extents, Extent{data, hole - data})
+		off = hole
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	return
+}
+
+// IsSparse reports whether f has any holes
+func IsSparse(f *os.File) (bool, error) {
+	size, extents, err := Extents(f)
+	if err != nil {
+		return false, err
+	}
+
+	var data int64
+	for _, e := range extents {
+		data += e.Length
+	}
+
+	return data < size, nil
+}
+
+// reader encodes a file as a sparse body
+type reader struct {
+	f       *os.File
+	size    int64
+	extents []Extent
+	logical io.Writer
+
+	buf  []byte    // encoded header of what is read next
+	data io.Reader // data of the current extent
+	off  int64     // logical offset already passed to logical
+}
+
+// NewReader returns a reader of the sparse body of f, if logical is
+// not nil the content of f, with its holes as zeros, is written to it
+// as the body is read
+func NewReader(f *os.File, logical io.Writer) (io.Reader, error) {
+	size, extents, err := Extents(f)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reader{
+		f:       f,
+		size:    size,
+		extents: extents,
+		logical: logical,
+		buf:     make([]byte, 8),
+	}
+	binary.BigEndian.PutUint64(r.buf, uint64(size))
+
+	return r, nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for {
+		if len(r.buf) > 0 {
+			n := copy(p, r.buf)
+			r.buf = r.buf[n:]
+			return n, nil
+		}
+
+		if r.data != nil {
+			n, err := r.data.Read(p)
+			if r.logical != nil && n > 0 {
+				r.logical.Write(p[:n])
+			}
+			r.off += int64(n)
+
+			if err == io.EOF {
+				r.data = nil
+				err = nil
+				if n == 0 {
+					continue
+				}
+			}
+			return n, err
+		}
+
+		if len(r.extents) == 0 {
+			err := r.zeros(r.size)
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+
+		e := r.extents[0]
+		r.extents = r.extents[1:]
+
+		err := r.zeros(e.Offset)
+		if err != nil {
+			return 0, err
+		}
+
+		r.buf = make([]byte, 16)
+		binary.BigEndian.PutUint64(r.buf, uint64(e.Offset))
+		binary.BigEndian.PutUint64(r.buf[8:], uint64(e.Length))
+		r.data = io.NewSectionReader(r.f, e.Offset, e.Length)
+	}
+}
+
+// pass the hole up to end to logical
+func (r *reader) zeros(end int64) error {
+	if r.logical != nil && end > r.off {
+		_, err := io.CopyN(r.logical, zeroReader{}, end-r.off)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.off = end
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// logicalReader decodes a sparse body into the content of the file
+type logicalReader struct {
+	r       io.Reader
+	started bool
+	size    int64
+	off     int64 // logical offset read so far
+	start   int64 // offset of the current extent
+	left    int64 // data left in the current extent
+	done    bool  // no more extents
+}
+
+// NewLogicalReader decodes the sparse body r into the content of the
+// file it was made from, holes are read as zeros
+func NewLogicalReader(r io.Reader) io.Reader {
+	return &logicalReader{r: r}
+}
+
+func (lr *logicalReader) Read(p []byte) (int, error) {
+	if !lr.started {
+		err := binary.Read(lr.r, binary.BigEndian, &lr.size)
+		if err != nil || lr.size < 0 {
+			return 0, ErrFormat
+		}
+		lr.started = true
+	}
+
+	for {
+		switch {
+		case lr.left > 0 && lr.off < lr.start:
+			// the hole before the extent
+			return lr.zeros(p, lr.start), nil
+
+		case lr.left > 0:
+			if int64(len(p)) > lr.left {
+				p = p[:lr.left]
+			}
+
+			n, err := lr.r.Read(p)
+			lr.off += int64(n)
+			lr.left -= int64(n)
+			if err == io.EOF {
+				err = nil
+				if lr.left > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+			return n, err
+
+		case !lr.done:
+			var ext [2]int64
+			err := binary.Read(lr.r, binary.BigEndian, &ext)
+			if err == io.EOF {
+				lr.done = true
+				continue
+			}
+			if err != nil || ext[0] < lr.off || ext[1] < 0 || ext[0]+ext[1] > lr.size {
+				return 0, ErrFormat
+			}
+			lr.start, lr.left = ext[0], ext[1]
+
+		case lr.off < lr.size:
+			// the hole at the end of the file
+			return lr.zeros(p, lr.size), nil
+
+		default:
+			return 0, io.EOF
+		}
+	}
+}
+
+// fill p with the zeros of a hole ending at end
+func (lr *logicalReader) zeros(p []byte, end int64) int {
+	if int64(len(p)) > end-lr.off {
+		p = p[:end-lr.off]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+
+	lr.off += int64(len(p))
+	return len(p)
+}
+
+// Writer writes the content of a file leaving blocks of zeros as
+// holes, Close sets the size of the file. The file must be empty,
+// the holes don't overwrite what is already there
+type Writer struct {
+	f   *os.File
+	off int64
+}
+
+func NewWriter(f *os.File) *Writer {
+	return &Writer{f: f}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		// keep blocks aligned to the file's offsets
+		n := blockSize - int(w.off%blockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+
+		if !isZero(p[:n]) {
+			_, err := w.f.WriteAt(p[:n], w.off)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		w.off += int64(n)
+		written += n
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// Close extends the file over a trailing hole, it does not close
+// the underlying file
+func (w *Writer) Close() error {
+	return w.f.Truncate(w.off)
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+package sparse
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	src, err := os.Create(path.Join(dir, "src"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	// data, a 1 MiB hole, data, and a trailing hole
+	src.WriteAt([]byte("head"), 0)
+	src.WriteAt([]byte("tail"), 1<<20)
+	src.Truncate(2 << 20)
+
+	logical := &bytes.Buffer{}
+	r, err := NewReader(src, logical)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := ioutil.ReadFile(src.Name())
+	if !bytes.Equal(logical.Bytes(), want) {
+		t.Fatalf("logical content differs")
+	}
+
+	dst, err := os.Create(path.Join(dir, "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	w := NewWriter(dst)
+	_, err = io.Copy(w, NewLogicalReader(bytes.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	got, _ := ioutil.ReadFile(dst.Name())
+	if !bytes.Equal(got, want) {
+		t.Fatalf("decoded file differs")
+	}
+
+	// a file system without holes keeps the whole file as data
+	if isSparse, _ := IsSparse(src); isSparse {
+		if isSparse, _ = IsSparse(dst); !isSparse {
+			t.Errorf("holes were not kept")
+		}
+		if len(body) > 64<<10 {
+			t.Errorf("sparse body is %d bytes", len(body))
+		}
+	}
+
+	_, err = ioutil.ReadAll(NewLogicalReader(bytes.NewReader(body[:len(body)-2])))
+	if err == nil {
+		t.Errorf("truncated body decoded without error")
+	}
+}
+
+func TestParseAllocMode(t *testing.T) {
+	m, err := ParseAllocMode(PunchHole.String() + "," + KeepSize.String())
+	if err != nil || m != PunchHole|KeepSize {
+		t.Errorf("ParseAllocMode: %v %v", m, err)
+	}
+
+	if _, err = ParseAllocMode("punch-hole"); err == nil {
+		t.Errorf("punch-hole without keep-size accepted")
+	}
+}
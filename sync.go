@@ -0,0 +1,989 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/client"
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/sparse"
+)
+
+/*
+sync reconciles a local directory with a remote one without fuse.
+The versions both sides had after the last sync are kept in a state
+file at the top of the local directory, .r3stfs-sync
+
+	{"host": "...", "user": "julio", "remote": "/photos", "files": {
+		"2017/a.jpg": {
+			"local": {"size": 1024, "mtime": 1501632000123456789, "ino": 4211, "perm": 420},
+			"remote": {"size": 1024, "mtime": 1501632001, "perm": 420, "etag": "\"14d6b5a2c3f1e000-400\""}
+		}
+	}}
+
+a file whose size or mtime differs from its recorded version was
+edited on that side. Remote mtimes are seconds, remote files are
+compared by the server's ETag instead, which has the mtime in
+nanoseconds. Edits go to the other side, deletes are repeated there
+unless the other side edited the file.
+
+renames are found before that. A local file or directory gone from
+its path with its inode at a new one was moved, a remote file gone
+with a single new one of the same size and mtime too. The move is
+made on the other side instead of a copy and a delete.
+
+files edited on both sides are conflicts, settled by the policy:
+
+	keep-both  the local file is renamed name.conflict-<time>.ext,
+	           both are synced
+	newer      the side with the later mtime wins, keep-both on ties
+	local      the local file overwrites the remote one
+	remote     the remote file overwrites the local one
+
+files with the same content on both sides are no conflict. A file
+on one side which is a directory on the other is left for the user
+*/
+
+const syncStateName = ".r3stfs-sync"
+
+var syncPolicies = []string{"keep-both", "newer", "local", "remote"}
+
+// a version of a file on one side
+type syncVersion struct {
+	Dir   bool        `json:"dir,omitempty"`
+	Size  int64       `json:"size"`
+	Mtime int64       `json:"mtime"` // nanoseconds locally, seconds remotely
+	Ino   uint64      `json:"ino,omitempty"`
+	Perm  os.FileMode `json:"perm"`
+	// remotely, states of older versions have none
+	ETag string `json:"etag,omitempty"`
+}
+
+type syncEntry struct {
+	Local  syncVersion `json:"local"`
+	Remote syncVersion `json:"remote"`
+}
+
+type syncState struct {
+	Host   string                `json:"host"`
+	User   string                `json:"user"`
+	Remote string                `json:"remote"`
+	Files  map[string]*syncEntry `json:"files"`
+}
+
+// how a side changed a file since the last sync
+type syncChange int
+
+const (
+	syncSame syncChange = iota
+	syncCreated
+	syncModified
+	syncDeleted
+)
+
+func changeOf(base, cur *syncVersion) syncChange {
+	switch {
+	case base == nil && cur == nil:
+		return syncSame
+	case base == nil:
+		return syncCreated
+	case cur == nil:
+		return syncDeleted
+	case base.Dir != cur.Dir:
+		return syncModified
+	case !cur.Dir && base.ETag != "" && cur.ETag != "":
+		if base.ETag != cur.ETag {
+			return syncModified
+		}
+	case !cur.Dir && (base.Size != cur.Size || base.Mtime != cur.Mtime):
+		return syncModified
+	}
+
+	return syncSame
+}
+
+func localVersion(fi os.FileInfo) *syncVersion {
+	v := &syncVersion{
+		Dir:   fi.IsDir(),
+		Mtime: fi.ModTime().UnixNano(),
+		Perm:  fi.Mode().Perm(),
+	}
+	if !v.Dir {
+		v.Size = fi.Size()
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		v.Ino = uint64(st.Ino)
+	}
+
+	return v
+}
+
+func remoteVersion(attr *batch.Attr) *syncVersion {
+	v := &syncVersion{
+		Dir:   attr.IsDir,
+		Mtime: attr.Mtime,
+		Perm:  os.FileMode(attr.Mode & 0777),
+		ETag:  attr.ETag,
+	}
+	if !v.Dir {
+		v.Size = attr.Size
+	}
+
+	return v
+}
+
+// a removal waits for the files under it
+type syncRemoval struct {
+	path  string
+	local bool
+}
+
+type syncer struct {
+	*transfer
+	local, remote string
+	policy        string
+	dryRun        bool
+
+	state *syncState
+	// versions found by the scans, kept up to date as files are synced
+	locals, remotes map[string]*syncVersion
+	removals        []syncRemoval
+}
+
+func syncDirs(argv []string) error {
+	var policy string
+	var dryRun, quiet bool
+	c, fs, err := transferFlags("sync", "LOCAL REMOTE", argv, func(fs *flag.FlagSet) {
+		fs.StringVar(&policy, "conflict", "keep-both", "what settles files edited on both sides: "+strings.Join(syncPolicies, ", "))
+		fs.BoolVar(&dryRun, "n", false, "show what would be done without doing it")
+		fs.BoolVar(&quiet, "q", false, "don't show progress")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	known := false
+	for _, p := range syncPolicies {
+		known = known || p == policy
+	}
+	if !known {
+		return fmt.Errorf("unknown conflict policy %q, use one of %s", policy, strings.Join(syncPolicies, ", "))
+	}
+
+	s := &syncer{
+		transfer: newTransfer("sync", c, quiet),
+		local:    fs.Arg(0),
+		remote:   remotePath(fs.Arg(1)),
+		policy:   policy,
+		dryRun:   dryRun,
+		locals:   make(map[string]*syncVersion),
+		remotes:  make(map[string]*syncVersion),
+	}
+
+	err = s.run(c)
+	if err != nil {
+		return err
+	}
+
+	return s.err()
+}
+
+func (s *syncer) run(c *config) error {
+	err := s.load(c)
+	if err != nil {
+		return err
+	}
+
+	// a failed scan would look like deleted files, nothing is
+	// synced without both
+	err = s.scanLocal()
+	if err != nil {
+		return err
+	}
+
+	err = s.scanRemote()
+	if err != nil {
+		return err
+	}
+
+	s.renames()
+
+	seen := make(map[string]bool)
+	for _, m := range []map[string]*syncVersion{s.locals, s.remotes} {
+		for p := range m {
+			seen[p] = true
+		}
+	}
+	for p := range s.state.Files {
+		seen[p] = true
+	}
+
+	paths := make([]string, 0, len(seen))
+	for p := range seen {
+		paths = append(paths, p)
+	}
+
+	// parents before their files
+	sort.Strings(paths)
+
+	for _, p := range paths {
+		err := s.reconcile(p)
+		if err != nil {
+			s.fail(err)
+		}
+	}
+
+	// files before their parents
+	for i := len(s.removals) - 1; i >= 0; i-- {
+		err := s.remove(s.removals[i])
+		if err != nil {
+			s.fail(err)
+		}
+	}
+
+	if s.dryRun {
+		return nil
+	}
+
+	return s.save()
+}
+
+func (s *syncer) localName(p string) string {
+	return filepath.Join(s.local, filepath.FromSlash(p))
+}
+
+func (s *syncer) remoteName(p string) string {
+	return path.Join(s.remote, p)
+}
+
+func (s *syncer) report(action, p string) {
+	fmt.Printf("%-13s %s\n", action, p)
+}
+
+func (s *syncer) statePath() string {
+	return filepath.Join(s.local, syncStateName)
+}
+
+func (s *syncer) load(c *config) error {
+	s.state = &syncState{
+		Host:   c.Host,
+		User:   c.User,
+		Remote: "/" + s.remote,
+		Files:  make(map[string]*syncEntry),
+	}
+
+	byt, err := ioutil.ReadFile(s.statePath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var st syncState
+	err = json.Unmarshal(byt, &st)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.statePath(), err)
+	}
+
+	if st.Host != s.state.Host || st.User != s.state.User || st.Remote != s.state.Remote {
+		return fmt.Errorf("%s is synced with %s@%s:%s, remove %s to sync it with another directory",
+			s.local, st.User, st.Host, st.Remote, s.statePath())
+	}
+
+	if st.Files == nil {
+		st.Files = make(map[string]*syncEntry)
+	}
+
+	s.state = &st
+	return nil
+}
+
+// write the state file whole, an interrupted write leaves the old one
+func (s *syncer) save() error {
+	byt, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(s.local, syncStateName+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(byt)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.statePath())
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+func (s *syncer) scanLocal() error {
+	err := os.MkdirAll(s.local, 0755)
+	if err != nil {
+		return err
+	}
+
+	return filepath.Walk(s.local, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(s.local, name)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		// the state file and the sync's temporary files
+		if strings.HasPrefix(fi.Name(), syncStateName) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			fmt.Fprintf(os.Stderr, "r3stfs sync: skipping %s, not a regular file\n", name)
+			return nil
+		}
+
+		s.locals[filepath.ToSlash(rel)] = localVersion(fi)
+		return nil
+	})
+}
+
+func (s *syncer) scanRemote() error {
+	st, err := s.stat(s.remote)
+	if exitCode(err) == exitNotFound {
+		if s.dryRun {
+			return nil
+		}
+
+		// an empty directory to sync into
+		return s.mkdir(s.remote, 0755, true)
+	}
+	if err != nil {
+		return err
+	}
+	if !st.mode.IsDir() {
+		return fmt.Errorf("/%s is not a directory", s.remote)
+	}
+
+	dirs := []string{""}
+	for len(dirs) > 0 {
+		dir := dirs[0]
+		dirs = dirs[1:]
+
+		entries, res, err := s.client.List(s.remoteName(dir))
+		if err != nil {
+			return err
+		}
+
+		err = check(res, s.remoteName(dir))
+		if err != nil {
+			return err
+		}
+
+		var paths, names []string
+		for _, name := range sortedNames(entries) {
+			p := path.Join(dir, name)
+			if mode := entries[name]; !mode.IsDir() && !mode.IsRegular() {
+				fmt.Fprintf(os.Stderr, "r3stfs sync: skipping /%s, not a regular file\n", s.remoteName(p))
+				continue
+			}
+
+			paths = append(paths, p)
+			names = append(names, s.remoteName(p))
+		}
+
+		results, err := s.statAll(names)
+		if err != nil {
+			return err
+		}
+
+		for i, r := range results {
+			if r.Status == http.StatusNotFound {
+				// removed since the listing
+				continue
+			}
+			if r.Attr == nil {
+				return &statusError{names[i], r.Status}
+			}
+
+			v := remoteVersion(r.Attr)
+			s.remotes[paths[i]] = v
+			if v.Dir {
+				dirs = append(dirs, paths[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// find the files moved on one side and move them on the other
+func (s *syncer) renames() {
+	// new local paths by inode
+	byIno := make(map[uint64][]string)
+	for p, v := range s.locals {
+		if s.state.Files[p] == nil && s.remotes[p] == nil && v.Ino != 0 {
+			byIno[v.Ino] = append(byIno[v.Ino], p)
+		}
+	}
+
+	// new remote files by size and mtime
+	type key struct{ size, mtime int64 }
+	byVersion := make(map[key][]string)
+	for p, v := range s.remotes {
+		if !v.Dir && s.state.Files[p] == nil && s.locals[p] == nil {
+			k := key{v.Size, v.Mtime}
+			byVersion[k] = append(byVersion[k], p)
+		}
+	}
+
+	// the path the rename went to, if there is just one
+	match := func(candidates []string, ok func(q string) bool) string {
+		var ret string
+		for _, q := range candidates {
+			if !ok(q) {
+				continue
+			}
+			if ret != "" {
+				return ""
+			}
+			ret = q
+		}
+
+		return ret
+	}
+
+	bases := make([]string, 0, len(s.state.Files))
+	for p := range s.state.Files {
+		bases = append(bases, p)
+	}
+
+	// directories before the files they hold, which move with them
+	sort.Strings(bases)
+
+	for _, p := range bases {
+		e := s.state.Files[p]
+		if e == nil {
+			continue
+		}
+
+		l, r := s.locals[p], s.remotes[p]
+
+		switch {
+		case l == nil && r != nil && changeOf(&e.Remote, r) == syncSame:
+			q := match(byIno[e.Local.Ino], func(q string) bool {
+				v := s.locals[q]
+				return v != nil && s.state.Files[q] == nil && s.remotes[q] == nil &&
+					v.Dir == e.Local.Dir && changeOf(&e.Local, v) == syncSame
+			})
+			if q != "" {
+				s.renameRemote(p, q)
+			}
+
+		case r == nil && l != nil && !e.Remote.Dir && changeOf(&e.Local, l) == syncSame:
+			q := match(byVersion[key{e.Remote.Size, e.Remote.Mtime}], func(q string) bool {
+				v := s.remotes[q]
+				return v != nil && s.state.Files[q] == nil && s.locals[q] == nil &&
+					(e.Remote.ETag == "" || e.Remote.ETag == v.ETag)
+			})
+			if q != "" {
+				s.renameLocal(p, q)
+			}
+		}
+	}
+}
+
+func (s *syncer) renameRemote(p, q string) {
+	s.report("mv remote", p+" -> "+q)
+
+	if !s.dryRun {
+		err := s.ensureRemoteDir(path.Dir(q), 0755)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		op := batch.Op{Op: batch.Rename, Path: s.remoteName(p), To: s.remoteName(q)}
+		res, err := s.client.Batch([]batch.Op{op}, false)
+		if err != nil {
+			s.fail(err)
+			return
+		}
+
+		if r := res.Results[0]; remote.ResultErrno(r) != 0 {
+			s.fail(&statusError{op.Path, r.Status})
+			return
+		}
+	}
+
+	s.move(p, q, s.remotes)
+}
+
+func (s *syncer) renameLocal(p, q string) {
+	s.report("mv local", p+" -> "+q)
+
+	if !s.dryRun {
+		err := s.ensureLocalDir(path.Dir(q), 0755)
+		if err == nil {
+			err = os.Rename(s.localName(p), s.localName(q))
+		}
+		if err != nil {
+			s.fail(err)
+			return
+		}
+	}
+
+	s.move(p, q, s.locals)
+}
+
+// move the versions of p, and the files under it, to q
+func (s *syncer) move(p, q string, versions map[string]*syncVersion) {
+	moved := func(k string) (string, bool) {
+		if k == p || strings.HasPrefix(k, p+"/") {
+			return q + k[len(p):], true
+		}
+		return "", false
+	}
+
+	var keys []string
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if to, ok := moved(k); ok {
+			versions[to] = versions[k]
+			delete(versions, k)
+		}
+	}
+
+	keys = keys[:0]
+	for k := range s.state.Files {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if to, ok := moved(k); ok {
+			s.state.Files[to] = s.state.Files[k]
+			delete(s.state.Files, k)
+		}
+	}
+}
+
+// keep the state of p, a file on just one side is dropped from it
+func (s *syncer) record(p string) {
+	l, r := s.locals[p], s.remotes[p]
+	if l == nil || r == nil {
+		delete(s.state.Files, p)
+		return
+	}
+
+	s.state.Files[p] = &syncEntry{Local: *l, Remote: *r}
+}
+
+func (s *syncer) reconcile(p string) error {
+	var lb, rb *syncVersion
+	if e := s.state.Files[p]; e != nil {
+		lb, rb = &e.Local, &e.Remote
+	}
+
+	l, r := s.locals[p], s.remotes[p]
+	lc, rc := changeOf(lb, l), changeOf(rb, r)
+
+	if l != nil && r != nil && l.Dir != r.Dir {
+		return fmt.Errorf("%s is a file on one side and a directory on the other, resolve it by hand", p)
+	}
+
+	switch {
+	case lc == syncSame && rc == syncSame:
+		return nil
+	case lc == syncDeleted && rc == syncDeleted:
+		delete(s.state.Files, p)
+		return nil
+	case lc == syncDeleted && rc == syncSame:
+		s.removals = append(s.removals, syncRemoval{p, false})
+		return nil
+	case lc == syncSame && rc == syncDeleted:
+		s.removals = append(s.removals, syncRemoval{p, true})
+		return nil
+	case rc == syncSame || rc == syncDeleted:
+		return s.push(p, l)
+	case lc == syncSame || lc == syncDeleted:
+		return s.pull(p, r, "")
+	}
+
+	return s.conflict(p, l, r)
+}
+
+// send the local version of p to the remote
+func (s *syncer) push(p string, l *syncVersion) error {
+	if l.Dir {
+		s.report("mkdir remote", p)
+		if s.dryRun {
+			return nil
+		}
+
+		// records p
+		return s.ensureRemoteDir(p, l.Perm)
+	}
+
+	s.report("upload", p)
+	if s.dryRun {
+		return nil
+	}
+
+	err := s.ensureRemoteDir(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Lstat(s.localName(p))
+	if err != nil {
+		return err
+	}
+
+	err = s.putFile(s.localName(p), s.remoteName(p), fi)
+	if err != nil {
+		return err
+	}
+
+	results, err := s.statAll([]string{s.remoteName(p)})
+	if err != nil {
+		return err
+	}
+	if results[0].Attr == nil {
+		return &statusError{s.remoteName(p), results[0].Status}
+	}
+
+	s.remotes[p] = remoteVersion(results[0].Attr)
+	s.record(p)
+	return nil
+}
+
+// bring the remote version of p here, tmp holds it if it was fetched
+func (s *syncer) pull(p string, r *syncVersion, tmp string) error {
+	if r.Dir {
+		s.report("mkdir local", p)
+		if s.dryRun {
+			return nil
+		}
+
+		// records p
+		return s.ensureLocalDir(p, r.Perm)
+	}
+
+	s.report("download", p)
+	if s.dryRun {
+		return nil
+	}
+
+	var err error
+	if tmp == "" {
+		tmp, err = s.fetch(p, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(tmp, s.localName(p))
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	fi, err := os.Lstat(s.localName(p))
+	if err != nil {
+		return err
+	}
+
+	s.locals[p] = localVersion(fi)
+	s.record(p)
+	return nil
+}
+
+// download p next to its local path, the temporary file is returned
+func (s *syncer) fetch(p string, r *syncVersion) (string, error) {
+	err := s.ensureLocalDir(path.Dir(p), 0755)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.localName(p)), syncStateName+"-get-")
+	if err != nil {
+		return "", err
+	}
+
+	// keep the holes of sparse files
+	w := sparse.NewWriter(f)
+	err = s.download(s.remoteName(p), w)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Chmod(r.Perm)
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		mtime := time.Unix(r.Mtime, 0)
+		err = os.Chtimes(f.Name(), mtime, mtime)
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
+
+func (s *syncer) conflict(p string, l, r *syncVersion) error {
+	if l.Dir {
+		// directories made on both sides merge
+		s.record(p)
+		return nil
+	}
+
+	var tmp string
+	if l.Size == r.Size && !s.dryRun {
+		var err error
+		tmp, err = s.fetch(p, r)
+		if err != nil {
+			return err
+		}
+
+		same, err := sameContent(tmp, s.localName(p))
+		if err != nil || same {
+			os.Remove(tmp)
+			if same {
+				s.record(p)
+			}
+			return err
+		}
+	}
+
+	policy := s.policy
+	if policy == "newer" {
+		lt := time.Unix(0, l.Mtime).Unix()
+		switch {
+		case lt > r.Mtime:
+			policy = "local"
+		case lt < r.Mtime:
+			policy = "remote"
+		default:
+			policy = "keep-both"
+		}
+	}
+
+	switch policy {
+	case "local":
+		s.report("conflict", p+", keeping the local file")
+		if tmp != "" {
+			os.Remove(tmp)
+		}
+		return s.push(p, l)
+
+	case "remote":
+		s.report("conflict", p+", keeping the remote file")
+		return s.pull(p, r, tmp)
+	}
+
+	c := client.ConflictName(p, func(q string) bool {
+		return s.locals[q] != nil || s.remotes[q] != nil
+	})
+	s.report("conflict", p+", the local file is kept as "+c)
+
+	if !s.dryRun {
+		err := os.Rename(s.localName(p), s.localName(c))
+		if err != nil {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+			return err
+		}
+	}
+
+	s.locals[c] = l
+	delete(s.locals, p)
+
+	err := s.pull(p, r, tmp)
+	if err != nil {
+		return err
+	}
+
+	return s.push(c, l)
+}
+
+func sameContent(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+
+	bufa, bufb := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		na, erra := io.ReadFull(fa, bufa)
+		nb, errb := io.ReadFull(fb, bufb)
+		if !bytes.Equal(bufa[:na], bufb[:nb]) {
+			return false, nil
+		}
+
+		switch {
+		case erra == nil && errb == nil:
+			continue
+		case erra == io.ErrUnexpectedEOF || erra == io.EOF:
+			return errb == io.ErrUnexpectedEOF || errb == io.EOF, nil
+		case erra != nil:
+			return false, erra
+		default:
+			return false, errb
+		}
+	}
+}
+
+// make a local directory and its missing parents
+func (s *syncer) ensureLocalDir(p string, perm os.FileMode) error {
+	var missing []string
+	for d := p; d != "." && s.locals[d] == nil; d = path.Dir(d) {
+		missing = append(missing, d)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err := os.MkdirAll(s.localName(p), perm|0700)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range missing {
+		fi, err := os.Lstat(s.localName(d))
+		if err != nil {
+			return err
+		}
+
+		s.locals[d] = localVersion(fi)
+		s.record(d)
+	}
+
+	return nil
+}
+
+// make a remote directory and its missing parents
+func (s *syncer) ensureRemoteDir(p string, perm os.FileMode) error {
+	var missing []string
+	for d := p; d != "." && s.remotes[d] == nil; d = path.Dir(d) {
+		missing = append(missing, d)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	err := s.mkdir(s.remoteName(p), perm, true)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, len(missing))
+	for i, d := range missing {
+		names[i] = s.remoteName(d)
+	}
+
+	results, err := s.statAll(names)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range results {
+		if r.Attr == nil {
+			return &statusError{names[i], r.Status}
+		}
+
+		s.remotes[missing[i]] = remoteVersion(r.Attr)
+		s.record(missing[i])
+	}
+
+	return nil
+}
+
+// remove p from a side unless a file synced into it brought it back
+func (s *syncer) remove(rm syncRemoval) error {
+	p := rm.path
+
+	if rm.local {
+		if s.remotes[p] != nil {
+			s.record(p)
+			return nil
+		}
+
+		s.report("rm local", p)
+		if !s.dryRun {
+			err := os.Remove(s.localName(p))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		delete(s.locals, p)
+	} else {
+		if s.locals[p] != nil {
+			s.record(p)
+			return nil
+		}
+
+		s.report("rm remote", p)
+		if !s.dryRun {
+			res, err := s.client.Delete(s.remoteName(p))
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusNotFound {
+				err = check(res, s.remoteName(p))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		delete(s.remotes, p)
+	}
+
+	s.record(p)
+	return nil
+}
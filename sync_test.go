@@ -0,0 +1,318 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sync local with /r of the server like a run of the command
+func runSync(t *testing.T, c *config, local, policy string) {
+	s := &syncer{
+		transfer: newTransfer("sync", c, true),
+		local:    local,
+		remote:   "r",
+		policy:   policy,
+		locals:   make(map[string]*syncVersion),
+		remotes:  make(map[string]*syncVersion),
+	}
+
+	err := s.run(c)
+	if err == nil {
+		err = s.err()
+	}
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+}
+
+// the files under dir and their content, without the sync's state
+func readTree(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+
+	err := filepath.Walk(dir, func(name string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || strings.HasPrefix(fi.Name(), syncStateName) {
+			return err
+		}
+
+		byt, err := ioutil.ReadFile(name)
+		rel, _ := filepath.Rel(dir, name)
+		files[filepath.ToSlash(rel)] = string(byt)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func inode(t *testing.T, name string) uint64 {
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return uint64(fi.Sys().(*syscall.Stat_t).Ino)
+}
+
+// edit a file keeping its size and the second of its mtime
+func editInSecond(t *testing.T, name, content string) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := fi.ModTime().Truncate(time.Second)
+	if mtime.Equal(fi.ModTime()) {
+		mtime = mtime.Add(time.Nanosecond)
+	}
+
+	err = ioutil.WriteFile(name, []byte(content), 0644)
+	if err == nil {
+		err = os.Chtimes(name, mtime, mtime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	hour := time.Now().Add(time.Hour)
+	later := func(t *testing.T, name string) {
+		os.Chtimes(name, hour, hour)
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		// edits to the synced files on each side
+		local, remote func(t *testing.T, dir string)
+		want          map[string]string
+		// renamed files, which the other side moves instead of copying
+		moved map[string]string
+	}{{
+		name: "local edit",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "a2"})
+		},
+		want: map[string]string{"a.txt": "a2", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name: "remote edit within the second",
+		remote: func(t *testing.T, dir string) {
+			editInSecond(t, filepath.Join(dir, "a.txt"), "x")
+		},
+		want: map[string]string{"a.txt": "x", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name: "local delete",
+		local: func(t *testing.T, dir string) {
+			os.RemoveAll(filepath.Join(dir, "d"))
+		},
+		want: map[string]string{"a.txt": "a"},
+	}, {
+		name: "remote delete",
+		remote: func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "d/b.txt"))
+		},
+		want: map[string]string{"a.txt": "a", "d/e/c.txt": "c"},
+	}, {
+		name: "local edit of a remote delete",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "a2"})
+		},
+		remote: func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "a.txt"))
+		},
+		want: map[string]string{"a.txt": "a2", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name: "remote edit of a local delete",
+		local: func(t *testing.T, dir string) {
+			os.Remove(filepath.Join(dir, "a.txt"))
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "a2"})
+		},
+		want: map[string]string{"a.txt": "a2", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name: "local rename of a directory",
+		local: func(t *testing.T, dir string) {
+			os.Rename(filepath.Join(dir, "d"), filepath.Join(dir, "f"))
+		},
+		want:  map[string]string{"a.txt": "a", "f/b.txt": "b", "f/e/c.txt": "c"},
+		moved: map[string]string{"d/b.txt": "f/b.txt", "d/e/c.txt": "f/e/c.txt"},
+	}, {
+		name: "remote rename",
+		remote: func(t *testing.T, dir string) {
+			os.Rename(filepath.Join(dir, "a.txt"), filepath.Join(dir, "d/g.txt"))
+		},
+		want:  map[string]string{"d/g.txt": "a", "d/b.txt": "b", "d/e/c.txt": "c"},
+		moved: map[string]string{"a.txt": "d/g.txt"},
+	}, {
+		name:   "conflict keeping both",
+		policy: "keep-both",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "local"})
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "remote!"})
+		},
+		want: map[string]string{"a.txt": "remote!", "a.conflict-*.txt": "local", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name:   "conflict of the same size keeping both",
+		policy: "keep-both",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "local"})
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "other"})
+		},
+		want: map[string]string{"a.txt": "other", "a.conflict-*.txt": "local", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name:   "conflict won by the newer local file",
+		policy: "newer",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "local"})
+			later(t, filepath.Join(dir, "a.txt"))
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "remote!"})
+		},
+		want: map[string]string{"a.txt": "local", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name:   "conflict won by the newer remote file",
+		policy: "newer",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "local"})
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "remote!"})
+			later(t, filepath.Join(dir, "a.txt"))
+		},
+		want: map[string]string{"a.txt": "remote!", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name:   "conflict won by the local file",
+		policy: "local",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "local"})
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "remote!"})
+			later(t, filepath.Join(dir, "a.txt"))
+		},
+		want: map[string]string{"a.txt": "local", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name:   "conflict won by the remote file",
+		policy: "remote",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "local"})
+			later(t, filepath.Join(dir, "a.txt"))
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "remote!"})
+		},
+		want: map[string]string{"a.txt": "remote!", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}, {
+		name:   "the same edit on both sides",
+		policy: "keep-both",
+		local: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "same"})
+		},
+		remote: func(t *testing.T, dir string) {
+			writeTree(t, dir, map[string]string{"a.txt": "same"})
+		},
+		want: map[string]string{"a.txt": "same", "d/b.txt": "b", "d/e/c.txt": "c"},
+	}}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, dirroot := startServer(t)
+			local := t.TempDir()
+			remote := filepath.Join(dirroot, "r")
+
+			writeTree(t, local, map[string]string{"a.txt": "a", "d/b.txt": "b", "d/e/c.txt": "c"})
+			runSync(t, c, local, "keep-both")
+
+			// the side which didn't rename keeps the inodes
+			other := local
+			if test.local != nil {
+				other = remote
+			}
+			inodes := make(map[string]uint64)
+			for from := range test.moved {
+				inodes[from] = inode(t, filepath.Join(other, from))
+			}
+
+			if test.local != nil {
+				test.local(t, local)
+			}
+			if test.remote != nil {
+				test.remote(t, remote)
+			}
+
+			// the state is reloaded by each run
+			runSync(t, c, local, test.policy)
+
+			for side, dir := range map[string]string{"local": local, "remote": remote} {
+				got := readTree(t, dir)
+				if len(got) != len(test.want) {
+					t.Errorf("%s: %v, want %v", side, got, test.want)
+				}
+
+				for pattern, content := range test.want {
+					matches, _ := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+					if len(matches) != 1 {
+						t.Errorf("%s: %d files %s", side, len(matches), pattern)
+						continue
+					}
+
+					byt, _ := ioutil.ReadFile(matches[0])
+					if string(byt) != content {
+						t.Errorf("%s: %s is %q, want %q", side, pattern, byt, content)
+					}
+				}
+			}
+
+			for from, to := range test.moved {
+				if inode(t, filepath.Join(other, to)) != inodes[from] {
+					t.Errorf("%s was copied to %s, not moved", from, to)
+				}
+			}
+
+			// with nothing changed the next run does nothing
+			before := readTree(t, local)
+			runSync(t, c, local, test.policy)
+			after := readTree(t, local)
+			if len(before) != len(after) {
+				t.Errorf("a sync without changes went from %v to %v", before, after)
+			}
+		})
+	}
+}
+
+func TestSyncState(t *testing.T) {
+	c, _ := startServer(t)
+	local := t.TempDir()
+
+	writeTree(t, local, map[string]string{"a.txt": "a"})
+	runSync(t, c, local, "keep-both")
+
+	s := &syncer{transfer: newTransfer("sync", c, true), local: local, remote: "r"}
+	err := s.load(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := s.state.Files["a.txt"]
+	if e == nil || e.Remote.ETag == "" || e.Local.Ino == 0 {
+		t.Errorf("state of a.txt: %+v", e)
+	}
+
+	// a directory synced with one remote isn't synced with another
+	s.remote = "other"
+	if err := s.load(c); err == nil {
+		t.Error("loaded the state of another remote directory")
+	}
+}
@@ -0,0 +1,979 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ear7h/r3stfs/batch"
+	"github.com/ear7h/r3stfs/client/log"
+	"github.com/ear7h/r3stfs/client/remote"
+	"github.com/ear7h/r3stfs/digest"
+	"github.com/ear7h/r3stfs/sparse"
+)
+
+/*
+the transfer commands work on the remote files without fuse, for
+machines which can't mount them
+
+remote paths are relative to the root of the server and may hold
+glob patterns, like 'builds/*.tar.gz', which are matched against
+the server's listings. Quote them so the shell leaves them alone
+*/
+
+// exit codes of the server's answers
+const (
+	exitFailed   = 1
+	exitUsage    = 2
+	exitNotFound = 3
+	exitExists   = 4
+	exitDenied   = 5
+)
+
+// statusError is a failed request for a remote path
+type statusError struct {
+	path   string
+	status int
+}
+
+func (e *statusError) Error() string {
+	p := "/" + e.path
+
+	switch e.status {
+	case http.StatusNotFound:
+		return p + ": not found"
+	case http.StatusConflict:
+		return p + ": exists"
+	case http.StatusForbidden:
+		return p + ": permission denied"
+	}
+
+	return fmt.Sprintf("%s: %d %s", p, e.status, http.StatusText(e.status))
+}
+
+// exitError ends the command with its code, the errors were printed
+type exitError int
+
+func (e exitError) Error() string {
+	return "exit status " + strconv.Itoa(int(e))
+}
+
+// the exit code of a failed command
+func exitCode(err error) int {
+	var code exitError
+	if errors.As(err, &code) {
+		return int(code)
+	}
+
+	var se *statusError
+	if !errors.As(err, &se) {
+		return exitFailed
+	}
+
+	switch se.status {
+	case http.StatusNotFound:
+		return exitNotFound
+	case http.StatusConflict:
+		return exitExists
+	case http.StatusForbidden:
+		return exitDenied
+	}
+
+	return exitFailed
+}
+
+// an error for res if it failed
+func check(res *http.Response, p string) error {
+	if remote.Errno(res) != 0 {
+		return &statusError{p, res.StatusCode}
+	}
+
+	return nil
+}
+
+// transfer runs a command on the arguments it was given, a failure
+// is printed and the command goes on with the other arguments
+type transfer struct {
+	name   string
+	client *remote.Client
+	quiet  bool
+	code   int
+}
+
+func newTransfer(name string, c *config, quiet bool) *transfer {
+	// the fuse client's log is for the fuse client
+	log.SetOutput(ioutil.Discard)
+
+	client := remote.Login(c.Host, c.User, c.Secret)
+	client.SetTimeout(0)
+
+	return &transfer{name: name, client: client, quiet: quiet}
+}
+
+func (t *transfer) fail(err error) {
+	fmt.Fprintf(os.Stderr, "r3stfs %s: %v\n", t.name, err)
+
+	if t.code == 0 {
+		t.code = exitCode(err)
+	}
+}
+
+// the error the command ends with, the exit code of the first failure
+func (t *transfer) err() error {
+	if t.code != 0 {
+		return exitError(t.code)
+	}
+
+	return nil
+}
+
+// a remote path as the client's requests take it, "" is the root
+func remotePath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
+}
+
+// the remote paths matching a pattern, a path without patterns is
+// returned as it is
+func (t *transfer) glob(pattern string) ([]string, error) {
+	p := remotePath(pattern)
+	if !hasMeta(p) {
+		return []string{p}, nil
+	}
+
+	matches := []string{""}
+	for _, elem := range strings.Split(p, "/") {
+		var next []string
+
+		for _, dir := range matches {
+			if !hasMeta(elem) {
+				next = append(next, path.Join(dir, elem))
+				continue
+			}
+
+			entries, res, err := t.client.List(dir)
+			if errors.Is(err, syscall.ENOTDIR) || (err == nil && remote.Errno(res) != 0) {
+				// files and missing directories hold no matches
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			for _, name := range sortedNames(entries) {
+				ok, err := path.Match(elem, name)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					next = append(next, path.Join(dir, name))
+				}
+			}
+		}
+
+		matches = next
+	}
+
+	if len(matches) == 0 {
+		return nil, &statusError{p, http.StatusNotFound}
+	}
+
+	return matches, nil
+}
+
+// the remote paths of the arguments, with their patterns expanded
+func (t *transfer) globAll(args []string) []string {
+	var ret []string
+
+	for _, arg := range args {
+		paths, err := t.glob(arg)
+		if err != nil {
+			t.fail(err)
+			continue
+		}
+		ret = append(ret, paths...)
+	}
+
+	return ret
+}
+
+func sortedNames(entries map[string]os.FileMode) []string {
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// the attributes of a remote file
+type remoteStat struct {
+	mode         os.FileMode
+	size         int64
+	atime, mtime time.Time
+}
+
+func (t *transfer) stat(p string) (*remoteStat, error) {
+	res, err := t.client.Head(p)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	err = check(res, p)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, _ := strconv.ParseUint(res.Header.Get("File-Mode"), 8, 32)
+	size, _ := strconv.ParseInt(res.Header.Get("File-Size"), 10, 64)
+	atime, _ := strconv.ParseInt(res.Header.Get("Atime"), 10, 64)
+	mtime, _ := strconv.ParseInt(res.Header.Get("Mtime"), 10, 64)
+
+	return &remoteStat{
+		mode:  fileMode(uint32(mode), res.Header.Get("Is-Dir") == "true"),
+		size:  size,
+		atime: time.Unix(atime, 0),
+		mtime: time.Unix(mtime, 0),
+	}, nil
+}
+
+// the os.FileMode of the mode bits of a stat call
+func fileMode(mode uint32, isDir bool) os.FileMode {
+	m := os.FileMode(mode & 0777)
+
+	switch {
+	case isDir:
+		m |= os.ModeDir
+	case mode&syscall.S_IFMT == syscall.S_IFLNK:
+		m |= os.ModeSymlink
+	}
+
+	return m
+}
+
+func (t *transfer) isDir(p string) bool {
+	st, err := t.stat(p)
+	return err == nil && st.mode.IsDir()
+}
+
+// the flags of a command taking client settings
+func transferFlags(name, args string, argv []string, extra func(*flag.FlagSet)) (*config, *flag.FlagSet, error) {
+	c, _, fs, err := parseFlags(name, args, argv, (*config).clientSettings, extra)
+	return c, fs, err
+}
+
+func ls(argv []string) error {
+	var long, recursive bool
+	c, fs, err := transferFlags("ls", "[PATH...]", argv, func(fs *flag.FlagSet) {
+		fs.BoolVar(&long, "l", false, "show modes, sizes and modification times")
+		fs.BoolVar(&recursive, "R", false, "list directories recursively")
+	})
+	if err != nil {
+		return err
+	}
+
+	t := newTransfer("ls", c, true)
+
+	args := fs.Args()
+	if len(args) == 0 {
+		args = []string{"/"}
+	}
+
+	paths := t.globAll(args)
+	for _, p := range paths {
+		err := t.ls(p, long, recursive, len(paths) > 1 || recursive)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return t.err()
+}
+
+func (t *transfer) ls(p string, long, recursive, header bool) error {
+	entries, res, err := t.client.List(p)
+	if errors.Is(err, syscall.ENOTDIR) {
+		// a file lists itself
+		return t.lsEntries("", []string{p}, "/", long)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = check(res, p)
+	if err != nil {
+		return err
+	}
+
+	if header {
+		fmt.Printf("/%s:\n", p)
+	}
+
+	names := sortedNames(entries)
+	err = t.lsEntries(p, names, "", long)
+	if err != nil {
+		return err
+	}
+
+	if !recursive {
+		return nil
+	}
+
+	for _, name := range names {
+		if entries[name].IsDir() {
+			fmt.Println()
+
+			err := t.ls(path.Join(p, name), long, recursive, header)
+			if err != nil {
+				t.fail(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// print the entries of a directory after prefix, the attributes
+// of a long listing come from a batch of stats
+func (t *transfer) lsEntries(dir string, names []string, prefix string, long bool) error {
+	if !long {
+		for _, name := range names {
+			fmt.Println(prefix + name)
+		}
+		return nil
+	}
+
+	paths := make([]string, len(names))
+	for i, name := range names {
+		paths[i] = path.Join(dir, name)
+	}
+
+	results, err := t.statAll(paths)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range results {
+		if r.Attr == nil {
+			t.fail(&statusError{paths[i], r.Status})
+			continue
+		}
+
+		mode := fileMode(r.Attr.Mode, r.Attr.IsDir)
+		mtime := time.Unix(r.Attr.Mtime, 0).Format("Jan _2 15:04 2006")
+		fmt.Printf("%s %12d %s %s%s\n", mode, r.Attr.Size, mtime, prefix, names[i])
+	}
+
+	return nil
+}
+
+// the results of stat ops on remote paths, sent 256 to a batch
+func (t *transfer) statAll(paths []string) ([]batch.Result, error) {
+	var ret []batch.Result
+
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > 256 {
+			n = 256
+		}
+
+		ops := make([]batch.Op, n)
+		for i, p := range paths[:n] {
+			ops[i] = batch.Op{Op: batch.Stat, Path: p}
+		}
+
+		res, err := t.client.Batch(ops, false)
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, res.Results...)
+		paths = paths[n:]
+	}
+
+	return ret, nil
+}
+
+func stat(argv []string) error {
+	c, fs, err := transferFlags("stat", "PATH...", argv, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("stat", c, true)
+
+	for _, p := range t.globAll(fs.Args()) {
+		st, err := t.stat(p)
+		if err != nil {
+			t.fail(err)
+			continue
+		}
+
+		fmt.Printf("/%s\n", p)
+		fmt.Printf("  mode  %s (%o)\n", st.mode, st.mode.Perm())
+		if !st.mode.IsDir() {
+			fmt.Printf("  size  %d\n", st.size)
+		}
+		fmt.Printf("  mtime %s\n", st.mtime.Format(time.RFC3339))
+		fmt.Printf("  atime %s\n", st.atime.Format(time.RFC3339))
+	}
+
+	return t.err()
+}
+
+func cat(argv []string) error {
+	c, fs, err := transferFlags("cat", "PATH...", argv, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("cat", c, true)
+
+	for _, p := range t.globAll(fs.Args()) {
+		err := t.download(p, os.Stdout)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return t.err()
+}
+
+// write the content of a remote file to w, checked against the
+// digest of the server
+func (t *transfer) download(p string, w io.Writer) (err error) {
+	res, err := t.client.Get(p)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	err = check(res, p)
+	if err != nil {
+		return err
+	}
+	if res.Header.Get("Is-Dir") == "true" {
+		return &os.PathError{Op: "get", Path: "/" + p, Err: syscall.EISDIR}
+	}
+
+	var body io.Reader = res.Body
+	if res.Header.Get("Content-Type") == sparse.ContentType {
+		body = sparse.NewLogicalReader(body)
+	}
+
+	size, _ := strconv.ParseInt(res.Header.Get("File-Size"), 10, 64)
+	pr := t.progress(p, size)
+	defer pr.done()
+
+	hash := digest.New()
+	n, err := io.Copy(io.MultiWriter(w, hash, pr), body)
+	if err != nil {
+		return err
+	}
+
+	return remote.Verify(res, n, hash.Sum(nil))
+}
+
+func get(argv []string) error {
+	var recursive, quiet bool
+	c, fs, err := transferFlags("get", "REMOTE... LOCAL", argv, func(fs *flag.FlagSet) {
+		fs.BoolVar(&recursive, "r", false, "get directories recursively")
+		fs.BoolVar(&quiet, "q", false, "don't show progress")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("get", c, quiet)
+
+	local := fs.Arg(fs.NArg() - 1)
+	srcs := t.globAll(fs.Args()[:fs.NArg()-1])
+
+	fi, err := os.Stat(local)
+	into := err == nil && fi.IsDir()
+	if len(srcs) > 1 && !into {
+		return fmt.Errorf("%s is not a directory", local)
+	}
+
+	for _, src := range srcs {
+		dst := local
+		if into {
+			dst = filepath.Join(local, path.Base("/"+src))
+		}
+
+		err := t.get(src, dst, recursive)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return t.err()
+}
+
+func (t *transfer) get(src, dst string, recursive bool) error {
+	st, err := t.stat(src)
+	if err != nil {
+		return err
+	}
+
+	if !st.mode.IsDir() {
+		return t.getFile(src, dst, st)
+	}
+
+	if !recursive {
+		return fmt.Errorf("/%s is a directory, use -r", src)
+	}
+
+	err = os.MkdirAll(dst, st.mode.Perm()|0700)
+	if err != nil {
+		return err
+	}
+
+	entries, res, err := t.client.List(src)
+	if err != nil {
+		return err
+	}
+
+	err = check(res, src)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sortedNames(entries) {
+		err := t.get(path.Join(src, name), filepath.Join(dst, name), recursive)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return nil
+}
+
+func (t *transfer) getFile(src, dst string, st *remoteStat) error {
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, st.mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	// keep the holes of sparse files
+	w := sparse.NewWriter(f)
+	err = t.download(src, w)
+	if err == nil {
+		err = w.Close()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	// a short or corrupt download doesn't stay
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return os.Chtimes(dst, st.atime, st.mtime)
+}
+
+func put(argv []string) error {
+	var recursive, quiet bool
+	c, fs, err := transferFlags("put", "LOCAL... REMOTE", argv, func(fs *flag.FlagSet) {
+		fs.BoolVar(&recursive, "r", false, "put directories recursively")
+		fs.BoolVar(&quiet, "q", false, "don't show progress")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("put", c, quiet)
+
+	remoteDst := remotePath(fs.Arg(fs.NArg() - 1))
+
+	// patterns the shell left alone
+	var srcs []string
+	for _, arg := range fs.Args()[:fs.NArg()-1] {
+		matches, err := filepath.Glob(arg)
+		if err != nil || len(matches) == 0 {
+			matches = []string{arg}
+		}
+		srcs = append(srcs, matches...)
+	}
+
+	into := t.isDir(remoteDst)
+	if len(srcs) > 1 && !into {
+		return fmt.Errorf("/%s is not a directory", remoteDst)
+	}
+
+	for _, src := range srcs {
+		dst := remoteDst
+		if into {
+			dst = path.Join(remoteDst, filepath.Base(src))
+		}
+
+		err := t.put(src, dst, recursive)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return t.err()
+}
+
+func (t *transfer) put(src, dst string, recursive bool) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.Mode().IsRegular():
+		return t.putFile(src, dst, fi)
+	case !fi.IsDir():
+		return fmt.Errorf("%s is not a regular file", src)
+	case !recursive:
+		return fmt.Errorf("%s is a directory, use -r", src)
+	}
+
+	// an existing directory is written into
+	err = t.mkdir(dst, fi.Mode().Perm(), true)
+	if err != nil {
+		return err
+	}
+
+	names, err := readDirNames(src)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err := t.put(filepath.Join(src, name), path.Join(dst, name), recursive)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return nil
+}
+
+func (t *transfer) putFile(src, dst string, fi os.FileInfo) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pr := t.progress(dst, fi.Size())
+	defer pr.done()
+
+	res, err := t.client.PutProgress(dst, f, pr.set)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return check(res, dst)
+}
+
+func readDirNames(dirname string) ([]string, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	sort.Strings(names)
+
+	return names, err
+}
+
+func mkdir(argv []string) error {
+	var parents bool
+	var mode string
+	c, fs, err := transferFlags("mkdir", "PATH...", argv, func(fs *flag.FlagSet) {
+		fs.BoolVar(&parents, "p", false, "make parent directories, existing directories are fine")
+		fs.StringVar(&mode, "m", "755", "octal mode of the directories")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("mode %q: %v", mode, err)
+	}
+
+	t := newTransfer("mkdir", c, true)
+
+	for _, arg := range fs.Args() {
+		err := t.mkdir(remotePath(arg), os.FileMode(perm), parents)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return t.err()
+}
+
+// make a remote directory, with parents its missing parents are
+// made and it may exist
+func (t *transfer) mkdir(p string, perm os.FileMode, parents bool) error {
+	dirs := []string{p}
+	if parents {
+		dirs = nil
+		for d := p; d != "" && d != "."; d = path.Dir(d) {
+			dirs = append([]string{d}, dirs...)
+		}
+	}
+
+	var ops []batch.Op
+	for _, d := range dirs {
+		ops = append(ops, batch.Op{
+			Op:   batch.Mkdir,
+			Path: d,
+			Mode: strconv.FormatUint(uint64(perm), 8),
+		})
+	}
+
+	res, err := t.client.Batch(ops, false)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range res.Results {
+		if remote.ResultErrno(r) == 0 {
+			continue
+		}
+		if parents && r.Status == http.StatusConflict && t.isDir(ops[i].Path) {
+			continue
+		}
+
+		return &statusError{ops[i].Path, r.Status}
+	}
+
+	return nil
+}
+
+func rm(argv []string) error {
+	var recursive, force bool
+	c, fs, err := transferFlags("rm", "PATH...", argv, func(fs *flag.FlagSet) {
+		fs.BoolVar(&recursive, "r", false, "remove directories and their contents")
+		fs.BoolVar(&force, "f", false, "missing files are fine")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("rm", c, true)
+
+	for _, arg := range fs.Args() {
+		paths, err := t.glob(arg)
+		if err != nil {
+			if !force || exitCode(err) != exitNotFound {
+				t.fail(err)
+			}
+			continue
+		}
+
+		for _, p := range paths {
+			err := t.rm(p, recursive)
+			if err != nil && (!force || exitCode(err) != exitNotFound) {
+				t.fail(err)
+			}
+		}
+	}
+
+	return t.err()
+}
+
+func (t *transfer) rm(p string, recursive bool) error {
+	if p == "" {
+		return fmt.Errorf("refusing to remove /")
+	}
+
+	st, err := t.stat(p)
+	if err != nil {
+		return err
+	}
+
+	if st.mode.IsDir() {
+		if !recursive {
+			return fmt.Errorf("/%s is a directory, use -r", p)
+		}
+
+		entries, res, err := t.client.List(p)
+		if err != nil {
+			return err
+		}
+
+		err = check(res, p)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range sortedNames(entries) {
+			err := t.rm(path.Join(p, name), recursive)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	res, err := t.client.Delete(p)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return check(res, p)
+}
+
+func mv(argv []string) error {
+	c, fs, err := transferFlags("mv", "SRC... DST", argv, nil)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("mv", c, true)
+
+	dst := remotePath(fs.Arg(fs.NArg() - 1))
+	srcs := t.globAll(fs.Args()[:fs.NArg()-1])
+
+	into := t.isDir(dst)
+	if len(srcs) > 1 && !into {
+		return fmt.Errorf("/%s is not a directory", dst)
+	}
+
+	var ops []batch.Op
+	for _, src := range srcs {
+		to := dst
+		if into {
+			to = path.Join(dst, path.Base("/"+src))
+		}
+
+		ops = append(ops, batch.Op{Op: batch.Rename, Path: src, To: to})
+	}
+
+	if len(ops) == 0 {
+		return t.err()
+	}
+
+	res, err := t.client.Batch(ops, false)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range res.Results {
+		if remote.ResultErrno(r) != 0 {
+			t.fail(&statusError{ops[i].Path, r.Status})
+		}
+	}
+
+	return t.err()
+}
+
+func cp(argv []string) error {
+	var recursive, noClobber bool
+	c, fs, err := transferFlags("cp", "SRC... DST", argv, func(fs *flag.FlagSet) {
+		fs.BoolVar(&recursive, "r", false, "copy directories recursively")
+		fs.BoolVar(&noClobber, "n", false, "don't overwrite existing files")
+	})
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return exitError(exitUsage)
+	}
+
+	t := newTransfer("cp", c, true)
+
+	dst := remotePath(fs.Arg(fs.NArg() - 1))
+	srcs := t.globAll(fs.Args()[:fs.NArg()-1])
+
+	into := t.isDir(dst)
+	if len(srcs) > 1 && !into {
+		return fmt.Errorf("/%s is not a directory", dst)
+	}
+
+	for _, src := range srcs {
+		to := dst
+		if into {
+			to = path.Join(dst, path.Base("/"+src))
+		}
+
+		err := t.cp(src, to, recursive, !noClobber)
+		if err != nil {
+			t.fail(err)
+		}
+	}
+
+	return t.err()
+}
+
+// copy on the server, the content isn't downloaded
+func (t *transfer) cp(src, dst string, recursive, overwrite bool) error {
+	st, err := t.stat(src)
+	if err != nil {
+		return err
+	}
+
+	if st.mode.IsDir() && !recursive {
+		return fmt.Errorf("/%s is a directory, use -r", src)
+	}
+
+	res, err := t.client.Copy(src, dst, overwrite)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		return &statusError{dst, res.StatusCode}
+	}
+
+	return check(res, src)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ear7h/r3stfs/server"
+)
+
+// the settings of a server rooted in a temporary directory
+func startServer(t *testing.T) (*config, string) {
+	dirroot := t.TempDir()
+
+	ts := httptest.NewServer(server.NewServeMux(server.FsMount("", dirroot, &server.R3stFsHandler{})))
+	t.Cleanup(ts.Close)
+
+	return &config{Host: ts.Listener.Addr().String(), User: "julio"}, dirroot
+}
+
+func startTransfer(t *testing.T) (*transfer, string) {
+	c, dirroot := startServer(t)
+	return newTransfer("test", c, true), dirroot
+}
+
+// write files, their directories are made as needed
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		name = filepath.Join(root, name)
+
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(name, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{&statusError{"a", http.StatusNotFound}, exitNotFound},
+		{&statusError{"a", http.StatusConflict}, exitExists},
+		{&statusError{"a", http.StatusForbidden}, exitDenied},
+		{&statusError{"a", http.StatusInternalServerError}, exitFailed},
+		{fmt.Errorf("get: %w", &statusError{"a", http.StatusNotFound}), exitNotFound},
+		{exitError(exitUsage), exitUsage},
+		{errors.New("local"), exitFailed},
+	}
+
+	for _, test := range tests {
+		if code := exitCode(test.err); code != test.code {
+			t.Errorf("%v: exit code %d, want %d", test.err, code, test.code)
+		}
+	}
+
+	for status, code := range map[int]int{404: exitNotFound, 409: exitExists, 403: exitDenied} {
+		err := check(&http.Response{StatusCode: status}, "a")
+		if exitCode(err) != code {
+			t.Errorf("check %d: %v", status, err)
+		}
+	}
+	if err := check(&http.Response{StatusCode: http.StatusOK}, "a"); err != nil {
+		t.Errorf("check 200: %v", err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	tr, dirroot := startTransfer(t)
+
+	writeTree(t, dirroot, map[string]string{
+		"builds/a.tar.gz": "a",
+		"builds/b.tar.gz": "b",
+		"builds/c.txt":    "c",
+		"logs/x/1.log":    "1",
+		"logs/y/2.log":    "2",
+	})
+
+	tests := []struct {
+		pattern string
+		paths   []string
+	}{
+		{"builds/*.tar.gz", []string{"builds/a.tar.gz", "builds/b.tar.gz"}},
+		{"/logs/*/*.log", []string{"logs/x/1.log", "logs/y/2.log"}},
+		{"logs/[x]/1.log", []string{"logs/x/1.log"}},
+		// without patterns the path is taken as it is
+		{"/missing/file", []string{"missing/file"}},
+	}
+
+	for _, test := range tests {
+		paths, err := tr.glob(test.pattern)
+		if err != nil || !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: %v %v, want %v", test.pattern, paths, err, test.paths)
+		}
+	}
+
+	// files and missing directories hold no matches
+	for _, pattern := range []string{"builds/*.zip", "builds/c.txt/*", "missing/*"} {
+		paths, err := tr.glob(pattern)
+		if exitCode(err) != exitNotFound {
+			t.Errorf("%s: %v %v", pattern, paths, err)
+		}
+	}
+}
+
+func TestGetPutRm(t *testing.T) {
+	tr, dirroot := startTransfer(t)
+	local := t.TempDir()
+
+	files := map[string]string{
+		"a.txt":       "a",
+		"sub/b.txt":   "b",
+		"sub/c/d.txt": "d",
+	}
+	writeTree(t, filepath.Join(local, "src"), files)
+
+	if err := tr.put(filepath.Join(local, "src"), "up", false); err == nil {
+		t.Error("put of a directory without -r")
+	}
+
+	err := tr.put(filepath.Join(local, "src"), "up", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		byt, err := ioutil.ReadFile(filepath.Join(dirroot, "up", name))
+		if err != nil || string(byt) != content {
+			t.Errorf("put %s: %q %v", name, byt, err)
+		}
+	}
+
+	// putting again writes into the existing directories
+	writeTree(t, filepath.Join(local, "src"), map[string]string{"sub/b.txt": "b2"})
+	err = tr.put(filepath.Join(local, "src"), "up", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["sub/b.txt"] = "b2"
+
+	err = tr.get("up", filepath.Join(local, "down"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		byt, err := ioutil.ReadFile(filepath.Join(local, "down", name))
+		if err != nil || string(byt) != content {
+			t.Errorf("get %s: %q %v", name, byt, err)
+		}
+	}
+
+	if err := tr.get("up/missing.txt", filepath.Join(local, "missing.txt"), false); exitCode(err) != exitNotFound {
+		t.Errorf("get of a missing file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local, "missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("a failed get left its file: %v", err)
+	}
+
+	if err := tr.rm("up", false); err == nil {
+		t.Error("rm of a directory without -r")
+	}
+	if err := tr.rm("", true); err == nil {
+		t.Error("rm of the root")
+	}
+
+	err = tr.rm("up", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dirroot, "up")); !os.IsNotExist(err) {
+		t.Errorf("rm -r left the directory: %v", err)
+	}
+
+	if err := tr.rm("up", true); exitCode(err) != exitNotFound {
+		t.Errorf("rm of a missing directory: %v", err)
+	}
+}
+
+func TestCp(t *testing.T) {
+	tr, dirroot := startTransfer(t)
+
+	writeTree(t, dirroot, map[string]string{
+		"src/a.txt":     "a",
+		"src/sub/b.txt": "b",
+	})
+
+	err := tr.cp("src/a.txt", "a.txt", false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byt, _ := ioutil.ReadFile(filepath.Join(dirroot, "a.txt")); string(byt) != "a" {
+		t.Errorf("cp of a file: %q", byt)
+	}
+
+	if err := tr.cp("src", "dst", false, true); err == nil {
+		t.Error("cp of a directory without -r")
+	}
+
+	err = tr.cp("src", "dst", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byt, _ := ioutil.ReadFile(filepath.Join(dirroot, "dst/sub/b.txt")); string(byt) != "b" {
+		t.Errorf("cp -r: %q", byt)
+	}
+
+	// -n keeps what's there
+	if err := tr.cp("src/sub/b.txt", "a.txt", false, false); exitCode(err) != exitExists {
+		t.Errorf("cp -n over a file: %v", err)
+	}
+	if byt, _ := ioutil.ReadFile(filepath.Join(dirroot, "a.txt")); string(byt) != "a" {
+		t.Errorf("cp -n overwrote: %q", byt)
+	}
+
+	if err := tr.cp("missing.txt", "b.txt", false, true); exitCode(err) != exitNotFound {
+		t.Errorf("cp of a missing file: %v", err)
+	}
+}